@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -23,6 +24,18 @@ var (
 	PrivateKeyFile string
 	Aws            awsConfig
 	Db             dbConfig
+	Payments       paymentsConfig
+	Mail           mailConfig
+	Carts          cartsConfig
+	Webhooks       webhooksConfig
+	Jobs           jobsConfig
+	Stock          stockConfig
+	Trash          trashConfig
+	Audit          auditConfig
+	Seller         sellerConfig
+	Shipping       shippingConfig
+	StoreUrl       string
+	ApiUrl         string
 )
 
 type config struct {
@@ -33,6 +46,18 @@ type config struct {
 	PrivateKeyFile string
 	Db             dbConfig
 	Aws            awsConfig
+	Payments       paymentsConfig
+	Mail           mailConfig
+	Carts          cartsConfig
+	Webhooks       webhooksConfig
+	Jobs           jobsConfig
+	Stock          stockConfig
+	Trash          trashConfig
+	Audit          auditConfig
+	Seller         sellerConfig
+	Shipping       shippingConfig
+	StoreUrl       string // The storefront, used for links in emails
+	ApiUrl         string // The public url of this server, used for links in emails
 }
 
 type dbConfig struct {
@@ -41,6 +66,77 @@ type dbConfig struct {
 	Database int
 }
 
+type paymentsConfig struct {
+	Gateway         string // Either "stripe" or "fake"
+	Currency        string
+	StripeSecretKey string
+	FakeDelay       time.Duration // Only used by the fake gateway
+}
+
+type mailConfig struct {
+	Transport    string // Either "smtp", "file", or "outbox"
+	From         string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	OutboxDir    string // Only used by the file transport
+}
+
+type cartsConfig struct {
+	AbandonedAfter   time.Duration // How long after it was last changed a cart is considered abandoned
+	ReminderInterval time.Duration // How often to check for abandoned carts. 0 means never
+}
+
+type webhooksConfig struct {
+	Timeout time.Duration // How long to wait for an endpoint to respond
+}
+
+type jobsConfig struct {
+	Concurrency  int           // How many background jobs can run at once. 0 means jobs are not run
+	PollInterval time.Duration // How long idle workers wait before checking for jobs again
+}
+
+type stockConfig struct {
+	LowStockThreshold int // The default for items which don't set their own threshold
+}
+
+type trashConfig struct {
+	Retention     time.Duration // How long deleted records are kept in the trash before they are purged
+	PurgeInterval time.Duration // How often to purge the trash. 0 means never
+}
+
+type auditConfig struct {
+	Retention     time.Duration // How long entries are kept in the audit log
+	PurgeInterval time.Duration // How often to delete entries older than Retention. 0 means never
+	// TrustedProxies are the ip addresses of the proxies in front of the server. The
+	// X-Forwarded-For header is only used for the ip of a request sent by one of them.
+	TrustedProxies []string
+}
+
+// sellerConfig is the business details printed on invoices
+type sellerConfig struct {
+	Name         string
+	AddressLines []string
+	Email        string
+	TaxId        string // e.g. a VAT or sales tax registration number. Left off invoices if empty
+}
+
+type shippingConfig struct {
+	// TrackingUrls are templates for the url where customers can track a package,
+	// by the lowercase name of the carrier. {trackingNumber} is replaced with the
+	// tracking number of the package.
+	TrackingUrls map[string]string
+}
+
+// trackingUrls are the tracking url templates for the carriers we ship with
+var trackingUrls = map[string]string{
+	"usps":  "https://tools.usps.com/go/TrackConfirmAction?tLabels={trackingNumber}",
+	"ups":   "https://www.ups.com/track?tracknum={trackingNumber}",
+	"fedex": "https://www.fedex.com/fedextrack/?trknbr={trackingNumber}",
+	"dhl":   "https://www.dhl.com/en/express/tracking.html?AWB={trackingNumber}",
+}
+
 type awsConfig struct {
 	AccessKeyId     string
 	SecretAccessKey string
@@ -63,6 +159,52 @@ var Prod config = config{
 		SecretAccessKey: os.Getenv("SWAG_AWS_SECRET_ACCESS_KEY"),
 		BucketName:      "5w4g-images",
 	},
+	Payments: paymentsConfig{
+		Gateway:         "stripe",
+		Currency:        "usd",
+		StripeSecretKey: os.Getenv("SWAG_STRIPE_SECRET_KEY"),
+	},
+	Mail: mailConfig{
+		Transport:    "smtp",
+		From:         "5w4g <orders@5w4g.com>",
+		SMTPHost:     os.Getenv("SWAG_SMTP_HOST"),
+		SMTPPort:     "587",
+		SMTPUsername: os.Getenv("SWAG_SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SWAG_SMTP_PASSWORD"),
+	},
+	Carts: cartsConfig{
+		AbandonedAfter:   4 * time.Hour,
+		ReminderInterval: 15 * time.Minute,
+	},
+	Webhooks: webhooksConfig{
+		Timeout: 10 * time.Second,
+	},
+	Jobs: jobsConfig{
+		Concurrency:  10,
+		PollInterval: 1 * time.Second,
+	},
+	Stock: stockConfig{
+		LowStockThreshold: 5,
+	},
+	Trash: trashConfig{
+		Retention:     30 * 24 * time.Hour,
+		PurgeInterval: 1 * time.Hour,
+	},
+	Audit: auditConfig{
+		Retention:      365 * 24 * time.Hour,
+		PurgeInterval:  1 * time.Hour,
+		TrustedProxies: []string{}, // TODO: Set this to the ips of our load balancers
+	},
+	Seller: sellerConfig{
+		Name:         "5w4g",
+		AddressLines: []string{}, // TODO: Set this to our business address
+		Email:        "orders@5w4g.com",
+	},
+	Shipping: shippingConfig{
+		TrackingUrls: trackingUrls,
+	},
+	StoreUrl: "https://5w4g.com",
+	ApiUrl:   os.Getenv("SWAG_API_URL"),
 }
 
 var Dev config = config{
@@ -81,6 +223,49 @@ var Dev config = config{
 		SecretAccessKey: os.Getenv("SWAG_AWS_SECRET_ACCESS_KEY"),
 		BucketName:      "5w4g-images-dev",
 	},
+	Payments: paymentsConfig{
+		Gateway:   "fake",
+		Currency:  "usd",
+		FakeDelay: 500 * time.Millisecond,
+	},
+	Mail: mailConfig{
+		Transport: "file",
+		From:      "5w4g <orders@localhost>",
+		OutboxDir: filepath.Join(os.TempDir(), "5w4g-emails"),
+	},
+	Carts: cartsConfig{
+		AbandonedAfter:   1 * time.Hour,
+		ReminderInterval: 5 * time.Minute,
+	},
+	Webhooks: webhooksConfig{
+		Timeout: 10 * time.Second,
+	},
+	Jobs: jobsConfig{
+		Concurrency:  2,
+		PollInterval: 1 * time.Second,
+	},
+	Stock: stockConfig{
+		LowStockThreshold: 5,
+	},
+	Trash: trashConfig{
+		Retention:     30 * 24 * time.Hour,
+		PurgeInterval: 1 * time.Hour,
+	},
+	Audit: auditConfig{
+		Retention:      365 * 24 * time.Hour,
+		PurgeInterval:  1 * time.Hour,
+		TrustedProxies: []string{},
+	},
+	Seller: sellerConfig{
+		Name:         "5w4g",
+		AddressLines: []string{"123 Main Street", "Springfield, IL 62701", "US"},
+		Email:        "orders@localhost",
+	},
+	Shipping: shippingConfig{
+		TrackingUrls: trackingUrls,
+	},
+	StoreUrl: "http://localhost:8000",
+	ApiUrl:   "http://localhost:3000",
 }
 
 var Test config = config{
@@ -99,6 +284,52 @@ var Test config = config{
 		SecretAccessKey: os.Getenv("SWAG_AWS_SECRET_ACCESS_KEY"),
 		BucketName:      "5w4g-images-test",
 	},
+	Payments: paymentsConfig{
+		Gateway:  "fake",
+		Currency: "usd",
+	},
+	Mail: mailConfig{
+		Transport: "outbox",
+		From:      "5w4g <orders@localhost>",
+	},
+	Carts: cartsConfig{
+		AbandonedAfter: 1 * time.Hour,
+		// Tests send reminders directly, so the server doesn't need to check
+		ReminderInterval: 0,
+	},
+	Webhooks: webhooksConfig{
+		Timeout: 2 * time.Second,
+	},
+	Jobs: jobsConfig{
+		// Tests run jobs directly, so that they are run with the handlers
+		// registered by the test
+		Concurrency: 0,
+	},
+	Stock: stockConfig{
+		LowStockThreshold: 5,
+	},
+	Trash: trashConfig{
+		Retention: 30 * 24 * time.Hour,
+		// Tests purge the trash directly
+		PurgeInterval: 0,
+	},
+	Audit: auditConfig{
+		Retention: 365 * 24 * time.Hour,
+		// Tests purge the audit log directly
+		PurgeInterval:  0,
+		TrustedProxies: []string{},
+	},
+	Seller: sellerConfig{
+		Name:         "5w4g",
+		AddressLines: []string{"123 Main Street", "Springfield, IL 62701", "US"},
+		Email:        "orders@localhost",
+		TaxId:        "TEST-TAX-ID",
+	},
+	Shipping: shippingConfig{
+		TrackingUrls: trackingUrls,
+	},
+	StoreUrl: "http://localhost:8000",
+	ApiUrl:   "http://localhost:4000",
 }
 
 var once = sync.Once{}
@@ -113,6 +344,7 @@ func Init() {
 		} else if Env == "test" {
 			Use(Test)
 		} else if Env == "production" {
+			requireEnvVariables("SWAG_STRIPE_SECRET_KEY", "SWAG_SMTP_HOST", "SWAG_API_URL")
 			Use(Prod)
 		} else {
 			panic("Unkown environment. Don't know what configuration to use!")
@@ -158,4 +390,16 @@ func Use(c config) {
 	PrivateKeyFile = c.PrivateKeyFile
 	Db = c.Db
 	Aws = c.Aws
+	Payments = c.Payments
+	Mail = c.Mail
+	Carts = c.Carts
+	Webhooks = c.Webhooks
+	Jobs = c.Jobs
+	Stock = c.Stock
+	Trash = c.Trash
+	Audit = c.Audit
+	Seller = c.Seller
+	Shipping = c.Shipping
+	StoreUrl = c.StoreUrl
+	ApiUrl = c.ApiUrl
 }
@@ -48,8 +48,9 @@ func (c *AdminTokensController) Create(res http.ResponseWriter, req *http.Reques
 		}
 	}
 
-	// Check if the found admin's password matches the submitted password
-	if err := bcrypt.CompareHashAndPassword([]byte(admin.HashedPassword), adminData.GetBytes("password")); err != nil {
+	// Check if the found admin's password matches the submitted password. Admins in
+	// the trash can't sign in.
+	if err := bcrypt.CompareHashAndPassword([]byte(admin.HashedPassword), adminData.GetBytes("password")); err != nil || admin.DeletedAt != 0 {
 		val.AddError("email", "email or password was incorrect.")
 		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
 		return
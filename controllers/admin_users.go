@@ -10,6 +10,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 	"net/http"
+	"time"
 )
 
 type AdminUsersController struct{}
@@ -56,6 +57,7 @@ func (c AdminUsersController) Create(res http.ResponseWriter, req *http.Request)
 	admin := &models.AdminUser{
 		Email:          adminData.Get("email"),
 		HashedPassword: string(hashedPassword),
+		StockAlerts:    adminData.GetBool("stockAlerts"),
 	}
 	if err := zoom.Save(admin); err != nil {
 		panic(err)
@@ -75,19 +77,53 @@ func (c AdminUsersController) Show(res http.ResponseWriter, req *http.Request) {
 	// Get the admin user from the database
 	admin := &models.AdminUser{}
 	if err := zoom.ScanById(id, admin); err != nil {
-		if _, ok := err.(*zoom.KeyNotFoundError); ok {
-			// This means an admin user with the given id was not found
-			msg := fmt.Sprintf("Could not find admin user with id = %s", id)
-			jsonErr := map[string][]string{
-				"id": []string{msg},
-			}
-			r.JSON(res, lib.StatusUnprocessableEntity, jsonErr)
-			return
-		} else {
+		if _, ok := err.(*zoom.KeyNotFoundError); !ok {
 			// This means there was some other error
 			panic(err)
 		}
 	}
+	if admin.Id == "" || admin.DeletedAt != 0 {
+		// This means an admin user with the given id was not found, or is in the trash
+		msg := fmt.Sprintf("Could not find admin user with id = %s", id)
+		jsonErr := map[string][]string{
+			"id": []string{msg},
+		}
+		r.JSON(res, lib.StatusUnprocessableEntity, jsonErr)
+		return
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, admin)
+}
+
+// Update changes the settings for an admin user. Currently the only setting is
+// whether they get stock alerts.
+func (c AdminUsersController) Update(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Parse data from request
+	adminData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Get the admin user from the database
+	admin := findAdminUserOr404(res, id)
+	if admin == nil {
+		return
+	}
+
+	// Update the admin user and save to database
+	if adminData.KeyExists("stockAlerts") {
+		admin.StockAlerts = adminData.GetBool("stockAlerts")
+	}
+	if err := zoom.Save(admin); err != nil {
+		panic(err)
+	}
 
 	// Render response
 	r.JSON(res, http.StatusOK, admin)
@@ -96,16 +132,24 @@ func (c AdminUsersController) Show(res http.ResponseWriter, req *http.Request) {
 func (c AdminUsersController) Index(res http.ResponseWriter, req *http.Request) {
 	r := render.New()
 
-	// Find all admin users in the database
-	var admins []*models.AdminUser
-	if err := zoom.NewQuery("AdminUser").Scan(&admins); err != nil {
+	// Find all admin users in the database, except for the ones in the trash
+	var allAdmins []*models.AdminUser
+	if err := zoom.NewQuery("AdminUser").Scan(&allAdmins); err != nil {
 		panic(err)
 	}
+	admins := []*models.AdminUser{}
+	for _, admin := range allAdmins {
+		if admin.DeletedAt == 0 {
+			admins = append(admins, admin)
+		}
+	}
 
 	// Render response
 	r.JSON(res, http.StatusOK, admins)
 }
 
+// Delete moves an admin user to the trash, so that they can no longer sign in. They
+// can be restored until they are purged once the retention period has passed.
 func (c AdminUsersController) Delete(res http.ResponseWriter, req *http.Request) {
 	r := render.New()
 
@@ -127,11 +171,64 @@ func (c AdminUsersController) Delete(res http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	// Delete from database
-	if err := zoom.DeleteById("AdminUser", id); err != nil {
+	// Move the admin user to the trash
+	admin := findAdminUserOr404(res, id)
+	if admin == nil {
+		return
+	}
+	admin.DeletedAt = time.Now().UTC().Unix()
+	if err := zoom.Save(admin); err != nil {
 		panic(err)
 	}
 
 	// Render response
 	r.JSON(res, http.StatusOK, struct{}{})
 }
+
+// Restore takes an admin user out of the trash.
+func (c AdminUsersController) Restore(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Get the admin user from the database. They must be in the trash.
+	admin := &models.AdminUser{}
+	if err := zoom.ScanById(id, admin); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); !ok {
+			panic(err)
+		}
+	}
+	if admin.DeletedAt == 0 {
+		msg := fmt.Sprintf("Could not find admin user with id = %s in the trash", id)
+		r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+		return
+	}
+
+	// Take the admin user out of the trash
+	admin.DeletedAt = 0
+	if err := zoom.Save(admin); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, admin)
+}
+
+// findAdminUserOr404 finds the admin user with the given id. If there is no such
+// admin user, or they are in the trash, it writes a 404 error to res and returns nil.
+func findAdminUserOr404(res http.ResponseWriter, id string) *models.AdminUser {
+	admin := &models.AdminUser{}
+	if err := zoom.ScanById(id, admin); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); !ok {
+			panic(err)
+		}
+	} else if admin.DeletedAt == 0 {
+		return admin
+	}
+	r := render.New()
+	msg := fmt.Sprintf("Could not find admin user with id = %s", id)
+	r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+	return nil
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/unrolled/render"
+	"net/http"
+	"strconv"
+)
+
+type AuditLogController struct{}
+
+// The default and maximum number of audit log entries on each page
+const (
+	auditLogPerPage    = 50
+	auditLogMaxPerPage = 200
+)
+
+// Index lists the entries in the audit log, newest first. The entries can be
+// filtered and paginated with url parameters.
+func (c AuditLogController) Index(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	query := req.URL.Query()
+	errors := map[string][]string{}
+
+	// parseInt parses the url parameter with the given name, which must be an integer
+	// which is at least min. It returns def if the parameter is empty.
+	parseInt := func(name string, def int64, min int64) int64 {
+		value := query.Get(name)
+		if value == "" {
+			return def
+		}
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || i < min {
+			errors[name] = append(errors[name], fmt.Sprintf("%s must be an integer greater than or equal to %d.", name, min))
+		}
+		return i
+	}
+	filter := lib.AuditLogFilter{
+		AdminUserId:  query.Get("adminUserId"),
+		Action:       query.Get("action"),
+		ResourceType: query.Get("resourceType"),
+		ResourceId:   query.Get("resourceId"),
+		Since:        parseInt("since", 0, 0),
+		Until:        parseInt("until", 0, 0),
+	}
+	page := parseInt("page", 1, 1)
+	perPage := parseInt("perPage", auditLogPerPage, 1)
+	if filter.Action != "" && !stringSliceContains(models.AuditActions, filter.Action) {
+		errors["action"] = append(errors["action"], fmt.Sprintf("action must be one of %v.", models.AuditActions))
+	}
+	if perPage > auditLogMaxPerPage {
+		errors["perPage"] = append(errors["perPage"], fmt.Sprintf("perPage must be at most %d.", auditLogMaxPerPage))
+	}
+	if len(errors) > 0 {
+		r.JSON(res, lib.StatusUnprocessableEntity, errors)
+		return
+	}
+
+	// Find the page of entries
+	auditLog, err := lib.QueryAuditLog(filter, int(page), int(perPage))
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(res, http.StatusOK, auditLog)
+}
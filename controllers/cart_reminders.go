@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/go-data-parser"
+	"github.com/unrolled/render"
+	"net/http"
+)
+
+type CartRemindersController struct{}
+
+// Stats shows how many abandoned cart reminders have been sent and how many of them
+// led to orders.
+func (c CartRemindersController) Stats(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	stats, err := lib.GetCartReminderStats()
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(res, http.StatusOK, stats)
+}
+
+// Unsubscribe stops any more cart reminders from being sent to an email address. It
+// is linked to from every reminder.
+func (c CartRemindersController) Unsubscribe(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Parse data from the request
+	unsubscribeData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := unsubscribeData.Validator()
+	val.Require("email")
+	val.Require("token")
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+	if ok, err := lib.UnsubscribeFromCartReminders(unsubscribeData.Get("email"), unsubscribeData.Get("token")); err != nil {
+		panic(err)
+	} else if !ok {
+		r.JSON(res, http.StatusForbidden, lib.NewJsonError("That unsubscribe link is not valid."))
+		return
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, map[string]string{
+		"message": "You will not get any more reminders about your cart.",
+	})
+}
@@ -0,0 +1,528 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type CartsController struct{}
+
+// cartResponse is a cart along with the live prices for each of its items and
+// the totals for the order it would become if the customer checked out now.
+type cartResponse struct {
+	*models.Cart
+	Items          []*models.OrderItem       `json:"items"`
+	ShippingMethod string                    `json:"shippingMethod,omitempty"`
+	ShippingCost   float64                   `json:"shippingCost"`
+	Subtotal       float64                   `json:"subtotal"`
+	Promotions     []models.AppliedPromotion `json:"promotions"`
+	Discount       float64                   `json:"discount"`
+	Tax            float64                   `json:"tax"`
+	Total          float64                   `json:"total"`
+	Warnings       []cartWarning             `json:"warnings"`
+}
+
+// cartWarning is a problem with a cart which the customer should know about before
+// checking out, e.g. an item which is out of stock or a code which has expired.
+type cartWarning struct {
+	Field   string `json:"field"`
+	ItemId  string `json:"itemId,omitempty"`
+	Message string `json:"message"`
+}
+
+func (c CartsController) Create(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Parse data from the request
+	cartData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := cartData.Validator()
+	cart, err := lib.NewCart()
+	if err != nil {
+		panic(err)
+	}
+	if cartData.KeyExists("items") {
+		oiData := parseOrderItemData(cartData, val)
+		if val.HasErrors() {
+			r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+			return
+		}
+		// Make sure all the items exist
+		loadOrderItems(oiData, val)
+		for _, datum := range oiData {
+			cart.AddLine(datum.ItemId, datum.Quantity)
+		}
+	}
+	setCartFields(cartData, val, cart)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Save the cart, and offer to merge any other cart for the same email address
+	if err := lib.SaveCart(cart); err != nil {
+		panic(err)
+	}
+	if _, err := lib.RequestCartMerge(cart); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	renderCart(res, cart, cartData.Validator())
+}
+
+func (c CartsController) Show(res http.ResponseWriter, req *http.Request) {
+	cart := findCartOr404(res, req)
+	if cart == nil {
+		return
+	}
+
+	// Parse data from the request. There is no body, but we need a validator to
+	// collect any problems with the cart.
+	cartData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Render response
+	renderCart(res, cart, cartData.Validator())
+}
+
+func (c CartsController) Update(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	cart := findCartOr404(res, req)
+	if cart == nil {
+		return
+	}
+
+	// Parse data from the request
+	cartData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := cartData.Validator()
+	previousEmail := cart.Email
+	setCartFields(cartData, val, cart)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Make sure the new shipping address, shipping method, and code can actually be
+	// used for the cart. Problems that were already there are only reported as warnings.
+	if _, _, _, err := priceCart(cart, val); err != nil {
+		panic(err)
+	}
+	errors := val.ErrorMap()
+	for _, key := range []string{"code", "shippingRateId", "shippingAddress"} {
+		if len(errors[key]) > 0 && cartData.KeyExists(key) {
+			r.JSON(res, lib.StatusUnprocessableEntity, map[string][]string{key: errors[key]})
+			return
+		}
+	}
+
+	// Save the cart, and if the email address changed, offer to merge any other cart
+	// for the new email address
+	if err := lib.SaveCart(cart); err != nil {
+		panic(err)
+	}
+	if cart.Email != previousEmail {
+		if _, err := lib.RequestCartMerge(cart); err != nil {
+			panic(err)
+		}
+	}
+
+	// Render response
+	renderCart(res, cart, cartData.Validator())
+}
+
+func (c CartsController) Delete(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	cart := findCartOr404(res, req)
+	if cart == nil {
+		return
+	}
+
+	// Delete from database
+	if err := lib.DeleteCart(cart); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, struct{}{})
+}
+
+// Merge moves the items from the other cart for the cart's email address into the
+// cart. The token comes from the link emailed to the customer by RequestCartMerge,
+// which proves that they own the email address.
+func (c CartsController) Merge(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	cart := findCartOr404(res, req)
+	if cart == nil {
+		return
+	}
+
+	// Parse data from the request
+	mergeData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+	if cart.Email == "" || !lib.ValidCartMergeToken(cart, mergeData.Get("token")) {
+		r.JSON(res, http.StatusForbidden, lib.ErrForbidden)
+		return
+	}
+
+	// Merge the carts and save the result
+	if err := lib.MergeCartForEmail(cart); err != nil {
+		panic(err)
+	}
+	if err := lib.SaveCart(cart); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	renderCart(res, cart, mergeData.Validator())
+}
+
+// AddLine adds a quantity of an item to the cart, or increases the quantity if the
+// item is already in the cart.
+func (c CartsController) AddLine(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	cart := findCartOr404(res, req)
+	if cart == nil {
+		return
+	}
+
+	// Parse data from the request
+	lineData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := lineData.Validator()
+	val.Require("itemId")
+	val.Require("quantity")
+	val.Greater("quantity", 0)
+	val.Less("quantity", 1e4)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+	itemId := lineData.Get("itemId")
+	if !validateCartItem(itemId, val) {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+	cart.AddLine(itemId, lineData.GetInt("quantity"))
+	for _, line := range cart.Lines {
+		if line.ItemId == itemId && line.Quantity >= 1e4 {
+			val.AddError("quantity", "the quantity of each item in a cart must be less than 10,000.")
+			r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+			return
+		}
+	}
+
+	// Save the cart
+	if err := lib.SaveCart(cart); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	renderCart(res, cart, lineData.Validator())
+}
+
+// UpdateLine sets the quantity of an item in the cart. A quantity of 0 removes
+// the item from the cart.
+func (c CartsController) UpdateLine(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	cart := findCartOr404(res, req)
+	if cart == nil {
+		return
+	}
+	itemId := mux.Vars(req)["itemId"]
+
+	// Parse data from the request
+	lineData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := lineData.Validator()
+	val.Require("quantity")
+	val.GreaterOrEqual("quantity", 0)
+	val.Less("quantity", 1e4)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+	quantity := lineData.GetInt("quantity")
+	if quantity > 0 && !cart.HasLine(itemId) && !validateCartItem(itemId, val) {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+	cart.SetLineQuantity(itemId, quantity)
+
+	// Save the cart
+	if err := lib.SaveCart(cart); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	renderCart(res, cart, lineData.Validator())
+}
+
+// DeleteLine removes an item from the cart.
+func (c CartsController) DeleteLine(res http.ResponseWriter, req *http.Request) {
+	cart := findCartOr404(res, req)
+	if cart == nil {
+		return
+	}
+	cart.SetLineQuantity(mux.Vars(req)["itemId"], 0)
+
+	// Parse data from the request. There is no body, but we need a validator to
+	// collect any problems with the cart.
+	lineData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Save the cart
+	if err := lib.SaveCart(cart); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	renderCart(res, cart, lineData.Validator())
+}
+
+// Checkout converts the cart into an order, using the same rules as POST /orders.
+// If the order is placed, the cart is deleted and the order is returned.
+func (c CartsController) Checkout(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Lock the cart so that it can't be checked out twice at the same time
+	cartId := mux.Vars(req)["id"]
+	lockKey := "cart:" + cartId + ":checkout"
+	lock, err := lib.AcquireLock(lockKey, 30*time.Second)
+	if err != nil {
+		panic(err)
+	} else if lock == nil {
+		r.JSON(res, http.StatusConflict, lib.NewJsonError("This cart is already being checked out. Please try again."))
+		return
+	}
+	// If releasing the lock fails, it will still expire on its own
+	defer lock.Release()
+
+	cart := findCartOr404(res, req)
+	if cart == nil {
+		return
+	}
+
+	// Parse data from the request
+	checkoutData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := checkoutData.Validator()
+	val.Require("paymentSource")
+	if cart.Email == "" {
+		val.AddError("email", "an email address is required before checking out.")
+	}
+	if cart.ShippingAddress == nil {
+		val.AddError("shippingAddress", "a shipping address is required before checking out.")
+	}
+	if len(cart.Lines) == 0 {
+		val.AddError("items", "the cart is empty.")
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Build the order from the cart. Items which are no longer available prevent
+	// checking out, since the customer would not get what they expect.
+	order, promotions, warnings, err := priceCart(cart, val)
+	if err != nil {
+		panic(err)
+	}
+	for _, warning := range warnings {
+		if lib.FindOrderItem(order, warning.ItemId) == nil {
+			val.AddError("items", warning.Message)
+		}
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Take payment and save the order
+	if placed := placeOrder(res, req, order, promotions, checkoutData.Get("paymentSource"), val); !placed {
+		return
+	}
+
+	// The cart has become an order, so we don't need it anymore
+	if err := lib.RecordCartConversion(cart, order); err != nil {
+		panic(err)
+	}
+	if err := lib.DeleteCart(cart); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, order)
+}
+
+// findCartOr404 finds the cart with the id in the url. If there is no such cart, it
+// writes a 404 error to res and returns nil.
+func findCartOr404(res http.ResponseWriter, req *http.Request) *models.Cart {
+	id := mux.Vars(req)["id"]
+	cart, err := lib.FindCart(id)
+	if err != nil {
+		panic(err)
+	}
+	if cart == nil {
+		r := render.New()
+		msg := fmt.Sprintf("Could not find cart with id = %s. It may have expired.", id)
+		r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+	}
+	return cart
+}
+
+// setCartFields validates and sets the email, addresses, shipping method, and code for
+// cart for any of them that exist in cartData, adding any errors to val.
+func setCartFields(cartData *data.Data, val *data.Validator, cart *models.Cart) {
+	if cartData.KeyExists("email") {
+		if cartData.Get("email") != "" {
+			val.MatchEmail("email")
+		}
+		cart.Email = strings.TrimSpace(cartData.Get("email"))
+	}
+	if cartData.KeyExists("shippingAddress") {
+		cart.ShippingAddress = parseAddress(cartData, val, "shippingAddress")
+	}
+	if cartData.KeyExists("billingAddress") {
+		cart.BillingAddress = parseAddress(cartData, val, "billingAddress")
+	}
+	if cartData.KeyExists("shippingRateId") {
+		cart.ShippingRateId = cartData.Get("shippingRateId")
+	}
+	if cartData.KeyExists("code") {
+		cart.Code = models.NormalizePromotionCode(cartData.Get("code"))
+	}
+}
+
+// validateCartItem adds a validation error to val if there is no public item with
+// the given id. It returns true iff the item exists and is public.
+func validateCartItem(itemId string, val *data.Validator) bool {
+	item := &models.Item{}
+	if err := zoom.ScanById(itemId, item); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); !ok {
+			panic(err)
+		}
+	} else if item.IsPublic(time.Now().UTC().Unix()) {
+		return true
+	}
+	val.AddError("itemId", fmt.Sprintf("Could not find item with id = %s", itemId))
+	return false
+}
+
+// priceCart builds an unsaved order from the items in cart using their current prices,
+// and then applies promotions, shipping, and taxes with priceOrder. Items which no longer
+// exist or are no longer public are left out of the order. It returns the order and the promotions that were
+// applied to it, along with warnings for any items which are missing or do not have
+// enough stock. Any other problems with the cart are added to val.
+func priceCart(cart *models.Cart, val *data.Validator) (*models.Order, []*models.Promotion, []cartWarning, error) {
+	order := &models.Order{
+		Email:          cart.Email,
+		BillingAddress: cart.BillingAddress,
+		Status:         models.OrderStatusPending,
+	}
+	if cart.ShippingAddress != nil {
+		order.ShippingAddress = *cart.ShippingAddress
+	}
+	warnings := []cartWarning{}
+	for _, line := range cart.Lines {
+		item := &models.Item{}
+		if err := zoom.ScanById(line.ItemId, item); err != nil {
+			if _, ok := err.(*zoom.KeyNotFoundError); ok {
+				warnings = append(warnings, cartWarning{
+					Field:   "items",
+					ItemId:  line.ItemId,
+					Message: "One of the items in your cart is no longer available.",
+				})
+				continue
+			}
+			return nil, nil, nil, err
+		}
+		if !item.IsPublic(time.Now().UTC().Unix()) {
+			warnings = append(warnings, cartWarning{
+				Field:   "items",
+				ItemId:  line.ItemId,
+				Message: "One of the items in your cart is no longer available.",
+			})
+			continue
+		}
+		if msg := lib.UnavailableMessage(item, line.Quantity); msg != "" {
+			warnings = append(warnings, cartWarning{
+				Field:   "items",
+				ItemId:  item.Id,
+				Message: msg,
+			})
+		}
+		order.AddItem(item, line.Quantity)
+	}
+	if len(order.Items) == 0 {
+		order.UpdateTotals()
+		return order, nil, warnings, nil
+	}
+	promotions, err := priceOrder(order, cart.Code, cart.ShippingRateId, val)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return order, promotions, warnings, nil
+}
+
+// renderCart prices cart and writes it to res along with any warnings. Problems
+// with the cart which were added to val are included as warnings.
+func renderCart(res http.ResponseWriter, cart *models.Cart, val *data.Validator) {
+	r := render.New()
+	order, _, warnings, err := priceCart(cart, val)
+	if err != nil {
+		panic(err)
+	}
+	for field, messages := range val.ErrorMap() {
+		for _, msg := range messages {
+			warnings = append(warnings, cartWarning{Field: field, Message: msg})
+		}
+	}
+	r.JSON(res, http.StatusOK, cartResponse{
+		Cart:           cart,
+		Items:          order.Items,
+		ShippingMethod: order.ShippingMethod,
+		ShippingCost:   order.ShippingCost,
+		Subtotal:       order.Subtotal,
+		Promotions:     order.Promotions,
+		Discount:       order.Discount,
+		Tax:            order.Tax,
+		Total:          order.Total,
+		Warnings:       warnings,
+	})
+}
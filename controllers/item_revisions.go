@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+)
+
+type ItemRevisionsController struct{}
+
+// Index lists the revisions for an item, newest first.
+func (c ItemRevisionsController) Index(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	item := findItemOr404(res, req)
+	if item == nil {
+		return
+	}
+	revisions, err := lib.ItemRevisions(item.Id)
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(res, http.StatusOK, revisions)
+}
+
+// Restore rolls an item back to the way it was before one of its revisions, undoing
+// that revision and every later one (including the image, if it was changed). The
+// rollback is recorded as a new revision, so it can be undone too.
+func (c ItemRevisionsController) Restore(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	item := findItemOr404(res, req)
+	if item == nil {
+		return
+	}
+	revisionId := mux.Vars(req)["revisionId"]
+	reverted, imageArchivePath, err := lib.RevertItem(item, revisionId)
+	if err != nil {
+		panic(err)
+	}
+	if reverted == nil {
+		msg := fmt.Sprintf("Could not find revision with id = %s for item with id = %s", revisionId, item.Id)
+		r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+		return
+	}
+
+	// The old name may have been taken by another item since
+	if reverted.Name != item.Name {
+		otherItem := &models.Item{}
+		if err := zoom.NewQuery("Item").Filter("Name =", reverted.Name).ScanOne(otherItem); err != nil {
+			if _, ok := err.(*zoom.ModelNotFoundError); !ok {
+				panic(err)
+			}
+		} else if otherItem.Id != item.Id {
+			r.JSON(res, lib.StatusUnprocessableEntity, map[string][]string{
+				"name": {fmt.Sprintf("The name %s has been taken by another item since the revision.", reverted.Name)},
+			})
+			return
+		}
+	}
+
+	// Restore the old image, keeping a copy of the current one so that the rollback
+	// can be undone
+	currentImageArchivePath := ""
+	if imageArchivePath != "" {
+		if currentImageArchivePath, err = lib.ArchiveItemImage(item); err != nil {
+			panic(err)
+		}
+		if reverted.ImageS3Path, reverted.ImageUrl, err = restoreImage(imageArchivePath, reverted.Name); err != nil {
+			panic(err)
+		}
+	}
+
+	// Save the item and record the rollback
+	if err := lib.SaveItem(reverted); err != nil {
+		panic(err)
+	}
+	if reverted.ImageS3Path != item.ImageS3Path {
+		if err := lib.QueueImageDeletion(item.ImageS3Path); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := lib.RecordItemRevision(item, reverted, lib.CurrentAdminUser(req).Id, currentImageArchivePath, revisionId); err != nil {
+		panic(err)
+	}
+	triggerWebhookEvent(models.WebhookEventItemUpdated, reverted)
+	checkStockAlert(reverted.Id)
+
+	// Render response
+	r.JSON(res, http.StatusOK, reverted)
+}
@@ -16,6 +16,7 @@ import (
 	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type ItemsController struct{}
@@ -33,10 +34,7 @@ func (c ItemsController) Create(res http.ResponseWriter, req *http.Request) {
 
 	// Validations
 	val := itemData.Validator()
-	val.Require("name")
-	val.Require("price")
-	val.Greater("price", 0.0)
-	val.Require("description")
+	validateNewItem(itemData, val)
 	val.RequireFile("image")
 	val.AcceptFileExts("image", acceptedImageExts...)
 	if itemData.Get("name") != "" {
@@ -56,9 +54,16 @@ func (c ItemsController) Create(res http.ResponseWriter, req *http.Request) {
 
 	// Create model with the attributes we have so far
 	item := &models.Item{
-		Name:        itemData.Get("name"),
-		Price:       itemData.GetFloat("price"),
-		Description: itemData.Get("description"),
+		Name:         itemData.Get("name"),
+		Price:        itemData.GetFloat("price"),
+		Description:  itemData.Get("description"),
+		Availability: models.ItemInStock,
+		Status:       models.ItemDraft,
+	}
+	setItemDetails(itemData, item)
+	if !validateItemState(item, val) {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
 	}
 
 	// Upload the image to S3
@@ -70,9 +75,10 @@ func (c ItemsController) Create(res http.ResponseWriter, req *http.Request) {
 	}
 
 	// Save the item to the database
-	if err := zoom.Save(item); err != nil {
+	if err := lib.SaveItem(item); err != nil {
 		panic(err)
 	}
+	setItemStock(req, itemData, item, models.StockReasonRestock, "Initial stock")
 
 	// Render response
 	r.JSON(res, http.StatusOK, item)
@@ -81,14 +87,15 @@ func (c ItemsController) Create(res http.ResponseWriter, req *http.Request) {
 func (c ItemsController) Show(res http.ResponseWriter, req *http.Request) {
 	r := render.New()
 
-	// Get the id from the url
-	vars := mux.Vars(req)
-	id := vars["id"]
-
-	// Find item in the database
-	item := &models.Item{}
-	if err := zoom.ScanById(id, item); err != nil {
-		panic(err)
+	// Find item in the database. Only admins can see items which are not public.
+	item := findItemOr404(res, req)
+	if item == nil {
+		return
+	}
+	if !item.IsPublic(time.Now().UTC().Unix()) && lib.CurrentAdminUser(req) == nil {
+		msg := fmt.Sprintf("Could not find item with id = %s", item.Id)
+		r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+		return
 	}
 
 	// render response
@@ -110,16 +117,7 @@ func (c ItemsController) Update(res http.ResponseWriter, req *http.Request) {
 
 	// Validations
 	val := itemData.Validator()
-	if itemData.KeyExists("name") {
-		val.Require("name").Message("name cannot be blank")
-	}
-	if itemData.KeyExists("price") {
-		val.Require("price").Message("price cannot be blank")
-		val.Greater("price", 0.0)
-	}
-	if itemData.KeyExists("description") {
-		val.Require("description").Message("description cannot be blank")
-	}
+	validateItemChanges(itemData, val)
 	if itemData.KeyExists("name") {
 		// Validate that name is unique
 		otherItem := &models.Item{}
@@ -150,10 +148,11 @@ func (c ItemsController) Update(res http.ResponseWriter, req *http.Request) {
 	}
 
 	// Find item in the database
-	item := &models.Item{}
-	if err := zoom.ScanById(id, item); err != nil {
-		panic(err)
+	item := findItemOr404(res, req)
+	if item == nil {
+		return
 	}
+	before := *item
 
 	// Update the item
 	nameChanged := false
@@ -167,6 +166,19 @@ func (c ItemsController) Update(res http.ResponseWriter, req *http.Request) {
 	if itemData.KeyExists("price") {
 		item.Price = itemData.GetFloat("price")
 	}
+	setItemDetails(itemData, item)
+	if !validateItemState(item, val) {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Keep a copy of the old image so that the change can be rolled back
+	imageArchivePath := ""
+	if itemData.FileExists("image") || nameChanged {
+		if imageArchivePath, err = lib.ArchiveItemImage(&before); err != nil {
+			panic(err)
+		}
+	}
 
 	// Handle different image upload cases
 	switch {
@@ -181,7 +193,7 @@ func (c ItemsController) Update(res http.ResponseWriter, req *http.Request) {
 	case itemData.FileExists("image") && nameChanged:
 		// We should delete the old image (which uses the old name)
 		// and then upload the new one using the new item name
-		if err := deleteImage(item.ImageS3Path); err != nil {
+		if err := lib.QueueImageDeletion(item.ImageS3Path); err != nil {
 			panic(err)
 		}
 		if imagePath, imageUrl, err := uploadImage(itemData.GetFile("image"), item.Name); err != nil {
@@ -200,52 +212,325 @@ func (c ItemsController) Update(res http.ResponseWriter, req *http.Request) {
 		item.ImageS3Path = newPath
 		item.ImageUrl = newUrl
 	}
-	if err := zoom.Save(item); err != nil {
+	if err := lib.SaveItem(item); err != nil {
+		panic(err)
+	}
+	setItemStock(req, itemData, item, models.StockReasonCorrection, "Set amount in stock")
+	if _, err := lib.RecordItemRevision(&before, item, lib.CurrentAdminUser(req).Id, imageArchivePath, ""); err != nil {
 		panic(err)
 	}
+	triggerWebhookEvent(models.WebhookEventItemUpdated, item)
+	if itemData.KeyExists("amountInStock") || itemData.KeyExists("lowStockThreshold") {
+		checkStockAlert(item.Id)
+	}
 
 	// Render response
 	r.JSON(res, http.StatusOK, item)
 }
 
+// Delete moves an item to the trash. It can be restored until it is purged along
+// with its image once the retention period has passed.
 func (c ItemsController) Delete(res http.ResponseWriter, req *http.Request) {
 	r := render.New()
 
+	// Get the item from the database
+	item := findItemOr404(res, req)
+	if item == nil {
+		return
+	}
+
+	// Move the item to the trash
+	item.DeletedAt = time.Now().UTC().Unix()
+	if err := lib.SaveItem(item); err != nil {
+		panic(err)
+	}
+	triggerWebhookEvent(models.WebhookEventItemDeleted, item)
+
+	// Render response
+	r.JSON(res, http.StatusOK, struct{}{})
+}
+
+// Restore takes an item out of the trash.
+func (c ItemsController) Restore(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
 	// Get the id from the url
 	vars := mux.Vars(req)
 	id := vars["id"]
 
-	// Get the item from the database
+	// Get the item from the database. It must be in the trash.
 	item := &models.Item{}
 	if err := zoom.ScanById(id, item); err != nil {
-		panic(err)
+		if _, ok := err.(*zoom.KeyNotFoundError); !ok {
+			panic(err)
+		}
+	}
+	if item.DeletedAt == 0 {
+		msg := fmt.Sprintf("Could not find item with id = %s in the trash", id)
+		r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+		return
 	}
 
-	// Delete the image from S3
-	deleteImage(item.ImageS3Path)
-
-	// Delete from database
-	if err := zoom.Delete(item); err != nil {
+	// Take the item out of the trash
+	item.DeletedAt = 0
+	if err := lib.SaveItem(item); err != nil {
 		panic(err)
 	}
 
 	// Render response
-	r.JSON(res, http.StatusOK, struct{}{})
+	r.JSON(res, http.StatusOK, item)
 }
 
 func (c ItemsController) Index(res http.ResponseWriter, req *http.Request) {
 	r := render.New()
 
-	// Find all admin users in the database
+	// Find all items in the database, except for the ones in the trash
 	var items []*models.Item
 	if err := zoom.NewQuery("Item").Scan(&items); err != nil {
 		panic(err)
 	}
+	items = filterUntrashedItems(items)
+
+	// Admins can see every item and filter by status, but everyone else only sees
+	// items which are public
+	isAdmin := lib.CurrentAdminUser(req) != nil
+	switch status := req.URL.Query().Get("status"); {
+	case status == "":
+		if !isAdmin {
+			items = filterPublicItems(items)
+		}
+	case !stringSliceContains(models.ItemStatuses, status):
+		r.JSON(res, lib.StatusUnprocessableEntity, map[string][]string{
+			"status": {fmt.Sprintf("status must be one of %v.", models.ItemStatuses)},
+		})
+		return
+	case !isAdmin:
+		r.JSON(res, http.StatusUnauthorized, lib.ErrUnauthorized)
+		return
+	default:
+		items = filterItemsByStatus(items, status)
+	}
+
+	// Admins can filter by stock level to see which items need to be restocked
+	switch stock := req.URL.Query().Get("stock"); stock {
+	case "":
+	case "low", "out":
+		if !isAdmin {
+			r.JSON(res, http.StatusUnauthorized, lib.ErrUnauthorized)
+			return
+		}
+		if stock == "low" {
+			items = lib.FilterItemsByStockLevel(items, lib.StockLevelLow, lib.StockLevelOut)
+		} else {
+			items = lib.FilterItemsByStockLevel(items, lib.StockLevelOut)
+		}
+	default:
+		r.JSON(res, lib.StatusUnprocessableEntity, map[string][]string{
+			"stock": {"stock must be either low or out."},
+		})
+		return
+	}
 
 	// Render response
 	r.JSON(res, http.StatusOK, items)
 }
 
+// filterPublicItems returns the items which are currently visible to customers.
+func filterPublicItems(items []*models.Item) []*models.Item {
+	now := time.Now().UTC().Unix()
+	filtered := []*models.Item{}
+	for _, item := range items {
+		if item.IsPublic(now) {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// filterUntrashedItems returns the items which are not in the trash.
+func filterUntrashedItems(items []*models.Item) []*models.Item {
+	filtered := []*models.Item{}
+	for _, item := range items {
+		if item.DeletedAt == 0 {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// filterItemsByStatus returns the items which have the given status. Items with no
+// status are treated as published.
+func filterItemsByStatus(items []*models.Item, status string) []*models.Item {
+	filtered := []*models.Item{}
+	for _, item := range items {
+		if item.Status == status || (item.Status == "" && status == models.ItemPublished) {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// findItemOr404 finds the item with the id in the url. If there is no such item, or
+// the item is in the trash, it writes a 404 error to res and returns nil.
+func findItemOr404(res http.ResponseWriter, req *http.Request) *models.Item {
+	id := mux.Vars(req)["id"]
+	item := &models.Item{}
+	if err := zoom.ScanById(id, item); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); !ok {
+			panic(err)
+		}
+	} else if item.DeletedAt == 0 {
+		return item
+	}
+	r := render.New()
+	msg := fmt.Sprintf("Could not find item with id = %s", id)
+	r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+	return nil
+}
+
+// setItemStock sets the amount of item in stock to the amountInStock in itemData, if
+// it exists, and records the change in the stock ledger with the given reason and
+// reference. The item must already have been saved.
+func setItemStock(req *http.Request, itemData *data.Data, item *models.Item, reason string, reference string) {
+	if !itemData.KeyExists("amountInStock") {
+		return
+	}
+	amount := itemData.GetInt("amountInStock")
+	if _, err := lib.SetItemStock(&models.StockAdjustment{
+		ItemId:      item.Id,
+		Reason:      reason,
+		Reference:   reference,
+		AdminUserId: lib.CurrentAdminUser(req).Id,
+	}, amount); err != nil {
+		panic(err)
+	}
+	item.AmountInStock = amount
+}
+
+// checkStockAlert alerts admins if the item with the given id has become low on or
+// out of stock. Problems sending alerts should never fail the request, so errors
+// are only logged.
+func checkStockAlert(itemId string) {
+	if err := lib.CheckStockAlert(itemId); err != nil {
+		fmt.Printf("[stock] Error checking stock alerts for item %s: %s\n", itemId, err)
+	}
+}
+
+// validateNewItem validates the fields needed to create an item, other than the
+// image, adding any errors to val.
+func validateNewItem(itemData *data.Data, val *data.Validator) {
+	val.Require("name")
+	val.Require("price")
+	val.Greater("price", 0.0)
+	val.Require("description")
+	validateItemDetails(itemData, val)
+}
+
+// validateItemChanges validates the fields which can be changed when updating an
+// item, other than the image, adding any errors to val. Only the fields which exist
+// in itemData are validated.
+func validateItemChanges(itemData *data.Data, val *data.Validator) {
+	if itemData.KeyExists("name") {
+		val.Require("name").Message("name cannot be blank")
+	}
+	if itemData.KeyExists("price") {
+		val.Require("price").Message("price cannot be blank")
+		val.Greater("price", 0.0)
+	}
+	if itemData.KeyExists("description") {
+		val.Require("description").Message("description cannot be blank")
+	}
+	validateItemDetails(itemData, val)
+}
+
+// itemDimensionKeys are the keys for the optional shipping weight and dimensions of
+// an item, which must be at least 0 if they are provided.
+var itemDimensionKeys = []string{"weight", "length", "width", "height"}
+
+// validateItemDetails validates the optional fields of an item which are used to
+// calculate shipping and tax and to track stock, adding any errors to val.
+func validateItemDetails(itemData *data.Data, val *data.Validator) {
+	if itemData.KeyExists("amountInStock") {
+		val.GreaterOrEqual("amountInStock", 0.0)
+	}
+	if itemData.KeyExists("lowStockThreshold") {
+		val.GreaterOrEqual("lowStockThreshold", 0.0)
+	}
+	if status := itemData.Get("status"); status != "" && !stringSliceContains(models.ItemStatuses, status) {
+		val.AddError("status", fmt.Sprintf("status must be one of %v.", models.ItemStatuses))
+	}
+	if availability := itemData.Get("availability"); availability != "" && !stringSliceContains(models.ItemAvailabilities, availability) {
+		val.AddError("availability", fmt.Sprintf("availability must be one of %v.", models.ItemAvailabilities))
+	}
+	if itemData.KeyExists("backorderLimit") {
+		val.GreaterOrEqual("backorderLimit", 0.0)
+	}
+	for _, key := range itemDimensionKeys {
+		if itemData.KeyExists(key) {
+			val.GreaterOrEqual(key, 0.0)
+		}
+	}
+	if itemData.Get("taxCategory") != "" {
+		val.Match("taxCategory", taxCategoryRegex).Message("taxCategory must consist of lowercase letters and underscores.")
+	}
+}
+
+// validateItemState checks that item has everything it needs for its availability
+// and status once its details have been set, adding any errors to val. It returns
+// false if there were any errors.
+func validateItemState(item *models.Item, val *data.Validator) bool {
+	if item.Availability == models.ItemPreorder && item.ExpectedShipDate == 0 {
+		val.AddError("expectedShipDate", "expectedShipDate is required for pre-order items.")
+	}
+	if item.Status == models.ItemScheduled && item.PublishAt == 0 {
+		val.AddError("publishAt", "publishAt is required for scheduled items.")
+	}
+	return !val.HasErrors()
+}
+
+// setItemDetails sets the weight and dimensions of item for any of the
+// itemDimensionKeys that exist in itemData, along with its status, category, tax
+// category, low stock threshold, and availability. The amount in stock is set separately by
+// setItemStock so that the change is recorded in the stock ledger.
+func setItemDetails(itemData *data.Data, item *models.Item) {
+	if itemData.Get("status") != "" {
+		item.Status = itemData.Get("status")
+	}
+	if itemData.KeyExists("publishAt") {
+		item.PublishAt = int64(itemData.GetInt("publishAt"))
+	}
+	if itemData.KeyExists("lowStockThreshold") {
+		item.LowStockThreshold = itemData.GetInt("lowStockThreshold")
+	}
+	if itemData.Get("availability") != "" {
+		item.Availability = itemData.Get("availability")
+	}
+	if itemData.KeyExists("backorderLimit") {
+		item.BackorderLimit = itemData.GetInt("backorderLimit")
+	}
+	if itemData.KeyExists("expectedShipDate") {
+		item.ExpectedShipDate = int64(itemData.GetInt("expectedShipDate"))
+	}
+	if itemData.KeyExists("category") {
+		item.Category = strings.TrimSpace(itemData.Get("category"))
+	}
+	if itemData.KeyExists("taxCategory") {
+		item.TaxCategory = itemData.Get("taxCategory")
+	}
+	if itemData.KeyExists("weight") {
+		item.Weight = itemData.GetFloat("weight")
+	}
+	if itemData.KeyExists("length") {
+		item.Length = itemData.GetFloat("length")
+	}
+	if itemData.KeyExists("width") {
+		item.Width = itemData.GetFloat("width")
+	}
+	if itemData.KeyExists("height") {
+		item.Height = itemData.GetFloat("height")
+	}
+}
+
 func calculateImageS3Path(itemName, filename string) string {
 	imageFilename := url.QueryEscape(itemName)
 	return fmt.Sprintf("items/%s%s", imageFilename, filepath.Ext(filename))
@@ -276,11 +561,21 @@ func uploadImage(fileHeader *multipart.FileHeader, itemName string) (imageOrigPa
 	if err != nil {
 		return "", "", err
 	}
+	return uploadImageBytes(imageBytes, fileHeader.Filename, itemName)
+}
+
+// uploadImageBytes uploads an image with the given contents and filename for the
+// item with the given name, and returns its path and url. Unlike deletes, uploads
+// and copies are not background jobs. The image path only depends on the item name
+// and file extension, so a queued upload could overwrite the image before
+// lib.ArchiveItemImage copies it for a revision, and the returned url has to work as
+// soon as the item is saved.
+func uploadImageBytes(imageBytes []byte, filename string, itemName string) (imageOrigPath string, imageUrl string, e error) {
 	// Get the mimetype of the image file
-	imageType, _ := lib.GetImageMimeType(fileHeader.Filename)
+	imageType, _ := lib.GetImageMimeType(filename)
 
 	// Calculate and set original image path
-	imageOrigPath = calculateImageS3Path(itemName, fileHeader.Filename)
+	imageOrigPath = calculateImageS3Path(itemName, filename)
 
 	// Get the bucket instance
 	bucket, err := lib.S3Bucket()
@@ -294,22 +589,24 @@ func uploadImage(fileHeader *multipart.FileHeader, itemName string) (imageOrigPa
 	}
 
 	// Calculate and set image url
-	imageUrl = calculateImageUrl(itemName, fileHeader.Filename)
+	imageUrl = calculateImageUrl(itemName, filename)
 	return imageOrigPath, imageUrl, nil
 }
 
-func deleteImage(path string) error {
-	// Get the bucket instance
+// restoreImage copies an image which was archived by lib.ArchiveItemImage back to
+// the path for an item with the given name.
+func restoreImage(archivePath string, itemName string) (newPath string, newUrl string, e error) {
 	bucket, err := lib.S3Bucket()
 	if err != nil {
-		return err
+		return "", "", err
 	}
-
-	// Delete the file from the bucket
-	if err := bucket.Del(path); err != nil {
-		return err
+	archiveFilename := filepath.Base(archivePath)
+	newPath = calculateImageS3Path(itemName, archiveFilename)
+	newUrl = calculateImageUrl(itemName, archiveFilename)
+	if err := bucket.Copy(archivePath, newPath, s3.PublicRead); err != nil {
+		return "", "", err
 	}
-	return nil
+	return newPath, newUrl, nil
 }
 
 func renameImage(oldPath string, newName string) (newPath string, newUrl string, e error) {
@@ -324,11 +621,12 @@ func renameImage(oldPath string, newName string) (newPath string, newUrl string,
 	newUrl = calculateImageUrl(newName, oldFilename)
 
 	// As far as I know the only way to do this with goamz is to
-	// copy and then delete
+	// copy and then delete. The copy has to happen now so that the new
+	// url works right away, but the delete can happen in the background.
 	if err := bucket.Copy(oldPath, newPath, s3.PublicRead); err != nil {
 		return "", "", err
 	}
-	if err := deleteImage(oldPath); err != nil {
+	if err := lib.QueueImageDeletion(oldPath); err != nil {
 		return "", "", err
 	}
 	return newPath, newUrl, nil
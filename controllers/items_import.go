@@ -0,0 +1,486 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/albrow/zoom"
+	"github.com/unrolled/render"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// itemImportMaxRows is the most items which can be imported at once.
+const itemImportMaxRows = 1000
+
+// Limits on the uncompressed size of the images in the zip file for an import, so
+// that a small zip file can't expand into more than the server can hold in memory.
+const (
+	itemImportMaxImageSize  = 5 << 20   // Each image
+	itemImportMaxImagesSize = 100 << 20 // Every image in the zip file together
+)
+
+// errImportImageTooLarge is returned by readZipFile if the file is larger than
+// itemImportMaxImageSize.
+var errImportImageTooLarge = fmt.Errorf("image is larger than the limit of %d MB.", itemImportMaxImageSize>>20)
+
+// itemExportColumns are the columns in a CSV export of items, in order, along with
+// functions which format the value of each column for an item.
+var itemExportColumns = []struct {
+	name  string
+	value func(item *models.Item) string
+}{
+	{"id", func(item *models.Item) string { return item.Id }},
+	{"name", func(item *models.Item) string { return item.Name }},
+	{"description", func(item *models.Item) string { return item.Description }},
+	{"price", func(item *models.Item) string { return formatImportFloat(item.Price) }},
+	{"imageUrl", func(item *models.Item) string { return item.ImageUrl }},
+	{"category", func(item *models.Item) string { return item.Category }},
+	{"taxCategory", func(item *models.Item) string { return item.TaxCategory }},
+	{"weight", func(item *models.Item) string { return formatImportFloat(item.Weight) }},
+	{"length", func(item *models.Item) string { return formatImportFloat(item.Length) }},
+	{"width", func(item *models.Item) string { return formatImportFloat(item.Width) }},
+	{"height", func(item *models.Item) string { return formatImportFloat(item.Height) }},
+	{"amountInStock", func(item *models.Item) string { return strconv.Itoa(item.AmountInStock) }},
+	{"lowStockThreshold", func(item *models.Item) string { return strconv.Itoa(item.LowStockThreshold) }},
+	{"availability", func(item *models.Item) string { return item.Availability }},
+	{"backorderLimit", func(item *models.Item) string { return strconv.Itoa(item.BackorderLimit) }},
+	{"expectedShipDate", func(item *models.Item) string { return strconv.FormatInt(item.ExpectedShipDate, 10) }},
+	{"status", func(item *models.Item) string { return item.Status }},
+	{"publishAt", func(item *models.Item) string { return strconv.FormatInt(item.PublishAt, 10) }},
+}
+
+// isItemImportColumn returns true iff key is one of the fields which can be set by
+// an import. These are the exported columns other than the id and imageUrl (which
+// are ignored, so that exports can be imported again), plus the image, which is
+// the filename of an image in the zip file of images.
+func isItemImportColumn(key string) bool {
+	if key == "image" {
+		return true
+	}
+	if key == "id" || key == "imageUrl" {
+		return false
+	}
+	for _, column := range itemExportColumns {
+		if column.name == key {
+			return true
+		}
+	}
+	return false
+}
+
+func formatImportFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// itemImportRow is the result of importing a single item.
+type itemImportRow struct {
+	Row    int                 `json:"row"` // Starting at 1 for the first item in the file
+	Name   string              `json:"name"`
+	Action string              `json:"action"`           // Either "create", "update", or "error"
+	ItemId string              `json:"itemId,omitempty"` // Empty for new items in a dry run
+	Errors map[string][]string `json:"errors,omitempty"`
+}
+
+// itemImportReport is the result of an import.
+type itemImportReport struct {
+	DryRun  bool            `json:"dryRun"`
+	Created int             `json:"created"`
+	Updated int             `json:"updated"`
+	Failed  int             `json:"failed"`
+	Rows    []itemImportRow `json:"rows"`
+}
+
+// Import creates or updates items (matched by name) from a CSV or JSON file, along
+// with an optional zip file of images. Each item is validated with the same rules
+// as Create and Update. Items which are valid are saved even if others are not,
+// unless it is a dry run, in which case nothing is saved. The amountInStock of existing
+// items is only changed if setStock is true, since the stock may have changed since
+// the file was exported. The response is a report of what happened (or would happen)
+// to each item.
+func (c ItemsController) Import(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Parse data from request
+	importData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := importData.Validator()
+	val.RequireFile("file")
+	val.AcceptFileExts("file", "csv", "json")
+	if importData.FileExists("images") {
+		val.AcceptFileExts("images", "zip")
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Read the items from the file
+	fileHeader := importData.GetFile("file")
+	fileBytes, err := readFileHeader(fileHeader)
+	if err != nil {
+		panic(err)
+	}
+	var rows []url.Values
+	if strings.ToLower(filepath.Ext(fileHeader.Filename)) == ".json" {
+		rows, err = parseItemImportJSON(fileBytes)
+	} else {
+		rows, err = parseItemImportCSV(fileBytes)
+	}
+	if err != nil {
+		val.AddError("file", err.Error())
+	} else if len(rows) == 0 {
+		val.AddError("file", "file must contain at least one item.")
+	} else if len(rows) > itemImportMaxRows {
+		val.AddError("file", fmt.Sprintf("file can contain at most %d items.", itemImportMaxRows))
+	}
+
+	// Read the images from the zip file, by filename
+	images := map[string]*zip.File{}
+	if importData.FileExists("images") {
+		zipBytes, err := readFileHeader(importData.GetFile("images"))
+		if err != nil {
+			panic(err)
+		}
+		if zipReader, err := zip.NewReader(bytes.NewReader(zipBytes), int64(len(zipBytes))); err != nil {
+			val.AddError("images", "images must be a valid zip file.")
+		} else {
+			var totalSize uint64
+			for _, f := range zipReader.File {
+				if f.FileInfo().IsDir() {
+					continue
+				}
+				if f.UncompressedSize64 > itemImportMaxImageSize {
+					val.AddError("images", fmt.Sprintf("%s is larger than the limit of %d MB for each image.", f.Name, itemImportMaxImageSize>>20))
+				}
+				totalSize += f.UncompressedSize64
+				images[filepath.Base(f.Name)] = f
+			}
+			if totalSize > itemImportMaxImagesSize {
+				val.AddError("images", fmt.Sprintf("the images can be at most %d MB in total when uncompressed.", itemImportMaxImagesSize>>20))
+			}
+		}
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Import each item
+	report := &itemImportReport{
+		DryRun: importData.GetBool("dryRun"),
+		Rows:   []itemImportRow{},
+	}
+	seenNames := map[string]bool{}
+	for i, values := range rows {
+		row := importItem(req, values, images, seenNames, report.DryRun, importData.GetBool("setStock"))
+		row.Row = i + 1
+		switch row.Action {
+		case "create":
+			report.Created++
+		case "update":
+			report.Updated++
+		default:
+			report.Failed++
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, report)
+}
+
+// importItem validates a single item from an import, and then creates or updates it
+// unless dryRun is true. seenNames is the names of the items earlier in the file,
+// which is used to catch duplicates. images are the images from the zip file, by
+// filename. The amountInStock of an existing item is ignored unless setStock is true.
+func importItem(req *http.Request, values url.Values, images map[string]*zip.File, seenNames map[string]bool, dryRun bool, setStock bool) itemImportRow {
+	row := itemImportRow{Name: values.Get("name")}
+	failed := func(errors map[string][]string) itemImportRow {
+		row.Action = "error"
+		row.Errors = errors
+		return row
+	}
+	itemData, err := parseItemImportValues(values)
+	if err != nil {
+		panic(err)
+	}
+	val := itemData.Validator()
+
+	// Find the existing item with the same name, if there is one
+	item := &models.Item{}
+	exists := false
+	if row.Name != "" {
+		if err := zoom.NewQuery("Item").Filter("Name =", row.Name).ScanOne(item); err != nil {
+			if _, ok := err.(*zoom.ModelNotFoundError); !ok {
+				panic(err)
+			}
+		} else {
+			exists = true
+		}
+		if exists && item.DeletedAt != 0 {
+			val.AddError("name", "an item with that name is in the trash.")
+		}
+		if seenNames[row.Name] {
+			val.AddError("name", "that item name appears more than once in the file.")
+		}
+		seenNames[row.Name] = true
+	}
+
+	// Validations
+	if exists {
+		validateItemChanges(itemData, val)
+	} else {
+		validateNewItem(itemData, val)
+		val.Require("image")
+	}
+	var imageFile *zip.File
+	var imageBytes []byte
+	if filename := itemData.Get("image"); filename != "" {
+		ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+		if imageFile = images[filename]; imageFile == nil {
+			val.AddError("image", fmt.Sprintf("could not find %s in the zip file of images.", filename))
+		} else if !stringSliceContains(acceptedImageExts, ext) {
+			val.AddError("image", fmt.Sprintf("image must have one of the following extensions: %s.", strings.Join(acceptedImageExts, ", ")))
+		} else if imageBytes, err = readZipFile(imageFile); err == errImportImageTooLarge {
+			val.AddError("image", err.Error())
+		} else if err != nil {
+			panic(err)
+		}
+	}
+	if val.HasErrors() {
+		return failed(val.ErrorMap())
+	}
+
+	// Set the fields of the item
+	before := *item
+	if exists {
+		row.Action = "update"
+		row.ItemId = item.Id
+		if itemData.KeyExists("description") {
+			item.Description = itemData.Get("description")
+		}
+		if itemData.KeyExists("price") {
+			item.Price = itemData.GetFloat("price")
+		}
+	} else {
+		row.Action = "create"
+		item = &models.Item{
+			Name:         itemData.Get("name"),
+			Price:        itemData.GetFloat("price"),
+			Description:  itemData.Get("description"),
+			Availability: models.ItemInStock,
+			Status:       models.ItemDraft,
+		}
+	}
+	setItemDetails(itemData, item)
+	if !validateItemState(item, val) {
+		return failed(val.ErrorMap())
+	}
+	if dryRun {
+		return row
+	}
+
+	// Upload the image, keeping a copy of the old one for existing items so that
+	// the change can be rolled back
+	imageArchivePath := ""
+	if imageFile != nil {
+		if exists {
+			if imageArchivePath, err = lib.ArchiveItemImage(&before); err != nil {
+				panic(err)
+			}
+		}
+		if item.ImageS3Path, item.ImageUrl, err = uploadImageBytes(imageBytes, filepath.Base(imageFile.Name), item.Name); err != nil {
+			panic(err)
+		}
+	}
+
+	// Save the item
+	if err := lib.SaveItem(item); err != nil {
+		panic(err)
+	}
+	row.ItemId = item.Id
+	if !exists {
+		setItemStock(req, itemData, item, models.StockReasonRestock, "Initial stock")
+		return row
+	}
+	if before.ImageS3Path != item.ImageS3Path {
+		// The new image has a different extension, so the old one wasn't replaced
+		if err := lib.QueueImageDeletion(before.ImageS3Path); err != nil {
+			panic(err)
+		}
+	}
+	stockChanged := setStock && itemData.KeyExists("amountInStock")
+	if stockChanged {
+		setItemStock(req, itemData, item, models.StockReasonCorrection, "Set amount in stock by import")
+	}
+	if _, err := lib.RecordItemRevision(&before, item, lib.CurrentAdminUser(req).Id, imageArchivePath, ""); err != nil {
+		panic(err)
+	}
+	triggerWebhookEvent(models.WebhookEventItemUpdated, item)
+	if stockChanged || itemData.KeyExists("lowStockThreshold") {
+		checkStockAlert(item.Id)
+	}
+	return row
+}
+
+// parseItemImportValues converts the values for an item in an import to data which
+// can be validated in the same way as the data for a request to create or update
+// an item.
+func parseItemImportValues(values url.Values) (*data.Data, error) {
+	req, err := http.NewRequest("POST", "/items/import", strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return data.Parse(req)
+}
+
+// parseItemImportCSV returns the values for each item in a CSV file. The first row
+// must be a header with the names of the columns. Empty values and unknown columns
+// are left out, so that fields which are not given are left unchanged for existing
+// items.
+func parseItemImportCSV(fileBytes []byte) ([]url.Values, error) {
+	records, err := csv.NewReader(bytes.NewReader(fileBytes)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("file is not a valid CSV file: %s.", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	header := records[0]
+	rows := []url.Values{}
+	for _, record := range records[1:] {
+		values := url.Values{}
+		for i, value := range record {
+			key := strings.TrimSpace(header[i])
+			if value = unescapeImportCell(strings.TrimSpace(value)); value != "" && isItemImportColumn(key) {
+				values.Set(key, value)
+			}
+		}
+		rows = append(rows, values)
+	}
+	return rows, nil
+}
+
+// parseItemImportJSON returns the values for each item in a JSON file, which must
+// be an array of objects. Like parseItemImportCSV, empty values and unknown keys are
+// left out.
+func parseItemImportJSON(fileBytes []byte) ([]url.Values, error) {
+	var objects []map[string]interface{}
+	if err := json.Unmarshal(fileBytes, &objects); err != nil {
+		return nil, fmt.Errorf("file must be a JSON array of objects.")
+	}
+	rows := []url.Values{}
+	for i, object := range objects {
+		values := url.Values{}
+		for key, value := range object {
+			if !isItemImportColumn(key) {
+				continue
+			}
+			switch v := value.(type) {
+			case nil:
+			case string:
+				if v = strings.TrimSpace(v); v != "" {
+					values.Set(key, v)
+				}
+			case float64:
+				values.Set(key, formatImportFloat(v))
+			case bool:
+				values.Set(key, strconv.FormatBool(v))
+			default:
+				return nil, fmt.Errorf("%s for item %d must be a string, number, or boolean.", key, i+1)
+			}
+		}
+		rows = append(rows, values)
+	}
+	return rows, nil
+}
+
+// Export lists every item which is not in the trash as a CSV file (the default) or
+// a JSON file, in a format which can be imported again.
+func (c ItemsController) Export(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Find all items in the database, except for the ones in the trash
+	var items []*models.Item
+	if err := zoom.NewQuery("Item").Order("Name").Scan(&items); err != nil {
+		panic(err)
+	}
+	items = filterUntrashedItems(items)
+
+	// Render response in the requested format
+	switch format := req.URL.Query().Get("format"); format {
+	case "", "csv":
+		res.Header().Set("Content-Type", "text/csv")
+		res.Header().Set("Content-Disposition", `attachment; filename="items.csv"`)
+		writer := csv.NewWriter(res)
+		header := make([]string, len(itemExportColumns))
+		for i, column := range itemExportColumns {
+			header[i] = column.name
+		}
+		writer.Write(header)
+		for _, item := range items {
+			record := make([]string, len(itemExportColumns))
+			for i, column := range itemExportColumns {
+				record[i] = escapeExportCell(column.value(item))
+			}
+			writer.Write(record)
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			panic(err)
+		}
+	case "json":
+		res.Header().Set("Content-Disposition", `attachment; filename="items.json"`)
+		r.JSON(res, http.StatusOK, items)
+	default:
+		r.JSON(res, lib.StatusUnprocessableEntity, map[string][]string{
+			"format": {"format must be either csv or json."},
+		})
+	}
+}
+
+// readFileHeader returns the contents of an uploaded file.
+func readFileHeader(fileHeader *multipart.FileHeader) ([]byte, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// readZipFile returns the contents of a file in a zip file, or errImportImageTooLarge
+// if it is larger than itemImportMaxImageSize. The size in the zip file's header is
+// not trusted, so at most one byte more than the limit is ever read.
+func readZipFile(f *zip.File) ([]byte, error) {
+	file, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	contents, err := ioutil.ReadAll(io.LimitReader(file, itemImportMaxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) > itemImportMaxImageSize {
+		return nil, errImportImageTooLarge
+	}
+	return contents, nil
+}
@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/jobs"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+)
+
+type JobsController struct{}
+
+// Stats shows how many jobs are waiting in each queue and how many have failed.
+func (c JobsController) Stats(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	stats, err := jobs.GetStats()
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(res, http.StatusOK, stats)
+}
+
+func (c JobsController) Show(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	id := mux.Vars(req)["id"]
+	job, err := jobs.Find(id)
+	if err != nil {
+		panic(err)
+	}
+	if job == nil {
+		msg := fmt.Sprintf("Could not find job with id = %s. Jobs are deleted once they succeed.", id)
+		r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+		return
+	}
+	r.JSON(res, http.StatusOK, job)
+}
+
+// Dead lists the jobs which failed too many times to be retried automatically,
+// newest first.
+func (c JobsController) Dead(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	deadJobs, err := jobs.DeadJobs()
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(res, http.StatusOK, deadJobs)
+}
+
+// Retry puts a dead job back on its queue so that it will be run again.
+func (c JobsController) Retry(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	id := mux.Vars(req)["id"]
+	if retried, err := jobs.RetryDead(id); err != nil {
+		panic(err)
+	} else if !retried {
+		r.JSON(res, http.StatusNotFound, lib.NewJsonError(fmt.Sprintf("Could not find dead job with id = %s", id)))
+		return
+	}
+	job, err := jobs.Find(id)
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(res, http.StatusOK, job)
+}
+
+// Delete deletes a dead job so that it is never run.
+func (c JobsController) Delete(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	id := mux.Vars(req)["id"]
+	if deleted, err := jobs.DeleteDead(id); err != nil {
+		panic(err)
+	} else if !deleted {
+		r.JSON(res, http.StatusNotFound, lib.NewJsonError(fmt.Sprintf("Could not find dead job with id = %s", id)))
+		return
+	}
+	r.JSON(res, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Invoice renders a printable invoice for an order as a PDF. The order is given the
+// next invoice number the first time its invoice is requested, and keeps that number
+// from then on.
+func (o OrdersController) Invoice(res http.ResponseWriter, req *http.Request) {
+	order := findOrderOr404(res, req)
+	if order == nil {
+		return
+	}
+	if err := lib.AssignInvoiceNumber(order); err != nil {
+		panic(err)
+	}
+	filename := lib.FormatInvoiceNumber(order.InvoiceNumber) + ".pdf"
+	renderPDF(res, filename, order, lib.WriteInvoicePDF)
+}
+
+// PackingSlip renders a printable packing slip for an order as a PDF, with the items
+// and quantities to ship but no prices.
+func (o OrdersController) PackingSlip(res http.ResponseWriter, req *http.Request) {
+	order := findOrderOr404(res, req)
+	if order == nil {
+		return
+	}
+	renderPDF(res, "packing_slip_"+order.Id+".pdf", order, lib.WritePackingSlipPDF)
+}
+
+// renderPDF writes the PDF for order generated by write to res, so that it will be
+// shown in the browser (and downloaded with the given filename if it is saved). The
+// PDF is generated before anything is written, so that errors can be reported.
+func renderPDF(res http.ResponseWriter, filename string, order *models.Order, write func(w io.Writer, order *models.Order) error) {
+	buf := &bytes.Buffer{}
+	if err := write(buf, order); err != nil {
+		panic(err)
+	}
+	res.Header().Set("Content-Type", "application/pdf")
+	res.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+	res.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	res.WriteHeader(http.StatusOK)
+	buf.WriteTo(res)
+}
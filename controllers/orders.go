@@ -3,15 +3,22 @@ package controllers
 import (
 	"fmt"
 	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/payments"
 	"github.com/albrow/5w4g-server/models"
 	"github.com/albrow/go-data-parser"
 	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 	"net/http"
+	"regexp"
+	"time"
 )
 
 type OrdersController struct{}
 
+// trackingUrlRegex matches valid urls for tracking a package
+var trackingUrlRegex = regexp.MustCompile(`^https?://`)
+
 type orderItemDatum struct {
 	ItemId   string `json:"itemId"`
 	Quantity int    `json:"quantity"`
@@ -26,6 +33,7 @@ func (o OrdersController) Create(res http.ResponseWriter, req *http.Request) {
 		r.JSON(res, http.StatusUnsupportedMediaType, map[string]string{
 			"error": msg,
 		})
+		return
 	}
 
 	// Parse data from the request.
@@ -37,34 +45,339 @@ func (o OrdersController) Create(res http.ResponseWriter, req *http.Request) {
 	// Validations
 	val := orderData.Validator()
 	val.Require("email")
+	val.MatchEmail("email")
 	val.Require("items")
+	val.Require("shippingAddress")
+	val.Require("paymentSource")
+	shippingAddress := parseAddress(orderData, val, "shippingAddress")
+	billingAddress := parseAddress(orderData, val, "billingAddress")
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Get all the items for the order from the database
+	oiData := parseOrderItemData(orderData, val)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+	items := loadOrderItems(oiData, val)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Create the Order model and add each item to the order
+	order := &models.Order{
+		Email:          orderData.Get("email"),
+		BillingAddress: billingAddress,
+		Status:         models.OrderStatusPending,
+	}
+	if shippingAddress != nil {
+		order.ShippingAddress = *shippingAddress
+	}
+	for i, datum := range oiData {
+		order.AddItem(items[i], datum.Quantity)
+	}
+
+	// Apply promotions, shipping, and taxes
+	promotions, err := priceOrder(order, orderData.Get("code"), orderData.Get("shippingRateId"), val)
+	if err != nil {
+		panic(err)
+	}
 	if val.HasErrors() {
 		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
 		return
 	}
 
+	// Take payment and save the order
+	if placed := placeOrder(res, req, order, promotions, orderData.Get("paymentSource"), val); !placed {
+		return
+	}
+
+	// Return the Order
+	r.JSON(res, http.StatusOK, order)
+}
+
+func (o OrdersController) Show(res http.ResponseWriter, req *http.Request) {
+	order := findOrderOr404(res, req)
+	if order == nil {
+		return
+	}
+
+	// Render response
+	r := render.New()
+	r.JSON(res, http.StatusOK, order)
+}
+
+// Lookup lets a customer see their order without signing in, using the token from
+// the link in their order emails.
+func (o OrdersController) Lookup(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Parse data from the request
+	lookupData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Check the token before looking for the order, so that the response doesn't
+	// reveal which orders exist
+	id := mux.Vars(req)["id"]
+	if !lib.ValidOrderLookupToken(id, lookupData.Get("token")) {
+		r.JSON(res, http.StatusForbidden, lib.ErrForbidden)
+		return
+	}
+	order := findOrderOr404(res, req)
+	if order == nil {
+		return
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, order)
+}
+
+// SendEmail sends (or resends) one of the emails about an order to the customer.
+func (o OrdersController) SendEmail(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	order := findOrderOr404(res, req)
+	if order == nil {
+		return
+	}
+
+	// Parse data from the request
+	emailData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := emailData.Validator()
+	val.Require("type")
+	emailType := emailData.Get("type")
+	if emailType != "" && !stringSliceContains(models.OrderEmailTypes, emailType) {
+		val.AddError("type", fmt.Sprintf("type must be one of %v.", models.OrderEmailTypes))
+	} else if emailType == models.OrderEmailShipped && !order.HasShipped() {
+		val.AddError("type", "the order has not shipped yet.")
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Send the email. Unlike when the email is sent automatically, an error here
+	// should be reported to the admin.
+	if err := lib.SendOrderEmail(order, emailType); err != nil {
+		panic(err)
+	}
+	if err := zoom.Save(order); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, order)
+}
+
+func (o OrdersController) Update(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Don't let a refund or shipment change the order at the same time, so that
+	// cancelling it can't return the same stock twice
+	lock := lockOrder(res, mux.Vars(req)["id"])
+	if lock == nil {
+		return
+	}
+	defer unlockOrder(lock)
+
+	// Find the order in the database
+	order := findOrderOr404(res, req)
+	if order == nil {
+		return
+	}
+
+	// Parse data from the request
+	orderData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := orderData.Validator()
+	if orderData.KeyExists("status") {
+		val.Require("status").Message("status cannot be blank")
+		if status := orderData.Get("status"); status != "" && !stringSliceContains(models.OrderStatuses, status) {
+			val.AddError("status", fmt.Sprintf("status must be one of %v.", models.OrderStatuses))
+		} else if status != "" && status != order.Status && !order.CanChangeStatusTo(status) {
+			val.AddError("status", fmt.Sprintf("the status of an order cannot be changed from %s to %s.", order.Status, status))
+		} else if status != order.Status && (status == models.OrderStatusShipped || status == models.OrderStatusPartiallyShipped) {
+			// Shipments record what was shipped, and send the customer a shipping notice
+			val.AddError("status", "orders can only be shipped by creating a shipment with POST /orders/:id/shipments.")
+		}
+	}
+	addressesChanged := orderData.KeyExists("shippingAddress") || orderData.KeyExists("billingAddress")
+	if addressesChanged && order.HasShipped() {
+		// Addresses can only be corrected until the order ships
+		val.AddError("shippingAddress", "the addresses for an order cannot be changed after it has shipped.")
+	} else if addressesChanged && order.Status == models.OrderStatusCancelled {
+		val.AddError("shippingAddress", "the addresses for a cancelled order cannot be changed.")
+	}
+	shippingAddress := parseAddress(orderData, val, "shippingAddress")
+	billingAddress := parseAddress(orderData, val, "billingAddress")
+	if orderData.Get("trackingUrl") != "" {
+		val.Match("trackingUrl", trackingUrlRegex).Message("trackingUrl must be an http or https url.")
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Update the order
+	if shippingAddress != nil {
+		order.ShippingAddress = *shippingAddress
+	}
+	if billingAddress != nil {
+		order.BillingAddress = billingAddress
+	}
+	if orderData.KeyExists("carrier") {
+		order.Carrier = orderData.Get("carrier")
+	}
+	if orderData.KeyExists("trackingNumber") {
+		order.TrackingNumber = orderData.Get("trackingNumber")
+	}
+	if orderData.KeyExists("trackingUrl") {
+		order.TrackingUrl = orderData.Get("trackingUrl")
+	}
+	previousStatus := order.Status
+	var statusErr error
+	if status := orderData.Get("status"); status == models.OrderStatusCancelled && previousStatus != status {
+		statusErr = lib.CancelOrder(order, lib.CurrentAdminUser(req).Id)
+	} else if orderData.KeyExists("status") {
+		statusErr = lib.ChangeOrderStatus(order, status)
+	}
+	if statusErr != nil {
+		if declineErr, ok := statusErr.(*payments.DeclineError); ok {
+			r.JSON(res, http.StatusPaymentRequired, lib.NewJsonError(declineErr.Message))
+			return
+		}
+		panic(statusErr)
+	}
+	if err := zoom.Save(order); err != nil {
+		panic(err)
+	}
+
+	// Let any webhooks know about every change. The customer is sent a shipping
+	// notice when a shipment is created instead (see ShipmentsController.Create).
+	if order.Status != previousStatus {
+		triggerOrderStatusChanged(order, previousStatus)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, order)
+}
+
+func (o OrdersController) Delete(res http.ResponseWriter, req *http.Request) {
+	panic("Orders.Delete not yet implemented!")
+}
+
+func (o OrdersController) Index(res http.ResponseWriter, req *http.Request) {
+	panic("Orders.Index not yet implemented!")
+}
+
+// triggerOrderStatusChanged triggers the order.status_changed webhook event for order,
+// which has just been changed from previousStatus.
+func triggerOrderStatusChanged(order *models.Order, previousStatus string) {
+	triggerWebhookEvent(models.WebhookEventOrderStatusChanged, map[string]interface{}{
+		"previousStatus": previousStatus,
+		"order":          order,
+	})
+}
+
+// orderLockKey is the lock held while refunding or shipping items in the order with
+// the given id.
+func orderLockKey(orderId string) string {
+	return "Order:" + orderId + ":lock"
+}
+
+// lockOrder makes sure only one refund or shipment is made at a time for the order
+// with the given id, so that concurrent changes to the quantities refunded and
+// shipped can't overwrite each other. If another is already in progress, it writes
+// a 409 error to res and returns nil. Otherwise the lock should be released with
+// unlockOrder.
+func lockOrder(res http.ResponseWriter, orderId string) *lib.Lock {
+	lock, err := lib.AcquireLock(orderLockKey(orderId), 30*time.Second)
+	if err != nil {
+		panic(err)
+	} else if lock == nil {
+		r := render.New()
+		r.JSON(res, http.StatusConflict, lib.NewJsonError("Another change to this order is already in progress. Please try again."))
+	}
+	return lock
+}
+
+// unlockOrder releases the lock acquired by lockOrder. If releasing the lock fails,
+// it will still expire on its own, so errors are ignored.
+func unlockOrder(lock *lib.Lock) {
+	lock.Release()
+}
+
+// findOrderOr404 finds the order with the id in the url. If there is no such order,
+// it writes a 404 error to res and returns nil.
+func findOrderOr404(res http.ResponseWriter, req *http.Request) *models.Order {
+	id := mux.Vars(req)["id"]
+	order := &models.Order{}
+	if err := zoom.ScanById(id, order); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); ok {
+			r := render.New()
+			msg := fmt.Sprintf("Could not find order with id = %s", id)
+			r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+			return nil
+		} else {
+			panic(err)
+		}
+	}
+	return order
+}
+
+// parseOrderItemData gets and unmarshals the items key from orderData, which should be
+// an array of objects with itemId and quantity fields. Any validation errors are added
+// to val, in which case the return value should not be used.
+func parseOrderItemData(orderData *data.Data, val *data.Validator) []orderItemDatum {
 	// Get and unmarshall the items key
 	oiData := []orderItemDatum{}
 	if err := orderData.GetAndUnmarshalJSON("items", &oiData); err != nil {
-		panic(err)
+		val.AddError("items", "items must be an array of objects with itemId and quantity fields.")
+		return nil
+	}
+	if len(oiData) == 0 {
+		val.AddError("items", "items must contain at least one item.")
+		return nil
 	}
-
-	// Get all the items by their id from the database.
-	itemIds := make([]string, len(oiData))
 	for i, datum := range oiData {
 		if datum.ItemId == "" {
 			// Return a validation error if any itemId parameters are blank
 			msg := fmt.Sprintf("items[%d] had a blank itemId. itemId is required for each item.", i)
-			r.JSON(res, lib.StatusUnprocessableEntity, map[string]string{"items": msg})
-			return
+			val.AddError("items", msg)
+			return nil
 		}
 		if (datum.Quantity <= 0) || (datum.Quantity >= 1e4) {
 			// Return a validation error if any quantity parameters are
 			// out of range.
 			msg := fmt.Sprintf("items[%d] had an invalid quantity. quantity must be between 0 and 10,000.", i)
-			r.JSON(res, lib.StatusUnprocessableEntity, map[string]string{"items": msg})
-			return
+			val.AddError("items", msg)
+			return nil
 		}
+	}
+	return oiData
+}
+
+// loadOrderItems finds the items for oiData in the database. The returned items have
+// the same length and order as oiData. If any of the items do not exist or are not
+// public, a validation error is added to val, in which case the return value should
+// not be used.
+func loadOrderItems(oiData []orderItemDatum, val *data.Validator) []*models.Item {
+	itemIds := make([]string, len(oiData))
+	for i, datum := range oiData {
 		itemIds[i] = datum.ItemId
 	}
 	// Use MScanById to get all the items in one go
@@ -73,46 +386,224 @@ func (o OrdersController) Create(res http.ResponseWriter, req *http.Request) {
 		if _, ok := err.(*zoom.KeyNotFoundError); ok {
 			// This means the itemId was invalid. Return a validation error.
 			msg := fmt.Sprintf("One of the items had an invalid itemId. %s.", err.Error())
-			r.JSON(res, lib.StatusUnprocessableEntity, map[string]string{"items": msg})
-			return
+			val.AddError("items", msg)
+			return nil
 		} else {
 			// For any other error, panic
 			panic(err)
 		}
 	}
+	now := time.Now().UTC().Unix()
+	for _, item := range items {
+		if !item.IsPublic(now) {
+			val.AddError("items", fmt.Sprintf("%s is not available.", item.Name))
+			return nil
+		}
+	}
+	return items
+}
 
-	// Create the Order model and add each item to the order
-	order := &models.Order{
-		Email: orderData.Get("email"),
+// priceOrder applies any sales and the promotion code the customer entered (if any)
+// to order, which must already contain its items, and then calculates shipping using
+// the rate the customer chose and tax based on the shipping address. If the order does
+// not have a shipping address yet, shipping and tax are left out of the totals. Any
+// validation errors are added to val. It returns the promotions that were applied,
+// which need to be redeemed when the order is placed.
+func priceOrder(order *models.Order, code string, rateId string, val *data.Validator) ([]*models.Promotion, error) {
+	promotions, err := lib.ApplyPromotions(order, code, val)
+	if err != nil {
+		return nil, err
 	}
-	for i, datum := range oiData {
-		order.AddItem(items[i], datum.Quantity)
+	if order.ShippingAddress.Country == "" {
+		order.UpdateTotals()
+		return promotions, nil
+	}
+	if err := applyShippingRate(order, rateId, val); err != nil {
+		return nil, err
+	}
+	if err := lib.ApplyTaxes(order); err != nil {
+		return nil, err
+	}
+	return promotions, nil
+}
+
+// rollBackOrder voids the payment for order and puts back the stock and promotions
+// it used. It is called if the order could not be saved after the payment was
+// authorized, so that the customer is not charged for an order that doesn't exist.
+// Errors are only logged, since the caller is already failing with the error from
+// saving the order.
+func rollBackOrder(req *http.Request, order *models.Order, promotions []*models.Promotion) {
+	if _, err := payments.CurrentGateway().Void(order.PaymentIntentId); err != nil {
+		fmt.Printf("[orders] Error voiding payment %s for an order which could not be saved: %s\n", order.PaymentIntentId, err)
+	} else if err := lib.ExpirePaymentIdempotencyKey(req.Header.Get("Idempotency-Key")); err != nil {
+		fmt.Printf("[orders] Error expiring the payment idempotency key for an order which could not be saved: %s\n", err)
+	}
+	if err := lib.ReleaseOrderStock(order); err != nil {
+		fmt.Printf("[orders] Error releasing stock for an order which could not be saved: %s\n", err)
+	}
+	if err := lib.ReleasePromotions(promotions, order.Email); err != nil {
+		fmt.Printf("[orders] Error releasing promotions for an order which could not be saved: %s\n", err)
 	}
+}
+
+// placeOrder redeems the promotions for order, takes the items out of stock, authorizes
+// payment for the order total using paymentSource, and then saves the order and its
+// items. If the order could not be placed (e.g. because an item is not available in
+// the quantity ordered), it writes an error response to res and returns false.
+func placeOrder(res http.ResponseWriter, req *http.Request, order *models.Order, promotions []*models.Promotion, paymentSource string, val *data.Validator) bool {
+	r := render.New()
+
+	// Get the idempotency key for the payment first, so that nothing needs to be
+	// released if it fails
+	paymentKey, err := lib.PaymentIdempotencyKey(req.Header.Get("Idempotency-Key"))
+	if err != nil {
+		panic(err)
+	}
+
+	// Atomically check and increment the usage counters for the promotions. This
+	// is done last so that the counters are only incremented for orders we save.
+	if failed, err := lib.RedeemPromotions(promotions, order.Email); err != nil {
+		panic(err)
+	} else if failed != nil {
+		if failed.IsAutomatic() {
+			val.AddError("promotions", fmt.Sprintf("The %s promotion is no longer available.", failed.Description))
+		} else {
+			val.AddError("code", fmt.Sprintf("%s is no longer available.", failed.Code))
+		}
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return false
+	}
+
+	// Atomically check that the items are available and take them out of stock
+	if unavailable, err := lib.ReserveOrderStock(order); err != nil {
+		panic(err)
+	} else if unavailable != nil {
+		if err := lib.ReleasePromotions(promotions, order.Email); err != nil {
+			panic(err)
+		}
+		val.AddError("items", lib.UnavailableMessage(unavailable.Item, unavailable.Quantity))
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return false
+	}
+
+	// Authorize payment for the order total. The payment is captured when the order ships.
+	description := fmt.Sprintf("5w4g order for %s", order.Email)
+	intent, err := payments.CurrentGateway().Authorize(payments.ToCents(order.Total), paymentSource, description, paymentKey)
+	if err != nil {
+		// The order won't be placed, so the promotions and stock were not really used
+		if err := lib.ReleasePromotions(promotions, order.Email); err != nil {
+			panic(err)
+		}
+		if err := lib.ReleaseOrderStock(order); err != nil {
+			panic(err)
+		}
+		if declineErr, ok := err.(*payments.DeclineError); ok {
+			r.JSON(res, http.StatusPaymentRequired, lib.NewJsonError(declineErr.Message))
+			return false
+		}
+		panic(err)
+	}
+	lib.ApplyPaymentIntent(order, intent)
+	order.CreatedAt = time.Now().UTC().Unix()
+
 	// Save all the OrderItems in one go using MSave
 	if err := zoom.MSave(zoom.Models(order.Items)); err != nil {
+		rollBackOrder(req, order, promotions)
 		panic(err)
 	}
 	// Then save the order itself
 	if err := zoom.Save(order); err != nil {
+		rollBackOrder(req, order, promotions)
 		panic(err)
 	}
 
-	// Return the Order
-	r.JSON(res, http.StatusOK, order)
+	// Record the stock that was taken in the ledger, and the sale in the reports
+	if err := lib.RecordOrderSales(order); err != nil {
+		panic(err)
+	}
+	if err := lib.RecordOrderInReports(order); err != nil {
+		panic(err)
+	}
+	for _, orderItem := range order.Items {
+		checkStockAlert(orderItem.Item.Id)
+	}
+
+	// Let the customer and any webhooks know the order was placed
+	sendOrderEmail(order, models.OrderEmailConfirmation)
+	triggerWebhookEvent(models.WebhookEventOrderCreated, order)
+	return true
 }
 
-func (o OrdersController) Show(res http.ResponseWriter, req *http.Request) {
-	panic("Orders.Show not yet implemented!")
+// sendOrderEmail sends an email of the given type about order to the customer and
+// then saves the order so that the email is recorded on it. Problems sending email
+// should never fail the request, so errors are only logged.
+func sendOrderEmail(order *models.Order, emailType string) {
+	if err := lib.SendOrderEmail(order, emailType); err != nil {
+		fmt.Printf("[orders] Error sending %s email for order %s: %s\n", emailType, order.Id, err)
+		return
+	}
+	if err := zoom.Save(order); err != nil {
+		panic(err)
+	}
 }
 
-func (o OrdersController) Update(res http.ResponseWriter, req *http.Request) {
-	panic("Orders.Update not yet implemented!")
+// applyShippingRate sets the shipping method and cost for order, which must already
+// have a shipping address and items. If rateId is empty, the cheapest available rate
+// is used. If rateId is not available for the order (or no rates are available at all)
+// a validation error is added to val.
+func applyShippingRate(order *models.Order, rateId string, val *data.Validator) error {
+	quotes, err := lib.ShippingQuotes(order.ShippingAddress.Country, order.CalculateSubtotal(), order.CalculateWeight())
+	if err != nil {
+		return err
+	}
+	if len(quotes) == 0 {
+		val.AddError("shippingAddress", "we are not able to ship this order to the given address.")
+		return nil
+	}
+	quote := quotes[0]
+	if rateId != "" {
+		found := false
+		for _, q := range quotes {
+			if q.RateId == rateId {
+				quote = q
+				found = true
+				break
+			}
+		}
+		if !found {
+			val.AddError("shippingRateId", "that shipping method is not available for this order.")
+			return nil
+		}
+	}
+	order.ShippingRateId = quote.RateId
+	order.ShippingMethod = quote.Name
+	order.ShippingCost = quote.Cost
+	return nil
 }
 
-func (o OrdersController) Delete(res http.ResponseWriter, req *http.Request) {
-	panic("Orders.Delete not yet implemented!")
+// parseAddress gets the address stored under key in orderData, normalizes it, and
+// validates it, adding any errors to val. It returns nil if key does not exist or
+// the address could not be unmarshaled.
+func parseAddress(orderData *data.Data, val *data.Validator, key string) *models.Address {
+	if !orderData.KeyExists(key) || orderData.Get(key) == "" {
+		return nil
+	}
+	addr := &models.Address{}
+	if err := orderData.GetAndUnmarshalJSON(key, addr); err != nil {
+		val.AddError(key, fmt.Sprintf("%s must be an object with name, line1, line2, city, region, postalCode, and country fields.", key))
+		return nil
+	}
+	lib.NormalizeAddress(addr)
+	lib.ValidateAddress(val, key, addr)
+	return addr
 }
 
-func (o OrdersController) Index(res http.ResponseWriter, req *http.Request) {
-	panic("Orders.Index not yet implemented!")
+// stringSliceContains returns true iff s contains str.
+func stringSliceContains(s []string, str string) bool {
+	for _, el := range s {
+		if el == str {
+			return true
+		}
+	}
+	return false
 }
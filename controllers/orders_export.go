@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/unrolled/render"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// orderExportBatchSize is the number of orders read from the database at a time
+// while exporting.
+const orderExportBatchSize = 100
+
+// orderExportColumns are the columns in a CSV export of orders, in order, along with
+// functions which format the value of each column for a line of an order. The order
+// totals are repeated on each line.
+var orderExportColumns = []struct {
+	name  string
+	value func(order *models.Order, orderItem *models.OrderItem) string
+}{
+	{"orderId", func(o *models.Order, oi *models.OrderItem) string { return o.Id }},
+	{"createdAt", func(o *models.Order, oi *models.OrderItem) string {
+		return time.Unix(o.CreatedAt, 0).UTC().Format(time.RFC3339)
+	}},
+	{"status", func(o *models.Order, oi *models.OrderItem) string { return o.Status }},
+	{"email", func(o *models.Order, oi *models.OrderItem) string { return o.Email }},
+	{"itemId", func(o *models.Order, oi *models.OrderItem) string { return oi.Item.Id }},
+	{"itemName", func(o *models.Order, oi *models.OrderItem) string { return oi.ItemName }},
+	{"quantity", func(o *models.Order, oi *models.OrderItem) string { return strconv.Itoa(oi.Quantity) }},
+	{"refunded", func(o *models.Order, oi *models.OrderItem) string { return strconv.Itoa(oi.Refunded) }},
+	{"unitPrice", func(o *models.Order, oi *models.OrderItem) string { return formatExportAmount(oi.UnitPrice) }},
+	{"lineTotal", func(o *models.Order, oi *models.OrderItem) string { return formatExportAmount(oi.LineTotal()) }},
+	{"lineDiscount", func(o *models.Order, oi *models.OrderItem) string { return formatExportAmount(oi.Discount) }},
+	{"lineTaxRate", func(o *models.Order, oi *models.OrderItem) string {
+		return strconv.FormatFloat(oi.TaxRate, 'f', -1, 64)
+	}},
+	{"lineTaxInclusive", func(o *models.Order, oi *models.OrderItem) string { return strconv.FormatBool(oi.TaxInclusive) }},
+	{"lineTax", func(o *models.Order, oi *models.OrderItem) string { return formatExportAmount(oi.Tax) }},
+	{"subtotal", func(o *models.Order, oi *models.OrderItem) string { return formatExportAmount(o.Subtotal) }},
+	{"discount", func(o *models.Order, oi *models.OrderItem) string { return formatExportAmount(o.Discount) }},
+	{"shippingMethod", func(o *models.Order, oi *models.OrderItem) string { return o.ShippingMethod }},
+	{"shippingCost", func(o *models.Order, oi *models.OrderItem) string { return formatExportAmount(o.ShippingCost) }},
+	{"tax", func(o *models.Order, oi *models.OrderItem) string { return formatExportAmount(o.Tax) }},
+	{"total", func(o *models.Order, oi *models.OrderItem) string { return formatExportAmount(o.Total) }},
+	{"amountRefunded", func(o *models.Order, oi *models.OrderItem) string { return formatExportAmount(o.AmountRefunded) }},
+	{"paymentStatus", func(o *models.Order, oi *models.OrderItem) string { return o.PaymentStatus }},
+	{"shippingName", func(o *models.Order, oi *models.OrderItem) string { return o.ShippingAddress.Name }},
+	{"shippingLine1", func(o *models.Order, oi *models.OrderItem) string { return o.ShippingAddress.Line1 }},
+	{"shippingLine2", func(o *models.Order, oi *models.OrderItem) string { return o.ShippingAddress.Line2 }},
+	{"shippingCity", func(o *models.Order, oi *models.OrderItem) string { return o.ShippingAddress.City }},
+	{"shippingRegion", func(o *models.Order, oi *models.OrderItem) string { return o.ShippingAddress.Region }},
+	{"shippingPostalCode", func(o *models.Order, oi *models.OrderItem) string { return o.ShippingAddress.PostalCode }},
+	{"shippingCountry", func(o *models.Order, oi *models.OrderItem) string { return o.ShippingAddress.Country }},
+	{"carrier", func(o *models.Order, oi *models.OrderItem) string { return o.Carrier }},
+	{"trackingNumber", func(o *models.Order, oi *models.OrderItem) string { return o.TrackingNumber }},
+}
+
+func formatExportAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+// escapeExportCell prefixes value with a single quote if it starts with a character
+// which makes spreadsheet programs treat it as a formula, so that values customers or
+// admins entered (e.g. names) can't run formulas when an export is opened. Numbers
+// are left alone so that negative amounts stay numbers. See unescapeImportCell for
+// the reverse.
+func escapeExportCell(value string) string {
+	if value == "" || !strings.ContainsAny(value[:1], "=+-@\t\r") {
+		return value
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	return "'" + value
+}
+
+// unescapeImportCell removes the single quote added by escapeExportCell, so that
+// exported files can be imported again without changing any values.
+func unescapeImportCell(value string) string {
+	if len(value) > 1 && value[0] == '\'' && escapeExportCell(value[1:]) == value {
+		return value[1:]
+	}
+	return value
+}
+
+// Export streams the orders which match the filters in the url parameters, oldest
+// first, as a CSV file with a row for each line of each order (the default) or as
+// JSON Lines with an object for each order. Orders are read from the database and
+// written to the response in batches.
+func (o OrdersController) Export(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	query := req.URL.Query()
+	errors := map[string][]string{}
+
+	// parseTime parses the url parameter with the given name, which must be a UTC
+	// unix time. It returns 0 if the parameter is empty.
+	parseTime := func(name string) int64 {
+		value := query.Get(name)
+		if value == "" {
+			return 0
+		}
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || i < 0 {
+			errors[name] = append(errors[name], fmt.Sprintf("%s must be a UTC unix time.", name))
+		}
+		return i
+	}
+	filter := lib.OrderFilter{
+		Status: query.Get("status"),
+		Since:  parseTime("since"),
+		Until:  parseTime("until"),
+	}
+	if filter.Status != "" && !stringSliceContains(models.OrderStatuses, filter.Status) {
+		errors["status"] = append(errors["status"], fmt.Sprintf("status must be one of %v.", models.OrderStatuses))
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "jsonl" {
+		errors["format"] = append(errors["format"], "format must be either csv or jsonl.")
+	}
+	if len(errors) > 0 {
+		r.JSON(res, lib.StatusUnprocessableEntity, errors)
+		return
+	}
+
+	// Stream the orders in the requested format, sending what has been written so
+	// far to the client after each batch
+	flusher, _ := res.(http.Flusher)
+	written := 0
+	if format == "jsonl" {
+		res.Header().Set("Content-Type", "application/x-ndjson")
+		res.Header().Set("Content-Disposition", `attachment; filename="orders.jsonl"`)
+		encoder := json.NewEncoder(res)
+		if err := lib.EachOrder(filter, orderExportBatchSize, func(order *models.Order) error {
+			if err := encoder.Encode(order); err != nil {
+				return err
+			}
+			if written++; written%orderExportBatchSize == 0 && flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+		return
+	}
+	res.Header().Set("Content-Type", "text/csv")
+	res.Header().Set("Content-Disposition", `attachment; filename="orders.csv"`)
+	writer := csv.NewWriter(res)
+	header := make([]string, len(orderExportColumns))
+	for i, column := range orderExportColumns {
+		header[i] = column.name
+	}
+	writer.Write(header)
+	if err := lib.EachOrder(filter, orderExportBatchSize, func(order *models.Order) error {
+		for _, orderItem := range order.Items {
+			record := make([]string, len(orderExportColumns))
+			for i, column := range orderExportColumns {
+				record[i] = escapeExportCell(column.value(order, orderItem))
+			}
+			writer.Write(record)
+		}
+		if written++; written%orderExportBatchSize == 0 {
+			writer.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return writer.Error()
+	}); err != nil {
+		panic(err)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		panic(err)
+	}
+}
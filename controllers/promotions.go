@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type PromotionsController struct{}
+
+// promotionCodeRegex matches valid (normalized) promotion codes
+var promotionCodeRegex = regexp.MustCompile(`^[A-Z0-9_-]+$`)
+
+func (c PromotionsController) Create(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Parse data from request
+	promotionData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := promotionData.Validator()
+	val.Require("description")
+	val.Require("type")
+	val.Require("amount")
+	promotion := &models.Promotion{}
+	setPromotionFields(promotionData, val, promotion)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Save to database
+	if err := zoom.Save(promotion); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, promotion)
+}
+
+func (c PromotionsController) Show(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Find the promotion in the database
+	promotion := &models.Promotion{}
+	if err := zoom.ScanById(id, promotion); err != nil {
+		panic(err)
+	}
+	if err := lib.LoadPromotionUses(promotion); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, promotion)
+}
+
+func (c PromotionsController) Index(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Find all promotions in the database
+	var promotions []*models.Promotion
+	if err := zoom.NewQuery("Promotion").Scan(&promotions); err != nil {
+		panic(err)
+	}
+	if err := lib.LoadPromotionUses(promotions...); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, promotions)
+}
+
+func (c PromotionsController) Update(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Find the promotion in the database
+	promotion := &models.Promotion{}
+	if err := zoom.ScanById(id, promotion); err != nil {
+		panic(err)
+	}
+
+	// Parse data from request
+	promotionData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := promotionData.Validator()
+	for _, key := range []string{"description", "type", "amount"} {
+		if promotionData.KeyExists(key) {
+			val.Require(key).Message(key + " cannot be blank")
+		}
+	}
+	setPromotionFields(promotionData, val, promotion)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Save to database
+	if err := zoom.Save(promotion); err != nil {
+		panic(err)
+	}
+	if err := lib.LoadPromotionUses(promotion); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, promotion)
+}
+
+func (c PromotionsController) Delete(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Delete from database, along with the usage counters
+	if err := zoom.DeleteById("Promotion", id); err != nil {
+		panic(err)
+	}
+	if err := lib.DeletePromotionUses(id); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, struct{}{})
+}
+
+// setPromotionFields sets the fields of promotion for each key that exists in
+// promotionData, and validates the result. Any validation errors are added to val.
+func setPromotionFields(promotionData *data.Data, val *data.Validator, promotion *models.Promotion) {
+	if promotionData.KeyExists("code") {
+		promotion.Code = models.NormalizePromotionCode(promotionData.Get("code"))
+		if promotion.Code != "" {
+			if !promotionCodeRegex.MatchString(promotion.Code) {
+				val.AddError("code", "code must consist of letters, numbers, dashes, and underscores.")
+			}
+			// Validate that code is unique
+			other := &models.Promotion{}
+			if err := zoom.NewQuery("Promotion").Filter("Code =", promotion.Code).ScanOne(other); err != nil {
+				if _, ok := err.(*zoom.ModelNotFoundError); !ok {
+					panic(err)
+				}
+			} else if other.Id != promotion.Id {
+				val.AddError("code", "that code is already taken.")
+			}
+		}
+	}
+	if promotionData.KeyExists("description") {
+		promotion.Description = promotionData.Get("description")
+	}
+	if promotionData.KeyExists("type") {
+		promotion.Type = promotionData.Get("type")
+		if !stringSliceContains(models.PromotionTypes, promotion.Type) {
+			val.AddError("type", fmt.Sprintf("type must be one of %v.", models.PromotionTypes))
+		}
+	}
+	if promotionData.KeyExists("amount") {
+		val.Greater("amount", 0.0)
+		promotion.Amount = promotionData.GetFloat("amount")
+	}
+	if promotion.Type == models.PromotionTypePercent && promotion.Amount > 100 {
+		val.AddError("amount", "amount cannot be more than 100 for percent promotions.")
+	}
+	if promotionData.KeyExists("startsAt") {
+		val.GreaterOrEqual("startsAt", 0.0)
+		promotion.StartsAt = int64(promotionData.GetInt("startsAt"))
+	}
+	if promotionData.KeyExists("endsAt") {
+		val.GreaterOrEqual("endsAt", 0.0)
+		promotion.EndsAt = int64(promotionData.GetInt("endsAt"))
+	}
+	if promotion.StartsAt != 0 && promotion.EndsAt != 0 && promotion.EndsAt <= promotion.StartsAt {
+		val.AddError("endsAt", "endsAt must be after startsAt.")
+	}
+	if promotionData.KeyExists("minSubtotal") {
+		val.GreaterOrEqual("minSubtotal", 0.0)
+		promotion.MinSubtotal = promotionData.GetFloat("minSubtotal")
+	}
+	if promotionData.KeyExists("itemIds") {
+		promotion.ItemIds = splitList(promotionData.Get("itemIds"))
+	}
+	if promotionData.KeyExists("categories") {
+		promotion.Categories = splitList(promotionData.Get("categories"))
+	}
+	if promotionData.KeyExists("usageLimit") {
+		val.GreaterOrEqual("usageLimit", 0.0)
+		promotion.UsageLimit = promotionData.GetInt("usageLimit")
+	}
+	if promotionData.KeyExists("perEmailLimit") {
+		val.GreaterOrEqual("perEmailLimit", 0.0)
+		promotion.PerEmailLimit = promotionData.GetInt("perEmailLimit")
+	}
+	if promotionData.KeyExists("stackable") {
+		promotion.Stackable = promotionData.GetBool("stackable")
+	}
+}
+
+// splitList converts a comma-separated list into a slice, trimming whitespace and
+// ignoring empty elements.
+func splitList(list string) []string {
+	result := []string{}
+	for _, el := range strings.Split(list, ",") {
+		if el = strings.TrimSpace(el); el != "" {
+			result = append(result, el)
+		}
+	}
+	return result
+}
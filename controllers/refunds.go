@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/payments"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+)
+
+type RefundsController struct{}
+
+// Create refunds all or some of the lines in an order. If the lines key is not
+// provided, everything in the order which has not already been refunded is refunded.
+func (c RefundsController) Create(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the order id from the url
+	vars := mux.Vars(req)
+	orderId := vars["id"]
+
+	// Only allow one refund at a time for each order, so that concurrent refunds
+	// can't add up to more than the amount that was charged
+	lock := lockOrder(res, orderId)
+	if lock == nil {
+		return
+	}
+	defer unlockOrder(lock)
+
+	// Find the order in the database
+	order := &models.Order{}
+	if err := zoom.ScanById(orderId, order); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); ok {
+			msg := fmt.Sprintf("Could not find order with id = %s", orderId)
+			r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+			return
+		} else {
+			panic(err)
+		}
+	}
+
+	// Parse data from the request
+	refundData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := refundData.Validator()
+	val.Require("reason")
+	lines := []lib.RefundLineRequest{}
+	if refundData.KeyExists("lines") {
+		if err := refundData.GetAndUnmarshalJSON("lines", &lines); err != nil {
+			val.AddError("lines", "lines must be an array of objects with itemId and quantity fields.")
+		} else if len(lines) == 0 {
+			val.AddError("lines", "lines must contain at least one line.")
+		}
+		requested := map[string]int{}
+		for i, line := range lines {
+			orderItem := lib.FindOrderItem(order, line.ItemId)
+			requested[line.ItemId] += line.Quantity
+			if orderItem == nil {
+				val.AddError("lines", fmt.Sprintf("lines[%d] had an itemId which is not part of this order.", i))
+			} else if line.Quantity <= 0 || requested[line.ItemId] > orderItem.RefundableQuantity() {
+				msg := fmt.Sprintf("lines[%d] had an invalid quantity. quantity must be between 1 and %d.", i, orderItem.RefundableQuantity())
+				val.AddError("lines", msg)
+			}
+		}
+	}
+	if order.PaymentStatus == payments.StatusVoided || order.RefundableAmount() <= 0 {
+		val.AddError("id", "there is nothing left to refund for this order.")
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+	refund := lib.CalculateRefund(order, lines)
+	if refund.Amount > order.RefundableAmount() {
+		// This can happen when the line amounts are rounded up
+		refund.Amount = order.RefundableAmount()
+	}
+	refund.Reason = refundData.Get("reason")
+	refund.AdminUserId = lib.CurrentAdminUser(req).Id
+
+	// Issue the refund
+	previousStatus := order.Status
+	if err := lib.IssueRefund(order, refund, refundData.GetBool("restock")); err != nil {
+		panic(err)
+	}
+	if order.Status != previousStatus {
+		triggerOrderStatusChanged(order, previousStatus)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, refund)
+}
+
+// Index lists all the refunds for an order
+func (c RefundsController) Index(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the order id from the url
+	vars := mux.Vars(req)
+	orderId := vars["id"]
+
+	// Find all the refunds for the order
+	var refunds []*models.Refund
+	if err := zoom.NewQuery("Refund").Filter("OrderId =", orderId).Order("CreatedAt").Scan(&refunds); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, refunds)
+}
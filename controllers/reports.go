@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/unrolled/render"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type ReportsController struct{}
+
+// The number of days in a report by default, and the most days a report can cover
+const (
+	reportDefaultDays = 30
+	reportMaxDays     = 731
+)
+
+// The default and maximum number of items in a report of item sales
+const (
+	itemSalesLimit    = 10
+	itemSalesMaxLimit = 100
+)
+
+// Sales reports the number of orders, revenue, refunds, and average order value for
+// the orders placed in a range of days, bucketed by day, week, or month.
+func (c ReportsController) Sales(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	query := req.URL.Query()
+	errors := map[string][]string{}
+	since, until, format := parseReportParams(query, errors)
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = lib.SalesIntervalDay
+	}
+	if !stringSliceContains(lib.SalesIntervals, interval) {
+		errors["interval"] = append(errors["interval"], fmt.Sprintf("interval must be one of %v.", lib.SalesIntervals))
+	}
+	if len(errors) > 0 {
+		r.JSON(res, lib.StatusUnprocessableEntity, errors)
+		return
+	}
+
+	// Build the report from the daily counters
+	report, err := lib.QuerySalesReport(interval, since, until)
+	if err != nil {
+		panic(err)
+	}
+
+	// Render response in the requested format
+	if format == "json" {
+		r.JSON(res, http.StatusOK, report)
+		return
+	}
+	records := [][]string{{"start", "orders", "revenue", "refunded", "netRevenue", "averageOrderValue"}}
+	for _, bucket := range report.Buckets {
+		records = append(records, []string{
+			bucket.Start,
+			strconv.Itoa(bucket.Orders),
+			formatExportAmount(bucket.Revenue),
+			formatExportAmount(bucket.Refunded),
+			formatExportAmount(bucket.NetRevenue),
+			formatExportAmount(bucket.AverageOrderValue),
+		})
+	}
+	writeReportCSV(res, "sales.csv", records)
+}
+
+// Items reports the top-selling items for the orders placed in a range of days, with
+// the units sold and revenue for each of them.
+func (c ReportsController) Items(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	query := req.URL.Query()
+	errors := map[string][]string{}
+	since, until, format := parseReportParams(query, errors)
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = lib.ItemSalesByUnits
+	}
+	if sortBy != lib.ItemSalesByUnits && sortBy != lib.ItemSalesByRevenue {
+		errors["sort"] = append(errors["sort"], "sort must be either units or revenue.")
+	}
+	limit := itemSalesLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > itemSalesMaxLimit {
+			errors["limit"] = append(errors["limit"], fmt.Sprintf("limit must be an integer between 1 and %d.", itemSalesMaxLimit))
+		}
+	}
+	if len(errors) > 0 {
+		r.JSON(res, lib.StatusUnprocessableEntity, errors)
+		return
+	}
+
+	// Build the report from the daily counters
+	items, err := lib.QueryItemSales(since, until, sortBy, limit)
+	if err != nil {
+		panic(err)
+	}
+
+	// Render response in the requested format
+	if format == "json" {
+		r.JSON(res, http.StatusOK, map[string]interface{}{
+			"since": since.Format(lib.SalesReportDateFormat),
+			"until": until.Format(lib.SalesReportDateFormat),
+			"items": items,
+		})
+		return
+	}
+	records := [][]string{{"itemId", "name", "unitsSold", "revenue"}}
+	for _, item := range items {
+		records = append(records, []string{item.ItemId, item.Name, strconv.Itoa(item.UnitsSold), formatExportAmount(item.Revenue)})
+	}
+	writeReportCSV(res, "items.csv", records)
+}
+
+// Rebuild deletes the counters which reports are built from and records every order
+// and refund in them again (see lib.RebuildSalesReports). Only one rebuild can run
+// at a time.
+func (c ReportsController) Rebuild(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	lock, err := lib.AcquireLock("salesReportsRebuild", 10*time.Minute)
+	if err != nil {
+		panic(err)
+	} else if lock == nil {
+		r.JSON(res, http.StatusConflict, lib.NewJsonError("The reports are already being rebuilt. Please try again later."))
+		return
+	}
+	defer lock.Release()
+	orders, err := lib.RebuildSalesReports()
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(res, http.StatusOK, map[string]interface{}{
+		"orders": orders,
+	})
+}
+
+// parseReportParams parses the since, until, and format url parameters which are
+// shared by every report, and adds any problems with them to errors. since and until
+// default to the last 30 days, and format defaults to json.
+func parseReportParams(query url.Values, errors map[string][]string) (since time.Time, until time.Time, format string) {
+	parseDate := func(name string, def time.Time) time.Time {
+		value := query.Get(name)
+		if value == "" {
+			return def
+		}
+		date, err := time.Parse(lib.SalesReportDateFormat, value)
+		if err != nil {
+			errors[name] = append(errors[name], fmt.Sprintf("%s must be a date in the format YYYY-MM-DD.", name))
+		}
+		return date
+	}
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	until = parseDate("until", today)
+	since = parseDate("since", until.AddDate(0, 0, -(reportDefaultDays-1)))
+	if errors["since"] == nil && errors["until"] == nil {
+		if since.After(until) {
+			errors["since"] = append(errors["since"], "since must not be after until.")
+		} else if until.Sub(since) >= reportMaxDays*24*time.Hour {
+			errors["until"] = append(errors["until"], fmt.Sprintf("a report can cover at most %d days.", reportMaxDays))
+		}
+	}
+	format = query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		errors["format"] = append(errors["format"], "format must be either json or csv.")
+	}
+	return since, until, format
+}
+
+// writeReportCSV writes records to res as a CSV file with the given filename. Values
+// which look like formulas are escaped (see escapeExportCell).
+func writeReportCSV(res http.ResponseWriter, filename string, records [][]string) {
+	res.Header().Set("Content-Type", "text/csv")
+	res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	for _, record := range records {
+		for i, value := range record {
+			record[i] = escapeExportCell(value)
+		}
+	}
+	writer := csv.NewWriter(res)
+	if err := writer.WriteAll(records); err != nil {
+		panic(err)
+	}
+}
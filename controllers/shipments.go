@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/payments"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+	"time"
+)
+
+type ShipmentsController struct{}
+
+// Create records a shipment of all or some of the lines in an order, and advances the
+// status of the order. If the lines key is not provided, everything in the order
+// which has not already been shipped or refunded is shipped. The customer is sent
+// the shipping notice for the shipment.
+func (c ShipmentsController) Create(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Only allow one shipment (or refund) at a time for each order, so that the same
+	// items can't be shipped twice
+	orderId := mux.Vars(req)["id"]
+	lock := lockOrder(res, orderId)
+	if lock == nil {
+		return
+	}
+	defer unlockOrder(lock)
+
+	// Find the order in the database
+	order := findOrderOr404(res, req)
+	if order == nil {
+		return
+	}
+
+	// Parse data from the request
+	shipmentData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := shipmentData.Validator()
+	val.Require("carrier")
+	if shipmentData.Get("trackingUrl") != "" {
+		val.Match("trackingUrl", trackingUrlRegex).Message("trackingUrl must be an http or https url.")
+	}
+	lines := []lib.ShipmentLineRequest{}
+	if shipmentData.KeyExists("lines") {
+		if err := shipmentData.GetAndUnmarshalJSON("lines", &lines); err != nil {
+			val.AddError("lines", "lines must be an array of objects with itemId and quantity fields.")
+		} else if len(lines) == 0 {
+			val.AddError("lines", "lines must contain at least one line.")
+		}
+		requested := map[string]int{}
+		for i, line := range lines {
+			orderItem := lib.FindOrderItem(order, line.ItemId)
+			requested[line.ItemId] += line.Quantity
+			if orderItem == nil {
+				val.AddError("lines", fmt.Sprintf("lines[%d] had an itemId which is not part of this order.", i))
+			} else if line.Quantity <= 0 || requested[line.ItemId] > orderItem.UnshippedQuantity() {
+				msg := fmt.Sprintf("lines[%d] had an invalid quantity. quantity must be between 1 and %d.", i, orderItem.UnshippedQuantity())
+				val.AddError("lines", msg)
+			}
+		}
+	}
+	if order.Status != models.OrderStatusPending && order.Status != models.OrderStatusPartiallyShipped {
+		val.AddError("id", fmt.Sprintf("shipments cannot be created for orders which are %s.", order.Status))
+	} else {
+		unshipped := 0
+		for _, orderItem := range order.Items {
+			unshipped += orderItem.UnshippedQuantity()
+		}
+		if unshipped == 0 {
+			val.AddError("id", "there is nothing left to ship for this order.")
+		}
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Create the shipment
+	shipment := &models.Shipment{
+		Carrier:        shipmentData.Get("carrier"),
+		TrackingNumber: shipmentData.Get("trackingNumber"),
+		TrackingUrl:    shipmentData.Get("trackingUrl"),
+	}
+	previousStatus := order.Status
+	if err := lib.CreateShipment(order, shipment, lines); err != nil {
+		if declineErr, ok := err.(*payments.DeclineError); ok {
+			r.JSON(res, http.StatusPaymentRequired, lib.NewJsonError(declineErr.Message))
+			return
+		}
+		panic(err)
+	}
+
+	// Let the customer and any webhooks know
+	sendOrderEmail(order, models.OrderEmailShipped)
+	if order.Status != previousStatus {
+		triggerOrderStatusChanged(order, previousStatus)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, shipment)
+}
+
+// Index lists the shipments for an order, oldest first.
+func (c ShipmentsController) Index(res http.ResponseWriter, req *http.Request) {
+	order := findOrderOr404(res, req)
+	if order == nil {
+		return
+	}
+	r := render.New()
+	r.JSON(res, http.StatusOK, order.Shipments)
+}
+
+// Update corrects the tracking details for a shipment, or marks it as delivered.
+// Once every shipment for an order has been delivered, the order is delivered too.
+func (c ShipmentsController) Update(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	orderId := mux.Vars(req)["id"]
+	lock := lockOrder(res, orderId)
+	if lock == nil {
+		return
+	}
+	defer unlockOrder(lock)
+
+	// Find the order and the shipment in the database
+	order := findOrderOr404(res, req)
+	if order == nil {
+		return
+	}
+	shipmentId := mux.Vars(req)["shipmentId"]
+	shipment := order.FindShipment(shipmentId)
+	if shipment == nil {
+		msg := fmt.Sprintf("Could not find shipment with id = %s", shipmentId)
+		r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+		return
+	}
+
+	// Parse data from the request
+	shipmentData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := shipmentData.Validator()
+	if shipmentData.KeyExists("carrier") {
+		val.Require("carrier").Message("carrier cannot be blank")
+	}
+	if shipmentData.Get("trackingUrl") != "" {
+		val.Match("trackingUrl", trackingUrlRegex).Message("trackingUrl must be an http or https url.")
+	}
+	if shipmentData.KeyExists("deliveredAt") {
+		val.Greater("deliveredAt", 0)
+	}
+	if shipmentData.KeyExists("delivered") && !shipmentData.GetBool("delivered") {
+		// Orders can't go back from delivered to shipped
+		val.AddError("delivered", "delivered can only be set to true.")
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Update the shipment
+	if shipmentData.KeyExists("carrier") {
+		shipment.Carrier = shipmentData.Get("carrier")
+	}
+	if shipmentData.KeyExists("trackingNumber") {
+		shipment.TrackingNumber = shipmentData.Get("trackingNumber")
+	}
+	if shipmentData.KeyExists("trackingUrl") {
+		shipment.TrackingUrl = shipmentData.Get("trackingUrl")
+	} else if shipmentData.KeyExists("carrier") || shipmentData.KeyExists("trackingNumber") {
+		shipment.TrackingUrl = lib.TrackingUrl(shipment.Carrier, shipment.TrackingNumber)
+	}
+	if shipment == &order.Shipments[len(order.Shipments)-1] {
+		// The tracking details for the order are for the latest shipment
+		order.Carrier = shipment.Carrier
+		order.TrackingNumber = shipment.TrackingNumber
+		order.TrackingUrl = shipment.TrackingUrl
+	}
+	if shipmentData.KeyExists("deliveredAt") {
+		shipment.DeliveredAt = int64(shipmentData.GetInt("deliveredAt"))
+	} else if shipmentData.KeyExists("delivered") && !shipment.IsDelivered() {
+		shipment.DeliveredAt = time.Now().UTC().Unix()
+	}
+	previousStatus := order.Status
+	if err := lib.UpdateFulfillmentStatus(order); err != nil {
+		panic(err)
+	}
+	if err := zoom.Save(order); err != nil {
+		panic(err)
+	}
+	if order.Status != previousStatus {
+		triggerOrderStatusChanged(order, previousStatus)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, shipment)
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/unrolled/render"
+	"net/http"
+)
+
+type ShippingController struct{}
+
+// Quote responds with an array of shipping quotes (one for each available shipping
+// method) for a cart and shipping address. The request body has the same format as
+// the body for creating an order, but only items and shippingAddress are used.
+func (c ShippingController) Quote(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Parse data from the request
+	quoteData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := quoteData.Validator()
+	val.Require("items")
+	val.Require("shippingAddress")
+	shippingAddress := parseAddress(quoteData, val, "shippingAddress")
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+	oiData := parseOrderItemData(quoteData, val)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+	items := loadOrderItems(oiData, val)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Use an unsaved order to calculate the subtotal and weight of the cart
+	order := &models.Order{}
+	for i, datum := range oiData {
+		order.AddItem(items[i], datum.Quantity)
+	}
+	quotes, err := lib.ShippingQuotes(shippingAddress.Country, order.CalculateSubtotal(), order.CalculateWeight())
+	if err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, quotes)
+}
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+)
+
+type ShippingRatesController struct{}
+
+func (c ShippingRatesController) Create(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Parse data from request
+	rateData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := rateData.Validator()
+	val.Require("zoneId")
+	val.Require("name")
+	val.Require("type")
+	if rateData.Get("zoneId") != "" {
+		// Validate that the zone exists
+		if err := zoom.ScanById(rateData.Get("zoneId"), &models.ShippingZone{}); err != nil {
+			if _, ok := err.(*zoom.KeyNotFoundError); ok {
+				val.AddError("zoneId", fmt.Sprintf("Could not find shipping zone with id = %s", rateData.Get("zoneId")))
+			} else {
+				panic(err)
+			}
+		}
+	}
+	rate := &models.ShippingRate{
+		ZoneId: rateData.Get("zoneId"),
+		Name:   rateData.Get("name"),
+		Type:   rateData.Get("type"),
+	}
+	parseShippingRateAmounts(rateData, val, rate)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Save to database
+	if err := zoom.Save(rate); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, rate)
+}
+
+func (c ShippingRatesController) Index(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Find all the shipping rates in the database, optionally for a single zone
+	var rates []*models.ShippingRate
+	q := zoom.NewQuery("ShippingRate")
+	if zoneId := req.URL.Query().Get("zoneId"); zoneId != "" {
+		q.Filter("ZoneId =", zoneId)
+	}
+	if err := q.Scan(&rates); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, rates)
+}
+
+func (c ShippingRatesController) Update(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Find the rate in the database
+	rate := &models.ShippingRate{}
+	if err := zoom.ScanById(id, rate); err != nil {
+		panic(err)
+	}
+
+	// Parse data from request
+	rateData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := rateData.Validator()
+	if rateData.KeyExists("name") {
+		val.Require("name").Message("name cannot be blank")
+		rate.Name = rateData.Get("name")
+	}
+	if rateData.KeyExists("type") {
+		rate.Type = rateData.Get("type")
+	}
+	parseShippingRateAmounts(rateData, val, rate)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Save to database
+	if err := zoom.Save(rate); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, rate)
+}
+
+func (c ShippingRatesController) Delete(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Delete from database
+	if err := zoom.DeleteById("ShippingRate", id); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, struct{}{})
+}
+
+// parseShippingRateAmounts sets the price, brackets, and freeAbove fields of rate from
+// rateData (if they exist) and then validates them according to rate.Type. Any
+// validation errors are added to val.
+func parseShippingRateAmounts(rateData *data.Data, val *data.Validator, rate *models.ShippingRate) {
+	if rateData.KeyExists("price") {
+		val.GreaterOrEqual("price", 0.0)
+		rate.Price = rateData.GetFloat("price")
+	}
+	if rateData.KeyExists("freeAbove") {
+		val.GreaterOrEqual("freeAbove", 0.0)
+		rate.FreeAbove = rateData.GetFloat("freeAbove")
+	}
+	if rateData.KeyExists("brackets") {
+		brackets := []models.WeightBracket{}
+		if err := rateData.GetAndUnmarshalJSON("brackets", &brackets); err != nil {
+			val.AddError("brackets", "brackets must be an array of objects with maxWeight and price fields.")
+		}
+		rate.Brackets = brackets
+	}
+	switch rate.Type {
+	case models.ShippingRateTypeFlat:
+		if !rateData.KeyExists("price") && rate.Price == 0 {
+			val.AddError("price", "price is required for flat shipping rates.")
+		}
+	case models.ShippingRateTypeWeight:
+		if len(rate.Brackets) == 0 {
+			val.AddError("brackets", "brackets is required for weight shipping rates.")
+		}
+		for i, bracket := range rate.Brackets {
+			if bracket.MaxWeight <= 0 || bracket.Price < 0 {
+				msg := fmt.Sprintf("brackets[%d] must have a positive maxWeight and a price of at least 0.", i)
+				val.AddError("brackets", msg)
+			}
+		}
+	case "":
+		// Type is required, but that error has already been added
+	default:
+		val.AddError("type", fmt.Sprintf("type must be one of %v.", models.ShippingRateTypes))
+	}
+}
@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+	"strings"
+)
+
+type ShippingZonesController struct{}
+
+func (c ShippingZonesController) Create(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Parse data from request
+	zoneData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := zoneData.Validator()
+	val.Require("name")
+	val.Require("countries")
+	countries := parseCountries(zoneData.Get("countries"))
+	validateZoneCountries(val, "", countries)
+	if zoneData.Get("name") != "" {
+		// Validate that name is unique
+		count, err := zoom.NewQuery("ShippingZone").Filter("Name =", zoneData.Get("name")).Count()
+		if err != nil {
+			panic(err)
+		}
+		if count != 0 {
+			val.AddError("name", "that shipping zone name is already taken.")
+		}
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Save to database
+	zone := &models.ShippingZone{
+		Name:      zoneData.Get("name"),
+		Countries: countries,
+	}
+	if err := zoom.Save(zone); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, zone)
+}
+
+func (c ShippingZonesController) Show(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Find the zone in the database
+	zone := &models.ShippingZone{}
+	if err := zoom.ScanById(id, zone); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, zone)
+}
+
+func (c ShippingZonesController) Index(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Find all shipping zones in the database
+	var zones []*models.ShippingZone
+	if err := zoom.NewQuery("ShippingZone").Scan(&zones); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, zones)
+}
+
+func (c ShippingZonesController) Update(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Parse data from request
+	zoneData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := zoneData.Validator()
+	if zoneData.KeyExists("name") {
+		val.Require("name").Message("name cannot be blank")
+		otherZone := &models.ShippingZone{}
+		if err := zoom.NewQuery("ShippingZone").Filter("Name =", zoneData.Get("name")).ScanOne(otherZone); err != nil {
+			if _, ok := err.(*zoom.ModelNotFoundError); !ok {
+				panic(err)
+			}
+		} else if otherZone.Id != id {
+			val.AddError("name", "that shipping zone name is already taken.")
+		}
+	}
+	countries := parseCountries(zoneData.Get("countries"))
+	if zoneData.KeyExists("countries") {
+		val.Require("countries").Message("countries cannot be blank")
+		validateZoneCountries(val, id, countries)
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Find the zone in the database
+	zone := &models.ShippingZone{}
+	if err := zoom.ScanById(id, zone); err != nil {
+		panic(err)
+	}
+
+	// Update the zone
+	if zoneData.KeyExists("name") {
+		zone.Name = zoneData.Get("name")
+	}
+	if zoneData.KeyExists("countries") {
+		zone.Countries = countries
+	}
+	if err := zoom.Save(zone); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, zone)
+}
+
+func (c ShippingZonesController) Delete(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Delete all the rates for the zone, since they can't be used without it
+	var rates []*models.ShippingRate
+	if err := zoom.NewQuery("ShippingRate").Filter("ZoneId =", id).Scan(&rates); err != nil {
+		panic(err)
+	}
+	if err := zoom.MDelete(zoom.Models(rates)); err != nil {
+		panic(err)
+	}
+
+	// Delete the zone itself
+	if err := zoom.DeleteById("ShippingZone", id); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, struct{}{})
+}
+
+// parseCountries converts a comma-separated list of country codes into a slice
+// of upper-case country codes.
+func parseCountries(list string) []string {
+	countries := splitList(list)
+	for i, country := range countries {
+		countries[i] = strings.ToUpper(country)
+	}
+	return countries
+}
+
+// validateZoneCountries adds an error to val for each country that we can't ship
+// to or which already belongs to a zone other than the zone identified by zoneId.
+// If the zone has not been created yet, zoneId should be an empty string.
+func validateZoneCountries(val *data.Validator, zoneId string, countries []string) {
+	var zones []*models.ShippingZone
+	if err := zoom.NewQuery("ShippingZone").Scan(&zones); err != nil {
+		panic(err)
+	}
+	for _, country := range countries {
+		if !lib.IsSupportedCountry(country) {
+			val.AddError("countries", fmt.Sprintf("%s is not a country we ship to.", country))
+			continue
+		}
+		for _, zone := range zones {
+			if zone.Id != zoneId && zone.HasCountry(country) {
+				val.AddError("countries", fmt.Sprintf("%s already belongs to the %s shipping zone.", country, zone.Name))
+			}
+		}
+	}
+}
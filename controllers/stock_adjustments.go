@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/unrolled/render"
+	"net/http"
+)
+
+type StockAdjustmentsController struct{}
+
+// Create records a change to the stock of an item, e.g. when new stock arrives or
+// some is found to be damaged.
+func (c StockAdjustmentsController) Create(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	item := findItemOr404(res, req)
+	if item == nil {
+		return
+	}
+
+	// Parse data from request
+	adjustmentData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := adjustmentData.Validator()
+	val.Require("delta")
+	val.Require("reason")
+	if adjustmentData.KeyExists("delta") && adjustmentData.GetInt("delta") == 0 {
+		val.AddError("delta", "delta must not be 0.")
+	}
+	if reason := adjustmentData.Get("reason"); reason != "" && !stringSliceContains(models.StockReasons, reason) {
+		val.AddError("reason", fmt.Sprintf("reason must be one of %v.", models.StockReasons))
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Adjust the stock and record it in the ledger
+	adjustment := &models.StockAdjustment{
+		ItemId:      item.Id,
+		Delta:       adjustmentData.GetInt("delta"),
+		Reason:      adjustmentData.Get("reason"),
+		Reference:   adjustmentData.Get("reference"),
+		AdminUserId: lib.CurrentAdminUser(req).Id,
+	}
+	if err := lib.AdjustItemStock(adjustment); err != nil {
+		panic(err)
+	}
+	checkStockAlert(item.Id)
+
+	// Render response
+	r.JSON(res, http.StatusOK, adjustment)
+}
+
+// Index lists the stock ledger for an item, oldest first.
+func (c StockAdjustmentsController) Index(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	item := findItemOr404(res, req)
+	if item == nil {
+		return
+	}
+	adjustments, err := lib.StockHistory(item.Id)
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(res, http.StatusOK, adjustments)
+}
+
+// Reconcile checks the stock ledger for an item against the amount in stock, and
+// records a correction if they don't match.
+func (c StockAdjustmentsController) Reconcile(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	item := findItemOr404(res, req)
+	if item == nil {
+		return
+	}
+	correction, err := lib.ReconcileItemStock(item, lib.CurrentAdminUser(req).Id)
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(res, http.StatusOK, map[string]interface{}{
+		"amountInStock": item.AmountInStock,
+		"correction":    correction,
+	})
+}
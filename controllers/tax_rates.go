@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type TaxRatesController struct{}
+
+// taxCategoryRegex matches valid tax categories, e.g. "printed_matter"
+var taxCategoryRegex = regexp.MustCompile(`^[a-z_]+$`)
+
+// Create creates a new tax rate. If there is already a current rate for the same
+// country, region, and category, it is retired and the new rate becomes the next
+// version of it.
+func (c TaxRatesController) Create(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Parse data from request
+	rateData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := rateData.Validator()
+	val.Require("country")
+	country := strings.ToUpper(strings.TrimSpace(rateData.Get("country")))
+	if country != "" && !lib.IsSupportedCountry(country) {
+		val.AddError("country", fmt.Sprintf("%s is not a country we ship to.", country))
+	}
+	if rateData.Get("category") != "" {
+		val.Match("category", taxCategoryRegex).Message("category must consist of lowercase letters and underscores.")
+	}
+	val.Require("rate")
+	val.GreaterOrEqual("rate", 0.0)
+	val.Less("rate", 1.0).Message("rate must be a fraction less than 1, e.g. 0.0825 for 8.25%.")
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	rate := &models.TaxRate{
+		Country:   country,
+		Region:    strings.ToUpper(strings.TrimSpace(rateData.Get("region"))),
+		Category:  rateData.Get("category"),
+		Rate:      rateData.GetFloat("rate"),
+		Inclusive: rateData.GetBool("inclusive"),
+	}
+	if err := saveTaxRateVersion(rate); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, rate)
+}
+
+// Index lists the current tax rates. If the all query parameter is "true", retired
+// versions are included too.
+func (c TaxRatesController) Index(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Find all the tax rates in the database, optionally for a single country
+	var rates []*models.TaxRate
+	q := zoom.NewQuery("TaxRate")
+	if country := req.URL.Query().Get("country"); country != "" {
+		q.Filter("Country =", strings.ToUpper(country))
+	}
+	if err := q.Scan(&rates); err != nil {
+		panic(err)
+	}
+	if req.URL.Query().Get("all") != "true" {
+		current := []*models.TaxRate{}
+		for _, rate := range rates {
+			if rate.IsCurrent() {
+				current = append(current, rate)
+			}
+		}
+		rates = current
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, rates)
+}
+
+// Update creates a new version of an existing tax rate with a different rate and/or
+// inclusive setting. The country, region, and category cannot be changed.
+func (c TaxRatesController) Update(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Find the existing rate in the database
+	oldRate := &models.TaxRate{}
+	if err := zoom.ScanById(id, oldRate); err != nil {
+		panic(err)
+	}
+
+	// Parse data from request
+	rateData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := rateData.Validator()
+	if !oldRate.IsCurrent() {
+		val.AddError("id", "a retired tax rate cannot be changed.")
+	}
+	if rateData.KeyExists("rate") {
+		val.Require("rate").Message("rate cannot be blank")
+		val.GreaterOrEqual("rate", 0.0)
+		val.Less("rate", 1.0).Message("rate must be a fraction less than 1, e.g. 0.0825 for 8.25%.")
+	}
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Create the new version
+	rate := &models.TaxRate{
+		Country:   oldRate.Country,
+		Region:    oldRate.Region,
+		Category:  oldRate.Category,
+		Rate:      oldRate.Rate,
+		Inclusive: oldRate.Inclusive,
+	}
+	if rateData.KeyExists("rate") {
+		rate.Rate = rateData.GetFloat("rate")
+	}
+	if rateData.KeyExists("inclusive") {
+		rate.Inclusive = rateData.GetBool("inclusive")
+	}
+	if err := saveTaxRateVersion(rate); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, rate)
+}
+
+// Delete retires a tax rate. It is not removed from the database, since orders that
+// were placed while it was in effect still refer to it.
+func (c TaxRatesController) Delete(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Find the rate in the database
+	rate := &models.TaxRate{}
+	if err := zoom.ScanById(id, rate); err != nil {
+		panic(err)
+	}
+
+	// Retire it
+	if rate.IsCurrent() {
+		rate.RetiredAt = time.Now().UTC().Unix()
+		if err := zoom.Save(rate); err != nil {
+			panic(err)
+		}
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, struct{}{})
+}
+
+// saveTaxRateVersion retires the current rate (if any) with the same country, region,
+// and category as rate, and then saves rate as the next version.
+func saveTaxRateVersion(rate *models.TaxRate) error {
+	now := time.Now().UTC().Unix()
+	rate.Version = 1
+	rate.EffectiveAt = now
+	rates, err := lib.CurrentTaxRates(rate.Country)
+	if err != nil {
+		return err
+	}
+	for _, existing := range rates {
+		if existing.Region == rate.Region && existing.Category == rate.Category {
+			existing.RetiredAt = now
+			if err := zoom.Save(existing); err != nil {
+				return err
+			}
+			rate.Version = existing.Version + 1
+		}
+	}
+	return zoom.Save(rate)
+}
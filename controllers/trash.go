@@ -0,0 +1,19 @@
+package controllers
+
+import (
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/unrolled/render"
+	"net/http"
+)
+
+type TrashController struct{}
+
+// Index lists every item and admin user which has been deleted but not yet purged.
+func (c TrashController) Index(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	trash, err := lib.GetTrash()
+	if err != nil {
+		panic(err)
+	}
+	r.JSON(res, http.StatusOK, trash)
+}
@@ -0,0 +1,237 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+type WebhooksController struct{}
+
+// webhookUrlRegex matches valid webhook urls
+var webhookUrlRegex = regexp.MustCompile(`^https?://`)
+
+func (c WebhooksController) Create(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Parse data from request
+	webhookData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := webhookData.Validator()
+	val.Require("url")
+	val.Require("events")
+	webhook := &models.Webhook{
+		Active:    true,
+		CreatedAt: time.Now().UTC().Unix(),
+	}
+	setWebhookFields(webhookData, val, webhook)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Generate a secret for signing deliveries and save to database
+	if webhook.Secret, err = lib.NewWebhookSecret(); err != nil {
+		panic(err)
+	}
+	if err := zoom.Save(webhook); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, webhook)
+}
+
+func (c WebhooksController) Show(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	webhook := findWebhookOr404(res, req)
+	if webhook == nil {
+		return
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, webhook)
+}
+
+func (c WebhooksController) Index(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Find all webhooks in the database
+	var webhooks []*models.Webhook
+	if err := zoom.NewQuery("Webhook").Order("CreatedAt").Scan(&webhooks); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, webhooks)
+}
+
+func (c WebhooksController) Update(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	webhook := findWebhookOr404(res, req)
+	if webhook == nil {
+		return
+	}
+
+	// Parse data from request
+	webhookData, err := data.Parse(req)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validations
+	val := webhookData.Validator()
+	for _, key := range []string{"url", "events"} {
+		if webhookData.KeyExists(key) {
+			val.Require(key).Message(key + " cannot be blank")
+		}
+	}
+	setWebhookFields(webhookData, val, webhook)
+	if val.HasErrors() {
+		r.JSON(res, lib.StatusUnprocessableEntity, val.ErrorMap())
+		return
+	}
+
+	// Save to database
+	if err := zoom.Save(webhook); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, webhook)
+}
+
+func (c WebhooksController) Delete(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Delete from database, along with all its deliveries
+	var deliveries []*models.WebhookDelivery
+	if err := zoom.NewQuery("WebhookDelivery").Filter("WebhookId =", id).Scan(&deliveries); err != nil {
+		panic(err)
+	}
+	if err := zoom.MDelete(zoom.Models(deliveries)); err != nil {
+		panic(err)
+	}
+	if err := zoom.DeleteById("Webhook", id); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, struct{}{})
+}
+
+// Deliveries lists the deliveries for a webhook, newest first, along with every
+// attempt to deliver them.
+func (c WebhooksController) Deliveries(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the id from the url
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// Find all the deliveries for the webhook
+	var deliveries []*models.WebhookDelivery
+	if err := zoom.NewQuery("WebhookDelivery").Filter("WebhookId =", id).Order("-CreatedAt").Scan(&deliveries); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, deliveries)
+}
+
+// Replay sends a delivery to its webhook again.
+func (c WebhooksController) Replay(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	// Get the ids from the url
+	vars := mux.Vars(req)
+	webhookId := vars["id"]
+	deliveryId := vars["deliveryId"]
+
+	// Find the delivery in the database
+	delivery := &models.WebhookDelivery{}
+	if err := zoom.ScanById(deliveryId, delivery); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); !ok {
+			panic(err)
+		}
+		delivery = nil
+	}
+	if delivery == nil || delivery.WebhookId != webhookId {
+		msg := fmt.Sprintf("Could not find delivery with id = %s", deliveryId)
+		r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+		return
+	}
+
+	// Queue the delivery again
+	if err := lib.ReplayWebhookDelivery(delivery); err != nil {
+		panic(err)
+	}
+
+	// Render response
+	r.JSON(res, http.StatusOK, delivery)
+}
+
+// findWebhookOr404 finds the webhook with the id in the url. If there is no such
+// webhook, it writes a 404 error to res and returns nil.
+func findWebhookOr404(res http.ResponseWriter, req *http.Request) *models.Webhook {
+	id := mux.Vars(req)["id"]
+	webhook := &models.Webhook{}
+	if err := zoom.ScanById(id, webhook); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); ok {
+			r := render.New()
+			msg := fmt.Sprintf("Could not find webhook with id = %s", id)
+			r.JSON(res, http.StatusNotFound, lib.NewJsonError(msg))
+			return nil
+		} else {
+			panic(err)
+		}
+	}
+	return webhook
+}
+
+// setWebhookFields sets the fields of webhook for each key that exists in webhookData,
+// and validates the result. Any validation errors are added to val.
+func setWebhookFields(webhookData *data.Data, val *data.Validator, webhook *models.Webhook) {
+	if webhookData.KeyExists("url") {
+		val.Match("url", webhookUrlRegex).Message("url must be an http or https url.")
+		webhook.Url = webhookData.Get("url")
+	}
+	if webhookData.KeyExists("description") {
+		webhook.Description = webhookData.Get("description")
+	}
+	if webhookData.KeyExists("events") {
+		webhook.Events = splitList(webhookData.Get("events"))
+		for _, event := range webhook.Events {
+			if !stringSliceContains(models.WebhookEvents, event) {
+				val.AddError("events", fmt.Sprintf("%s is not a valid event. events must be a comma-separated list of %v.", event, models.WebhookEvents))
+			}
+		}
+	}
+	if webhookData.KeyExists("active") {
+		webhook.Active = webhookData.GetBool("active")
+	}
+}
+
+// triggerWebhookEvent queues deliveries of event to every webhook which subscribes
+// to it. Problems with webhooks should never fail the request, so errors are only
+// logged.
+func triggerWebhookEvent(event string, data interface{}) {
+	if err := lib.TriggerWebhookEvent(event, data); err != nil {
+		fmt.Printf("[webhooks] Error triggering %s event: %s\n", event, err)
+	}
+}
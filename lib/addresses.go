@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"regexp"
+	"strings"
+)
+
+// addressRules holds the address requirements for a single country.
+type addressRules struct {
+	requireRegion     bool
+	requirePostalCode bool
+	postalCodeFormat  *regexp.Regexp
+	postalCodeExample string
+}
+
+// countryAddressRules maps each country we ship to (as an ISO 3166-1 alpha-2 code)
+// to the rules which its addresses must satisfy.
+var countryAddressRules = map[string]addressRules{
+	"US": {true, true, regexp.MustCompile(`^\d{5}(-\d{4})?$`), "12345 or 12345-6789"},
+	"CA": {true, true, regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), "K1A 0B1"},
+	"AU": {true, true, regexp.MustCompile(`^\d{4}$`), "2000"},
+	"GB": {false, true, regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`), "SW1A 1AA"},
+	"IE": {false, false, regexp.MustCompile(`^[A-Z]\d[\dW] ?[A-Z\d]{4}$`), "D02 X285"},
+	"DE": {false, true, regexp.MustCompile(`^\d{5}$`), "10115"},
+	"FR": {false, true, regexp.MustCompile(`^\d{5}$`), "75008"},
+	"NL": {false, true, regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`), "1011 AB"},
+	"JP": {true, true, regexp.MustCompile(`^\d{3}-?\d{4}$`), "100-0001"},
+	"NZ": {false, true, regexp.MustCompile(`^\d{4}$`), "6011"},
+}
+
+// IsSupportedCountry returns true iff country is an ISO 3166-1 alpha-2 code for a
+// country that we know how to validate addresses for (and therefore can ship to).
+func IsSupportedCountry(country string) bool {
+	_, found := countryAddressRules[country]
+	return found
+}
+
+// NormalizeAddress trims whitespace from all the fields of addr and converts the
+// region, country, and postal code to upper case, which is the format ValidateAddress
+// expects and the format tax rates are stored in.
+func NormalizeAddress(addr *models.Address) {
+	addr.Name = strings.TrimSpace(addr.Name)
+	addr.Line1 = strings.TrimSpace(addr.Line1)
+	addr.Line2 = strings.TrimSpace(addr.Line2)
+	addr.City = strings.TrimSpace(addr.City)
+	addr.Region = strings.ToUpper(strings.TrimSpace(addr.Region))
+	addr.PostalCode = strings.ToUpper(strings.TrimSpace(addr.PostalCode))
+	addr.Country = strings.ToUpper(strings.TrimSpace(addr.Country))
+}
+
+// ValidateAddress checks addr against the rules for its country and adds any errors
+// to val. Errors are keyed by field, using the dotted form "field.subfield", e.g.
+// "shippingAddress.postalCode". ValidateAddress expects addr to already be normalized.
+func ValidateAddress(val *data.Validator, field string, addr *models.Address) {
+	requireAddressField(val, field, "name", addr.Name)
+	requireAddressField(val, field, "line1", addr.Line1)
+	requireAddressField(val, field, "city", addr.City)
+	if addr.Country == "" {
+		requireAddressField(val, field, "country", addr.Country)
+		return
+	}
+	rules, found := countryAddressRules[addr.Country]
+	if !found {
+		val.AddError(field+".country", fmt.Sprintf("%s.country %s is not a country we ship to.", field, addr.Country))
+		return
+	}
+	if rules.requireRegion {
+		requireAddressField(val, field, "region", addr.Region)
+	}
+	if rules.requirePostalCode {
+		requireAddressField(val, field, "postalCode", addr.PostalCode)
+	}
+	if addr.PostalCode != "" && !rules.postalCodeFormat.MatchString(addr.PostalCode) {
+		msg := fmt.Sprintf("%s.postalCode must be formatted like %s.", field, rules.postalCodeExample)
+		val.AddError(field+".postalCode", msg)
+	}
+}
+
+func requireAddressField(val *data.Validator, field, subfield, value string) {
+	if value == "" {
+		key := field + "." + subfield
+		val.AddError(key, key+" is required.")
+	}
+}
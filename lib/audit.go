@@ -0,0 +1,443 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// auditActions maps the request methods which are recorded in the audit log to the
+// action they are recorded as.
+var auditActions = map[string]string{
+	"POST":   models.AuditActionCreate,
+	"PUT":    models.AuditActionUpdate,
+	"PATCH":  models.AuditActionUpdate,
+	"DELETE": models.AuditActionDelete,
+}
+
+// auditValueMaxLength is the longest a value can be in the changes for an audit
+// entry. Longer values are truncated.
+const auditValueMaxLength = 200
+
+// auditRedactedKeys are parts of field names which are never recorded in the audit
+// log. Fields which contain any of them are recorded as "[redacted]".
+var auditRedactedKeys = []string{"password", "secret", "token", "paymentsource"}
+
+// auditModels returns a new, empty model for each kind of resource which is saved in
+// the database, keyed by the path to the resource without its id. The resource is
+// read before and after each request, so that the entry can record what changed.
+var auditModels = map[string]func() zoom.Model{
+	"admin_users":    func() zoom.Model { return &models.AdminUser{} },
+	"items":          func() zoom.Model { return &models.Item{} },
+	"orders":         func() zoom.Model { return &models.Order{} },
+	"promotions":     func() zoom.Model { return &models.Promotion{} },
+	"shipping/rates": func() zoom.Model { return &models.ShippingRate{} },
+	"shipping/zones": func() zoom.Model { return &models.ShippingZone{} },
+	"tax/rates":      func() zoom.Model { return &models.TaxRate{} },
+	"webhooks":       func() zoom.Model { return &models.Webhook{} },
+}
+
+// auditRecorder remembers the status code written to a ResponseWriter, and the body
+// if body is not nil.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   *bytes.Buffer
+}
+
+func (r *auditRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditRecorder) Write(b []byte) (int, error) {
+	if r.body != nil {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// AuditRequest calls next, and then records the request in the audit log if it is a
+// request that can change something (i.e. not a GET request). admin should be the
+// admin user who made the request. The entry is recorded even if next panics.
+// Problems recording the entry never fail the request, so they are only logged.
+func AuditRequest(admin *models.AdminUser, res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	action, found := auditActions[req.Method]
+	if !found {
+		next(res, req)
+		return
+	}
+
+	// The body of JSON requests can only be read once, so keep a copy for the entry
+	var jsonBody []byte
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") && req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			panic(err)
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		jsonBody = body
+	}
+
+	// Remember the resource as it was before the request. New resources don't have an
+	// id in the path, so it is taken from the response instead.
+	route, resourcePath := auditRoute(req)
+	resourceId := mux.Vars(req)["id"]
+	before := auditSnapshot(resourcePath, resourceId)
+	recorder := &auditRecorder{ResponseWriter: res, status: http.StatusOK}
+	if resourceId == "" {
+		recorder.body = &bytes.Buffer{}
+	}
+	defer func() {
+		r := recover()
+		status := recorder.status
+		if r != nil {
+			status = http.StatusInternalServerError
+		}
+		if recorder.body != nil {
+			resourceId = responseId(recorder.body.Bytes())
+		}
+		after := auditSnapshot(resourcePath, resourceId)
+		entry := newAuditEntry(admin, action, req, route, resourceId, status)
+		entry.Changes = auditChanges(req, jsonBody, before, after)
+		if err := zoom.Save(entry); err != nil {
+			fmt.Printf("[audit] Error recording %s: %s\n", entry.Route, err)
+		}
+		if r != nil {
+			panic(r)
+		}
+	}()
+	next(recorder, req)
+}
+
+// auditRoute returns the method and path of req with the variables in the path (e.g.
+// ids) replaced by their names, and the path to the resource, which is the part of
+// the path before the first variable.
+func auditRoute(req *http.Request) (route string, resourcePath string) {
+	vars := mux.Vars(req)
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	resourceSegments := len(segments)
+	for i, segment := range segments {
+		for name, value := range vars {
+			if segment == value {
+				segments[i] = ":" + name
+				if i < resourceSegments {
+					resourceSegments = i
+				}
+			}
+		}
+	}
+	return req.Method + " /" + strings.Join(segments, "/"), strings.Join(segments[:resourceSegments], "/")
+}
+
+// responseId returns the id field of a JSON response, or "" if it doesn't have one.
+func responseId(body []byte) string {
+	resource := struct {
+		Id string `json:"id"`
+	}{}
+	if err := json.Unmarshal(body, &resource); err != nil {
+		return ""
+	}
+	return resource.Id
+}
+
+// auditSnapshot returns the fields of the resource at resourcePath with the given id,
+// encoded the same way as they are in responses. It returns nil if the resource does
+// not exist, or if the resource is not saved in the database.
+func auditSnapshot(resourcePath string, id string) map[string]string {
+	newModel, found := auditModels[resourcePath]
+	if !found || id == "" {
+		return nil
+	}
+	model := newModel()
+	if err := zoom.ScanById(id, model); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); !ok {
+			fmt.Printf("[audit] Error reading %s %s: %s\n", resourcePath, id, err)
+		}
+		return nil
+	}
+	encoded, err := json.Marshal(model)
+	if err != nil {
+		return nil
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil
+	}
+	return auditValues(fields)
+}
+
+// auditValues converts fields to strings, encoding any which are not strings as JSON.
+func auditValues(fields map[string]interface{}) map[string]string {
+	values := map[string]string{}
+	for key, value := range fields {
+		if str, ok := value.(string); ok {
+			values[key] = str
+		} else if encoded, err := json.Marshal(value); err == nil {
+			values[key] = string(encoded)
+		}
+	}
+	return values
+}
+
+// newAuditEntry returns an entry without any changes for a request admin made, which
+// has already been handled.
+func newAuditEntry(admin *models.AdminUser, action string, req *http.Request, route string, resourceId string, status int) *models.AuditEntry {
+	return &models.AuditEntry{
+		AdminUserId:  admin.Id,
+		AdminEmail:   admin.Email,
+		Action:       action,
+		Route:        route,
+		ResourceType: strings.Split(strings.Trim(req.URL.Path, "/"), "/")[0],
+		ResourceId:   resourceId,
+		Status:       status,
+		Ip:           requestIp(req),
+		UserAgent:    req.UserAgent(),
+		CreatedAt:    time.Now().UTC().Unix(),
+	}
+}
+
+// auditChanges returns every field which is different between before and after, the
+// resource from before and after req. Secret fields which were sent (e.g. passwords)
+// are always included, since they are usually not part of the resource. If neither
+// before nor after exist (e.g. because the request failed or the resource is not
+// saved in the database), the fields that were sent are recorded as new values
+// instead. Secrets are redacted, long values are truncated, and files are recorded
+// by their filename.
+func auditChanges(req *http.Request, jsonBody []byte, before, after map[string]string) []models.AuditFieldChange {
+	sent := sentFields(req, jsonBody)
+	changed := map[string]*models.AuditFieldChange{}
+	if before == nil && after == nil {
+		for key, value := range sent {
+			changed[key] = &models.AuditFieldChange{Field: key, New: value}
+		}
+	} else {
+		for key, value := range before {
+			if after[key] != value {
+				changed[key] = &models.AuditFieldChange{Field: key, Old: value, New: after[key]}
+			}
+		}
+		for key, value := range after {
+			if _, found := before[key]; !found {
+				changed[key] = &models.AuditFieldChange{Field: key, New: value}
+			}
+		}
+		for key, value := range sent {
+			if _, found := changed[key]; !found && isAuditRedacted(key) {
+				changed[key] = &models.AuditFieldChange{Field: key, New: value}
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	changes := make([]models.AuditFieldChange, 0, len(changed))
+	for _, change := range changed {
+		if isAuditRedacted(change.Field) {
+			if change.Old != "" {
+				change.Old = "[redacted]"
+			}
+			if change.New != "" {
+				change.New = "[redacted]"
+			}
+		}
+		change.Old = truncateAuditValue(change.Old)
+		change.New = truncateAuditValue(change.New)
+		changes = append(changes, *change)
+	}
+	sort.Sort(auditFieldChangesByField(changes))
+	return changes
+}
+
+// sentFields returns the fields that were sent with req, which has already been
+// parsed by the handler if it was a form.
+func sentFields(req *http.Request, jsonBody []byte) map[string]string {
+	fields := map[string]string{}
+	switch {
+	case jsonBody != nil:
+		values := map[string]interface{}{}
+		if err := json.Unmarshal(jsonBody, &values); err != nil {
+			return nil
+		}
+		fields = auditValues(values)
+	case req.MultipartForm != nil:
+		for key, values := range req.MultipartForm.Value {
+			fields[key] = strings.Join(values, ",")
+		}
+		for key, files := range req.MultipartForm.File {
+			if len(files) > 0 {
+				fields[key] = files[0].Filename
+			}
+		}
+	default:
+		for key, values := range req.PostForm {
+			fields[key] = strings.Join(values, ",")
+		}
+	}
+	return fields
+}
+
+// isAuditRedacted returns true iff the values of the field with the given name are
+// never recorded in the audit log (see auditRedactedKeys).
+func isAuditRedacted(field string) bool {
+	for _, redacted := range auditRedactedKeys {
+		if strings.Contains(strings.ToLower(field), redacted) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateAuditValue returns value, truncated if it is longer than auditValueMaxLength.
+func truncateAuditValue(value string) string {
+	if len(value) > auditValueMaxLength {
+		return value[:auditValueMaxLength] + "..."
+	}
+	return value
+}
+
+type auditFieldChangesByField []models.AuditFieldChange
+
+func (c auditFieldChangesByField) Len() int           { return len(c) }
+func (c auditFieldChangesByField) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c auditFieldChangesByField) Less(i, j int) bool { return c[i].Field < c[j].Field }
+
+// requestIp returns the ip address of the client which sent req. Anyone can set the
+// X-Forwarded-For header, so it is only used when req came from one of the trusted
+// proxies in config.Audit.TrustedProxies. Each proxy appends the address it received
+// the request from, so the client is the last address which is not a trusted proxy.
+func requestIp(req *http.Request) string {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		ip = host
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// isTrustedProxy returns true iff ip is one of config.Audit.TrustedProxies.
+func isTrustedProxy(ip string) bool {
+	for _, proxy := range config.Audit.TrustedProxies {
+		if ip == proxy {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditLogFilter limits the entries returned by QueryAuditLog. Fields which are
+// empty or 0 match every entry.
+type AuditLogFilter struct {
+	AdminUserId  string
+	Action       string
+	ResourceType string
+	ResourceId   string
+	Since        int64 // UTC unix time
+	Until        int64 // UTC unix time
+}
+
+// AuditLogPage is one page of entries from the audit log.
+type AuditLogPage struct {
+	Entries []*models.AuditEntry `json:"entries"`
+	Total   int                  `json:"total"` // The number of entries which matched, on every page
+	Page    int                  `json:"page"`
+	PerPage int                  `json:"perPage"`
+}
+
+// QueryAuditLog returns the given page (starting at 1) of the entries in the audit
+// log which match filter, newest first.
+func QueryAuditLog(filter AuditLogFilter, page int, perPage int) (*AuditLogPage, error) {
+	query := func() *zoom.Query {
+		q := zoom.NewQuery("AuditEntry")
+		if filter.AdminUserId != "" {
+			q = q.Filter("AdminUserId =", filter.AdminUserId)
+		}
+		if filter.Action != "" {
+			q = q.Filter("Action =", filter.Action)
+		}
+		if filter.ResourceType != "" {
+			q = q.Filter("ResourceType =", filter.ResourceType)
+		}
+		if filter.ResourceId != "" {
+			q = q.Filter("ResourceId =", filter.ResourceId)
+		}
+		if filter.Since != 0 {
+			q = q.Filter("CreatedAt >=", filter.Since)
+		}
+		if filter.Until != 0 {
+			q = q.Filter("CreatedAt <=", filter.Until)
+		}
+		return q
+	}
+	total, err := query().Count()
+	if err != nil {
+		return nil, err
+	}
+	entries := []*models.AuditEntry{}
+	offset := uint((page - 1) * perPage)
+	if err := query().Order("-CreatedAt").Offset(offset).Limit(uint(perPage)).Scan(&entries); err != nil {
+		return nil, err
+	}
+	return &AuditLogPage{Entries: entries, Total: total, Page: page, PerPage: perPage}, nil
+}
+
+// RunAuditLogPurge deletes entries which are older than the retention period from
+// the audit log every interval. It never returns, so it should be run in its own
+// goroutine. If more than one server is running, only one of them will purge at a
+// time.
+func RunAuditLogPurge(interval time.Duration) {
+	for range time.Tick(interval) {
+		if lock, err := AcquireLock("auditLogPurge", interval); err != nil {
+			fmt.Printf("[audit] Error acquiring lock: %s\n", err)
+			continue
+		} else if lock == nil {
+			continue
+		}
+		createdBefore := time.Now().Add(-config.Audit.Retention)
+		if purged, err := PurgeAuditLog(createdBefore); err != nil {
+			fmt.Printf("[audit] Error purging audit log: %s\n", err)
+		} else if purged > 0 {
+			fmt.Printf("[audit] Purged %d entries\n", purged)
+		}
+		// The lock is not released so that other servers skip this interval
+	}
+}
+
+// PurgeAuditLog deletes every entry in the audit log which was created before
+// createdBefore, and returns the number of entries that were deleted.
+func PurgeAuditLog(createdBefore time.Time) (int, error) {
+	var entries []*models.AuditEntry
+	if err := zoom.NewQuery("AuditEntry").Filter("CreatedAt <", createdBefore.UTC().Unix()).Scan(&entries); err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		if err := zoom.Delete(entry); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
@@ -51,6 +51,12 @@ func CurrentAdminUser(req *http.Request) *models.AdminUser {
 		}
 	}
 
+	// Admin users in the trash can't do anything
+	if admin.DeletedAt != 0 {
+		fmt.Println("Admin user is in the trash")
+		return nil
+	}
+
 	// TODO: check token iat against some value we store in the database for each AdminUser
 	return admin
 }
@@ -0,0 +1,239 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/lib/mailer"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"net/url"
+	"time"
+)
+
+// Keys for the counters and sets used to keep track of cart reminders
+const (
+	cartRemindersSentKey         = "cartReminders:sent"
+	cartRemindersConvertedKey    = "cartReminders:converted"
+	cartRemindersRevenueKey      = "cartReminders:revenue"
+	cartRemindersUnsubscribedKey = "cartReminders:unsubscribed"
+)
+
+// cartRemindedKey is set once a reminder has been sent for a cart, so that we never
+// send more than one.
+func cartRemindedKey(cartId string) string {
+	return "cart:" + cartId + ":reminded"
+}
+
+// cartReminder is the data for the cart_reminder email template.
+type cartReminder struct {
+	Lines          []cartReminderLine
+	CartUrl        string
+	UnsubscribeUrl string
+}
+
+type cartReminderLine struct {
+	Name     string
+	Quantity int
+	Price    float64
+}
+
+// CartReminderStats summarizes how effective abandoned cart reminders have been.
+type CartReminderStats struct {
+	Sent           int     `json:"sent"`
+	Converted      int     `json:"converted"` // The number of reminded carts which were checked out
+	ConversionRate float64 `json:"conversionRate"`
+	Revenue        float64 `json:"revenue"` // The total of the orders for reminded carts
+}
+
+// RunCartReminders checks for abandoned carts every interval and sends reminders for
+// them. It never returns, so it should be run in its own goroutine. If more than one
+// server is running, only one of them will check at a time.
+func RunCartReminders(interval time.Duration) {
+	for range time.Tick(interval) {
+		if lock, err := AcquireLock("cartReminders", interval); err != nil {
+			fmt.Printf("[cart reminders] Error acquiring lock: %s\n", err)
+			continue
+		} else if lock == nil {
+			continue
+		}
+		abandonedBefore := time.Now().Add(-config.Carts.AbandonedAfter)
+		if sent, err := SendCartReminders(abandonedBefore); err != nil {
+			fmt.Printf("[cart reminders] Error sending reminders: %s\n", err)
+		} else if sent > 0 {
+			fmt.Printf("[cart reminders] Sent %d reminders\n", sent)
+		}
+		// The lock is not released so that other servers skip this interval
+	}
+}
+
+// SendCartReminders sends a reminder email for every cart which was last changed before
+// abandonedBefore and has an email address, unless the customer has placed an order
+// since, has unsubscribed, or has already been reminded about the cart. It returns the
+// number of reminders that were sent.
+func SendCartReminders(abandonedBefore time.Time) (int, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	cartIds, err := redis.Strings(conn.Do("ZRANGEBYSCORE", cartsUpdatedKey, "-inf", abandonedBefore.Unix()))
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, cartId := range cartIds {
+		cart, err := FindCart(cartId)
+		if err != nil {
+			return sent, err
+		}
+		if cart != nil {
+			if reminded, err := sendCartReminder(cart); err != nil {
+				return sent, err
+			} else if reminded {
+				sent++
+			}
+		}
+		// Carts which weren't reminded will be checked again if they are changed,
+		// since SaveCart adds them back to the set.
+		if _, err := conn.Do("ZREM", cartsUpdatedKey, cartId); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// sendCartReminder sends a reminder for cart if it should get one, and returns true
+// iff the reminder was sent.
+func sendCartReminder(cart *models.Cart) (bool, error) {
+	if cart.Email == "" || len(cart.Lines) == 0 {
+		return false, nil
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+
+	// Don't remind customers who have unsubscribed or who have placed an order since
+	// they last changed the cart.
+	if unsubscribed, err := redis.Bool(conn.Do("SISMEMBER", cartRemindersUnsubscribedKey, cart.Email)); err != nil {
+		return false, err
+	} else if unsubscribed {
+		return false, nil
+	}
+	var orders []*models.Order
+	if err := zoom.NewQuery("Order").Filter("Email =", cart.Email).Filter("CreatedAt >=", cart.UpdatedAt).Scan(&orders); err != nil {
+		return false, err
+	}
+	if len(orders) > 0 {
+		return false, nil
+	}
+
+	// Build the message, skipping any items which no longer exist or are no longer
+	// public
+	unsubscribeUrl := CartReminderUnsubscribeUrl(cart.Email)
+	reminder := cartReminder{
+		CartUrl:        fmt.Sprintf("%s/cart/%s", config.StoreUrl, cart.Id),
+		UnsubscribeUrl: unsubscribeUrl,
+	}
+	for _, line := range cart.Lines {
+		item := &models.Item{}
+		if err := zoom.ScanById(line.ItemId, item); err != nil {
+			if _, ok := err.(*zoom.KeyNotFoundError); ok {
+				continue
+			}
+			return false, err
+		}
+		if !item.IsPublic(time.Now().UTC().Unix()) {
+			continue
+		}
+		reminder.Lines = append(reminder.Lines, cartReminderLine{
+			Name:     item.Name,
+			Quantity: line.Quantity,
+			Price:    item.Price,
+		})
+	}
+	if len(reminder.Lines) == 0 {
+		return false, nil
+	}
+	msg, err := mailer.NewMessage("cart_reminder", cart.Email, reminder)
+	if err != nil {
+		return false, err
+	}
+	msg.Headers = map[string]string{
+		"List-Unsubscribe": "<" + unsubscribeUrl + ">",
+	}
+
+	// Claim the cart so that it is never reminded twice, even if another server is
+	// checking at the same time. Once the message is queued it will be retried until
+	// it is delivered.
+	ttl := int64(CartTTL / time.Second)
+	if _, err := redis.String(conn.Do("SET", cartRemindedKey(cart.Id), time.Now().Unix(), "NX", "EX", ttl)); err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := mailer.Enqueue(msg); err != nil {
+		// Release the claim so we try again next time
+		conn.Do("DEL", cartRemindedKey(cart.Id))
+		return false, err
+	}
+	if _, err := conn.Do("INCR", cartRemindersSentKey); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// RecordCartConversion records that cart was checked out as order. If a reminder was
+// sent for the cart, the order counts towards the conversion stats for reminders. It
+// should be called before the cart is deleted.
+func RecordCartConversion(cart *models.Cart, order *models.Order) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	if reminded, err := redis.Bool(conn.Do("EXISTS", cartRemindedKey(cart.Id))); err != nil {
+		return err
+	} else if !reminded {
+		return nil
+	}
+	conn.Send("MULTI")
+	conn.Send("INCR", cartRemindersConvertedKey)
+	conn.Send("INCRBYFLOAT", cartRemindersRevenueKey, order.Total)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// GetCartReminderStats returns the stats for all the reminders that have been sent.
+func GetCartReminderStats() (*CartReminderStats, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	values, err := redis.Values(conn.Do("MGET", cartRemindersSentKey, cartRemindersConvertedKey, cartRemindersRevenueKey))
+	if err != nil {
+		return nil, err
+	}
+	stats := &CartReminderStats{}
+	if _, err := redis.Scan(values, &stats.Sent, &stats.Converted, &stats.Revenue); err != nil {
+		return nil, err
+	}
+	stats.Revenue = models.RoundToCents(stats.Revenue)
+	if stats.Sent > 0 {
+		stats.ConversionRate = float64(stats.Converted) / float64(stats.Sent)
+	}
+	return stats, nil
+}
+
+// CartReminderUnsubscribeUrl returns the url which unsubscribes email from cart reminders.
+func CartReminderUnsubscribeUrl(email string) string {
+	query := url.Values{}
+	query.Set("email", email)
+	query.Set("token", sign("cartReminders", email))
+	return config.ApiUrl + "/cart_reminders/unsubscribe?" + query.Encode()
+}
+
+// UnsubscribeFromCartReminders stops any more cart reminders from being sent to email.
+// It returns false without unsubscribing if token is not valid for email.
+func UnsubscribeFromCartReminders(email string, token string) (bool, error) {
+	if !validSignature("cartReminders", email, token) {
+		return false, nil
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	if _, err := conn.Do("SADD", cartRemindersUnsubscribedKey, email); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/lib/mailer"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"net/url"
+	"time"
+)
+
+// CartTTL is how long a cart is kept after it was last changed.
+var CartTTL = 30 * 24 * time.Hour
+
+// cartsUpdatedKey is a sorted set of the ids of all carts, scored by the time they
+// were last changed. It is used to find abandoned carts (see SendCartReminders).
+const cartsUpdatedKey = "carts:updated"
+
+func cartKey(cartId string) string {
+	return "cart:" + cartId
+}
+
+func cartEmailKey(email string) string {
+	return "cart:email:" + email
+}
+
+// setCartEmailScript points the email address index at a cart unless it already
+// points at a different cart which still exists, and resets its TTL. KEYS[1] is the
+// index key, ARGV[1] is the cart id, and ARGV[2] is the TTL in seconds.
+var setCartEmailScript = redis.NewScript(1, `
+local current = redis.call('GET', KEYS[1])
+if current and current ~= ARGV[1] and redis.call('EXISTS', 'cart:' .. current) == 1 then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2])
+return 1
+`)
+
+// cartMergeEmail is the data for the cart_merge email template.
+type cartMergeEmail struct {
+	MergeUrl string
+}
+
+// NewCart returns a new, empty cart with a random id. It does not save the cart.
+func NewCart() (*models.Cart, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	return &models.Cart{
+		Id:        hex.EncodeToString(idBytes),
+		Lines:     []models.CartLine{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+// SaveCart saves cart and resets its TTL. If the cart has an email address which
+// does not already belong to another cart, it also becomes the cart for that email
+// address (see FindCartByEmail). Otherwise the other cart keeps the email address
+// until the carts are merged (see RequestCartMerge).
+func SaveCart(cart *models.Cart) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	cart.UpdatedAt = time.Now().Unix()
+	encoded, err := json.Marshal(cart)
+	if err != nil {
+		return err
+	}
+	ttl := int64(CartTTL / time.Second)
+	conn.Send("MULTI")
+	conn.Send("SET", cartKey(cart.Id), encoded, "EX", ttl)
+	conn.Send("ZADD", cartsUpdatedKey, cart.UpdatedAt, cart.Id)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+	if cart.Email != "" {
+		if _, err := setCartEmailScript.Do(conn, cartEmailKey(cart.Email), cart.Id, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindCart returns the cart with the given id, or nil if there is no such cart
+// or it has expired.
+func FindCart(cartId string) (*models.Cart, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	reply, err := redis.Bytes(conn.Do("GET", cartKey(cartId)))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cart := &models.Cart{}
+	if err := json.Unmarshal(reply, cart); err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+// FindCartByEmail returns the cart that was most recently saved with the given
+// email address, or nil if there is no such cart or it has expired.
+func FindCartByEmail(email string) (*models.Cart, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	cartId, err := redis.String(conn.Do("GET", cartEmailKey(email)))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return FindCart(cartId)
+}
+
+// DeleteCart deletes cart, along with its email address index if it still points
+// to the cart.
+func DeleteCart(cart *models.Cart) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("DEL", cartKey(cart.Id), cartRemindedKey(cart.Id))
+	conn.Send("ZREM", cartsUpdatedKey, cart.Id)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+	if cart.Email == "" {
+		return nil
+	}
+	cartId, err := redis.String(conn.Do("GET", cartEmailKey(cart.Email)))
+	if err == redis.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if cartId == cart.Id {
+		_, err = conn.Do("DEL", cartEmailKey(cart.Email))
+	}
+	return err
+}
+
+// CartMergeUrl returns the url on the storefront which merges the other cart for
+// cart.Email into cart. It is only ever sent to cart.Email, so following it proves
+// that the customer owns the email address.
+func CartMergeUrl(cart *models.Cart) string {
+	query := url.Values{}
+	query.Set("mergeToken", sign("cartMerge", cart.Id+":"+cart.Email))
+	return config.StoreUrl + "/cart/" + cart.Id + "?" + query.Encode()
+}
+
+// ValidCartMergeToken returns true iff token is the token from the merge url for
+// cart and its current email address.
+func ValidCartMergeToken(cart *models.Cart, token string) bool {
+	return validSignature("cartMerge", cart.Id+":"+cart.Email, token)
+}
+
+// RequestCartMerge emails a link (see CartMergeUrl) to cart.Email if another cart
+// with items in it already belongs to that email address, e.g. because the customer
+// started a cart on another device. The carts are only merged once the customer
+// follows the link, so that entering someone else's email address never reveals or
+// takes over their cart. It returns true iff the email was sent.
+func RequestCartMerge(cart *models.Cart) (bool, error) {
+	if cart.Email == "" {
+		return false, nil
+	}
+	other, err := FindCartByEmail(cart.Email)
+	if err != nil {
+		return false, err
+	}
+	if other == nil || other.Id == cart.Id || len(other.Lines) == 0 {
+		return false, nil
+	}
+	msg, err := mailer.NewMessage("cart_merge", cart.Email, cartMergeEmail{
+		MergeUrl: CartMergeUrl(cart),
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := mailer.Enqueue(msg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MergeCartForEmail merges the lines from any other cart which belongs to cart.Email
+// into cart and then deletes the other cart. Callers must check that the customer
+// owns the email address first (see ValidCartMergeToken). It does not save cart.
+func MergeCartForEmail(cart *models.Cart) error {
+	if cart.Email == "" {
+		return nil
+	}
+	other, err := FindCartByEmail(cart.Email)
+	if err != nil {
+		return err
+	}
+	if other == nil || other.Id == cart.Id {
+		return nil
+	}
+	cart.Merge(other)
+	return DeleteCart(other)
+}
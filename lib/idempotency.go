@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"github.com/unrolled/render"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// IdempotencyKeyTTL is how long responses for requests with an Idempotency-Key
+// header are stored and can be replayed.
+var IdempotencyKeyTTL = 24 * time.Hour
+
+// idempotentResponse is what we store in redis for each Idempotency-Key. While the
+// first request with the key is being processed, Complete is false and only
+// RequestHash is set.
+type idempotentResponse struct {
+	RequestHash string      `json:"requestHash"`
+	Complete    bool        `json:"complete"`
+	Code        int         `json:"code,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// Idempotent is a middleware-like function that wraps around an http.HandlerFunc.
+// If the request includes an Idempotency-Key header, the response for the first
+// request with that key is stored in redis, and any later requests with the same key
+// get the stored response instead of calling next again. A request which reuses a key
+// with a different method, path, or body gets a 422 error, and a request which arrives
+// while the first request with the same key is still being processed gets a 409 error.
+// Requests without the header are passed straight to next.
+func Idempotent(next http.HandlerFunc) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		idempotencyKey := req.Header.Get("Idempotency-Key")
+		if idempotencyKey == "" {
+			next(res, req)
+			return
+		}
+		r := render.New()
+		redisKey := "idempotency:" + idempotencyKey
+
+		// Hash the request so that we can tell if the key is reused for a different
+		// request. We need to replace the body after reading it so next can read it.
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			panic(err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		// Atomically claim the key. If it is already claimed, we either replay the stored
+		// response or return an error.
+		claimed, stored, err := claimIdempotencyKey(redisKey, requestHash)
+		if err != nil {
+			panic(err)
+		}
+		if !claimed {
+			switch {
+			case stored.RequestHash != requestHash:
+				msg := "This Idempotency-Key has already been used for a different request."
+				r.JSON(res, StatusUnprocessableEntity, NewJsonError(msg))
+			case !stored.Complete:
+				msg := "A request with this Idempotency-Key is still being processed. Please try again."
+				r.JSON(res, http.StatusConflict, NewJsonError(msg))
+			default:
+				for key, values := range stored.Header {
+					res.Header()[key] = values
+				}
+				res.Header().Set("Idempotent-Replayed", "true")
+				res.WriteHeader(stored.Code)
+				res.Write(stored.Body)
+			}
+			return
+		}
+
+		// If next panics, release the key so the request can be retried, and then
+		// continue panicking so the recovery middleware can handle it.
+		defer func() {
+			if err := recover(); err != nil {
+				conn := zoom.GetConn()
+				conn.Do("DEL", redisKey)
+				conn.Close()
+				panic(err)
+			}
+		}()
+
+		// Record the response from next and store it
+		recorder := newResponseRecorder()
+		next(recorder, req)
+		stored = &idempotentResponse{
+			RequestHash: requestHash,
+			Complete:    true,
+			Code:        recorder.code,
+			Header:      recorder.header,
+			Body:        recorder.body.Bytes(),
+		}
+		if err := storeIdempotentResponse(redisKey, stored); err != nil {
+			panic(err)
+		}
+
+		// Write the recorded response to res
+		for key, values := range recorder.header {
+			res.Header()[key] = values
+		}
+		res.WriteHeader(recorder.code)
+		res.Write(recorder.body.Bytes())
+	}
+}
+
+// claimIdempotencyKey attempts to atomically claim redisKey for a request with the given
+// hash. If the key was already claimed, it returns false along with the stored response.
+func claimIdempotencyKey(redisKey string, requestHash string) (bool, *idempotentResponse, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	pending, err := json.Marshal(idempotentResponse{RequestHash: requestHash})
+	if err != nil {
+		return false, nil, err
+	}
+	ttl := int64(IdempotencyKeyTTL / time.Second)
+	if _, err := redis.String(conn.Do("SET", redisKey, pending, "NX", "EX", ttl)); err == nil {
+		return true, nil, nil
+	} else if err != redis.ErrNil {
+		return false, nil, err
+	}
+	reply, err := redis.Bytes(conn.Do("GET", redisKey))
+	if err == redis.ErrNil {
+		// The key expired or was released in between our two commands. Just try again.
+		return claimIdempotencyKey(redisKey, requestHash)
+	} else if err != nil {
+		return false, nil, err
+	}
+	stored := &idempotentResponse{}
+	if err := json.Unmarshal(reply, stored); err != nil {
+		return false, nil, err
+	}
+	return false, stored, nil
+}
+
+func storeIdempotentResponse(redisKey string, stored *idempotentResponse) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	encoded, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("SET", redisKey, encoded, "EX", int64(IdempotencyKeyTTL/time.Second))
+	return err
+}
+
+// paymentAttemptKey counts the orders placed by requests with the given
+// Idempotency-Key which were rolled back after their payment was authorized.
+func paymentAttemptKey(idempotencyKey string) string {
+	return "idempotency:" + idempotencyKey + ":payment_attempt"
+}
+
+// PaymentIdempotencyKey returns the idempotency key to send to the payment gateway
+// when authorizing payment for an order placed by a request with the given
+// Idempotency-Key header. Retries of the request get the same key, so the payment is
+// never authorized twice (e.g. if the first attempt timed out after the gateway
+// authorized it), until ExpirePaymentIdempotencyKey is called. If idempotencyKey is
+// empty, a random key is returned.
+func PaymentIdempotencyKey(idempotencyKey string) (string, error) {
+	if idempotencyKey == "" {
+		keyBytes := make([]byte, 32)
+		if _, err := rand.Read(keyBytes); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(keyBytes), nil
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	attempt, err := redis.Int(conn.Do("GET", paymentAttemptKey(idempotencyKey)))
+	if err != nil && err != redis.ErrNil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("authorize:%s:%d", idempotencyKey, attempt)))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// ExpirePaymentIdempotencyKey makes PaymentIdempotencyKey return a new key for
+// idempotencyKey. It should be called when an order is rolled back after its payment
+// was authorized and voided, since the gateway would otherwise return the voided
+// payment when the request is retried.
+func ExpirePaymentIdempotencyKey(idempotencyKey string) error {
+	if idempotencyKey == "" {
+		return nil
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("INCR", paymentAttemptKey(idempotencyKey))
+	conn.Send("EXPIRE", paymentAttemptKey(idempotencyKey), int64(IdempotencyKeyTTL/time.Second))
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// responseRecorder is an http.ResponseWriter which records the response so that
+// it can be stored and written later.
+type responseRecorder struct {
+	code   int
+	header http.Header
+	body   *bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{
+		code:   http.StatusOK,
+		header: http.Header{},
+		body:   &bytes.Buffer{},
+	}
+}
+
+func (rr *responseRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	return rr.body.Write(b)
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	rr.code = code
+}
@@ -2,9 +2,40 @@ package lib
 
 import (
 	"fmt"
+	"github.com/albrow/5w4g-server/lib/jobs"
+	"github.com/albrow/zoom"
 	"path/filepath"
 )
 
+// The name of the job which deletes an image from S3, and the queue it is added to.
+const (
+	deleteImageJob = "images.delete"
+	imagesQueue    = "images"
+)
+
+func init() {
+	jobs.Register(deleteImageJob, func(job *jobs.Job) error {
+		var path string
+		if err := job.ScanArgs(&path); err != nil {
+			return err
+		}
+		// Image paths are based on the item name, so the path may have been reused
+		// (e.g. by a new item with the same name) since the job was queued
+		if inUse, err := imageInUse(path); err != nil {
+			return err
+		} else if inUse {
+			return nil
+		}
+		return DeleteImage(path)
+	})
+}
+
+// imageInUse returns true iff any item has an image with the given path.
+func imageInUse(path string) (bool, error) {
+	count, err := zoom.NewQuery("Item").Filter("ImageS3Path =", path).Count()
+	return count > 0, err
+}
+
 func GetImageMimeType(filename string) (string, error) {
 	switch filepath.Ext(filename) {
 	case ".gif":
@@ -15,3 +46,23 @@ func GetImageMimeType(filename string) (string, error) {
 		return "", fmt.Errorf("Unsupported image file extension: %s. Supported types are .gif and .svg", filepath.Ext(filename))
 	}
 }
+
+// DeleteImage deletes the file designated by path from the S3 bucket.
+func DeleteImage(path string) error {
+	bucket, err := S3Bucket()
+	if err != nil {
+		return err
+	}
+	return bucket.Del(path)
+}
+
+// QueueImageDeletion adds a background job which deletes the file designated by path
+// from the S3 bucket, so that the request doesn't have to wait for S3. It does
+// nothing if path is empty.
+func QueueImageDeletion(path string) error {
+	if path == "" {
+		return nil
+	}
+	_, err := jobs.Enqueue(imagesQueue, deleteImageJob, path)
+	return err
+}
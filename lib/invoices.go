@@ -0,0 +1,324 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"github.com/jung-kurt/gofpdf"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// invoiceNumbersKey is a hash of the invoice number given to each order, by order
+// id. It is the record of which numbers have been used, so that an order keeps its
+// number even if it is saved again with a stale copy of the InvoiceNumber field.
+const invoiceNumbersKey = "invoices:numbers"
+
+// lastInvoiceNumberKey is a counter of the last invoice number which was given out.
+const lastInvoiceNumberKey = "invoices:lastNumber"
+
+// assignInvoiceNumberScript atomically finds the invoice number for the order with
+// the id ARGV[1] in the hash KEYS[2], or if it doesn't have one yet, gives it the next
+// number from the counter KEYS[3]. It also sets the InvoiceNumber field of the order
+// hash (KEYS[1]), and returns the number.
+var assignInvoiceNumberScript = redis.NewScript(3, `
+local number = redis.call('HGET', KEYS[2], ARGV[1])
+if not number then
+	number = redis.call('INCR', KEYS[3])
+	redis.call('HSET', KEYS[2], ARGV[1], number)
+end
+redis.call('HSET', KEYS[1], 'InvoiceNumber', number)
+return tonumber(number)
+`)
+
+// AssignInvoiceNumber sets order.InvoiceNumber, giving the order the next invoice
+// number if it doesn't have one yet. Numbers are sequential starting at 1, and are
+// never given to more than one order.
+func AssignInvoiceNumber(order *models.Order) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	number, err := redis.Int(assignInvoiceNumberScript.Do(conn, "Order:"+order.Id, invoiceNumbersKey, lastInvoiceNumberKey, order.Id))
+	if err != nil {
+		return err
+	}
+	order.InvoiceNumber = number
+	return nil
+}
+
+// FormatInvoiceNumber returns the invoice number as it is printed on invoices,
+// e.g. INV-000042.
+func FormatInvoiceNumber(number int) string {
+	return fmt.Sprintf("INV-%06d", number)
+}
+
+// pdfMargin is the margin on every side of the page, in millimeters.
+const pdfMargin = 15.0
+
+// pdfDocument is a single page (or more, if needed) PDF which invoices and packing
+// slips are drawn on, with helpers for the parts they have in common.
+type pdfDocument struct {
+	*gofpdf.Fpdf
+	tr    func(string) string // Converts UTF-8 text to the encoding used by the built-in fonts
+	width float64             // The width of the page inside the margins
+}
+
+func newPDFDocument(title string) *pdfDocument {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	pdf.SetAutoPageBreak(true, pdfMargin)
+	pdf.SetTitle(title, true)
+	pdf.SetCreator(config.Seller.Name, true)
+	pdf.AddPage()
+	pageWidth, _ := pdf.GetPageSize()
+	return &pdfDocument{
+		Fpdf:  pdf,
+		tr:    pdf.UnicodeTranslatorFromDescriptor(""),
+		width: pageWidth - 2*pdfMargin,
+	}
+}
+
+// text writes a line of text across the page in the given style ("" for regular,
+// "B" for bold, or "I" for italic) and size, aligned "L" (left) or "R" (right).
+func (d *pdfDocument) text(text string, style string, size float64, align string) {
+	d.SetFont("Helvetica", style, size)
+	d.CellFormat(d.width, size*0.5, d.tr(text), "", 1, align, false, 0, "")
+}
+
+// header writes the seller's details on the left, and the title of the document on
+// the right.
+func (d *pdfDocument) header(title string) {
+	top := d.GetY()
+	d.text(config.Seller.Name, "B", 18, "L")
+	d.SetY(top)
+	d.text(title, "B", 18, "R")
+	d.Ln(2)
+	for _, line := range config.Seller.AddressLines {
+		d.text(line, "", 10, "L")
+	}
+	if config.Seller.Email != "" {
+		d.text(config.Seller.Email, "", 10, "L")
+	}
+	if config.Seller.TaxId != "" {
+		d.text("Tax ID: "+config.Seller.TaxId, "", 10, "L")
+	}
+	d.Ln(6)
+}
+
+// details writes a label and a value on each line.
+func (d *pdfDocument) details(details [][2]string) {
+	for _, detail := range details {
+		d.SetFont("Helvetica", "B", 10)
+		d.CellFormat(40, 5, d.tr(detail[0]), "", 0, "L", false, 0, "")
+		d.SetFont("Helvetica", "", 10)
+		d.CellFormat(d.width-40, 5, d.tr(detail[1]), "", 1, "L", false, 0, "")
+	}
+	d.Ln(6)
+}
+
+// addresses writes each address under its heading, side by side.
+func (d *pdfDocument) addresses(headings []string, addresses []models.Address) {
+	columnWidth := d.width / float64(len(addresses))
+	top, bottom := d.GetY(), d.GetY()
+	for i, address := range addresses {
+		x := pdfMargin + columnWidth*float64(i)
+		d.SetXY(x, top)
+		d.SetFont("Helvetica", "B", 10)
+		d.CellFormat(columnWidth, 5, d.tr(headings[i]), "", 2, "L", false, 0, "")
+		d.SetFont("Helvetica", "", 10)
+		for _, line := range addressLines(address) {
+			d.CellFormat(columnWidth, 5, d.tr(line), "", 2, "L", false, 0, "")
+		}
+		if y := d.GetY(); y > bottom {
+			bottom = y
+		}
+	}
+	d.SetXY(pdfMargin, bottom)
+	d.Ln(6)
+}
+
+// addressLines returns the lines of address as they would be written on an envelope.
+func addressLines(address models.Address) []string {
+	lines := []string{address.Name, address.Line1}
+	if address.Line2 != "" {
+		lines = append(lines, address.Line2)
+	}
+	cityLine := strings.TrimSpace(strings.Join([]string{address.Region, address.PostalCode}, " "))
+	if address.City != "" && cityLine != "" {
+		cityLine = address.City + ", " + cityLine
+	} else if address.City != "" {
+		cityLine = address.City
+	}
+	return append(lines, cityLine, address.Country)
+}
+
+// table writes rows under a shaded header row. widths and aligns are the width and
+// alignment ("L" or "R") of each column. The first column is given whatever width
+// is left over from the others.
+func (d *pdfDocument) table(header []string, widths []float64, aligns []string, rows [][]string) {
+	widths[0] = d.width
+	for _, w := range widths[1:] {
+		widths[0] -= w
+	}
+	d.SetFont("Helvetica", "B", 10)
+	d.SetFillColor(230, 230, 230)
+	for i, heading := range header {
+		d.CellFormat(widths[i], 7, d.tr(heading), "B", 0, aligns[i], true, 0, "")
+	}
+	d.Ln(-1)
+	d.SetFont("Helvetica", "", 10)
+	for _, row := range rows {
+		for i, cell := range row {
+			d.CellFormat(widths[i], 7, d.tr(cell), "B", 0, aligns[i], false, 0, "")
+		}
+		d.Ln(-1)
+	}
+	d.Ln(4)
+}
+
+// pdfTotal is a line in the totals at the bottom of an invoice.
+type pdfTotal struct {
+	label string
+	value string
+	bold  bool
+}
+
+// totals writes each total right-aligned, with its label to the left of it.
+func (d *pdfDocument) totals(totals []pdfTotal) {
+	for _, total := range totals {
+		style := ""
+		if total.bold {
+			style = "B"
+		}
+		d.SetFont("Helvetica", style, 10)
+		d.CellFormat(d.width-30, 6, d.tr(total.label), "", 0, "R", false, 0, "")
+		d.CellFormat(30, 6, d.tr(total.value), "", 1, "R", false, 0, "")
+	}
+}
+
+func formatPDFMoney(amount float64) string {
+	return fmt.Sprintf("$%.2f", amount)
+}
+
+func formatPDFDate(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format("January 2, 2006")
+}
+
+// WriteInvoicePDF writes an invoice for order to w as a PDF, with the seller's
+// details, the billing and shipping addresses, the price, discount, and tax for each
+// line, and the order totals. The order must already have an invoice number (see
+// AssignInvoiceNumber).
+func WriteInvoicePDF(w io.Writer, order *models.Order) error {
+	invoiceNumber := FormatInvoiceNumber(order.InvoiceNumber)
+	d := newPDFDocument("Invoice " + invoiceNumber)
+	d.header("INVOICE")
+	d.details([][2]string{
+		{"Invoice number", invoiceNumber},
+		{"Invoice date", formatPDFDate(order.CreatedAt)},
+		{"Order", order.Id},
+		{"Customer", order.Email},
+	})
+	billingAddress := order.ShippingAddress
+	if order.BillingAddress != nil {
+		billingAddress = *order.BillingAddress
+	}
+	d.addresses([]string{"Bill to", "Ship to"}, []models.Address{billingAddress, order.ShippingAddress})
+
+	// Lines, with the name and price each item had when the order was placed
+	rows := [][]string{}
+	for _, orderItem := range order.Items {
+		rows = append(rows, []string{
+			orderItem.ItemName,
+			strconv.Itoa(orderItem.Quantity),
+			formatPDFMoney(orderItem.UnitPrice),
+			formatPDFMoney(orderItem.Discount),
+			formatPDFMoney(orderItem.Tax),
+			formatPDFMoney(orderItem.DiscountedTotal()),
+		})
+	}
+	d.table(
+		[]string{"Item", "Qty", "Unit Price", "Discount", "Tax", "Amount"},
+		[]float64{0, 15, 25, 22, 22, 26},
+		[]string{"L", "R", "R", "R", "R", "R"},
+		rows,
+	)
+
+	// Totals
+	totals := []pdfTotal{{label: "Subtotal", value: formatPDFMoney(order.Subtotal)}}
+	if order.Discount > 0 {
+		label := "Discount"
+		if len(order.Promotions) > 0 {
+			descriptions := []string{}
+			for _, promotion := range order.Promotions {
+				descriptions = append(descriptions, promotion.Description)
+			}
+			label += " (" + strings.Join(descriptions, ", ") + ")"
+		}
+		totals = append(totals, pdfTotal{label: label, value: "-" + formatPDFMoney(order.Discount)})
+	}
+	totals = append(totals, pdfTotal{label: "Shipping (" + order.ShippingMethod + ")", value: formatPDFMoney(order.ShippingCost)})
+	for _, taxLine := range order.TaxLines {
+		label := "Tax"
+		if taxLine.Inclusive {
+			label = "Tax included"
+		}
+		rate := strconv.FormatFloat(taxLine.Rate*100, 'f', -1, 64)
+		totals = append(totals, pdfTotal{label: fmt.Sprintf("%s (%s%%)", label, rate), value: formatPDFMoney(taxLine.Amount)})
+	}
+	totals = append(totals, pdfTotal{label: "Total", value: formatPDFMoney(order.Total), bold: true})
+	if order.AmountRefunded > 0 {
+		totals = append(totals,
+			pdfTotal{label: "Refunded", value: "-" + formatPDFMoney(order.AmountRefunded)},
+			pdfTotal{label: "Total after refunds", value: formatPDFMoney(order.RefundableAmount()), bold: true},
+		)
+	}
+	d.totals(totals)
+	d.Ln(10)
+	d.text("Thank you for your order!", "I", 10, "L")
+	return d.Output(w)
+}
+
+// WritePackingSlipPDF writes a packing slip for order to w as a PDF, with the
+// shipping address and the quantity of each item which still needs to be shipped,
+// but no prices. Items which have already been shipped or refunded are left out.
+func WritePackingSlipPDF(w io.Writer, order *models.Order) error {
+	d := newPDFDocument("Packing Slip for Order " + order.Id)
+	d.header("PACKING SLIP")
+	details := [][2]string{
+		{"Order", order.Id},
+		{"Order date", formatPDFDate(order.CreatedAt)},
+		{"Shipping method", order.ShippingMethod},
+	}
+	if order.TrackingNumber != "" {
+		details = append(details, [2]string{"Tracking number", strings.TrimSpace(order.Carrier + " " + order.TrackingNumber)})
+	}
+	d.details(details)
+	d.addresses([]string{"Ship to"}, []models.Address{order.ShippingAddress})
+
+	rows := [][]string{}
+	for _, orderItem := range order.Items {
+		quantity := orderItem.UnshippedQuantity()
+		if quantity <= 0 {
+			continue
+		}
+		note := ""
+		if orderItem.Preorder && orderItem.ExpectedShipDate != 0 {
+			note = "Pre-order, expected to ship " + formatPDFDate(orderItem.ExpectedShipDate)
+		} else if orderItem.Preorder {
+			note = "Pre-order"
+		} else if orderItem.Backordered > 0 {
+			note = fmt.Sprintf("%d backordered", orderItem.Backordered)
+		}
+		rows = append(rows, []string{orderItem.ItemName, strconv.Itoa(quantity), note})
+	}
+	d.table(
+		[]string{"Item", "Qty", "Notes"},
+		[]float64{0, 20, 70},
+		[]string{"L", "R", "L"},
+		rows,
+	)
+	return d.Output(w)
+}
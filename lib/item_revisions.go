@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"github.com/mitchellh/goamz/s3"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// itemRevisionCountKey is a counter used to number the revisions of an item.
+func itemRevisionCountKey(itemId string) string {
+	return "item:" + itemId + ":revisionCount"
+}
+
+// itemRevisionFields are the fields of an item which are recorded in revisions,
+// with their names in JSON and in Go. The image is recorded separately, and the
+// amount in stock is recorded in the stock ledger instead.
+var itemRevisionFields = []struct{ json, field string }{
+	{"name", "Name"},
+	{"description", "Description"},
+	{"price", "Price"},
+	{"category", "Category"},
+	{"status", "Status"},
+	{"publishAt", "PublishAt"},
+	{"lowStockThreshold", "LowStockThreshold"},
+	{"availability", "Availability"},
+	{"backorderLimit", "BackorderLimit"},
+	{"expectedShipDate", "ExpectedShipDate"},
+	{"taxCategory", "TaxCategory"},
+	{"weight", "Weight"},
+	{"length", "Length"},
+	{"width", "Width"},
+	{"height", "Height"},
+}
+
+// ArchiveItemImage copies the current image for item to a new path which will not
+// be overwritten, so that it can be restored by a rollback. It should be called
+// before the image is changed or renamed. It returns the path of the copy, or an
+// empty string if the item has no image.
+func ArchiveItemImage(item *models.Item) (string, error) {
+	if item.ImageS3Path == "" {
+		return "", nil
+	}
+	bucket, err := S3Bucket()
+	if err != nil {
+		return "", err
+	}
+	archivePath := fmt.Sprintf("item_revisions/%s/%d%s", item.Id, time.Now().UnixNano(), filepath.Ext(item.ImageS3Path))
+	if err := bucket.Copy(item.ImageS3Path, archivePath, s3.PublicRead); err != nil {
+		return "", err
+	}
+	return archivePath, nil
+}
+
+// imageArchiveUrl returns the public url for an image archived by ArchiveItemImage.
+func imageArchiveUrl(archivePath string) string {
+	return fmt.Sprintf("https://s3.amazonaws.com/%s/%s", config.Aws.BucketName, archivePath)
+}
+
+// RecordItemRevision saves a revision with every field which is different between
+// before and after, which should be copies of an item from before and after it was
+// changed by the admin with the given id. imageArchivePath should be the path
+// returned by ArchiveItemImage if the image was changed or renamed, and restoredFrom
+// should be the id of the revision that was rolled back if the change was a
+// rollback. It returns nil if nothing changed.
+func RecordItemRevision(before, after *models.Item, adminUserId, imageArchivePath, restoredFrom string) (*models.ItemRevision, error) {
+	changes := []models.ItemFieldChange{}
+	beforeVal := reflect.ValueOf(before).Elem()
+	afterVal := reflect.ValueOf(after).Elem()
+	for _, f := range itemRevisionFields {
+		oldValue, err := json.Marshal(beforeVal.FieldByName(f.field).Interface())
+		if err != nil {
+			return nil, err
+		}
+		newValue, err := json.Marshal(afterVal.FieldByName(f.field).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(oldValue, newValue) {
+			changes = append(changes, models.ItemFieldChange{Field: f.json, Old: oldValue, New: newValue})
+		}
+	}
+	if imageArchivePath != "" {
+		oldUrl, err := json.Marshal(imageArchiveUrl(imageArchivePath))
+		if err != nil {
+			return nil, err
+		}
+		newUrl, err := json.Marshal(after.ImageUrl)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, models.ItemFieldChange{Field: "image", Old: oldUrl, New: newUrl})
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	version, err := redis.Int(conn.Do("INCR", itemRevisionCountKey(after.Id)))
+	if err != nil {
+		return nil, err
+	}
+	revision := &models.ItemRevision{
+		ItemId:           after.Id,
+		Version:          version,
+		AdminUserId:      adminUserId,
+		Changes:          changes,
+		ImageArchivePath: imageArchivePath,
+		RestoredFrom:     restoredFrom,
+		CreatedAt:        time.Now().UTC().Unix(),
+	}
+	if err := zoom.Save(revision); err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+// ItemRevisions returns the revisions for the item with the given id, newest first.
+func ItemRevisions(itemId string) ([]*models.ItemRevision, error) {
+	var revisions []*models.ItemRevision
+	if err := zoom.NewQuery("ItemRevision").Filter("ItemId =", itemId).Order("-Version").Scan(&revisions); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// RevertItem returns a copy of item rolled back to the way it was before the
+// revision with the given id, i.e. with every field changed by that revision or
+// any later revision set back to its old value. If the image was changed by any of
+// those revisions, imageArchivePath is the path of the image to restore, which has
+// not been applied to the copy. reverted is nil if item has no such revision.
+func RevertItem(item *models.Item, revisionId string) (reverted *models.Item, imageArchivePath string, err error) {
+	revisions, err := ItemRevisions(item.Id)
+	if err != nil {
+		return nil, "", err
+	}
+	found := false
+	reverted = &models.Item{}
+	*reverted = *item
+	revertedVal := reflect.ValueOf(reverted).Elem()
+	// Revisions are newest first, so older values overwrite newer ones
+	for _, revision := range revisions {
+		for _, change := range revision.Changes {
+			for _, f := range itemRevisionFields {
+				if f.json == change.Field {
+					field := revertedVal.FieldByName(f.field)
+					if err := json.Unmarshal(change.Old, field.Addr().Interface()); err != nil {
+						return nil, "", err
+					}
+				}
+			}
+		}
+		if revision.ImageArchivePath != "" {
+			imageArchivePath = revision.ImageArchivePath
+		}
+		if revision.Id == revisionId {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, "", nil
+	}
+	return reverted, imageArchivePath, nil
+}
+
+// DeleteItemRevisions permanently deletes the revisions for the item with the given
+// id, along with any images they archived. It is used when an item is purged.
+func DeleteItemRevisions(itemId string) error {
+	revisions, err := ItemRevisions(itemId)
+	if err != nil {
+		return err
+	}
+	for _, revision := range revisions {
+		if err := QueueImageDeletion(revision.ImageArchivePath); err != nil {
+			return err
+		}
+		if err := zoom.Delete(revision); err != nil {
+			return err
+		}
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	_, err = conn.Do("DEL", itemRevisionCountKey(itemId))
+	return err
+}
@@ -0,0 +1,111 @@
+package jobs
+
+import (
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// QueueStats is the number of jobs waiting in a single queue.
+type QueueStats struct {
+	Name      string `json:"name"`
+	Queued    int    `json:"queued"`    // Jobs which are ready to run
+	Scheduled int    `json:"scheduled"` // Jobs which are delayed or waiting to be retried
+}
+
+// Stats is the number of jobs waiting in every queue, along with the number of
+// jobs in the dead-letter list.
+type Stats struct {
+	Queues []QueueStats `json:"queues"`
+	Dead   int          `json:"dead"`
+}
+
+// GetStats returns the current Stats for all queues.
+func GetStats() (*Stats, error) {
+	queues, err := Queues()
+	if err != nil {
+		return nil, err
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	stats := &Stats{Queues: []QueueStats{}}
+	for _, queue := range queues {
+		queued, err := redis.Int(conn.Do("LLEN", queueKey(queue)))
+		if err != nil {
+			return nil, err
+		}
+		scheduled, err := redis.Int(conn.Do("ZCARD", scheduledKey(queue)))
+		if err != nil {
+			return nil, err
+		}
+		stats.Queues = append(stats.Queues, QueueStats{Name: queue, Queued: queued, Scheduled: scheduled})
+	}
+	if stats.Dead, err = redis.Int(conn.Do("LLEN", deadKey)); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// DeadJobs returns the jobs in the dead-letter list, newest first.
+func DeadJobs() ([]*Job, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("LRANGE", deadKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*Job{}
+	for _, id := range ids {
+		job, err := findJob(conn, id)
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// RetryDead moves the job with the given id from the dead-letter list back onto
+// its queue with its attempts reset. It returns false if the job is not in the
+// dead-letter list.
+func RetryDead(id string) (bool, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	job, removed, err := removeDead(conn, id)
+	if err != nil || !removed {
+		return false, err
+	}
+	job.Attempts = 0
+	job.FailedAt = 0
+	job.RunAt = time.Now().UTC().Unix()
+	return true, schedule(conn, job)
+}
+
+// DeleteDead deletes the job with the given id from the dead-letter list, so that
+// it will never be run. It returns false if the job is not in the dead-letter list.
+func DeleteDead(id string) (bool, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	_, removed, err := removeDead(conn, id)
+	if err != nil || !removed {
+		return false, err
+	}
+	_, err = conn.Do("DEL", jobKey(id))
+	return true, err
+}
+
+// removeDead removes the job with the given id from the dead-letter list and
+// returns it. removed is false if the job was not in the list.
+func removeDead(conn redis.Conn, id string) (job *Job, removed bool, err error) {
+	count, err := redis.Int(conn.Do("LREM", deadKey, 1, id))
+	if err != nil || count == 0 {
+		return nil, false, err
+	}
+	job, err = findJob(conn, id)
+	if err != nil || job == nil {
+		return nil, false, err
+	}
+	return job, true, nil
+}
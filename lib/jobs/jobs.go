@@ -0,0 +1,343 @@
+// Package jobs is a small background job queue stored in redis. Jobs are added to
+// named queues with Enqueue, EnqueueIn, or EnqueueAt, and run by a Pool of workers
+// (or directly with RunQueued) using the Handler registered for their name. Jobs
+// which fail are retried with exponential backoff, and jobs which fail
+// MaxAttempts times are moved to a dead-letter list where they can be inspected
+// and retried by hand.
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"time"
+)
+
+// Keys for the redis data used by the queue
+const (
+	queuesKey = "jobs:queues" // A set of the names of every queue that has been used
+	deadKey   = "jobs:dead"   // Ids of jobs which failed MaxAttempts times, newest first
+)
+
+// jobKey is where the job with the given id is stored as JSON until it succeeds.
+func jobKey(id string) string {
+	return "job:" + id
+}
+
+// queueKey is a list of the ids of jobs in the given queue which are ready to run.
+func queueKey(queue string) string {
+	return "jobs:queue:" + queue
+}
+
+// scheduledKey is a sorted set of the ids of jobs in the given queue which are
+// waiting to run, scored by when they are due. This includes jobs waiting to be
+// retried.
+func scheduledKey(queue string) string {
+	return "jobs:scheduled:" + queue
+}
+
+// DefaultMaxAttempts is the number of times a job is attempted before it is moved
+// to the dead-letter list, unless the job sets MaxAttempts itself.
+var DefaultMaxAttempts = 5
+
+// RetryBackoff is how long to wait before retrying a job the first time. It doubles
+// after each failed attempt.
+var RetryBackoff = 15 * time.Second
+
+// Job is a unit of work in a queue.
+type Job struct {
+	Id          string          `json:"id"`
+	Queue       string          `json:"queue"`
+	Name        string          `json:"name"` // The name of the Handler which runs the job
+	Args        json.RawMessage `json:"args"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"maxAttempts"`
+	LastError   string          `json:"lastError,omitempty"`
+	CreatedAt   int64           `json:"createdAt"`
+	RunAt       int64           `json:"runAt"`
+	FailedAt    int64           `json:"failedAt,omitempty"`
+}
+
+// ScanArgs unmarshals the arguments the job was enqueued with into v.
+func (j *Job) ScanArgs(v interface{}) error {
+	return json.Unmarshal(j.Args, v)
+}
+
+// Handler runs a job. If it returns an error (or panics), the job is retried.
+type Handler func(job *Job) error
+
+var (
+	handlers   = map[string]Handler{}
+	handlersMu sync.RWMutex
+)
+
+// Register sets the handler for jobs with the given name. It should be called from
+// an init function in the package which enqueues the jobs, so that the handler is
+// registered in every process which might run them.
+func Register(name string, handler Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[name] = handler
+}
+
+func getHandler(name string) (Handler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	handler, found := handlers[name]
+	return handler, found
+}
+
+// moveDueJobsScript atomically moves every job id in the scheduled set (KEYS[1])
+// which is due by ARGV[1] onto the queue (KEYS[2]).
+var moveDueJobsScript = redis.NewScript(2, `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+for _, id in ipairs(due) do
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('LPUSH', KEYS[2], id)
+end
+return #due
+`)
+
+// Enqueue adds a job to queue which will be run as soon as possible by the handler
+// registered for name. args must be encodable as JSON.
+func Enqueue(queue, name string, args interface{}) (*Job, error) {
+	return EnqueueAt(queue, name, args, time.Now())
+}
+
+// EnqueueIn is like Enqueue but the job will not be run until delay has passed.
+func EnqueueIn(queue, name string, args interface{}, delay time.Duration) (*Job, error) {
+	return EnqueueAt(queue, name, args, time.Now().Add(delay))
+}
+
+// EnqueueAt is like Enqueue but the job will not be run until runAt.
+func EnqueueAt(queue, name string, args interface{}, runAt time.Time) (*Job, error) {
+	encodedArgs, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newId()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{
+		Id:          id,
+		Queue:       queue,
+		Name:        name,
+		Args:        encodedArgs,
+		MaxAttempts: DefaultMaxAttempts,
+		CreatedAt:   time.Now().UTC().Unix(),
+		RunAt:       runAt.UTC().Unix(),
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	if err := schedule(conn, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// newId returns a new random id for a job or owner.
+func newId() (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// schedule saves job and adds it to its queue if it is due, or to the scheduled
+// set for its queue if not.
+func schedule(conn redis.Conn, job *Job) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	conn.Send("MULTI")
+	sendSchedule(conn, job, encoded)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// sendSchedule sends the commands for schedule with the already encoded job, so
+// that they can be part of a larger transaction.
+func sendSchedule(conn redis.Conn, job *Job, encoded []byte) {
+	conn.Send("SET", jobKey(job.Id), encoded)
+	conn.Send("SADD", queuesKey, job.Queue)
+	if job.RunAt <= time.Now().UTC().Unix() {
+		conn.Send("LPUSH", queueKey(job.Queue), job.Id)
+	} else {
+		conn.Send("ZADD", scheduledKey(job.Queue), job.RunAt, job.Id)
+	}
+}
+
+// Queues returns the names of every queue that has had a job added to it.
+func Queues() ([]string, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", queuesKey))
+}
+
+// RunQueued runs every job in the given queues (or all queues if none are given)
+// which is due, one at a time, and returns the number of jobs which succeeded.
+// Jobs which fail are retried later, so an error is only returned if there was a
+// problem with the queue itself. It is mostly useful for tests, since the server
+// runs jobs with a Pool.
+func RunQueued(queues ...string) (succeeded int, err error) {
+	if len(queues) == 0 {
+		if queues, err = Queues(); err != nil {
+			return 0, err
+		}
+	}
+	if err := moveDueJobs(queues); err != nil {
+		return 0, err
+	}
+	o, err := startOwner(1)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if stopErr := o.stopOwner(); err == nil {
+			err = stopErr
+		}
+	}()
+	for _, queue := range queues {
+		for {
+			found, ok, err := runNext(queue, o.workers[0])
+			if err != nil {
+				return succeeded, err
+			}
+			if !found {
+				break
+			}
+			if ok {
+				succeeded++
+			}
+		}
+	}
+	return succeeded, nil
+}
+
+// moveDueJobs moves any scheduled jobs in the given queues which are due onto
+// their queue.
+func moveDueJobs(queues []string) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	now := time.Now().UTC().Unix()
+	for _, queue := range queues {
+		if _, err := moveDueJobsScript.Do(conn, scheduledKey(queue), queueKey(queue), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runNext takes the next job off queue and runs it with the worker with the given
+// id. found is false if the queue was empty, and ok is true if the job succeeded. No
+// connection is held while the job runs, since handlers can take a long time (e.g.
+// uploading to S3) and may need connections of their own.
+func runNext(queue string, workerId string) (found bool, ok bool, err error) {
+	job, found, err := popJob(queue, workerId)
+	if err != nil || job == nil {
+		return found, false, err
+	}
+	job.Attempts++
+	jobErr := run(job)
+	conn := zoom.GetConn()
+	defer conn.Close()
+	if jobErr != nil {
+		return true, false, fail(conn, job, jobErr, workerId)
+	}
+	conn.Send("MULTI")
+	conn.Send("DEL", jobKey(job.Id))
+	conn.Send("LREM", processingKey(workerId), 1, job.Id)
+	_, err = conn.Do("EXEC")
+	return true, true, err
+}
+
+// popJob moves the next job off queue and onto the processing list for the worker
+// with the given id. found is false if the queue was empty. The job is nil if it was
+// deleted while it was waiting, in which case it is not left in the processing list.
+func popJob(queue string, workerId string) (job *Job, found bool, err error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	id, err := redis.String(conn.Do("RPOPLPUSH", queueKey(queue), processingKey(workerId)))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if job, err = findJob(conn, id); err != nil || job != nil {
+		return job, true, err
+	}
+	_, err = conn.Do("LREM", processingKey(workerId), 1, id)
+	return nil, true, err
+}
+
+// run calls the handler for job, converting a panic into an error so that one bad
+// job can't stop a worker.
+func run(job *Job) (err error) {
+	handler, found := getHandler(job.Name)
+	if !found {
+		return fmt.Errorf("no handler is registered for jobs named %s", job.Name)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(job)
+}
+
+// fail records jobErr on job and schedules it to be retried, or moves it to the
+// dead-letter list if it has already been attempted MaxAttempts times. Either way
+// the job is removed from the processing list for the worker with the given id.
+func fail(conn redis.Conn, job *Job, jobErr error, workerId string) error {
+	job.LastError = jobErr.Error()
+	dead := job.Attempts >= job.MaxAttempts
+	if dead {
+		job.FailedAt = time.Now().UTC().Unix()
+	} else {
+		backoff := RetryBackoff * time.Duration(1<<uint(job.Attempts-1))
+		job.RunAt = time.Now().Add(backoff).UTC().Unix()
+	}
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	conn.Send("MULTI")
+	if dead {
+		conn.Send("SET", jobKey(job.Id), encoded)
+		conn.Send("LPUSH", deadKey, job.Id)
+	} else {
+		sendSchedule(conn, job, encoded)
+	}
+	conn.Send("LREM", processingKey(workerId), 1, job.Id)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// Find returns the job with the given id, or nil if there is no such job. Jobs are
+// deleted once they succeed.
+func Find(id string) (*Job, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	return findJob(conn, id)
+}
+
+func findJob(conn redis.Conn, id string) (*Job, error) {
+	encoded, err := redis.Bytes(conn.Do("GET", jobKey(id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(encoded, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
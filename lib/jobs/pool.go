@@ -0,0 +1,112 @@
+package jobs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pool is a group of workers which run jobs in the background.
+type Pool struct {
+	// Queues are the queues the pool takes jobs from, in order of priority. If
+	// empty, the pool takes jobs from every queue.
+	Queues []string
+	// Concurrency is the number of jobs which can run at the same time.
+	Concurrency int
+	// PollInterval is how long an idle worker waits before checking for jobs again.
+	PollInterval time.Duration
+
+	stop  chan struct{}
+	wg    sync.WaitGroup
+	owner *owner
+}
+
+// NewPool returns a pool with the given concurrency and poll interval which takes
+// jobs from queues, or from every queue if none are given. Call Start to start it.
+func NewPool(concurrency int, pollInterval time.Duration, queues ...string) *Pool {
+	return &Pool{
+		Queues:       queues,
+		Concurrency:  concurrency,
+		PollInterval: pollInterval,
+	}
+}
+
+// Start first requeues any jobs which were left running when a pool stopped
+// unexpectedly (see RequeueStaleJobs), and then starts the workers in the
+// background. It returns an error if the workers could not be registered.
+func (p *Pool) Start() error {
+	if requeued, err := RequeueStaleJobs(); err != nil {
+		fmt.Printf("[jobs] Error requeueing stale jobs: %s\n", err)
+	} else if requeued > 0 {
+		fmt.Printf("[jobs] Requeued %d jobs which were running when the server stopped\n", requeued)
+	}
+	o, err := startOwner(p.Concurrency)
+	if err != nil {
+		return err
+	}
+	p.owner = o
+	p.stop = make(chan struct{})
+	for _, workerId := range o.workers {
+		p.wg.Add(1)
+		go p.work(workerId)
+	}
+	return nil
+}
+
+// Stop stops the workers from taking any new jobs and waits for the jobs they are
+// running to finish. Jobs which are still queued are left for the next time a pool
+// is started.
+func (p *Pool) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+	if err := p.owner.stopOwner(); err != nil {
+		fmt.Printf("[jobs] Error unregistering workers: %s\n", err)
+	}
+}
+
+// work runs jobs with the worker with the given id until the pool is stopped,
+// waiting PollInterval whenever there are no jobs to run.
+func (p *Pool) work(workerId string) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		ran, err := p.runNext(workerId)
+		if err != nil {
+			fmt.Printf("[jobs] Error running jobs: %s\n", err)
+		}
+		if ran && err == nil {
+			continue
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(p.PollInterval):
+		}
+	}
+}
+
+// runNext runs the next job from the highest priority queue which has one with the
+// worker with the given id. It returns false if there were no jobs to run.
+func (p *Pool) runNext(workerId string) (bool, error) {
+	queues := p.Queues
+	if len(queues) == 0 {
+		var err error
+		if queues, err = Queues(); err != nil {
+			return false, err
+		}
+	}
+	if err := moveDueJobs(queues); err != nil {
+		return false, err
+	}
+	for _, queue := range queues {
+		found, _, err := runNext(queue, workerId)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,186 @@
+package jobs
+
+import (
+	"fmt"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"time"
+)
+
+// Each worker which runs jobs (one per goroutine in a Pool, or one for each call to
+// RunQueued) moves the id of each job it takes off a queue onto its own processing
+// list, and only removes it once the job has succeeded or been scheduled for a
+// retry. If the server stops while jobs are running (e.g. because it crashed), their
+// ids are left in the processing list, and RequeueStaleJobs puts them back on their
+// queues. Workers belong to an owner (a Pool or a call to RunQueued), which keeps its
+// alive key from expiring while it is running, so that the jobs of workers which are
+// still running are never requeued.
+
+// workersKey is a set of the ids of every worker which may have jobs in its
+// processing list.
+const workersKey = "jobs:workers"
+
+// How often a running owner refreshes its alive key, and how long the key lasts if
+// it is not refreshed.
+const (
+	heartbeatInterval = 10 * time.Second
+	heartbeatTTL      = 30 * time.Second
+)
+
+// processingKey is a list of the ids of the jobs the worker with the given id has
+// taken off their queues but not finished.
+func processingKey(workerId string) string {
+	return "jobs:processing:" + workerId
+}
+
+// aliveKey exists while the owner with the given id is running.
+func aliveKey(ownerId string) string {
+	return "jobs:alive:" + ownerId
+}
+
+// workerId returns the id of the nth worker of the owner with the given id.
+func workerId(ownerId string, n int) string {
+	return fmt.Sprintf("%s:%d", ownerId, n)
+}
+
+// ownerOf returns the id of the owner of the worker with the given id.
+func ownerOf(workerId string) string {
+	return strings.SplitN(workerId, ":", 2)[0]
+}
+
+// requeueScript atomically moves the job id ARGV[1] from the processing list
+// (KEYS[1]) back to the end of the queue (KEYS[2]) that is run next. It does nothing
+// if the id is no longer in the processing list, so that a job is never requeued
+// twice.
+var requeueScript = redis.NewScript(2, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 then
+	redis.call('RPUSH', KEYS[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// unregisterScript removes the worker ARGV[1] from the set of workers (KEYS[1])
+// unless its processing list (KEYS[2]) still has jobs in it.
+var unregisterScript = redis.NewScript(2, `
+if redis.call('LLEN', KEYS[2]) == 0 then
+	redis.call('SREM', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// owner is a Pool or a call to RunQueued, which runs jobs with one or more workers.
+type owner struct {
+	id      string
+	workers []string
+	stop    chan struct{}
+}
+
+// startOwner registers a new owner with the given number of workers and keeps it
+// alive until stopOwner is called.
+func startOwner(workers int) (*owner, error) {
+	id, err := newId()
+	if err != nil {
+		return nil, err
+	}
+	o := &owner{id: id, stop: make(chan struct{})}
+	for i := 0; i < workers; i++ {
+		o.workers = append(o.workers, workerId(id, i))
+	}
+	if err := o.heartbeat(); err != nil {
+		return nil, err
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	if _, err := conn.Do("SADD", redis.Args{workersKey}.AddFlat(o.workers)...); err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			select {
+			case <-o.stop:
+				return
+			case <-time.After(heartbeatInterval):
+				if err := o.heartbeat(); err != nil {
+					fmt.Printf("[jobs] Error refreshing workers: %s\n", err)
+				}
+			}
+		}
+	}()
+	return o, nil
+}
+
+// heartbeat sets the alive key for the owner, which expires after heartbeatTTL.
+func (o *owner) heartbeat() error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	_, err := conn.Do("SET", aliveKey(o.id), time.Now().UTC().Unix(), "PX", int64(heartbeatTTL/time.Millisecond))
+	return err
+}
+
+// stopOwner stops keeping the owner alive and unregisters any of its workers which
+// finished every job they took. It should only be called once the workers have
+// stopped.
+func (o *owner) stopOwner() error {
+	close(o.stop)
+	conn := zoom.GetConn()
+	defer conn.Close()
+	if _, err := conn.Do("DEL", aliveKey(o.id)); err != nil {
+		return err
+	}
+	for _, worker := range o.workers {
+		if _, err := unregisterScript.Do(conn, workersKey, processingKey(worker), worker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequeueStaleJobs puts every job which was taken by a worker whose owner is no
+// longer running (e.g. because the server crashed while running it) back on its
+// queue, where it will be the next job to run. It returns the number of jobs which
+// were requeued. It is called whenever a Pool starts.
+func RequeueStaleJobs() (int, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	workers, err := redis.Strings(conn.Do("SMEMBERS", workersKey))
+	if err != nil {
+		return 0, err
+	}
+	requeued := 0
+	for _, worker := range workers {
+		alive, err := redis.Bool(conn.Do("EXISTS", aliveKey(ownerOf(worker))))
+		if err != nil {
+			return requeued, err
+		} else if alive {
+			continue
+		}
+		ids, err := redis.Strings(conn.Do("LRANGE", processingKey(worker), 0, -1))
+		if err != nil {
+			return requeued, err
+		}
+		for _, id := range ids {
+			job, err := findJob(conn, id)
+			if err != nil {
+				return requeued, err
+			}
+			if job == nil {
+				// The job was deleted, so there is nothing to run
+				if _, err := conn.Do("LREM", processingKey(worker), 1, id); err != nil {
+					return requeued, err
+				}
+				continue
+			}
+			moved, err := redis.Int(requeueScript.Do(conn, processingKey(worker), queueKey(job.Queue), id))
+			if err != nil {
+				return requeued, err
+			}
+			requeued += moved
+		}
+		if _, err := unregisterScript.Do(conn, workersKey, processingKey(worker), worker); err != nil {
+			return requeued, err
+		}
+	}
+	return requeued, nil
+}
@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// Lock is a lock acquired with AcquireLock.
+type Lock struct {
+	key   string
+	token string // Random, so that only the holder can release the lock
+}
+
+// releaseLockScript deletes the lock KEYS[1] only if it still holds the token
+// ARGV[1], so that a lock which expired and was acquired by someone else is never
+// released.
+var releaseLockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// AcquireLock attempts to acquire a lock identified by key, which will expire
+// automatically after ttl if it is not released. It returns the lock if it was
+// acquired, or nil if it is already held by someone else.
+func AcquireLock(key string, ttl time.Duration) (*Lock, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, err
+	}
+	lock := &Lock{key: "lock:" + key, token: hex.EncodeToString(tokenBytes)}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	reply, err := redis.String(conn.Do("SET", lock.key, lock.token, "NX", "PX", int64(ttl/time.Millisecond)))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if reply != "OK" {
+		return nil, nil
+	}
+	return lock, nil
+}
+
+// Release releases the lock, unless it has already expired.
+func (l *Lock) Release() error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	_, err := releaseLockScript.Do(conn, l.key, l.token)
+	return err
+}
@@ -0,0 +1,44 @@
+package mailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileTransport is a Transport which writes each message to a .eml file in Dir
+// instead of sending it. The files can be opened with most email clients, which
+// makes it easy to check what messages look like during development.
+type FileTransport struct {
+	Dir   string
+	mutex sync.Mutex
+	count int
+}
+
+// NewFileTransport creates and returns a new FileTransport which writes to dir.
+func NewFileTransport(dir string) *FileTransport {
+	return &FileTransport{
+		Dir: dir,
+	}
+}
+
+func (t *FileTransport) Send(msg *Message) error {
+	raw, err := Encode(msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(t.Dir, 0755); err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	t.count++
+	count := t.count
+	t.mutex.Unlock()
+	to := strings.NewReplacer("@", "_at_", "/", "_", " ", "_", "<", "", ">", "").Replace(msg.To)
+	filename := fmt.Sprintf("%s-%03d-%s.eml", time.Now().Format("20060102-150405"), count, to)
+	return ioutil.WriteFile(filepath.Join(t.Dir, filename), raw, 0644)
+}
@@ -0,0 +1,141 @@
+// Package mailer sends transactional email. Messages are rendered from templates
+// (see NewMessage) and delivered through a pluggable transport: SMTP in production, a
+// directory of .eml files in development, and an in-memory outbox in tests. Messages
+// should usually be sent with Enqueue, which delivers them in the background and
+// retries failures, so that a problem with email never fails the request that
+// triggered it.
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/albrow/5w4g-server/config"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Message is a single email. If Html is not empty, the message is sent as
+// multipart/alternative with both the text and html versions.
+type Message struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Subject string            `json:"subject"`
+	Text    string            `json:"text"`
+	Html    string            `json:"html,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"` // Any extra headers, e.g. List-Unsubscribe
+}
+
+// Transport delivers messages.
+type Transport interface {
+	Send(msg *Message) error
+}
+
+var (
+	transport     Transport
+	transportOnce = sync.Once{}
+)
+
+// CurrentTransport returns the transport for the current environment, as determined
+// by config.Mail.
+func CurrentTransport() Transport {
+	transportOnce.Do(func() {
+		switch config.Mail.Transport {
+		case "smtp":
+			transport = NewSMTPTransport(config.Mail.SMTPHost, config.Mail.SMTPPort, config.Mail.SMTPUsername, config.Mail.SMTPPassword)
+		case "file":
+			transport = NewFileTransport(config.Mail.OutboxDir)
+		case "outbox":
+			transport = NewOutboxTransport()
+		default:
+			panic(fmt.Sprintf("Unknown mail transport: %s", config.Mail.Transport))
+		}
+	})
+	return transport
+}
+
+// Send sends msg immediately using the current transport. If msg.From is empty,
+// config.Mail.From is used. Most code should use Enqueue instead.
+func Send(msg *Message) error {
+	if msg.From == "" {
+		msg.From = config.Mail.From
+	}
+	return CurrentTransport().Send(msg)
+}
+
+// Encode returns the raw bytes for msg, including headers, as they would be sent
+// over SMTP.
+func Encode(msg *Message) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	headers := map[string]string{
+		"From":         msg.From,
+		"To":           msg.To,
+		"Subject":      mime.QEncoding.Encode("utf-8", msg.Subject),
+		"Date":         time.Now().Format(time.RFC1123Z),
+		"MIME-Version": "1.0",
+	}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	var writer *multipart.Writer
+	if msg.Html == "" {
+		headers["Content-Type"] = `text/plain; charset="utf-8"`
+		headers["Content-Transfer-Encoding"] = "quoted-printable"
+	} else {
+		writer = multipart.NewWriter(buf)
+		headers["Content-Type"] = fmt.Sprintf(`multipart/alternative; boundary="%s"`, writer.Boundary())
+	}
+
+	// Sort the headers so the output is deterministic
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	header := &bytes.Buffer{}
+	for _, key := range keys {
+		fmt.Fprintf(header, "%s: %s\r\n", key, headers[key])
+	}
+	header.WriteString("\r\n")
+
+	if writer == nil {
+		if err := writeQuotedPrintable(buf, msg.Text); err != nil {
+			return nil, err
+		}
+		return append(header.Bytes(), buf.Bytes()...), nil
+	}
+	for _, part := range []struct{ contentType, body string }{
+		{`text/plain; charset="utf-8"`, msg.Text},
+		{`text/html; charset="utf-8"`, msg.Html},
+	} {
+		partWriter, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(partWriter, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return append(header.Bytes(), buf.Bytes()...), nil
+}
+
+// writeQuotedPrintable writes body to w using the quoted-printable encoding, which
+// keeps lines short enough for SMTP.
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
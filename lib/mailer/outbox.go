@@ -0,0 +1,49 @@
+package mailer
+
+import (
+	"sync"
+)
+
+// OutboxTransport is a Transport which keeps every message in memory instead of
+// sending it, so that messages can be inspected in development and tests.
+type OutboxTransport struct {
+	mutex    sync.Mutex
+	messages []*Message
+}
+
+// NewOutboxTransport creates and returns a new, empty OutboxTransport.
+func NewOutboxTransport() *OutboxTransport {
+	return &OutboxTransport{}
+}
+
+func (t *OutboxTransport) Send(msg *Message) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.messages = append(t.messages, msg)
+	return nil
+}
+
+// Messages returns all the messages that have been sent to the outbox, oldest first.
+func (t *OutboxTransport) Messages() []*Message {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]*Message{}, t.messages...)
+}
+
+// MessagesTo returns all the messages that have been sent to the given address.
+func (t *OutboxTransport) MessagesTo(to string) []*Message {
+	result := []*Message{}
+	for _, msg := range t.Messages() {
+		if msg.To == to {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// Clear removes all the messages from the outbox.
+func (t *OutboxTransport) Clear() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.messages = nil
+}
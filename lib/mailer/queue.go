@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/lib/jobs"
+)
+
+// Queue is the job queue used to send messages in the background.
+const Queue = "mail"
+
+// sendJob is the name of the job which sends a single message.
+const sendJob = "mail.send"
+
+func init() {
+	jobs.Register(sendJob, func(job *jobs.Job) error {
+		msg := &Message{}
+		if err := job.ScanArgs(msg); err != nil {
+			return err
+		}
+		return Send(msg)
+	})
+}
+
+// Enqueue adds a job to send msg in the background. If msg.From is empty,
+// config.Mail.From is used. Messages which fail are retried like any other job,
+// and messages which still can't be sent end up in the dead-letter list for jobs.
+func Enqueue(msg *Message) error {
+	if msg.From == "" {
+		msg.From = config.Mail.From
+	}
+	_, err := jobs.Enqueue(Queue, sendJob, msg)
+	return err
+}
+
+// DeliverQueued sends every queued message which is due and returns the number of
+// messages that were sent. It is mostly useful for tests, since the server sends
+// messages with its job pool.
+func DeliverQueued() (int, error) {
+	return jobs.RunQueued(Queue)
+}
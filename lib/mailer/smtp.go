@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"fmt"
+	"net/mail"
+	"net/smtp"
+)
+
+// SMTPTransport sends messages through an SMTP server using PLAIN authentication.
+type SMTPTransport struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+}
+
+// NewSMTPTransport creates and returns a new SMTPTransport for the given server.
+func NewSMTPTransport(host, port, username, password string) *SMTPTransport {
+	return &SMTPTransport{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+	}
+}
+
+func (t *SMTPTransport) Send(msg *Message) error {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return fmt.Errorf("mailer: invalid from address %q: %s", msg.From, err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("mailer: invalid to address %q: %s", msg.To, err)
+	}
+	raw, err := Encode(msg)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if t.Username != "" {
+		auth = smtp.PlainAuth("", t.Username, t.Password, t.Host)
+	}
+	return smtp.SendMail(t.Host+":"+t.Port, auth, from.Address, []string{to.Address}, raw)
+}
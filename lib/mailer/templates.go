@@ -0,0 +1,98 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/albrow/5w4g-server/config"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"sync"
+	texttemplate "text/template"
+)
+
+// TemplatesDir is the directory which contains the templates for each type of
+// message. For a message type called name, name.txt is a text/template which must
+// define a "subject" template along with the text body, and name.html is an optional
+// html/template which defines a "content" template. The content is rendered inside
+// of layout.html, which is shared by all messages.
+var TemplatesDir = filepath.Join(config.AppRoot, "emails")
+
+// templateFuncs are available in all templates
+var templateFuncs = map[string]interface{}{
+	"money": func(amount float64) string {
+		return fmt.Sprintf("$%.2f", amount)
+	},
+}
+
+// messageTemplates holds the parsed templates for a single type of message
+type messageTemplates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template // nil if the message has no html version
+}
+
+var (
+	templateCache = map[string]*messageTemplates{}
+	templateMutex = sync.Mutex{}
+)
+
+// NewMessage renders the templates for the given type of message using data and
+// returns a message addressed to to, which can then be sent with Enqueue.
+func NewMessage(name string, to string, data interface{}) (*Message, error) {
+	tmpls, err := getTemplates(name)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{To: to}
+	subject := &bytes.Buffer{}
+	if err := tmpls.text.ExecuteTemplate(subject, "subject", data); err != nil {
+		return nil, err
+	}
+	msg.Subject = string(bytes.TrimSpace(subject.Bytes()))
+	text := &bytes.Buffer{}
+	if err := tmpls.text.Execute(text, data); err != nil {
+		return nil, err
+	}
+	msg.Text = string(bytes.TrimSpace(text.Bytes())) + "\n"
+	if tmpls.html != nil {
+		html := &bytes.Buffer{}
+		if err := tmpls.html.ExecuteTemplate(html, "layout.html", data); err != nil {
+			return nil, err
+		}
+		msg.Html = html.String()
+	}
+	return msg, nil
+}
+
+// getTemplates returns the parsed templates for the given type of message, parsing
+// them the first time they are needed.
+func getTemplates(name string) (*messageTemplates, error) {
+	templateMutex.Lock()
+	defer templateMutex.Unlock()
+	if tmpls, found := templateCache[name]; found {
+		return tmpls, nil
+	}
+	tmpls := &messageTemplates{}
+	textFile := filepath.Join(TemplatesDir, name+".txt")
+	text, err := texttemplate.New(name + ".txt").Funcs(templateFuncs).ParseFiles(textFile)
+	if err != nil {
+		return nil, err
+	}
+	if text.Lookup("subject") == nil {
+		return nil, fmt.Errorf("mailer: %s does not define a subject template", textFile)
+	}
+	tmpls.text = text
+	htmlFile := filepath.Join(TemplatesDir, name+".html")
+	if _, err := os.Stat(htmlFile); err == nil {
+		layoutFile := filepath.Join(TemplatesDir, "layout.html")
+		html, err := htmltemplate.New("layout.html").Funcs(templateFuncs).ParseFiles(layoutFile, htmlFile)
+		if err != nil {
+			return nil, err
+		}
+		tmpls.html = html
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	templateCache[name] = tmpls
+	return tmpls, nil
+}
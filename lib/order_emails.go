@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/lib/mailer"
+	"github.com/albrow/5w4g-server/models"
+	"net/url"
+	"time"
+)
+
+// orderEmail is the data for the order email templates.
+type orderEmail struct {
+	Order     *models.Order
+	LookupUrl string
+	// Shipment is the latest shipment for the order, if there is one
+	Shipment *models.Shipment
+}
+
+// SendOrderEmail queues an email of the given type (one of models.OrderEmailTypes)
+// about order to the customer, and records it on the order. The order must already
+// have been saved so that it has an id, and it needs to be saved again afterwards
+// for the record to persist.
+func SendOrderEmail(order *models.Order, emailType string) error {
+	data := orderEmail{
+		Order:     order,
+		LookupUrl: OrderLookupUrl(order),
+	}
+	if len(order.Shipments) > 0 {
+		data.Shipment = &order.Shipments[len(order.Shipments)-1]
+	}
+	msg, err := mailer.NewMessage(emailType, order.Email, data)
+	if err != nil {
+		return err
+	}
+	if err := mailer.Enqueue(msg); err != nil {
+		return err
+	}
+	order.Emails = append(order.Emails, models.OrderEmail{
+		Type:    emailType,
+		To:      msg.To,
+		Subject: msg.Subject,
+		SentAt:  time.Now().UTC().Unix(),
+	})
+	return nil
+}
+
+// OrderLookupUrl returns the url on the storefront where the customer can see the
+// status of order without signing in.
+func OrderLookupUrl(order *models.Order) string {
+	query := url.Values{}
+	query.Set("token", sign("orderLookup", order.Id))
+	return config.StoreUrl + "/orders/" + order.Id + "?" + query.Encode()
+}
+
+// ValidOrderLookupToken returns true iff token is the token from the lookup url for
+// the order with the given id.
+func ValidOrderLookupToken(orderId string, token string) bool {
+	return validSignature("orderLookup", orderId, token)
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib/payments"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+)
+
+// ApplyPaymentIntent updates the payment fields of order to match intent. It does
+// not change order.AmountRefunded, which also includes amounts refunded before the
+// payment was captured (see IssueRefund).
+func ApplyPaymentIntent(order *models.Order, intent *payments.Intent) {
+	order.PaymentIntentId = intent.Id
+	order.PaymentStatus = intent.Status
+	order.AmountCaptured = payments.ToDollars(intent.Captured)
+}
+
+// ChangeOrderStatus changes the status of order and takes care of any side effects
+// of the change. When an order ships (in full or in part), its payment is captured. When an order is
+// cancelled, its payment authorization is voided. It returns an error if the status
+// cannot be changed (see Order.CanChangeStatusTo) or if there was a problem with the
+// payment gateway, in which case the status is not changed. It does not save the order.
+func ChangeOrderStatus(order *models.Order, status string) error {
+	if order.Status == status {
+		return nil
+	}
+	if !order.CanChangeStatusTo(status) {
+		return fmt.Errorf("Cannot change the status of an order from %s to %s.", order.Status, status)
+	}
+	if order.PaymentStatus == payments.StatusAuthorized {
+		gateway := payments.CurrentGateway()
+		var intent *payments.Intent
+		var err error
+		switch status {
+		case models.OrderStatusPartiallyShipped, models.OrderStatusShipped:
+			// Amounts refunded before the order shipped are not captured
+			intent, err = gateway.Capture(order.PaymentIntentId, payments.ToCents(order.RefundableAmount()))
+		case models.OrderStatusCancelled:
+			intent, err = gateway.Void(order.PaymentIntentId)
+		}
+		if err != nil {
+			return err
+		}
+		if intent != nil {
+			ApplyPaymentIntent(order, intent)
+		}
+	}
+	order.Status = status
+	return nil
+}
+
+// CancelOrder cancels order, which must not have shipped yet, and takes care of every
+// side effect of cancelling it (see ChangeOrderStatus and releaseCancelledOrder).
+// Anything which was not already refunded no longer counts as a sale in the
+// reports. It saves the order and its items. Callers should hold a lock on the order
+// so that a refund can't return the same stock at the same time.
+func CancelOrder(order *models.Order, adminUserId string) error {
+	if err := ChangeOrderStatus(order, models.OrderStatusCancelled); err != nil {
+		return err
+	}
+	if err := RecordRefundInReports(order, CalculateRefund(order, nil)); err != nil {
+		return err
+	}
+	if err := releaseCancelledOrder(order, adminUserId); err != nil {
+		return err
+	}
+	if err := zoom.MSave(zoom.Models(order.Items)); err != nil {
+		return err
+	}
+	return zoom.Save(order)
+}
+
+// releaseCancelledOrder puts everything in order which was not shipped or already
+// put back in stock back in stock, records it in the stock ledger as a return, and
+// releases the promotions the order used, since none of them were really used. It is
+// called whenever an order is cancelled, either directly (see CancelOrder) or by
+// refunding everything (see IssueRefund). It does not save the order items.
+func releaseCancelledOrder(order *models.Order, adminUserId string) error {
+	for _, orderItem := range order.Items {
+		quantity := orderItem.Quantity - orderItem.Shipped - orderItem.Restocked
+		if quantity <= 0 {
+			continue
+		}
+		if err := AdjustItemStock(&models.StockAdjustment{
+			ItemId:      orderItem.Item.Id,
+			Delta:       quantity,
+			Reason:      models.StockReasonReturn,
+			Reference:   order.Id,
+			AdminUserId: adminUserId,
+		}); err != nil {
+			return err
+		}
+		orderItem.Restocked += quantity
+		checkStockAlertOrLog(orderItem.Item.Id)
+	}
+	return ReleaseOrderPromotions(order)
+}
+
+// OrderFilter limits the orders passed to EachOrder. Fields which are empty or 0
+// match every order.
+type OrderFilter struct {
+	Status string
+	Since  int64 // UTC unix time
+	Until  int64 // UTC unix time
+}
+
+// EachOrder calls fn for each order which matches filter, oldest first. Orders are
+// read from the database batchSize at a time, so that every order never has to be
+// held in memory at once. If fn returns an error, EachOrder stops and returns it.
+func EachOrder(filter OrderFilter, batchSize int, fn func(order *models.Order) error) error {
+	for offset := 0; ; offset += batchSize {
+		q := zoom.NewQuery("Order")
+		if filter.Status != "" {
+			q = q.Filter("Status =", filter.Status)
+		}
+		if filter.Since != 0 {
+			q = q.Filter("CreatedAt >=", filter.Since)
+		}
+		if filter.Until != 0 {
+			q = q.Filter("CreatedAt <=", filter.Until)
+		}
+		var orders []*models.Order
+		if err := q.Order("CreatedAt").Offset(uint(offset)).Limit(uint(batchSize)).Scan(&orders); err != nil {
+			return err
+		}
+		for _, order := range orders {
+			if err := fn(order); err != nil {
+				return err
+			}
+		}
+		if len(orders) < batchSize {
+			return nil
+		}
+	}
+}
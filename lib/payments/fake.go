@@ -0,0 +1,135 @@
+package payments
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Sources which cause the FakeGateway to decline a payment. They are the same as
+// the test tokens Stripe uses for declines, so the same client code can be used
+// against both gateways.
+const (
+	FakeSourceDeclined          = "tok_chargeDeclined"
+	FakeSourceInsufficientFunds = "tok_chargeDeclinedInsufficientFunds"
+)
+
+// FakeGateway is an in-memory Gateway which does not require network access. It
+// accepts any source except the FakeSource constants, which it declines. If Delay
+// is non-zero, every operation waits that long before returning, which can be used
+// to simulate a slow network.
+type FakeGateway struct {
+	Delay   time.Duration
+	mutex   sync.Mutex
+	intents map[string]*Intent
+	keys    map[string]string // Intent ids by the idempotency key they were authorized with
+	nextId  int
+}
+
+// NewFakeGateway creates and returns a new FakeGateway with the given delay.
+func NewFakeGateway(delay time.Duration) *FakeGateway {
+	return &FakeGateway{
+		Delay:   delay,
+		intents: map[string]*Intent{},
+		keys:    map[string]string{},
+	}
+}
+
+func (g *FakeGateway) Authorize(amount int64, source string, description string, idempotencyKey string) (*Intent, error) {
+	time.Sleep(g.Delay)
+	switch source {
+	case FakeSourceDeclined:
+		return nil, &DeclineError{Code: "card_declined", Message: "Your card was declined."}
+	case FakeSourceInsufficientFunds:
+		return nil, &DeclineError{Code: "insufficient_funds", Message: "Your card has insufficient funds."}
+	case "":
+		return nil, &DeclineError{Code: "missing_source", Message: "No payment method was provided."}
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if id, found := g.keys[idempotencyKey]; found && idempotencyKey != "" {
+		return copyIntent(g.intents[id]), nil
+	}
+	g.nextId++
+	intent := &Intent{
+		Id:     fmt.Sprintf("fake_pi_%d", g.nextId),
+		Status: StatusAuthorized,
+		Amount: amount,
+	}
+	g.intents[intent.Id] = intent
+	if idempotencyKey != "" {
+		g.keys[idempotencyKey] = intent.Id
+	}
+	return copyIntent(intent), nil
+}
+
+func (g *FakeGateway) Capture(intentId string, amount int64) (*Intent, error) {
+	time.Sleep(g.Delay)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	intent, err := g.findIntent(intentId)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status != StatusAuthorized {
+		return nil, fmt.Errorf("payments: cannot capture intent %s with status %s", intentId, intent.Status)
+	}
+	if amount > intent.Amount {
+		return nil, fmt.Errorf("payments: cannot capture %d for intent %s, which was only authorized for %d", amount, intentId, intent.Amount)
+	}
+	intent.Captured = amount
+	intent.Status = StatusCaptured
+	return copyIntent(intent), nil
+}
+
+func (g *FakeGateway) Refund(intentId string, amount int64) (*Intent, error) {
+	time.Sleep(g.Delay)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	intent, err := g.findIntent(intentId)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status != StatusCaptured && intent.Status != StatusPartiallyRefunded {
+		return nil, fmt.Errorf("payments: cannot refund intent %s with status %s", intentId, intent.Status)
+	}
+	if intent.Refunded+amount > intent.Captured {
+		return nil, fmt.Errorf("payments: cannot refund %d for intent %s, only %d is refundable", amount, intentId, intent.Captured-intent.Refunded)
+	}
+	intent.Refunded += amount
+	if intent.Refunded == intent.Captured {
+		intent.Status = StatusRefunded
+	} else {
+		intent.Status = StatusPartiallyRefunded
+	}
+	return copyIntent(intent), nil
+}
+
+func (g *FakeGateway) Void(intentId string) (*Intent, error) {
+	time.Sleep(g.Delay)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	intent, err := g.findIntent(intentId)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status != StatusAuthorized {
+		return nil, fmt.Errorf("payments: cannot void intent %s with status %s", intentId, intent.Status)
+	}
+	intent.Status = StatusVoided
+	return copyIntent(intent), nil
+}
+
+// findIntent returns the intent with the given id. The caller must hold g.mutex.
+func (g *FakeGateway) findIntent(intentId string) (*Intent, error) {
+	intent, found := g.intents[intentId]
+	if !found {
+		return nil, fmt.Errorf("payments: could not find intent with id = %s", intentId)
+	}
+	return intent, nil
+}
+
+func copyIntent(intent *Intent) *Intent {
+	c := *intent
+	return &c
+}
@@ -0,0 +1,88 @@
+// Package payments provides a common interface for payment gateways, along with
+// a Stripe-compatible gateway for production and an in-memory fake gateway for
+// development and testing.
+package payments
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/config"
+	"math"
+	"sync"
+)
+
+// The possible values for Intent.Status
+const (
+	StatusAuthorized        = "authorized"
+	StatusCaptured          = "captured"
+	StatusPartiallyRefunded = "partially_refunded"
+	StatusRefunded          = "refunded"
+	StatusVoided            = "voided"
+)
+
+// Intent is a payment for a single order. Amounts are in cents.
+type Intent struct {
+	Id       string
+	Status   string
+	Amount   int64 // The amount that was authorized
+	Captured int64
+	Refunded int64
+}
+
+// Gateway is a payment processor. All amounts are in cents.
+type Gateway interface {
+	// Authorize places a hold on amount using source, which is a token representing
+	// the customer's card (or other payment method) obtained by the client. Calls with
+	// the same idempotencyKey return the first intent instead of authorizing the payment
+	// again. If the payment is declined, it returns a *DeclineError.
+	Authorize(amount int64, source string, description string, idempotencyKey string) (*Intent, error)
+	// Capture collects amount (which must be no more than the authorized amount) from
+	// a previously authorized intent.
+	Capture(intentId string, amount int64) (*Intent, error)
+	// Refund returns amount (which must be no more than the amount captured and not
+	// already refunded) to the customer.
+	Refund(intentId string, amount int64) (*Intent, error)
+	// Void releases the hold for an intent which has been authorized but not captured.
+	Void(intentId string) (*Intent, error)
+}
+
+// DeclineError is returned when a payment is declined, e.g. because the card was
+// invalid or had insufficient funds. The message is safe to show to customers.
+type DeclineError struct {
+	Code    string
+	Message string
+}
+
+func (e *DeclineError) Error() string {
+	return e.Message
+}
+
+// ToCents converts a dollar amount to cents.
+func ToCents(dollars float64) int64 {
+	return int64(math.Floor(dollars*100 + 0.5))
+}
+
+// ToDollars converts an amount in cents to dollars.
+func ToDollars(cents int64) float64 {
+	return float64(cents) / 100
+}
+
+var (
+	gateway     Gateway
+	gatewayOnce = sync.Once{}
+)
+
+// CurrentGateway returns the gateway for the current environment, as determined
+// by config.Payments.
+func CurrentGateway() Gateway {
+	gatewayOnce.Do(func() {
+		switch config.Payments.Gateway {
+		case "stripe":
+			gateway = NewStripeGateway(config.Payments.StripeSecretKey, config.Payments.Currency)
+		case "fake":
+			gateway = NewFakeGateway(config.Payments.FakeDelay)
+		default:
+			panic(fmt.Sprintf("Unknown payment gateway: %s", config.Payments.Gateway))
+		}
+	})
+	return gateway
+}
@@ -0,0 +1,210 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StripeGateway is a Gateway which uses the Stripe PaymentIntents API. Payments
+// are authorized with manual capture, so that they can be captured later (e.g. when
+// the order ships).
+type StripeGateway struct {
+	SecretKey string
+	Currency  string
+	BaseUrl   string // Can be changed to point at a Stripe-compatible server
+	Client    *http.Client
+}
+
+// NewStripeGateway creates and returns a new StripeGateway which uses the given
+// secret key and currency (e.g. "usd").
+func NewStripeGateway(secretKey string, currency string) *StripeGateway {
+	return &StripeGateway{
+		SecretKey: secretKey,
+		Currency:  currency,
+		BaseUrl:   "https://api.stripe.com/v1",
+		Client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// stripePaymentIntent is the subset of the Stripe PaymentIntent object that we use
+type stripePaymentIntent struct {
+	Id             string `json:"id"`
+	Status         string `json:"status"`
+	Amount         int64  `json:"amount"`
+	AmountReceived int64  `json:"amount_received"`
+}
+
+type stripeRefund struct {
+	Id            string `json:"id"`
+	PaymentIntent string `json:"payment_intent"`
+}
+
+type stripeErrorResponse struct {
+	Error struct {
+		Type        string `json:"type"`
+		Code        string `json:"code"`
+		DeclineCode string `json:"decline_code"`
+		Message     string `json:"message"`
+	} `json:"error"`
+}
+
+func (g *StripeGateway) Authorize(amount int64, source string, description string, idempotencyKey string) (*Intent, error) {
+	params := url.Values{}
+	params.Set("amount", strconv.FormatInt(amount, 10))
+	params.Set("currency", g.Currency)
+	params.Set("payment_method", source)
+	params.Set("capture_method", "manual")
+	params.Set("confirm", "true")
+	params.Set("description", description)
+	pi := &stripePaymentIntent{}
+	if err := g.doIdempotent("POST", "/payment_intents", params, idempotencyKey, pi); err != nil {
+		return nil, err
+	}
+	if pi.Status != "requires_capture" {
+		// The payment was not authorized, e.g. because it needs 3D Secure (which we
+		// don't support) or the payment method failed. Cancel the intent so that it
+		// can't be completed later, and treat it as declined.
+		if pi.Id != "" {
+			g.Void(pi.Id)
+		}
+		return nil, &DeclineError{
+			Code:    pi.Status,
+			Message: "Your payment could not be authorized. Please try a different payment method.",
+		}
+	}
+	return pi.toIntent(), nil
+}
+
+func (g *StripeGateway) Capture(intentId string, amount int64) (*Intent, error) {
+	params := url.Values{}
+	params.Set("amount_to_capture", strconv.FormatInt(amount, 10))
+	pi := &stripePaymentIntent{}
+	if err := g.post("/payment_intents/"+intentId+"/capture", params, pi); err != nil {
+		return nil, err
+	}
+	return pi.toIntent(), nil
+}
+
+func (g *StripeGateway) Refund(intentId string, amount int64) (*Intent, error) {
+	params := url.Values{}
+	params.Set("payment_intent", intentId)
+	params.Set("amount", strconv.FormatInt(amount, 10))
+	if err := g.post("/refunds", params, &stripeRefund{}); err != nil {
+		return nil, err
+	}
+	return g.retrieve(intentId)
+}
+
+func (g *StripeGateway) Void(intentId string) (*Intent, error) {
+	pi := &stripePaymentIntent{}
+	if err := g.post("/payment_intents/"+intentId+"/cancel", url.Values{}, pi); err != nil {
+		return nil, err
+	}
+	return pi.toIntent(), nil
+}
+
+// retrieve gets the current state of an intent, including the total amount refunded.
+func (g *StripeGateway) retrieve(intentId string) (*Intent, error) {
+	pi := &stripePaymentIntent{}
+	if err := g.do("GET", "/payment_intents/"+intentId, nil, pi); err != nil {
+		return nil, err
+	}
+	intent := pi.toIntent()
+	var refunds struct {
+		Data []struct {
+			Amount int64 `json:"amount"`
+		} `json:"data"`
+	}
+	if err := g.do("GET", "/refunds?limit=100&payment_intent="+url.QueryEscape(intentId), nil, &refunds); err != nil {
+		return nil, err
+	}
+	for _, refund := range refunds.Data {
+		intent.Refunded += refund.Amount
+	}
+	if intent.Refunded > 0 {
+		if intent.Refunded >= intent.Captured {
+			intent.Status = StatusRefunded
+		} else {
+			intent.Status = StatusPartiallyRefunded
+		}
+	}
+	return intent, nil
+}
+
+func (g *StripeGateway) post(path string, params url.Values, v interface{}) error {
+	return g.do("POST", path, params, v)
+}
+
+// do sends a request to the Stripe API and unmarshals the response into v. Card
+// errors are converted to a *DeclineError.
+func (g *StripeGateway) do(method string, path string, params url.Values, v interface{}) error {
+	return g.doIdempotent(method, path, params, "", v)
+}
+
+// doIdempotent is like do but sends idempotencyKey (if it is not empty) in the
+// Idempotency-Key header, so that Stripe returns the result of the first request
+// with that key instead of repeating it.
+func (g *StripeGateway) doIdempotent(method string, path string, params url.Values, idempotencyKey string, v interface{}) error {
+	var body *strings.Reader
+	if params != nil {
+		body = strings.NewReader(params.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	req, err := http.NewRequest(method, g.BaseUrl+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(g.SecretKey, "")
+	if params != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	res, err := g.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		errRes := &stripeErrorResponse{}
+		if err := json.NewDecoder(res.Body).Decode(errRes); err != nil {
+			return fmt.Errorf("payments: stripe returned status %d", res.StatusCode)
+		}
+		if errRes.Error.Type == "card_error" {
+			code := errRes.Error.DeclineCode
+			if code == "" {
+				code = errRes.Error.Code
+			}
+			return &DeclineError{Code: code, Message: errRes.Error.Message}
+		}
+		return fmt.Errorf("payments: stripe returned status %d: %s", res.StatusCode, errRes.Error.Message)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// toIntent converts a Stripe PaymentIntent to an Intent
+func (pi *stripePaymentIntent) toIntent() *Intent {
+	intent := &Intent{
+		Id:       pi.Id,
+		Amount:   pi.Amount,
+		Captured: pi.AmountReceived,
+	}
+	switch pi.Status {
+	case "requires_capture":
+		intent.Status = StatusAuthorized
+	case "succeeded":
+		intent.Status = StatusCaptured
+	case "canceled":
+		intent.Status = StatusVoided
+	default:
+		intent.Status = pi.Status
+	}
+	return intent
+}
@@ -0,0 +1,306 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/go-data-parser"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// redeemPromotionScript atomically checks the usage counters for a promotion and
+// increments them if the limits have not been reached. KEYS[1] is the total uses
+// counter and KEYS[2] is the hash of uses per email. ARGV[1] is the usage limit,
+// ARGV[2] is the per-email limit (0 means unlimited for both), and ARGV[3] is the
+// email address. It returns 0 on success, 1 if the usage limit was reached, and 2
+// if the per-email limit was reached.
+var redeemPromotionScript = redis.NewScript(2, `
+local uses = tonumber(redis.call('GET', KEYS[1]) or '0')
+local emailUses = tonumber(redis.call('HGET', KEYS[2], ARGV[3]) or '0')
+if tonumber(ARGV[1]) > 0 and uses >= tonumber(ARGV[1]) then
+	return 1
+end
+if tonumber(ARGV[2]) > 0 and emailUses >= tonumber(ARGV[2]) then
+	return 2
+end
+redis.call('INCR', KEYS[1])
+redis.call('HINCRBY', KEYS[2], ARGV[3], 1)
+return 0
+`)
+
+func promotionUsesKey(promotionId string) string {
+	return "Promotion:" + promotionId + ":uses"
+}
+
+func promotionEmailUsesKey(promotionId string) string {
+	return "Promotion:" + promotionId + ":emailUses"
+}
+
+// LoadPromotionUses sets the Uses field for each promotion from its usage counter.
+func LoadPromotionUses(promotions ...*models.Promotion) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	for _, promotion := range promotions {
+		uses, err := redis.Int(conn.Do("GET", promotionUsesKey(promotion.Id)))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		promotion.Uses = uses
+	}
+	return nil
+}
+
+// DeletePromotionUses deletes the usage counters for a promotion. It should be called
+// when the promotion itself is deleted.
+func DeletePromotionUses(promotionId string) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	_, err := conn.Do("DEL", promotionUsesKey(promotionId), promotionEmailUsesKey(promotionId))
+	return err
+}
+
+// ApplyPromotions finds all the automatic promotions which are valid for order, along
+// with the promotion for code (if code is not empty), and applies the combination which
+// gives the biggest discount, recording the discount on each OrderItem and the promotions
+// on the order. Stackable promotions can be combined with each other, but a promotion
+// which is not stackable is only ever applied on its own. If code is invalid or cannot
+// be used for the order, a validation error is added to val. ApplyPromotions does not
+// change any usage counters (see RedeemPromotions), and does not update the totals
+// for the order. It returns the promotions that were applied.
+func ApplyPromotions(order *models.Order, code string, val *data.Validator) ([]*models.Promotion, error) {
+	now := time.Now().UTC().Unix()
+	subtotal := order.CalculateSubtotal()
+
+	// Find all the promotions which could apply to the order
+	var promotions []*models.Promotion
+	if err := zoom.NewQuery("Promotion").Scan(&promotions); err != nil {
+		return nil, err
+	}
+	candidates := []*models.Promotion{}
+	var codePromotion *models.Promotion
+	code = models.NormalizePromotionCode(code)
+	noDiscounts := make([]float64, len(order.Items))
+	for _, promotion := range promotions {
+		if promotion.IsAutomatic() {
+			if !promotion.IsActiveAt(now) || subtotal < promotion.MinSubtotal {
+				continue
+			}
+			if sumDiscounts(promotion.LineDiscounts(order, noDiscounts)) == 0 {
+				continue
+			}
+			if msg, err := checkPromotionLimits(promotion, order.Email); err != nil {
+				return nil, err
+			} else if msg != "" {
+				continue
+			}
+			candidates = append(candidates, promotion)
+		} else if code != "" && promotion.Code == code {
+			codePromotion = promotion
+		}
+	}
+
+	// Validate the code
+	if code != "" {
+		switch {
+		case codePromotion == nil:
+			val.AddError("code", fmt.Sprintf("%s is not a valid code.", code))
+		case !codePromotion.IsActiveAt(now):
+			val.AddError("code", fmt.Sprintf("%s is not currently valid.", code))
+		case subtotal < codePromotion.MinSubtotal:
+			msg := fmt.Sprintf("%s can only be used for orders of at least $%0.2f.", code, codePromotion.MinSubtotal)
+			val.AddError("code", msg)
+		case sumDiscounts(codePromotion.LineDiscounts(order, noDiscounts)) == 0:
+			val.AddError("code", fmt.Sprintf("%s does not apply to any of the items in this order.", code))
+		default:
+			if msg, err := checkPromotionLimits(codePromotion, order.Email); err != nil {
+				return nil, err
+			} else if msg != "" {
+				val.AddError("code", msg)
+			} else {
+				candidates = append(candidates, codePromotion)
+			}
+		}
+		if val.HasErrors() {
+			return nil, nil
+		}
+	}
+
+	// Consider all the stackable promotions together and each promotion that isn't
+	// stackable on its own, and choose whichever gives the biggest discount. In case
+	// of a tie, prefer the combination which uses the code the customer entered.
+	combinations := [][]*models.Promotion{}
+	stackable := []*models.Promotion{}
+	for _, promotion := range candidates {
+		if promotion.Stackable {
+			stackable = append(stackable, promotion)
+		} else {
+			combinations = append(combinations, []*models.Promotion{promotion})
+		}
+	}
+	combinations = append(combinations, stackable)
+	var best []*models.Promotion
+	var bestDiscounts [][]float64
+	bestTotal := -1.0
+	for _, combination := range combinations {
+		discounts := calculatePromotionDiscounts(order, combination)
+		total := 0.0
+		for _, d := range discounts {
+			total += sumDiscounts(d)
+		}
+		if total > bestTotal || (total == bestTotal && codePromotion != nil && promotionsContain(combination, codePromotion)) {
+			best, bestDiscounts, bestTotal = combination, discounts, total
+		}
+	}
+	if codePromotion != nil && !promotionsContain(best, codePromotion) {
+		val.AddError("code", fmt.Sprintf("%s cannot be combined with the other promotions which already apply to this order.", code))
+		return nil, nil
+	}
+
+	// Record the discounts on the order
+	order.Promotions = []models.AppliedPromotion{}
+	for _, orderItem := range order.Items {
+		orderItem.Discount = 0
+	}
+	for i, promotion := range best {
+		for j, orderItem := range order.Items {
+			orderItem.Discount = models.RoundToCents(orderItem.Discount + bestDiscounts[i][j])
+		}
+		order.Promotions = append(order.Promotions, models.AppliedPromotion{
+			PromotionId: promotion.Id,
+			Code:        promotion.Code,
+			Description: promotion.Description,
+			Amount:      models.RoundToCents(sumDiscounts(bestDiscounts[i])),
+		})
+	}
+	return best, nil
+}
+
+// calculatePromotionDiscounts applies each promotion in turn and returns the line
+// discounts given by each of them.
+func calculatePromotionDiscounts(order *models.Order, promotions []*models.Promotion) [][]float64 {
+	existing := make([]float64, len(order.Items))
+	result := make([][]float64, len(promotions))
+	for i, promotion := range promotions {
+		result[i] = promotion.LineDiscounts(order, existing)
+		for j, d := range result[i] {
+			existing[j] += d
+		}
+	}
+	return result
+}
+
+func sumDiscounts(discounts []float64) float64 {
+	total := 0.0
+	for _, d := range discounts {
+		total += d
+	}
+	return total
+}
+
+func promotionsContain(promotions []*models.Promotion, promotion *models.Promotion) bool {
+	for _, p := range promotions {
+		if p.Id == promotion.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPromotionLimits returns a message explaining why promotion cannot be used by
+// email if its usage limits have already been reached, or an empty string otherwise.
+// It is only a preliminary check which lets us return a friendly error early. The limits
+// are enforced atomically by RedeemPromotions.
+func checkPromotionLimits(promotion *models.Promotion, email string) (string, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	if promotion.UsageLimit > 0 {
+		uses, err := redis.Int(conn.Do("GET", promotionUsesKey(promotion.Id)))
+		if err != nil && err != redis.ErrNil {
+			return "", err
+		}
+		if uses >= promotion.UsageLimit {
+			return fmt.Sprintf("%s is no longer available.", promotionName(promotion)), nil
+		}
+	}
+	if promotion.PerEmailLimit > 0 {
+		uses, err := redis.Int(conn.Do("HGET", promotionEmailUsesKey(promotion.Id), email))
+		if err != nil && err != redis.ErrNil {
+			return "", err
+		}
+		if uses >= promotion.PerEmailLimit {
+			return fmt.Sprintf("%s has already been used the maximum number of times for %s.", promotionName(promotion), email), nil
+		}
+	}
+	return "", nil
+}
+
+// promotionName returns the name customers know promotion by for use in messages,
+// which is its code, or for automatic promotions, its description.
+func promotionName(promotion *models.Promotion) string {
+	if promotion.IsAutomatic() {
+		return fmt.Sprintf("The %s promotion", promotion.Description)
+	}
+	return promotion.Code
+}
+
+// RedeemPromotions atomically checks and increments the usage counters for each of
+// the promotions on behalf of email. If the limits for any of them have been reached,
+// the counters for the others are restored and the promotion that could not be redeemed
+// is returned. Otherwise the returned promotion is nil.
+func RedeemPromotions(promotions []*models.Promotion, email string) (*models.Promotion, error) {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	for i, promotion := range promotions {
+		result, err := redis.Int(redeemPromotionScript.Do(conn,
+			promotionUsesKey(promotion.Id),
+			promotionEmailUsesKey(promotion.Id),
+			promotion.UsageLimit,
+			promotion.PerEmailLimit,
+			email))
+		if err != nil {
+			return nil, err
+		}
+		if result != 0 {
+			if err := ReleasePromotions(promotions[:i], email); err != nil {
+				return nil, err
+			}
+			return promotion, nil
+		}
+	}
+	return nil, nil
+}
+
+// ReleasePromotions decrements the usage counters for each of the promotions on
+// behalf of email, undoing RedeemPromotions.
+func ReleasePromotions(promotions []*models.Promotion, email string) error {
+	ids := make([]string, len(promotions))
+	for i, promotion := range promotions {
+		ids[i] = promotion.Id
+	}
+	return releasePromotionIds(ids, email)
+}
+
+// ReleaseOrderPromotions decrements the usage counters for each of the promotions
+// applied to order, so that a cancelled order no longer counts towards their limits.
+func ReleaseOrderPromotions(order *models.Order) error {
+	ids := make([]string, len(order.Promotions))
+	for i, applied := range order.Promotions {
+		ids[i] = applied.PromotionId
+	}
+	return releasePromotionIds(ids, order.Email)
+}
+
+func releasePromotionIds(ids []string, email string) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	for _, id := range ids {
+		if _, err := conn.Do("DECR", promotionUsesKey(id)); err != nil {
+			return err
+		}
+		if _, err := conn.Do("HINCRBY", promotionEmailUsesKey(id), email, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
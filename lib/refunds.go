@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"github.com/albrow/5w4g-server/lib/payments"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"time"
+)
+
+// RefundLineRequest is the quantity of an item in an order that should be refunded.
+type RefundLineRequest struct {
+	ItemId   string `json:"itemId"`
+	Quantity int    `json:"quantity"`
+}
+
+// CalculateRefund returns an unsaved Refund for the given lines of order. If lines
+// is empty, the refund is for everything in the order that has not already been
+// refunded, including shipping. Otherwise each line is refunded at the price the
+// customer paid per unit (including discounts and tax). CalculateRefund assumes the
+// lines have already been validated against the order.
+func CalculateRefund(order *models.Order, lines []RefundLineRequest) *models.Refund {
+	refund := &models.Refund{
+		OrderId: order.Id,
+		Lines:   []models.RefundLine{},
+	}
+	if len(lines) == 0 {
+		for _, orderItem := range order.Items {
+			if quantity := orderItem.RefundableQuantity(); quantity > 0 {
+				refund.Lines = append(refund.Lines, models.RefundLine{
+					ItemId:   orderItem.Item.Id,
+					Quantity: quantity,
+					Amount:   models.RoundToCents(orderItem.UnitCharge() * float64(quantity)),
+				})
+			}
+		}
+		refund.Amount = order.RefundableAmount()
+		return refund
+	}
+	for _, line := range lines {
+		orderItem := FindOrderItem(order, line.ItemId)
+		amount := models.RoundToCents(orderItem.UnitCharge() * float64(line.Quantity))
+		refund.Lines = append(refund.Lines, models.RefundLine{
+			ItemId:   line.ItemId,
+			Quantity: line.Quantity,
+			Amount:   amount,
+		})
+		refund.Amount = models.RoundToCents(refund.Amount + amount)
+	}
+	return refund
+}
+
+// FindOrderItem returns the OrderItem in order for the item with the given id, or
+// nil if the item is not part of the order.
+func FindOrderItem(order *models.Order, itemId string) *models.OrderItem {
+	for _, orderItem := range order.Items {
+		if orderItem.Item.Id == itemId {
+			return orderItem
+		}
+	}
+	return nil
+}
+
+// IssueRefund returns refund.Amount to the customer and then saves the refund along
+// with the changes to the order. If the payment for the order has been captured, the
+// amount is refunded through the payment gateway. If it has only been authorized, the
+// amount is subtracted from what will be captured when the order ships, and if
+// nothing is left the authorization is voided and the order is cancelled, which puts
+// everything that was not shipped back in stock and releases its promotions (see
+// releaseCancelledOrder). Otherwise, if restock is true, the refunded quantities are
+// added back to the stock for each item, and stock alerts are checked for them.
+// IssueRefund assumes refund.Amount is no more than order.RefundableAmount(). Callers
+// should hold a lock on the order to prevent concurrent refunds.
+func IssueRefund(order *models.Order, refund *models.Refund, restock bool) error {
+	fullyRefunded := refund.Amount >= order.RefundableAmount()
+	gateway := payments.CurrentGateway()
+	switch order.PaymentStatus {
+	case payments.StatusAuthorized:
+		if fullyRefunded {
+			intent, err := gateway.Void(order.PaymentIntentId)
+			if err != nil {
+				return err
+			}
+			ApplyPaymentIntent(order, intent)
+		}
+	case payments.StatusCaptured, payments.StatusPartiallyRefunded:
+		intent, err := gateway.Refund(order.PaymentIntentId, payments.ToCents(refund.Amount))
+		if err != nil {
+			return err
+		}
+		ApplyPaymentIntent(order, intent)
+	}
+
+	// Update the order
+	order.AmountRefunded = models.RoundToCents(order.AmountRefunded + refund.Amount)
+	for _, line := range refund.Lines {
+		FindOrderItem(order, line.ItemId).Refunded += line.Quantity
+	}
+	cancelled := false
+	if fullyRefunded {
+		if order.Status == models.OrderStatusPending {
+			cancelled = true
+			order.Status = models.OrderStatusCancelled
+		} else {
+			order.Status = models.OrderStatusRefunded
+		}
+	} else if order.Status == models.OrderStatusPartiallyShipped {
+		// Refunding the items which were still waiting to ship may complete the order
+		if err := UpdateFulfillmentStatus(order); err != nil {
+			return err
+		}
+	}
+
+	// Return the items to stock if needed
+	if cancelled {
+		if err := releaseCancelledOrder(order, refund.AdminUserId); err != nil {
+			return err
+		}
+		refund.Restocked = true
+	} else if restock {
+		for _, line := range refund.Lines {
+			if err := AdjustItemStock(&models.StockAdjustment{
+				ItemId:      line.ItemId,
+				Delta:       line.Quantity,
+				Reason:      models.StockReasonReturn,
+				Reference:   order.Id,
+				AdminUserId: refund.AdminUserId,
+			}); err != nil {
+				return err
+			}
+			FindOrderItem(order, line.ItemId).Restocked += line.Quantity
+			checkStockAlertOrLog(line.ItemId)
+		}
+		refund.Restocked = true
+	}
+
+	// Save everything
+	refund.CreatedAt = time.Now().UTC().Unix()
+	if err := zoom.MSave(zoom.Models(order.Items)); err != nil {
+		return err
+	}
+	if err := zoom.Save(order); err != nil {
+		return err
+	}
+	if err := zoom.Save(refund); err != nil {
+		return err
+	}
+	return RecordRefundInReports(order, refund)
+}
@@ -0,0 +1,329 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib/payments"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// SalesReportDateFormat is the format of the dates used for sales reports. Sales
+// are counted by the UTC day each order was placed.
+const SalesReportDateFormat = "2006-01-02"
+
+// The intervals sales reports can be bucketed by. Weeks start on Monday.
+const (
+	SalesIntervalDay   = "day"
+	SalesIntervalWeek  = "week"
+	SalesIntervalMonth = "month"
+)
+
+// SalesIntervals is a list of all the valid intervals for QuerySalesReport
+var SalesIntervals = []string{SalesIntervalDay, SalesIntervalWeek, SalesIntervalMonth}
+
+// salesDayKey is a hash with the number of orders placed on the given day and their
+// revenue and refunded amount in cents.
+func salesDayKey(day string) string {
+	return "sales:" + day
+}
+
+// salesItemUnitsKey is a sorted set of the ids of the items sold on the given day,
+// scored by the number of units sold, not counting units which were refunded.
+func salesItemUnitsKey(day string) string {
+	return "sales:" + day + ":itemUnits"
+}
+
+// salesItemRevenueKey is a sorted set of the ids of the items sold on the given day,
+// scored by their revenue in cents (after discounts and refunds, but not including
+// tax or shipping).
+func salesItemRevenueKey(day string) string {
+	return "sales:" + day + ":itemRevenue"
+}
+
+// salesItemNamesKey is a hash of the name of each item that has been sold, by id, so
+// that reports can still name items which have since been deleted. Each name is the
+// one the item had in the latest order it was sold in.
+const salesItemNamesKey = "sales:itemNames"
+
+// orderSalesDay returns the day order was placed, which is the day its sales and
+// refunds are counted for.
+func orderSalesDay(order *models.Order) string {
+	return time.Unix(order.CreatedAt, 0).UTC().Format(SalesReportDateFormat)
+}
+
+// RecordOrderInReports adds order to the counters which sales reports are built
+// from. It should be called once when an order is placed. Like refunds, it only uses
+// the name and price saved on each line when the order was placed (see
+// OrderItem.UnitPrice), so changing an item later never changes its past sales.
+func RecordOrderInReports(order *models.Order) error {
+	day := orderSalesDay(order)
+	conn := zoom.GetConn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("HINCRBY", salesDayKey(day), "orders", 1)
+	conn.Send("HINCRBY", salesDayKey(day), "revenue", payments.ToCents(order.Total))
+	for _, orderItem := range order.Items {
+		conn.Send("ZINCRBY", salesItemUnitsKey(day), orderItem.Quantity, orderItem.Item.Id)
+		conn.Send("ZINCRBY", salesItemRevenueKey(day), payments.ToCents(orderItem.DiscountedTotal()), orderItem.Item.Id)
+		conn.Send("HSET", salesItemNamesKey, orderItem.Item.Id, orderItem.ItemName)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// RecordRefundInReports takes refund, which has been issued for order, out of the
+// counters which sales reports are built from. Refunds are counted against the day
+// the order was placed, so that the units and revenue for each item never go below
+// 0. Cancelled orders should be recorded as a refund of everything left in the order.
+func RecordRefundInReports(order *models.Order, refund *models.Refund) error {
+	day := orderSalesDay(order)
+	conn := zoom.GetConn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("HINCRBY", salesDayKey(day), "refunded", payments.ToCents(refund.Amount))
+	for _, line := range refund.Lines {
+		orderItem := FindOrderItem(order, line.ItemId)
+		revenue := orderItem.DiscountedTotal() * float64(line.Quantity) / float64(orderItem.Quantity)
+		conn.Send("ZINCRBY", salesItemUnitsKey(day), -line.Quantity, line.ItemId)
+		conn.Send("ZINCRBY", salesItemRevenueKey(day), -payments.ToCents(revenue), line.ItemId)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// salesReportsBatchSize is how many orders are read at a time by RebuildSalesReports.
+const salesReportsBatchSize = 100
+
+// RebuildSalesReports deletes the counters which sales reports are built from and
+// then records every order, refund, and cancellation in them again. It is needed for
+// orders placed before the counters existed, or if the counters were lost. Orders
+// placed or refunded while the counters are rebuilt may be counted twice or not at
+// all, so it should only be run when the store is quiet. It returns the number of
+// orders which were recorded.
+func RebuildSalesReports() (int, error) {
+	if err := deleteSalesCounters(); err != nil {
+		return 0, err
+	}
+	count := 0
+	err := EachOrder(OrderFilter{}, salesReportsBatchSize, func(order *models.Order) error {
+		if err := RecordOrderInReports(order); err != nil {
+			return err
+		}
+		var refunds []*models.Refund
+		if err := zoom.NewQuery("Refund").Filter("OrderId =", order.Id).Order("CreatedAt").Scan(&refunds); err != nil {
+			return err
+		}
+		for _, refund := range refunds {
+			if err := RecordRefundInReports(order, refund); err != nil {
+				return err
+			}
+		}
+		if order.Status == models.OrderStatusCancelled {
+			// Cancelling records everything which was not refunded as a refund (see
+			// CancelOrder). For orders which were cancelled by refunding
+			// everything, nothing is left.
+			if err := RecordRefundInReports(order, CalculateRefund(order, nil)); err != nil {
+				return err
+			}
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// deleteSalesCounters deletes every key used for the counters which sales reports
+// are built from.
+func deleteSalesCounters() error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "sales:*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		var keys []interface{}
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if _, err := conn.Do("DEL", keys...); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// SalesBucket is the sales for the orders placed in one day, week, or month.
+type SalesBucket struct {
+	Start             string  `json:"start,omitempty"` // The first day in the bucket
+	Orders            int     `json:"orders"`
+	Revenue           float64 `json:"revenue"`  // The total of every order, including shipping and tax
+	Refunded          float64 `json:"refunded"` // The amount refunded for the orders, including cancellations
+	NetRevenue        float64 `json:"netRevenue"`
+	AverageOrderValue float64 `json:"averageOrderValue"`
+}
+
+// add adds the sales in other to b.
+func (b *SalesBucket) add(other SalesBucket) {
+	b.Orders += other.Orders
+	b.Revenue = models.RoundToCents(b.Revenue + other.Revenue)
+	b.Refunded = models.RoundToCents(b.Refunded + other.Refunded)
+	b.NetRevenue = models.RoundToCents(b.Revenue - b.Refunded)
+	if b.Orders > 0 {
+		b.AverageOrderValue = models.RoundToCents(b.Revenue / float64(b.Orders))
+	}
+}
+
+// SalesReport is the sales for every bucket in a range of days.
+type SalesReport struct {
+	Interval string        `json:"interval"`
+	Since    string        `json:"since"`
+	Until    string        `json:"until"`
+	Buckets  []SalesBucket `json:"buckets"`
+	Totals   SalesBucket   `json:"totals"`
+}
+
+// salesBucketStart returns the first day of the bucket day belongs to.
+func salesBucketStart(day time.Time, interval string) time.Time {
+	switch interval {
+	case SalesIntervalWeek:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case SalesIntervalMonth:
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
+
+// QuerySalesReport returns the sales for the orders placed from since until until
+// (inclusive, as UTC days) bucketed by interval. Every bucket in the range is
+// included, even if there were no orders in it.
+func QuerySalesReport(interval string, since, until time.Time) (*SalesReport, error) {
+	days := []time.Time{}
+	for day := since.UTC(); !day.After(until); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	for _, day := range days {
+		conn.Send("HMGET", salesDayKey(day.Format(SalesReportDateFormat)), "orders", "revenue", "refunded")
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	report := &SalesReport{
+		Interval: interval,
+		Since:    since.Format(SalesReportDateFormat),
+		Until:    until.Format(SalesReportDateFormat),
+		Buckets:  []SalesBucket{},
+	}
+	for i, day := range days {
+		counts, err := redis.Values(replies[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		var orders, revenue, refunded int64
+		for j, dest := range []*int64{&orders, &revenue, &refunded} {
+			if counts[j] != nil {
+				if *dest, err = redis.Int64(counts[j], nil); err != nil {
+					return nil, err
+				}
+			}
+		}
+		start := salesBucketStart(day, interval).Format(SalesReportDateFormat)
+		if len(report.Buckets) == 0 || report.Buckets[len(report.Buckets)-1].Start != start {
+			report.Buckets = append(report.Buckets, SalesBucket{Start: start})
+		}
+		sales := SalesBucket{
+			Orders:   int(orders),
+			Revenue:  payments.ToDollars(revenue),
+			Refunded: payments.ToDollars(refunded),
+		}
+		report.Buckets[len(report.Buckets)-1].add(sales)
+		report.Totals.add(sales)
+	}
+	return report, nil
+}
+
+// ItemSales is the units sold and revenue for one item.
+type ItemSales struct {
+	ItemId    string  `json:"itemId"`
+	Name      string  `json:"name"`
+	UnitsSold int     `json:"unitsSold"`
+	Revenue   float64 `json:"revenue"`
+}
+
+// The ways QueryItemSales can sort items
+const (
+	ItemSalesByUnits   = "units"
+	ItemSalesByRevenue = "revenue"
+)
+
+// QueryItemSales returns the sales for the items sold in orders placed from since
+// until until (inclusive, as UTC days), sorted by the most units sold or the most
+// revenue. At most limit items are returned.
+func QueryItemSales(since, until time.Time, sortBy string, limit int) ([]ItemSales, error) {
+	unitsKeys := redis.Args{}
+	revenueKeys := redis.Args{}
+	for day := since.UTC(); !day.After(until); day = day.AddDate(0, 0, 1) {
+		unitsKeys = unitsKeys.Add(salesItemUnitsKey(day.Format(SalesReportDateFormat)))
+		revenueKeys = revenueKeys.Add(salesItemRevenueKey(day.Format(SalesReportDateFormat)))
+	}
+
+	// Add up the sales for every day into temporary keys
+	tempKey := fmt.Sprintf("sales:temp:%d", time.Now().UnixNano())
+	unitsKey, revenueKey := tempKey+":itemUnits", tempKey+":itemRevenue"
+	sortKey := unitsKey
+	if sortBy == ItemSalesByRevenue {
+		sortKey = revenueKey
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	defer conn.Do("DEL", unitsKey, revenueKey)
+	conn.Send("MULTI")
+	conn.Send("ZUNIONSTORE", redis.Args{unitsKey, len(unitsKeys)}.Add(unitsKeys...)...)
+	conn.Send("ZUNIONSTORE", redis.Args{revenueKey, len(revenueKeys)}.Add(revenueKeys...)...)
+	// Items which were sold and then refunded are left out
+	conn.Send("ZREMRANGEBYSCORE", sortKey, "-inf", 0)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return nil, err
+	}
+	itemIds, err := redis.Strings(conn.Do("ZREVRANGE", sortKey, 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	// Look up the units, revenue, and name for each item
+	conn.Send("MULTI")
+	for _, itemId := range itemIds {
+		conn.Send("ZSCORE", unitsKey, itemId)
+		conn.Send("ZSCORE", revenueKey, itemId)
+		conn.Send("HGET", salesItemNamesKey, itemId)
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	sales := []ItemSales{}
+	for i, itemId := range itemIds {
+		// Errors are ignored because a missing score or name is just left empty
+		units, _ := redis.Int(replies[3*i], nil)
+		revenue, _ := redis.Int64(replies[3*i+1], nil)
+		name, _ := redis.String(replies[3*i+2], nil)
+		sales = append(sales, ItemSales{
+			ItemId:    itemId,
+			Name:      name,
+			UnitsSold: units,
+			Revenue:   payments.ToDollars(revenue),
+		})
+	}
+	return sales, nil
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ShipmentLineRequest is the quantity of an item in an order that should be shipped.
+type ShipmentLineRequest struct {
+	ItemId   string `json:"itemId"`
+	Quantity int    `json:"quantity"`
+}
+
+// TrackingUrl returns the url where the customer can track a package sent with
+// carrier, built from the template for the carrier in config.Shipping.TrackingUrls.
+// It returns an empty string if there is no template for the carrier or no
+// tracking number.
+func TrackingUrl(carrier string, trackingNumber string) string {
+	template, found := config.Shipping.TrackingUrls[strings.ToLower(carrier)]
+	if !found || trackingNumber == "" {
+		return ""
+	}
+	return strings.Replace(template, "{trackingNumber}", url.QueryEscape(trackingNumber), -1)
+}
+
+// CreateShipment adds shipment to order with the given lines, or if lines is empty,
+// with everything in the order which has not been shipped or refunded yet. It marks
+// the items as shipped and advances the status of the order (see
+// UpdateFulfillmentStatus), and then saves the order along with its items.
+// CreateShipment assumes the lines have already been validated against the order.
+// Callers should hold a lock on the order to prevent concurrent changes to its items.
+func CreateShipment(order *models.Order, shipment *models.Shipment, lines []ShipmentLineRequest) error {
+	if len(lines) == 0 {
+		for _, orderItem := range order.Items {
+			if quantity := orderItem.UnshippedQuantity(); quantity > 0 {
+				lines = append(lines, ShipmentLineRequest{ItemId: orderItem.Item.Id, Quantity: quantity})
+			}
+		}
+	}
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return err
+	}
+	shipment.Id = hex.EncodeToString(idBytes)
+	shipment.ShippedAt = time.Now().UTC().Unix()
+	shipment.Lines = []models.ShipmentLine{}
+	for _, line := range lines {
+		orderItem := FindOrderItem(order, line.ItemId)
+		orderItem.Shipped += line.Quantity
+		shipment.Lines = append(shipment.Lines, models.ShipmentLine{
+			ItemId:   line.ItemId,
+			Name:     orderItem.ItemName,
+			Quantity: line.Quantity,
+		})
+	}
+	if shipment.TrackingUrl == "" {
+		shipment.TrackingUrl = TrackingUrl(shipment.Carrier, shipment.TrackingNumber)
+	}
+	order.Shipments = append(order.Shipments, *shipment)
+
+	// The tracking details for the order are for the latest shipment
+	order.Carrier = shipment.Carrier
+	order.TrackingNumber = shipment.TrackingNumber
+	order.TrackingUrl = shipment.TrackingUrl
+
+	if err := UpdateFulfillmentStatus(order); err != nil {
+		return err
+	}
+	if err := zoom.MSave(zoom.Models(order.Items)); err != nil {
+		return err
+	}
+	return zoom.Save(order)
+}
+
+// UpdateFulfillmentStatus changes the status of order to match its shipments. It is
+// partially_shipped while some of the items have not been shipped, shipped once
+// everything has been shipped, and delivered once every shipment has been delivered.
+// Orders which have not shipped, or which have been cancelled or refunded, are left
+// alone. Payment is captured as usual (see ChangeOrderStatus). It does not save the
+// order.
+func UpdateFulfillmentStatus(order *models.Order) error {
+	if len(order.Shipments) == 0 || (order.Status != models.OrderStatusPending && !order.HasShipped()) {
+		return nil
+	}
+	status := models.OrderStatusDelivered
+	for _, orderItem := range order.Items {
+		if orderItem.UnshippedQuantity() > 0 {
+			status = models.OrderStatusPartiallyShipped
+		}
+	}
+	if status == models.OrderStatusDelivered {
+		for _, shipment := range order.Shipments {
+			if !shipment.IsDelivered() {
+				status = models.OrderStatusShipped
+			}
+		}
+	}
+	if status == models.OrderStatusDelivered && order.Status != models.OrderStatusShipped {
+		// Orders can only be delivered once they have shipped
+		if err := ChangeOrderStatus(order, models.OrderStatusShipped); err != nil {
+			return err
+		}
+	}
+	return ChangeOrderStatus(order, status)
+}
@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"sort"
+)
+
+// ShippingQuote is the cost of shipping an order with a particular ShippingRate.
+type ShippingQuote struct {
+	RateId string  `json:"rateId"`
+	Name   string  `json:"name"`
+	Cost   float64 `json:"cost"`
+}
+
+type shippingQuotesByCost []ShippingQuote
+
+func (q shippingQuotesByCost) Len() int           { return len(q) }
+func (q shippingQuotesByCost) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q shippingQuotesByCost) Less(i, j int) bool { return q[i].Cost < q[j].Cost }
+
+// FindShippingZone returns the ShippingZone which contains country, or nil if
+// there is no such zone.
+func FindShippingZone(country string) (*models.ShippingZone, error) {
+	var zones []*models.ShippingZone
+	if err := zoom.NewQuery("ShippingZone").Scan(&zones); err != nil {
+		return nil, err
+	}
+	for _, zone := range zones {
+		if zone.HasCountry(country) {
+			return zone, nil
+		}
+	}
+	return nil, nil
+}
+
+// ShippingQuotes returns a quote for every ShippingRate which can be used to ship
+// an order with the given subtotal and weight to country, sorted from cheapest to
+// most expensive. If we don't ship to country, the returned slice will be empty.
+func ShippingQuotes(country string, subtotal float64, weight float64) ([]ShippingQuote, error) {
+	quotes := []ShippingQuote{}
+	zone, err := FindShippingZone(country)
+	if err != nil {
+		return nil, err
+	} else if zone == nil {
+		return quotes, nil
+	}
+	var rates []*models.ShippingRate
+	if err := zoom.NewQuery("ShippingRate").Filter("ZoneId =", zone.Id).Scan(&rates); err != nil {
+		return nil, err
+	}
+	for _, rate := range rates {
+		if cost, ok := rate.Cost(subtotal, weight); ok {
+			quotes = append(quotes, ShippingQuote{
+				RateId: rate.Id,
+				Name:   rate.Name,
+				Cost:   cost,
+			})
+		}
+	}
+	sort.Sort(shippingQuotesByCost(quotes))
+	return quotes, nil
+}
@@ -0,0 +1,23 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/albrow/5w4g-server/config"
+)
+
+// sign returns a signature for value which proves that it was generated by us. It
+// is used for links in emails, e.g. to unsubscribe or look up an order. purpose is
+// included so that a signature for one kind of link can't be used for another.
+func sign(purpose string, value string) string {
+	mac := hmac.New(sha256.New, config.Secret)
+	mac.Write([]byte(purpose + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature returns true iff signature was returned by sign for the given
+// purpose and value.
+func validSignature(purpose string, value string, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(sign(purpose, value)))
+}
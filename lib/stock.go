@@ -0,0 +1,295 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// The amount of each item in stock is kept in the Stock field of the hash zoom uses
+// to store the item. Item has no such field, so zoom never writes it, and saving an
+// item which was scanned before its stock changed can't undo the change. Every change
+// to the stock is copied to the AmountInStock field so that it is scanned along with
+// the rest of the item, and SaveItem copies it back after zoom overwrites it. Items
+// saved before the Stock field was added only have AmountInStock, which is used
+// until their stock first changes.
+const stockLua = `
+local function getStock(key)
+	local stock = redis.call('HGET', key, 'Stock') or redis.call('HGET', key, 'AmountInStock')
+	return tonumber(stock) or 0
+end
+local function setStock(key, stock)
+	redis.call('HMSET', key, 'Stock', stock, 'AmountInStock', stock)
+end
+`
+
+// setItemStockScript atomically sets the stock of the item hash (KEYS[1]) to ARGV[1]
+// and returns the previous amount.
+var setItemStockScript = redis.NewScript(1, stockLua+`
+local previous = getStock(KEYS[1])
+setStock(KEYS[1], ARGV[1])
+return previous
+`)
+
+// adjustItemStockScript atomically adds ARGV[1] (which may be negative) to the stock
+// of the item hash (KEYS[1]) and returns the new amount.
+var adjustItemStockScript = redis.NewScript(1, stockLua+`
+local stock = getStock(KEYS[1]) + tonumber(ARGV[1])
+setStock(KEYS[1], stock)
+return stock
+`)
+
+// syncItemStockScript copies the stock of the item hash (KEYS[1]) to its
+// AmountInStock field, which zoom may have just overwritten, and returns it.
+var syncItemStockScript = redis.NewScript(1, stockLua+`
+local stock = getStock(KEYS[1])
+if redis.call('HEXISTS', KEYS[1], 'Stock') == 1 then
+	redis.call('HSET', KEYS[1], 'AmountInStock', stock)
+end
+return stock
+`)
+
+// reserveStockScript atomically checks that every item hash in KEYS has enough
+// stock for the quantity in the corresponding ARGV, according to its availability,
+// and if so takes them all out of stock. On success it returns 1 followed by the
+// amount each item had in stock beforehand. Otherwise it returns 0, the (1-based)
+// index of the first item which is not available, and the amount it has in stock.
+var reserveStockScript = redis.NewScript(-1, stockLua+`
+local stocks = {}
+for i, key in ipairs(KEYS) do
+	local stock = getStock(key)
+	local fields = redis.call('HMGET', key, 'Availability', 'BackorderLimit')
+	local availability = fields[1] or ''
+	local limit = tonumber(fields[2]) or 0
+	local quantity = tonumber(ARGV[i])
+	if availability == 'backorder' or availability == 'preorder' then
+		if limit > 0 and stock - quantity < -limit then
+			return {0, i, stock}
+		end
+	elseif stock < quantity then
+		return {0, i, stock}
+	end
+	stocks[i] = stock
+end
+local result = {1}
+for i, key in ipairs(KEYS) do
+	setStock(key, stocks[i] - tonumber(ARGV[i]))
+	result[i + 1] = stocks[i]
+end
+return result
+`)
+
+// AvailableToOrder returns how many units of item can be ordered right now based on
+// its availability and the amount in stock. unlimited is true if the item is
+// available for backorder or pre-order without a limit.
+func AvailableToOrder(item *models.Item) (available int, unlimited bool) {
+	if item.CanOversell() {
+		if item.BackorderLimit == 0 {
+			return 0, true
+		}
+		available = item.AmountInStock + item.BackorderLimit
+	} else {
+		available = item.AmountInStock
+	}
+	if available < 0 {
+		available = 0
+	}
+	return available, false
+}
+
+// UnavailableMessage returns a message for the customer explaining why quantity of
+// item can't be ordered, or an empty string if it can.
+func UnavailableMessage(item *models.Item, quantity int) string {
+	available, unlimited := AvailableToOrder(item)
+	switch {
+	case unlimited || quantity <= available:
+		return ""
+	case available == 0 && !item.CanOversell():
+		return fmt.Sprintf("%s is out of stock.", item.Name)
+	case available == 0:
+		return fmt.Sprintf("%s can't be ordered right now.", item.Name)
+	case !item.CanOversell():
+		return fmt.Sprintf("Only %d of %s are left in stock.", available, item.Name)
+	default:
+		return fmt.Sprintf("Only %d of %s can be ordered right now.", available, item.Name)
+	}
+}
+
+// ReserveOrderStock atomically checks that every item in order can be ordered in
+// the quantity given (see AvailableToOrder) and takes them all out of stock. It also
+// flags each line in the order with what is backordered or pre-ordered, so that
+// fulfillment knows what can ship now. If any item is not available, nothing is
+// taken out of stock and the first unavailable line is returned, with the amount
+// in stock for its item updated. Once the order is saved, the sales should be
+// recorded with RecordOrderSales, or if the order can't be placed after all, the
+// stock should be put back with ReleaseOrderStock.
+func ReserveOrderStock(order *models.Order) (*models.OrderItem, error) {
+	args := redis.Args{len(order.Items)}
+	for _, orderItem := range order.Items {
+		args = args.Add("Item:" + orderItem.Item.Id)
+	}
+	for _, orderItem := range order.Items {
+		args = args.Add(orderItem.Quantity)
+	}
+	conn := zoom.GetConn()
+	values, err := redis.Values(reserveStockScript.Do(conn, args...))
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	reply := make([]int, len(values))
+	for i, value := range values {
+		if reply[i], err = redis.Int(value, nil); err != nil {
+			return nil, err
+		}
+	}
+	if reply[0] == 0 {
+		unavailable := order.Items[reply[1]-1]
+		unavailable.Item.AmountInStock = reply[2]
+		return unavailable, nil
+	}
+	for i, orderItem := range order.Items {
+		previous := reply[i+1]
+		orderItem.Item.AmountInStock = previous - orderItem.Quantity
+		inStock := previous
+		if inStock < 0 {
+			inStock = 0
+		}
+		if orderItem.Quantity > inStock {
+			orderItem.Backordered = orderItem.Quantity - inStock
+		}
+		if orderItem.Item.Availability == models.ItemPreorder {
+			orderItem.Preorder = true
+			orderItem.ExpectedShipDate = orderItem.Item.ExpectedShipDate
+		}
+		orderItem.ReadyToShip = orderItem.Backordered == 0 && !orderItem.Preorder
+	}
+	return nil, nil
+}
+
+// ReleaseOrderStock puts back the stock taken by ReserveOrderStock, for when the
+// order can't be placed after all (e.g. because payment was declined).
+func ReleaseOrderStock(order *models.Order) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	for _, orderItem := range order.Items {
+		if _, err := adjustItemStockScript.Do(conn, "Item:"+orderItem.Item.Id, orderItem.Quantity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordOrderSales records the stock taken by ReserveOrderStock for order in the
+// stock ledger. The order must already have been saved so that it has an id.
+func RecordOrderSales(order *models.Order) error {
+	now := time.Now().UTC().Unix()
+	for _, orderItem := range order.Items {
+		sale := &models.StockAdjustment{
+			ItemId:    orderItem.Item.Id,
+			Delta:     -orderItem.Quantity,
+			Reason:    models.StockReasonSale,
+			Reference: order.Id,
+			Balance:   orderItem.Item.AmountInStock,
+			CreatedAt: now,
+		}
+		if err := zoom.Save(sale); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AdjustItemStock atomically adds adjustment.Delta (which may be negative) to the
+// stock of the item with id adjustment.ItemId, and then records the adjustment in the
+// stock ledger along with the new amount. It modifies the hash zoom uses to store
+// the item directly, so that concurrent adjustments don't overwrite each other.
+func AdjustItemStock(adjustment *models.StockAdjustment) error {
+	conn := zoom.GetConn()
+	balance, err := redis.Int(adjustItemStockScript.Do(conn, "Item:"+adjustment.ItemId, adjustment.Delta))
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	adjustment.Balance = balance
+	adjustment.CreatedAt = time.Now().UTC().Unix()
+	return zoom.Save(adjustment)
+}
+
+// SetItemStock atomically sets the stock of the item with id
+// adjustment.ItemId to amount, and then records the difference in the stock ledger
+// with the reason, reference, and admin from adjustment. It returns false without
+// recording anything if the amount did not change.
+func SetItemStock(adjustment *models.StockAdjustment, amount int) (bool, error) {
+	conn := zoom.GetConn()
+	previous, err := redis.Int(setItemStockScript.Do(conn, "Item:"+adjustment.ItemId, amount))
+	conn.Close()
+	if err != nil || previous == amount {
+		return false, err
+	}
+	adjustment.Delta = amount - previous
+	adjustment.Balance = amount
+	adjustment.CreatedAt = time.Now().UTC().Unix()
+	return true, zoom.Save(adjustment)
+}
+
+// SaveItem saves item with zoom without changing its stock, which may have changed
+// since item was scanned. item.AmountInStock is set to the current amount. Items
+// should always be saved with SaveItem rather than zoom.Save once they exist.
+func SaveItem(item *models.Item) error {
+	if err := zoom.Save(item); err != nil {
+		return err
+	}
+	conn := zoom.GetConn()
+	defer conn.Close()
+	stock, err := redis.Int(syncItemStockScript.Do(conn, "Item:"+item.Id))
+	if err != nil {
+		return err
+	}
+	item.AmountInStock = stock
+	return nil
+}
+
+// StockHistory returns every entry in the stock ledger for the item with the given
+// id, oldest first.
+func StockHistory(itemId string) ([]*models.StockAdjustment, error) {
+	var adjustments []*models.StockAdjustment
+	if err := zoom.NewQuery("StockAdjustment").Filter("ItemId =", itemId).Order("CreatedAt").Scan(&adjustments); err != nil {
+		return nil, err
+	}
+	return adjustments, nil
+}
+
+// ReconcileItemStock compares the amount of item in stock with the total of its
+// entries in the stock ledger. If they are different (e.g. because the stock was
+// set before there was a ledger), it records a correction for the difference so
+// that the ledger matches the amount in stock, and returns it. Otherwise it
+// returns nil.
+func ReconcileItemStock(item *models.Item, adminUserId string) (*models.StockAdjustment, error) {
+	adjustments, err := StockHistory(item.Id)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, adjustment := range adjustments {
+		total += adjustment.Delta
+	}
+	if total == item.AmountInStock {
+		return nil, nil
+	}
+	correction := &models.StockAdjustment{
+		ItemId:      item.Id,
+		Delta:       item.AmountInStock - total,
+		Reason:      models.StockReasonCorrection,
+		Reference:   "Reconciled with the amount in stock",
+		AdminUserId: adminUserId,
+		Balance:     item.AmountInStock,
+		CreatedAt:   time.Now().UTC().Unix(),
+	}
+	if err := zoom.Save(correction); err != nil {
+		return nil, err
+	}
+	return correction, nil
+}
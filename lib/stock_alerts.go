@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/lib/mailer"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+)
+
+// The stock levels an item can be at, from best to worst. An alert is sent when an
+// item moves to a worse level.
+const (
+	StockLevelOk  = "ok"
+	StockLevelLow = "low"
+	StockLevelOut = "out"
+)
+
+var stockLevelRanks = map[string]int{
+	StockLevelOk:  0,
+	StockLevelLow: 1,
+	StockLevelOut: 2,
+}
+
+// stockAlertKey holds the level of the item with the given id when stock alerts
+// were last checked. It is used so that each alert is only sent once until the item
+// is restocked.
+func stockAlertKey(itemId string) string {
+	return "item:" + itemId + ":stockAlert"
+}
+
+// stockAlertEmail is the data for the stock_alert email template.
+type stockAlertEmail struct {
+	Item      *models.Item
+	Level     string
+	Threshold int
+}
+
+// LowStockThreshold returns the amount in stock at or below which item is
+// considered low on stock.
+func LowStockThreshold(item *models.Item) int {
+	if item.LowStockThreshold > 0 {
+		return item.LowStockThreshold
+	}
+	return config.Stock.LowStockThreshold
+}
+
+// StockLevel returns the stock level of item based on its current amount in stock.
+func StockLevel(item *models.Item) string {
+	switch {
+	case item.AmountInStock <= 0:
+		return StockLevelOut
+	case item.AmountInStock <= LowStockThreshold(item):
+		return StockLevelLow
+	default:
+		return StockLevelOk
+	}
+}
+
+// checkStockAlertOrLog calls CheckStockAlert for the item with the given id. Problems
+// sending alerts should never stop the change to the stock, so errors are only logged.
+func checkStockAlertOrLog(itemId string) {
+	if err := CheckStockAlert(itemId); err != nil {
+		fmt.Printf("[stock] Error checking stock alerts for item %s: %s\n", itemId, err)
+	}
+}
+
+// CheckStockAlert records the current stock level of the item with the given id,
+// and if it is worse than the last time it was checked, alerts the admins who
+// subscribe to stock alerts by email and triggers the item.low_stock or
+// item.out_of_stock webhook event. Once an alert has been sent, it is not sent
+// again until the item is restocked above its threshold. It should be called
+// whenever the stock or threshold of an item changes.
+func CheckStockAlert(itemId string) error {
+	item := &models.Item{}
+	if err := zoom.ScanById(itemId, item); err != nil {
+		return err
+	}
+	level := StockLevel(item)
+	conn := zoom.GetConn()
+	previous, err := redis.String(conn.Do("GETSET", stockAlertKey(item.Id), level))
+	conn.Close()
+	if err == redis.ErrNil {
+		previous = StockLevelOk
+	} else if err != nil {
+		return err
+	}
+	if stockLevelRanks[level] <= stockLevelRanks[previous] {
+		return nil
+	}
+
+	// The level got worse, so send the alerts
+	event := models.WebhookEventItemLowStock
+	if level == StockLevelOut {
+		event = models.WebhookEventItemOutOfStock
+	}
+	if err := TriggerWebhookEvent(event, item); err != nil {
+		return err
+	}
+	var admins []*models.AdminUser
+	if err := zoom.NewQuery("AdminUser").Scan(&admins); err != nil {
+		return err
+	}
+	for _, admin := range admins {
+		if !admin.StockAlerts || admin.DeletedAt != 0 {
+			continue
+		}
+		msg, err := mailer.NewMessage("stock_alert", admin.Email, stockAlertEmail{
+			Item:      item,
+			Level:     level,
+			Threshold: LowStockThreshold(item),
+		})
+		if err != nil {
+			return err
+		}
+		if err := mailer.Enqueue(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteStockAlert deletes the recorded stock level for the item with the given
+// id. It should be called when the item is deleted.
+func DeleteStockAlert(itemId string) error {
+	conn := zoom.GetConn()
+	defer conn.Close()
+	_, err := conn.Do("DEL", stockAlertKey(itemId))
+	return err
+}
+
+// FilterItemsByStockLevel returns the items which are at any of the given levels,
+// with the lowest amount in stock first.
+func FilterItemsByStockLevel(items []*models.Item, levels ...string) []*models.Item {
+	filtered := []*models.Item{}
+	for _, item := range items {
+		level := StockLevel(item)
+		for _, l := range levels {
+			if level == l {
+				filtered = append(filtered, item)
+				break
+			}
+		}
+	}
+	sort.Sort(itemsByStock(filtered))
+	return filtered
+}
+
+type itemsByStock []*models.Item
+
+func (items itemsByStock) Len() int           { return len(items) }
+func (items itemsByStock) Swap(i, j int)      { items[i], items[j] = items[j], items[i] }
+func (items itemsByStock) Less(i, j int) bool { return items[i].AmountInStock < items[j].AmountInStock }
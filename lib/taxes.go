@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+)
+
+// CurrentTaxRates returns all the tax rates for country which are currently in
+// effect, i.e. excluding retired versions.
+func CurrentTaxRates(country string) ([]*models.TaxRate, error) {
+	var rates []*models.TaxRate
+	if err := zoom.NewQuery("TaxRate").Filter("Country =", country).Scan(&rates); err != nil {
+		return nil, err
+	}
+	current := []*models.TaxRate{}
+	for _, rate := range rates {
+		if rate.IsCurrent() {
+			current = append(current, rate)
+		}
+	}
+	return current, nil
+}
+
+// bestTaxRate returns the most specific rate in rates which matches region and
+// category, or nil if none of them match.
+func bestTaxRate(rates []*models.TaxRate, region, category string) *models.TaxRate {
+	var best *models.TaxRate
+	for _, rate := range rates {
+		if rate.Matches(region, category) && (best == nil || rate.Specificity() > best.Specificity()) {
+			best = rate
+		}
+	}
+	return best
+}
+
+// ApplyTaxes finds the current tax rate for each item in order based on its
+// shipping address and the tax category of the item, and applies it to the
+// corresponding OrderItem. It then updates the totals for the order. Items for
+// which there is no matching rate are not taxed. It does not save the order.
+func ApplyTaxes(order *models.Order) error {
+	rates, err := CurrentTaxRates(order.ShippingAddress.Country)
+	if err != nil {
+		return err
+	}
+	for _, orderItem := range order.Items {
+		rate := bestTaxRate(rates, order.ShippingAddress.Region, orderItem.Item.TaxCategory)
+		orderItem.ApplyTaxRate(rate)
+	}
+	order.UpdateTotals()
+	return nil
+}
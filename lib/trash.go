@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"time"
+)
+
+// Trash is every item and admin user which has been deleted but not yet purged.
+type Trash struct {
+	Items      []*models.Item      `json:"items"`
+	AdminUsers []*models.AdminUser `json:"adminUsers"`
+}
+
+// GetTrash returns everything which is currently in the trash.
+func GetTrash() (*Trash, error) {
+	return findTrash(time.Time{})
+}
+
+// findTrash returns everything which was moved to the trash before deletedBefore,
+// or everything in the trash if deletedBefore is the zero time.
+func findTrash(deletedBefore time.Time) (*Trash, error) {
+	var items []*models.Item
+	if err := zoom.NewQuery("Item").Scan(&items); err != nil {
+		return nil, err
+	}
+	var admins []*models.AdminUser
+	if err := zoom.NewQuery("AdminUser").Scan(&admins); err != nil {
+		return nil, err
+	}
+	inTrash := func(deletedAt int64) bool {
+		return deletedAt != 0 && (deletedBefore.IsZero() || deletedAt < deletedBefore.UTC().Unix())
+	}
+	trash := &Trash{Items: []*models.Item{}, AdminUsers: []*models.AdminUser{}}
+	for _, item := range items {
+		if inTrash(item.DeletedAt) {
+			trash.Items = append(trash.Items, item)
+		}
+	}
+	for _, admin := range admins {
+		if inTrash(admin.DeletedAt) {
+			trash.AdminUsers = append(trash.AdminUsers, admin)
+		}
+	}
+	return trash, nil
+}
+
+// RunTrashPurge purges everything which has been in the trash for longer than the
+// retention period every interval. It never returns, so it should be run in its own
+// goroutine. If more than one server is running, only one of them will purge at a
+// time.
+func RunTrashPurge(interval time.Duration) {
+	for range time.Tick(interval) {
+		if lock, err := AcquireLock("trashPurge", interval); err != nil {
+			fmt.Printf("[trash] Error acquiring lock: %s\n", err)
+			continue
+		} else if lock == nil {
+			continue
+		}
+		deletedBefore := time.Now().Add(-config.Trash.Retention)
+		if purged, err := PurgeTrash(deletedBefore); err != nil {
+			fmt.Printf("[trash] Error purging trash: %s\n", err)
+		} else if purged > 0 {
+			fmt.Printf("[trash] Purged %d records\n", purged)
+		}
+		// The lock is not released so that other servers skip this interval
+	}
+}
+
+// trashBatchSize is how many orders are read at a time when checking which items in
+// the trash are still referred to by orders.
+const trashBatchSize = 100
+
+// PurgeTrash permanently deletes every item and admin user which was moved to the
+// trash before deletedBefore, along with the images and revisions for the items. Items
+// which any order refers to are kept in the trash for good, so that old orders can
+// still be shown. It returns the number of records that were deleted.
+func PurgeTrash(deletedBefore time.Time) (int, error) {
+	trash, err := findTrash(deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	ordered := map[string]bool{}
+	if len(trash.Items) > 0 {
+		if ordered, err = orderedItemIds(); err != nil {
+			return 0, err
+		}
+	}
+	purged := 0
+	for _, item := range trash.Items {
+		if ordered[item.Id] {
+			continue
+		}
+		if err := zoom.Delete(item); err != nil {
+			return purged, err
+		}
+		purged++
+		if err := DeleteStockAlert(item.Id); err != nil {
+			return purged, err
+		}
+		if err := QueueImageDeletion(item.ImageS3Path); err != nil {
+			return purged, err
+		}
+		if err := DeleteItemRevisions(item.Id); err != nil {
+			return purged, err
+		}
+	}
+	for _, admin := range trash.AdminUsers {
+		if err := zoom.Delete(admin); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// orderedItemIds returns the ids of every item which any order refers to.
+func orderedItemIds() (map[string]bool, error) {
+	ids := map[string]bool{}
+	err := EachOrder(OrderFilter{}, trashBatchSize, func(order *models.Order) error {
+		for _, orderItem := range order.Items {
+			if orderItem.Item != nil {
+				ids[orderItem.Item.Id] = true
+			}
+		}
+		return nil
+	})
+	return ids, err
+}
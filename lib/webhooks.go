@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/lib/jobs"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/zoom"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// WebhookQueue is the job queue used to deliver webhooks in the background.
+const WebhookQueue = "webhooks"
+
+// deliverWebhookJob is the name of the job which attempts a single delivery. Its
+// argument is the id of the delivery.
+const deliverWebhookJob = "webhooks.deliver"
+
+func init() {
+	jobs.Register(deliverWebhookJob, func(job *jobs.Job) error {
+		var deliveryId string
+		if err := job.ScanArgs(&deliveryId); err != nil {
+			return err
+		}
+		return deliverWebhook(job, deliveryId)
+	})
+}
+
+// webhookPayload is the body of every webhook request.
+type webhookPayload struct {
+	Event     string      `json:"event"`
+	CreatedAt int64       `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// NewWebhookSecret returns a new random secret for signing webhook deliveries.
+func NewWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// SignWebhookPayload returns the value of the X-5w4g-Signature header for payload
+// sent to a webhook with the given secret.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// TriggerWebhookEvent creates a delivery of event with the given data for every
+// active webhook which subscribes to it, and queues the deliveries to be sent in
+// the background.
+func TriggerWebhookEvent(event string, data interface{}) error {
+	var webhooks []*models.Webhook
+	if err := zoom.NewQuery("Webhook").Scan(&webhooks); err != nil {
+		return err
+	}
+	var payload []byte
+	for _, webhook := range webhooks {
+		if !webhook.SubscribesTo(event) {
+			continue
+		}
+		if payload == nil {
+			encoded, err := json.Marshal(webhookPayload{
+				Event:     event,
+				CreatedAt: time.Now().UTC().Unix(),
+				Data:      data,
+			})
+			if err != nil {
+				return err
+			}
+			payload = encoded
+		}
+		delivery := &models.WebhookDelivery{
+			WebhookId: webhook.Id,
+			Event:     event,
+			Payload:   string(payload),
+			Status:    models.WebhookDeliveryPending,
+			Attempts:  []models.WebhookAttempt{},
+			CreatedAt: time.Now().UTC().Unix(),
+		}
+		if err := zoom.Save(delivery); err != nil {
+			return err
+		}
+		if err := queueWebhookDelivery(delivery.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplayWebhookDelivery queues delivery to be sent again, regardless of whether
+// earlier attempts succeeded. The new attempts are added to the existing ones.
+func ReplayWebhookDelivery(delivery *models.WebhookDelivery) error {
+	delivery.Status = models.WebhookDeliveryPending
+	if err := zoom.Save(delivery); err != nil {
+		return err
+	}
+	return queueWebhookDelivery(delivery.Id)
+}
+
+func queueWebhookDelivery(deliveryId string) error {
+	_, err := jobs.Enqueue(WebhookQueue, deliverWebhookJob, deliveryId)
+	return err
+}
+
+// DeliverQueuedWebhooks attempts every queued delivery which is due and returns the
+// number of deliveries which succeeded. It is mostly useful for tests, since the
+// server delivers webhooks with its job pool.
+func DeliverQueuedWebhooks() (int, error) {
+	return jobs.RunQueued(WebhookQueue)
+}
+
+// deliverWebhook attempts the delivery with the given id once for job, and records
+// the attempt. It returns an error if the attempt failed so that the job is retried.
+// Once the job has no attempts left, the delivery is marked as failed.
+func deliverWebhook(job *jobs.Job, deliveryId string) error {
+	delivery := &models.WebhookDelivery{}
+	if err := zoom.ScanById(deliveryId, delivery); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); ok {
+			// The delivery was deleted along with its webhook
+			return nil
+		}
+		return err
+	}
+	if delivery.Status == models.WebhookDeliverySucceeded {
+		// The delivery was replayed while it was waiting to be retried
+		return nil
+	}
+	webhook := &models.Webhook{}
+	if err := zoom.ScanById(delivery.WebhookId, webhook); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	client := &http.Client{Timeout: config.Webhooks.Timeout}
+	attempt := attemptWebhookDelivery(client, webhook, delivery)
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	switch {
+	case attempt.Error == "":
+		delivery.Status = models.WebhookDeliverySucceeded
+	case job.Attempts >= job.MaxAttempts:
+		delivery.Status = models.WebhookDeliveryFailed
+	}
+	if err := zoom.Save(delivery); err != nil {
+		return err
+	}
+	if attempt.Error != "" {
+		return errors.New(attempt.Error)
+	}
+	return nil
+}
+
+// attemptWebhookDelivery sends delivery to webhook once and returns the result. Any
+// response other than 2xx counts as a failure.
+func attemptWebhookDelivery(client *http.Client, webhook *models.Webhook, delivery *models.WebhookDelivery) models.WebhookAttempt {
+	start := time.Now()
+	attempt := models.WebhookAttempt{At: start.UTC().Unix()}
+	req, err := http.NewRequest("POST", webhook.Url, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "5w4g-Webhooks")
+	req.Header.Set("X-5w4g-Event", delivery.Event)
+	req.Header.Set("X-5w4g-Delivery", delivery.Id)
+	req.Header.Set("X-5w4g-Signature", SignWebhookPayload(webhook.Secret, []byte(delivery.Payload)))
+	res, err := client.Do(req)
+	attempt.Duration = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	// Read the body so the connection can be reused, but don't store it
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	attempt.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		attempt.Error = fmt.Sprintf("endpoint responded with %s", res.Status)
+	}
+	return attempt
+}
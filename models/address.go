@@ -0,0 +1,14 @@
+package models
+
+// Address is a postal address. It is not a model in its own right, but is
+// embedded in other models (e.g. as the shipping and billing addresses of
+// an Order). Country is an ISO 3166-1 alpha-2 code (e.g. "US").
+type Address struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"` // State, province, county, etc.
+	PostalCode string `json:"postalCode,omitempty"`
+	Country    string `json:"country"`
+}
@@ -3,5 +3,7 @@ package models
 type AdminUser struct {
 	Email          string `json:"email" zoom:"index"`
 	HashedPassword string `json:"-" zoom:"index"`
+	StockAlerts    bool   `json:"stockAlerts"`         // Whether to email the admin when items are low or out of stock
+	DeletedAt      int64  `json:"deletedAt,omitempty"` // UTC unix time the admin user was moved to the trash. 0 if they weren't
 	Identifier     `redis:"-"`
 }
@@ -0,0 +1,38 @@
+package models
+
+// AuditEntry is a record of a request an admin made which changed something.
+// Entries are never changed, and are only deleted once they are older than the
+// retention period.
+type AuditEntry struct {
+	AdminUserId  string             `json:"adminUserId" zoom:"index"`
+	AdminEmail   string             `json:"adminEmail"`
+	Action       string             `json:"action" zoom:"index"`       // One of the AuditAction constants, based on the request method
+	Route        string             `json:"route"`                     // The method and path with ids replaced, e.g. "POST /items/:id/restore"
+	ResourceType string             `json:"resourceType" zoom:"index"` // The first part of the path, e.g. "items"
+	ResourceId   string             `json:"resourceId,omitempty" zoom:"index"`
+	Changes      []AuditFieldChange `json:"changes,omitempty"` // The fields that changed, with secrets redacted
+	Status       int                `json:"status"`            // The status code of the response
+	Ip           string             `json:"ip"`
+	UserAgent    string             `json:"userAgent"`
+	CreatedAt    int64              `json:"createdAt" zoom:"index"`
+	Identifier   `redis:"-"`
+}
+
+// AuditFieldChange is the old and new value of a single field in an AuditEntry.
+// Values which are not strings are encoded as JSON. Old is empty for resources which
+// were created, and New is empty for resources which were deleted for good.
+type AuditFieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// The possible values for AuditEntry.Action
+const (
+	AuditActionCreate = "create" // POST requests
+	AuditActionUpdate = "update" // PUT and PATCH requests
+	AuditActionDelete = "delete" // DELETE requests
+)
+
+// AuditActions is a list of all the valid values for AuditEntry.Action
+var AuditActions = []string{AuditActionCreate, AuditActionUpdate, AuditActionDelete}
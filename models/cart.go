@@ -0,0 +1,71 @@
+package models
+
+// Cart is a shopping cart which a customer can build up over time before checking
+// out. Unlike the other models, carts are not saved with zoom. They are stored as
+// JSON with a TTL so that abandoned carts expire automatically (see lib/carts.go).
+// Only the id and quantity of each item is stored, so prices are always up to date.
+type Cart struct {
+	Id              string     `json:"id"`
+	Email           string     `json:"email,omitempty"`
+	Lines           []CartLine `json:"lines"`
+	ShippingAddress *Address   `json:"shippingAddress,omitempty"`
+	BillingAddress  *Address   `json:"billingAddress,omitempty"`
+	ShippingRateId  string     `json:"shippingRateId,omitempty"`
+	Code            string     `json:"code,omitempty"`
+	CreatedAt       int64      `json:"createdAt"`
+	UpdatedAt       int64      `json:"updatedAt"`
+}
+
+// CartLine is the quantity of a single item in a cart.
+type CartLine struct {
+	ItemId   string `json:"itemId"`
+	Quantity int    `json:"quantity"`
+}
+
+// AddLine adds quantity of the item with the given id to the cart. If the item
+// is already in the cart, quantity is added to the existing line.
+func (c *Cart) AddLine(itemId string, quantity int) {
+	for i, line := range c.Lines {
+		if line.ItemId == itemId {
+			c.Lines[i].Quantity += quantity
+			return
+		}
+	}
+	c.Lines = append(c.Lines, CartLine{ItemId: itemId, Quantity: quantity})
+}
+
+// SetLineQuantity sets the quantity of the item with the given id, adding the item
+// to the cart if needed. A quantity of zero or less removes the item from the cart.
+func (c *Cart) SetLineQuantity(itemId string, quantity int) {
+	for i, line := range c.Lines {
+		if line.ItemId == itemId {
+			if quantity <= 0 {
+				c.Lines = append(c.Lines[:i], c.Lines[i+1:]...)
+			} else {
+				c.Lines[i].Quantity = quantity
+			}
+			return
+		}
+	}
+	if quantity > 0 {
+		c.Lines = append(c.Lines, CartLine{ItemId: itemId, Quantity: quantity})
+	}
+}
+
+// HasLine returns true iff the item with the given id is in the cart.
+func (c *Cart) HasLine(itemId string) bool {
+	for _, line := range c.Lines {
+		if line.ItemId == itemId {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge adds all the lines from other to the cart. Nothing else is copied, so that
+// the addresses and code for one cart are never revealed through another.
+func (c *Cart) Merge(other *Cart) {
+	for _, line := range other.Lines {
+		c.AddLine(line.ItemId, line.Quantity)
+	}
+}
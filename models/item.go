@@ -1,12 +1,70 @@
 package models
 
 type Item struct {
-	Name          string  `json:"name" zoom:"index"`
-	ImageUrl      string  `json:"imageUrl"` // A public-facing url which can be used to get the image file
-	ImageS3Path   string  `json:"-"`        // The path of the image file stored on s3. Only used internally
-	Price         float64 `json:"price"`
-	Description   string  `json:"description"`
-	AmountInStock int     `json:"amountInStock,omitempty"`
-	AmountOrdered int     `json:"amountOrdered,omitempty"`
-	Identifier    `redis:"-"`
+	Name              string  `json:"name" zoom:"index"`
+	ImageUrl          string  `json:"imageUrl"`       // A public-facing url which can be used to get the image file
+	ImageS3Path       string  `json:"-" zoom:"index"` // The path of the image file stored on s3. Only used internally
+	Price             float64 `json:"price"`
+	Description       string  `json:"description"`
+	Category          string  `json:"category,omitempty" zoom:"index"`
+	Status            string  `json:"status" zoom:"index"`
+	PublishAt         int64   `json:"publishAt,omitempty"` // UTC unix time. Only for scheduled items
+	DeletedAt         int64   `json:"deletedAt,omitempty"` // UTC unix time the item was moved to the trash. 0 if it wasn't
+	AmountInStock     int     `json:"amountInStock,omitempty"`
+	AmountOrdered     int     `json:"amountOrdered,omitempty"`
+	LowStockThreshold int     `json:"lowStockThreshold,omitempty"` // Alert admins at or below this amount. 0 means the default
+	Availability      string  `json:"availability"`
+	BackorderLimit    int     `json:"backorderLimit,omitempty"`   // How far below 0 stock can go for backorders and pre-orders. 0 means no limit
+	ExpectedShipDate  int64   `json:"expectedShipDate,omitempty"` // UTC unix time. Only for pre-orders
+	TaxCategory       string  `json:"taxCategory,omitempty"`      // Empty means the standard rate applies
+	Weight            float64 `json:"weight,omitempty"`           // Shipping weight in ounces
+	Length            float64 `json:"length,omitempty"`           // Package dimensions in inches
+	Width             float64 `json:"width,omitempty"`
+	Height            float64 `json:"height,omitempty"`
+	Identifier        `redis:"-"`
+}
+
+// The possible values for Item.Availability
+const (
+	ItemInStock   = "in_stock"  // Can only be ordered while there is stock
+	ItemBackorder = "backorder" // Can be ordered when out of stock, and ships once it is restocked
+	ItemPreorder  = "preorder"  // Can be ordered before it is released, and ships on the ExpectedShipDate
+)
+
+// ItemAvailabilities is a list of all the valid values for Item.Availability
+var ItemAvailabilities = []string{ItemInStock, ItemBackorder, ItemPreorder}
+
+// CanOversell returns true iff the item can be ordered when there is not enough in
+// stock, i.e. it is available for backorder or pre-order.
+func (i *Item) CanOversell() bool {
+	return i.Availability == ItemBackorder || i.Availability == ItemPreorder
+}
+
+// The possible values for Item.Status
+const (
+	ItemDraft     = "draft"     // Only visible to admins
+	ItemPublished = "published" // Visible to everyone and can be ordered
+	ItemScheduled = "scheduled" // Only visible to admins until PublishAt, then treated as published
+	ItemArchived  = "archived"  // Hidden from the storefront but kept for order history
+)
+
+// ItemStatuses is a list of all the valid values for Item.Status
+var ItemStatuses = []string{ItemDraft, ItemPublished, ItemScheduled, ItemArchived}
+
+// IsPublic returns true iff the item should be visible to customers at the given
+// time, i.e. it is not in the trash and it is published or it was scheduled to be
+// published before now. Items saved before statuses were added have no status and
+// are treated as published.
+func (i *Item) IsPublic(now int64) bool {
+	if i.DeletedAt != 0 {
+		return false
+	}
+	switch i.Status {
+	case ItemPublished, "":
+		return true
+	case ItemScheduled:
+		return i.PublishAt <= now
+	default:
+		return false
+	}
 }
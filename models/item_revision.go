@@ -0,0 +1,27 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+// ItemRevision records a change an admin made to an item, so that the change can be
+// seen later and rolled back.
+type ItemRevision struct {
+	ItemId           string            `json:"itemId" zoom:"index"`
+	Version          int               `json:"version" zoom:"index"` // Counts up from 1 for each item
+	AdminUserId      string            `json:"adminUserId"`
+	Changes          []ItemFieldChange `json:"changes"`
+	ImageArchivePath string            `json:"-"`                      // A copy of the image from before the change, if it was changed
+	RestoredFrom     string            `json:"restoredFrom,omitempty"` // The id of the revision that was rolled back, if this was a rollback
+	CreatedAt        int64             `json:"createdAt"`
+	Identifier       `redis:"-"`
+}
+
+// ItemFieldChange is the old and new value of a single field in an ItemRevision.
+// Field is the name of the field in JSON, or "image" if the image was changed, in
+// which case the values are the urls of the old and new image.
+type ItemFieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old"`
+	New   json.RawMessage `json:"new"`
+}
@@ -19,7 +19,7 @@ func Init() {
 		})
 
 		// Register all models
-		models := []zoom.Model{&AdminUser{}, &Item{}, &OrderItem{}, &Order{}}
+		models := []zoom.Model{&AdminUser{}, &Item{}, &OrderItem{}, &Order{}, &ShippingZone{}, &ShippingRate{}, &TaxRate{}, &Promotion{}, &Refund{}, &Webhook{}, &WebhookDelivery{}, &StockAdjustment{}, &ItemRevision{}, &AuditEntry{}}
 		for _, m := range models {
 			if err := zoom.Register(m); err != nil {
 				panic(err)
@@ -0,0 +1,10 @@
+package models
+
+import (
+	"math"
+)
+
+// RoundToCents rounds a dollar amount to the nearest cent.
+func RoundToCents(amount float64) float64 {
+	return math.Floor(amount*100+0.5) / 100
+}
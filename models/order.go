@@ -5,16 +5,129 @@ import (
 )
 
 type Order struct {
-	Items      []*OrderItem `json:"items"`
-	Email      string       `json:"email" zoom:"index"`
-	Identifier `redis:"-"`
+	Items           []*OrderItem       `json:"items"`
+	Email           string             `json:"email" zoom:"index"`
+	ShippingAddress Address            `json:"shippingAddress"`
+	BillingAddress  *Address           `json:"billingAddress,omitempty"` // nil means same as ShippingAddress
+	Status          string             `json:"status" zoom:"index"`
+	ShippingRateId  string             `json:"shippingRateId"`
+	ShippingMethod  string             `json:"shippingMethod"` // The name of the ShippingRate at the time of the order
+	ShippingCost    float64            `json:"shippingCost"`
+	Subtotal        float64            `json:"subtotal"`
+	Promotions      []AppliedPromotion `json:"promotions"`
+	Discount        float64            `json:"discount"`
+	Tax             float64            `json:"tax"`
+	TaxLines        []TaxLine          `json:"taxLines"`
+	Total           float64            `json:"total"`
+	PaymentIntentId string             `json:"paymentIntentId"`
+	PaymentStatus   string             `json:"paymentStatus"`
+	AmountCaptured  float64            `json:"amountCaptured"`
+	AmountRefunded  float64            `json:"amountRefunded"`
+	Carrier         string             `json:"carrier,omitempty"`
+	TrackingNumber  string             `json:"trackingNumber,omitempty"`
+	TrackingUrl     string             `json:"trackingUrl,omitempty"`
+	Shipments       []Shipment         `json:"shipments"`
+	Emails          []OrderEmail       `json:"emails"`
+	InvoiceNumber   int                `json:"invoiceNumber,omitempty"` // 0 until an invoice is generated for the order
+	CreatedAt       int64              `json:"createdAt" zoom:"index"`
+	Identifier      `redis:"-"`
 }
 
-// AddItem adds quantity of item to the order. It does not save the order, so
-// you will need to do so if you want the changes to persist in the database.
-// AddItem will return an error if the item you are attempting to add does not
-// have an Id. If the item you are attempting to add already exists in o, AddItem
-// will add quantity to the existing OrderItem.Quantity.
+// OrderEmail is a record of an email which was sent to the customer about an order.
+type OrderEmail struct {
+	Type    string `json:"type"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	SentAt  int64  `json:"sentAt"`
+}
+
+// TaxLine is a summary of all the tax charged on an order at a single rate.
+type TaxLine struct {
+	TaxRateId string  `json:"taxRateId"`
+	Rate      float64 `json:"rate"`
+	Inclusive bool    `json:"inclusive"`
+	Taxable   float64 `json:"taxable"` // The total discounted price of all the items taxed at this rate
+	Amount    float64 `json:"amount"`
+}
+
+// The types of email which can be sent about an order. Each of them is also the
+// name of the template for the email.
+const (
+	OrderEmailConfirmation = "order_confirmation"
+	OrderEmailShipped      = "order_shipped"
+)
+
+// OrderEmailTypes is a list of all the valid values for OrderEmail.Type
+var OrderEmailTypes = []string{OrderEmailConfirmation, OrderEmailShipped}
+
+// The possible values for Order.Status
+const (
+	OrderStatusPending          = "pending"
+	OrderStatusPartiallyShipped = "partially_shipped"
+	OrderStatusShipped          = "shipped"
+	OrderStatusDelivered        = "delivered"
+	OrderStatusCancelled        = "cancelled"
+	OrderStatusRefunded         = "refunded"
+)
+
+// OrderStatuses is a list of all the valid values for Order.Status
+var OrderStatuses = []string{
+	OrderStatusPending,
+	OrderStatusPartiallyShipped,
+	OrderStatusShipped,
+	OrderStatusDelivered,
+	OrderStatusCancelled,
+	OrderStatusRefunded,
+}
+
+// orderStatusTransitions maps each status to the statuses an order can be changed
+// to from it.
+var orderStatusTransitions = map[string][]string{
+	OrderStatusPending:          {OrderStatusPartiallyShipped, OrderStatusShipped, OrderStatusCancelled},
+	OrderStatusPartiallyShipped: {OrderStatusShipped},
+	OrderStatusShipped:          {OrderStatusDelivered},
+}
+
+// CanChangeStatusTo returns true iff the status of the order can be changed from
+// its current status to status.
+func (o *Order) CanChangeStatusTo(status string) bool {
+	for _, s := range orderStatusTransitions[o.Status] {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// RefundableAmount returns the amount which has been charged (or authorized, if the
+// order has not shipped yet) for the order and not yet refunded.
+func (o *Order) RefundableAmount() float64 {
+	return RoundToCents(o.Total - o.AmountRefunded)
+}
+
+// HasShipped returns true iff all or part of the order has already been shipped to
+// the customer. The addresses for an order can only be changed before it has shipped.
+func (o *Order) HasShipped() bool {
+	return o.Status == OrderStatusPartiallyShipped || o.Status == OrderStatusShipped || o.Status == OrderStatusDelivered
+}
+
+// FindShipment returns the shipment in the order with the given id, or nil if there
+// is no such shipment.
+func (o *Order) FindShipment(shipmentId string) *Shipment {
+	for i := range o.Shipments {
+		if o.Shipments[i].Id == shipmentId {
+			return &o.Shipments[i]
+		}
+	}
+	return nil
+}
+
+// AddItem adds quantity of item to the order, along with the current name and price
+// of the item, so that later changes to the item don't change the order. It does
+// not save the order, so you will need to do so if you want the changes to persist
+// in the database. AddItem will return an error if the item you are attempting to
+// add does not have an Id. If the item you are attempting to add already exists in
+// o, AddItem will add quantity to the existing OrderItem.Quantity.
 func (o *Order) AddItem(item *Item, quantity int) error {
 	if item.Id == "" {
 		return fmt.Errorf("Cannot add item with an empty Id: %+v", *item)
@@ -31,8 +144,10 @@ func (o *Order) AddItem(item *Item, quantity int) error {
 	if existingOrderItem == nil {
 		// If there *is not* an existing item, create one and add it to the order
 		orderItem := &OrderItem{
-			Item:     item,
-			Quantity: quantity,
+			Item:      item,
+			ItemName:  item.Name,
+			UnitPrice: item.Price,
+			Quantity:  quantity,
 		}
 		o.Items = append(o.Items, orderItem)
 	} else {
@@ -41,3 +156,70 @@ func (o *Order) AddItem(item *Item, quantity int) error {
 	}
 	return nil
 }
+
+// CalculateSubtotal returns the total price of all the items in the order, not
+// including shipping or exclusive tax.
+func (o *Order) CalculateSubtotal() float64 {
+	subtotal := 0.0
+	for _, orderItem := range o.Items {
+		subtotal += orderItem.LineTotal()
+	}
+	return RoundToCents(subtotal)
+}
+
+// CalculateWeight returns the total shipping weight of all the items in the order
+// in ounces.
+func (o *Order) CalculateWeight() float64 {
+	weight := 0.0
+	for _, orderItem := range o.Items {
+		weight += orderItem.Item.Weight * float64(orderItem.Quantity)
+	}
+	return weight
+}
+
+// UpdateTotals sets o.Subtotal, o.Discount, o.Tax, o.TaxLines, and o.Total based on
+// the items in the order (including the discount and tax already applied to each of
+// them) and o.ShippingCost. Tax which is included in item prices is part of the subtotal,
+// so only exclusive tax is added to the total. It does not save the order.
+func (o *Order) UpdateTotals() {
+	o.Subtotal = o.CalculateSubtotal()
+	o.Discount = 0
+	for _, orderItem := range o.Items {
+		o.Discount += orderItem.Discount
+	}
+	o.Discount = RoundToCents(o.Discount)
+	o.Tax = 0
+	o.TaxLines = []TaxLine{}
+	exclusiveTax := 0.0
+	for _, orderItem := range o.Items {
+		if orderItem.TaxRateId == "" {
+			continue
+		}
+		o.Tax += orderItem.Tax
+		if !orderItem.TaxInclusive {
+			exclusiveTax += orderItem.Tax
+		}
+		o.addToTaxLine(orderItem)
+	}
+	o.Tax = RoundToCents(o.Tax)
+	o.Total = RoundToCents(o.Subtotal - o.Discount + o.ShippingCost + exclusiveTax)
+}
+
+// addToTaxLine adds the tax for orderItem to the TaxLine for its rate, creating
+// the TaxLine if needed.
+func (o *Order) addToTaxLine(orderItem *OrderItem) {
+	for i, line := range o.TaxLines {
+		if line.TaxRateId == orderItem.TaxRateId {
+			o.TaxLines[i].Taxable = RoundToCents(line.Taxable + orderItem.DiscountedTotal())
+			o.TaxLines[i].Amount = RoundToCents(line.Amount + orderItem.Tax)
+			return
+		}
+	}
+	o.TaxLines = append(o.TaxLines, TaxLine{
+		TaxRateId: orderItem.TaxRateId,
+		Rate:      orderItem.TaxRate,
+		Inclusive: orderItem.TaxInclusive,
+		Taxable:   orderItem.DiscountedTotal(),
+		Amount:    orderItem.Tax,
+	})
+}
@@ -1,7 +1,70 @@
 package models
 
 type OrderItem struct {
-	Item       *Item `json:"item"`
-	Quantity   int   `json:"quantity"`
-	Identifier `redis:"-"`
+	Item             *Item   `json:"item"`
+	ItemName         string  `json:"itemName"`  // The name of the item when the order was placed
+	UnitPrice        float64 `json:"unitPrice"` // The price of the item when the order was placed
+	Quantity         int     `json:"quantity"`
+	Refunded         int     `json:"refunded"`  // The quantity which has been refunded
+	Shipped          int     `json:"shipped"`   // The quantity which has been shipped
+	Restocked        int     `json:"restocked"` // The quantity which has been put back in stock
+	Discount         float64 `json:"discount"`  // The total discount from all promotions
+	TaxRateId        string  `json:"taxRateId,omitempty"`
+	TaxRate          float64 `json:"taxRate"`
+	TaxInclusive     bool    `json:"taxInclusive"`
+	Tax              float64 `json:"tax"`
+	Backordered      int     `json:"backordered,omitempty"` // The quantity which was not in stock when the order was placed
+	Preorder         bool    `json:"preorder,omitempty"`
+	ExpectedShipDate int64   `json:"expectedShipDate,omitempty"` // Only for pre-orders
+	ReadyToShip      bool    `json:"readyToShip"`                // Whether the line could ship as soon as the order was placed
+	Identifier       `redis:"-"`
+}
+
+// LineTotal returns the unit price multiplied by the quantity. It uses the price
+// saved when the order was placed, so it never changes when the item is edited.
+func (oi *OrderItem) LineTotal() float64 {
+	return oi.UnitPrice * float64(oi.Quantity)
+}
+
+// DiscountedTotal returns the line total minus any discount.
+func (oi *OrderItem) DiscountedTotal() float64 {
+	return RoundToCents(oi.LineTotal() - oi.Discount)
+}
+
+// UnshippedQuantity returns the quantity of the item which still needs to be shipped,
+// i.e. which has not been shipped or refunded.
+func (oi *OrderItem) UnshippedQuantity() int {
+	if unshipped := oi.Quantity - oi.Refunded - oi.Shipped; unshipped > 0 {
+		return unshipped
+	}
+	return 0
+}
+
+// RefundableQuantity returns the quantity of the item which has not been refunded.
+func (oi *OrderItem) RefundableQuantity() int {
+	return oi.Quantity - oi.Refunded
+}
+
+// UnitCharge returns the amount the customer was charged for each unit of the item,
+// including discounts and exclusive tax.
+func (oi *OrderItem) UnitCharge() float64 {
+	charge := oi.DiscountedTotal()
+	if !oi.TaxInclusive {
+		charge += oi.Tax
+	}
+	return charge / float64(oi.Quantity)
+}
+
+// ApplyTaxRate calculates the tax for the discounted line using rate and stores it along with
+// the details of the rate, so that the order keeps the rate that was in effect when
+// it was placed. If rate is nil, the line is not taxed.
+func (oi *OrderItem) ApplyTaxRate(rate *TaxRate) {
+	if rate == nil {
+		oi.TaxRateId, oi.TaxRate, oi.TaxInclusive, oi.Tax = "", 0, false, 0
+		return
+	}
+	oi.TaxRateId = rate.Id
+	oi.TaxRate = rate.Rate
+	oi.TaxInclusive = rate.Inclusive
+	oi.Tax = rate.TaxFor(oi.DiscountedTotal())
 }
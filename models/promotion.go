@@ -0,0 +1,123 @@
+package models
+
+import (
+	"strings"
+)
+
+// Promotion is a discount which can be applied to orders. Promotions with a Code
+// are only applied when the customer enters the code. Promotions without a Code are
+// sales which are applied automatically to every order they are valid for.
+type Promotion struct {
+	Code          string   `json:"code,omitempty" zoom:"index"` // Always upper case
+	Description   string   `json:"description"`
+	Type          string   `json:"type"`                  // One of the PromotionType constants
+	Amount        float64  `json:"amount"`                // A percentage (e.g. 15 for 15% off) or a dollar amount
+	StartsAt      int64    `json:"startsAt,omitempty"`    // UTC unix time. 0 means no start date.
+	EndsAt        int64    `json:"endsAt,omitempty"`      // UTC unix time. 0 means no end date.
+	MinSubtotal   float64  `json:"minSubtotal,omitempty"` // The minimum order value
+	ItemIds       []string `json:"itemIds,omitempty"`     // If not empty, only these items are discounted
+	Categories    []string `json:"categories,omitempty"`  // If not empty, only items in these categories are discounted
+	UsageLimit    int      `json:"usageLimit,omitempty"`  // The total number of times it can be used. 0 means unlimited.
+	PerEmailLimit int      `json:"perEmailLimit,omitempty"`
+	Stackable     bool     `json:"stackable"` // Whether it can be combined with other promotions
+	Uses          int      `json:"uses" redis:"-"`
+	Identifier    `redis:"-"`
+}
+
+// The possible values for Promotion.Type
+const (
+	PromotionTypePercent = "percent"
+	PromotionTypeFixed   = "fixed"
+)
+
+// PromotionTypes is a list of all the valid values for Promotion.Type
+var PromotionTypes = []string{PromotionTypePercent, PromotionTypeFixed}
+
+// NormalizePromotionCode converts code to the format used for Promotion.Code.
+func NormalizePromotionCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// IsAutomatic returns true iff the promotion is applied without a code.
+func (p *Promotion) IsAutomatic() bool {
+	return p.Code == ""
+}
+
+// IsActiveAt returns true iff now (as UTC unix time) is within the valid date range
+// for the promotion.
+func (p *Promotion) IsActiveAt(now int64) bool {
+	return (p.StartsAt == 0 || now >= p.StartsAt) && (p.EndsAt == 0 || now < p.EndsAt)
+}
+
+// AppliesTo returns true iff the promotion can discount item.
+func (p *Promotion) AppliesTo(item *Item) bool {
+	if len(p.ItemIds) == 0 && len(p.Categories) == 0 {
+		return true
+	}
+	for _, id := range p.ItemIds {
+		if id == item.Id {
+			return true
+		}
+	}
+	for _, category := range p.Categories {
+		if category == item.Category {
+			return true
+		}
+	}
+	return false
+}
+
+// LineDiscounts calculates the discount the promotion gives for each item in order,
+// given the discounts that have already been applied to each item by other promotions.
+// The returned slice has the same length and order as order.Items. Percentage discounts
+// apply to the remaining price of each eligible line. Fixed discounts are split between
+// the eligible lines in proportion to their remaining prices, and never exceed them.
+// Any rounding remainder from splitting a fixed discount goes to the last eligible line.
+func (p *Promotion) LineDiscounts(order *Order, existing []float64) []float64 {
+	discounts := make([]float64, len(order.Items))
+	remaining := make([]float64, len(order.Items))
+	eligibleTotal := 0.0
+	for i, orderItem := range order.Items {
+		if p.AppliesTo(orderItem.Item) {
+			remaining[i] = orderItem.LineTotal() - existing[i]
+			eligibleTotal += remaining[i]
+		}
+	}
+	if eligibleTotal <= 0 {
+		return discounts
+	}
+	switch p.Type {
+	case PromotionTypePercent:
+		for i := range discounts {
+			discounts[i] = RoundToCents(remaining[i] * p.Amount / 100)
+		}
+	case PromotionTypeFixed:
+		amount := p.Amount
+		if amount > eligibleTotal {
+			amount = eligibleTotal
+		}
+		// Give any rounding remainder to the last eligible line, so that the line
+		// discounts always add up to exactly the amount
+		allocated, last := 0.0, -1
+		for i := range discounts {
+			if remaining[i] > 0 {
+				discounts[i] = RoundToCents(amount * remaining[i] / eligibleTotal)
+				allocated += discounts[i]
+				last = i
+			}
+		}
+		if last != -1 {
+			discounts[last] = RoundToCents(discounts[last] + amount - allocated)
+		}
+	}
+	return discounts
+}
+
+// AppliedPromotion records a promotion which was applied to an order and the total
+// discount it gave.
+type AppliedPromotion struct {
+	PromotionId string  `json:"promotionId"`
+	Code        string  `json:"code,omitempty"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
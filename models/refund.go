@@ -0,0 +1,20 @@
+package models
+
+// Refund records money returned to a customer for all or part of an order.
+type Refund struct {
+	OrderId     string       `json:"orderId" zoom:"index"`
+	AdminUserId string       `json:"adminUserId"` // The admin who issued the refund
+	Reason      string       `json:"reason"`
+	Amount      float64      `json:"amount"`
+	Lines       []RefundLine `json:"lines"`
+	Restocked   bool         `json:"restocked"` // Whether the refunded items were returned to stock
+	CreatedAt   int64        `json:"createdAt" zoom:"index"`
+	Identifier  `redis:"-"`
+}
+
+// RefundLine is the quantity of a single item in an order which was refunded.
+type RefundLine struct {
+	ItemId   string  `json:"itemId"`
+	Quantity int     `json:"quantity"`
+	Amount   float64 `json:"amount"`
+}
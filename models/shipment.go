@@ -0,0 +1,27 @@
+package models
+
+// Shipment is a package sent to the customer with all or some of the items in an
+// order. It is not a model in its own right, but is stored on the Order it belongs
+// to, since orders can be split into more than one shipment.
+type Shipment struct {
+	Id             string         `json:"id"`
+	Carrier        string         `json:"carrier"`
+	TrackingNumber string         `json:"trackingNumber,omitempty"`
+	TrackingUrl    string         `json:"trackingUrl,omitempty"`
+	Lines          []ShipmentLine `json:"lines"`
+	ShippedAt      int64          `json:"shippedAt"`
+	DeliveredAt    int64          `json:"deliveredAt,omitempty"` // 0 until the shipment is delivered
+}
+
+// ShipmentLine is the quantity of a single item in an order which was shipped in a
+// shipment.
+type ShipmentLine struct {
+	ItemId   string `json:"itemId"`
+	Name     string `json:"name"` // The name of the item when it was shipped
+	Quantity int    `json:"quantity"`
+}
+
+// IsDelivered returns true iff the shipment has been delivered.
+func (s *Shipment) IsDelivered() bool {
+	return s.DeliveredAt != 0
+}
@@ -0,0 +1,76 @@
+package models
+
+// ShippingZone is a group of countries which share the same shipping rates.
+// Each country should belong to at most one zone.
+type ShippingZone struct {
+	Name       string   `json:"name" zoom:"index"`
+	Countries  []string `json:"countries"` // ISO 3166-1 alpha-2 codes
+	Identifier `redis:"-"`
+}
+
+// HasCountry returns true iff country is one of the countries in the zone.
+func (z *ShippingZone) HasCountry(country string) bool {
+	for _, c := range z.Countries {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+// ShippingRate is a shipping method (e.g. "Standard" or "Express") which is
+// available for addresses in a particular ShippingZone.
+type ShippingRate struct {
+	ZoneId     string          `json:"zoneId" zoom:"index"`
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`                // One of the ShippingRateType constants
+	Price      float64         `json:"price,omitempty"`     // Only used for flat rates
+	Brackets   []WeightBracket `json:"brackets,omitempty"`  // Only used for weight rates
+	FreeAbove  float64         `json:"freeAbove,omitempty"` // Orders with a subtotal >= FreeAbove ship for free. 0 means never.
+	Identifier `redis:"-"`
+}
+
+// WeightBracket is one row in the rate table for a weight-based ShippingRate.
+// It applies to orders which weigh at most MaxWeight ounces.
+type WeightBracket struct {
+	MaxWeight float64 `json:"maxWeight"`
+	Price     float64 `json:"price"`
+}
+
+// The possible values for ShippingRate.Type
+const (
+	ShippingRateTypeFlat   = "flat"
+	ShippingRateTypeWeight = "weight"
+)
+
+// ShippingRateTypes is a list of all the valid values for ShippingRate.Type
+var ShippingRateTypes = []string{ShippingRateTypeFlat, ShippingRateTypeWeight}
+
+// Cost returns the cost of shipping an order with the given subtotal (in dollars) and
+// weight (in ounces) using this rate. The second return value will be false if the rate
+// cannot be used for the order, i.e. if the order is heavier than the heaviest bracket.
+func (r *ShippingRate) Cost(subtotal float64, weight float64) (float64, bool) {
+	var cost float64
+	switch r.Type {
+	case ShippingRateTypeFlat:
+		cost = r.Price
+	case ShippingRateTypeWeight:
+		// Use the lightest bracket which can fit the order
+		var bracket *WeightBracket
+		for i, b := range r.Brackets {
+			if weight <= b.MaxWeight && (bracket == nil || b.MaxWeight < bracket.MaxWeight) {
+				bracket = &r.Brackets[i]
+			}
+		}
+		if bracket == nil {
+			return 0, false
+		}
+		cost = bracket.Price
+	default:
+		return 0, false
+	}
+	if r.FreeAbove > 0 && subtotal >= r.FreeAbove {
+		return 0, true
+	}
+	return cost, true
+}
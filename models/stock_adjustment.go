@@ -0,0 +1,32 @@
+package models
+
+// StockAdjustment is an entry in the stock ledger, which records every change to
+// the amount of an item in stock. Entries are never changed or deleted.
+type StockAdjustment struct {
+	ItemId      string `json:"itemId" zoom:"index"`
+	Delta       int    `json:"delta"` // Negative when stock was taken out
+	Reason      string `json:"reason"`
+	Reference   string `json:"reference,omitempty"`   // An order id or a note
+	AdminUserId string `json:"adminUserId,omitempty"` // Empty if the change was not made by an admin (e.g. a sale)
+	Balance     int    `json:"balance"`               // The amount in stock after the change
+	CreatedAt   int64  `json:"createdAt" zoom:"index"`
+	Identifier  `redis:"-"`
+}
+
+// The possible values for StockAdjustment.Reason
+const (
+	StockReasonRestock    = "restock"
+	StockReasonSale       = "sale"
+	StockReasonReturn     = "return"
+	StockReasonDamage     = "damage"
+	StockReasonCorrection = "correction"
+)
+
+// StockReasons is a list of all the valid values for StockAdjustment.Reason
+var StockReasons = []string{
+	StockReasonRestock,
+	StockReasonSale,
+	StockReasonReturn,
+	StockReasonDamage,
+	StockReasonCorrection,
+}
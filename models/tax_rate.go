@@ -0,0 +1,54 @@
+package models
+
+// TaxRate is the rate of sales tax (or VAT, GST, etc.) for a country, optionally
+// narrowed to a specific region and/or item tax category. Tax rates are versioned:
+// they are never changed once created. Instead, changing a rate retires the current
+// version and creates a new one, so the history of every rate is preserved.
+type TaxRate struct {
+	Country     string  `json:"country" zoom:"index"` // ISO 3166-1 alpha-2 code
+	Region      string  `json:"region,omitempty"`     // Empty means the rate applies to the whole country
+	Category    string  `json:"category,omitempty"`   // Empty means the standard rate
+	Rate        float64 `json:"rate"`                 // E.g. 0.0825 for 8.25%
+	Inclusive   bool    `json:"inclusive"`            // Whether item prices already include the tax
+	Version     int     `json:"version"`
+	EffectiveAt int64   `json:"effectiveAt"`         // When this version took effect, as UTC unix time
+	RetiredAt   int64   `json:"retiredAt,omitempty"` // When this version was replaced or removed. 0 means it is current.
+	Identifier  `redis:"-"`
+}
+
+// IsCurrent returns true iff this version of the rate is still in effect.
+func (r *TaxRate) IsCurrent() bool {
+	return r.RetiredAt == 0
+}
+
+// Matches returns true iff the rate applies to the given region and category.
+// A rate with an empty Region or Category applies to any region or category,
+// respectively.
+func (r *TaxRate) Matches(region, category string) bool {
+	return (r.Region == "" || r.Region == region) && (r.Category == "" || r.Category == category)
+}
+
+// Specificity returns a score which is higher for more specific rates. A rate for
+// a specific category is more specific than a rate for a specific region, so that
+// e.g. a reduced rate for printed matter across a whole country still applies in
+// regions which have their own standard rate. Both are more specific than a rate
+// for a whole country.
+func (r *TaxRate) Specificity() int {
+	score := 0
+	if r.Category != "" {
+		score += 2
+	}
+	if r.Region != "" {
+		score += 1
+	}
+	return score
+}
+
+// TaxFor returns the amount of tax included in (for inclusive rates) or owed on
+// (for exclusive rates) the given amount, rounded to the nearest cent.
+func (r *TaxRate) TaxFor(amount float64) float64 {
+	if r.Inclusive {
+		return RoundToCents(amount - amount/(1+r.Rate))
+	}
+	return RoundToCents(amount * r.Rate)
+}
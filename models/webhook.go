@@ -0,0 +1,73 @@
+package models
+
+// Webhook is an endpoint registered by an admin which is sent a POST request
+// whenever one of the events it subscribes to happens.
+type Webhook struct {
+	Url         string   `json:"url"`
+	Description string   `json:"description"`
+	Events      []string `json:"events"`
+	Secret      string   `json:"secret"` // Used to sign each delivery so the endpoint can verify it came from us
+	Active      bool     `json:"active"`
+	CreatedAt   int64    `json:"createdAt"`
+	Identifier  `redis:"-"`
+}
+
+// The events webhooks can subscribe to
+const (
+	WebhookEventOrderCreated       = "order.created"
+	WebhookEventOrderStatusChanged = "order.status_changed"
+	WebhookEventItemUpdated        = "item.updated"
+	WebhookEventItemLowStock       = "item.low_stock"
+	WebhookEventItemOutOfStock     = "item.out_of_stock"
+	WebhookEventItemDeleted        = "item.deleted"
+)
+
+// WebhookEvents is a list of all the valid values for Webhook.Events
+var WebhookEvents = []string{
+	WebhookEventOrderCreated,
+	WebhookEventOrderStatusChanged,
+	WebhookEventItemUpdated,
+	WebhookEventItemLowStock,
+	WebhookEventItemOutOfStock,
+	WebhookEventItemDeleted,
+}
+
+// SubscribesTo returns true iff the webhook is active and subscribes to event.
+func (w *Webhook) SubscribesTo(event string) bool {
+	if !w.Active {
+		return false
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is a single event sent (or to be sent) to a webhook, along with
+// every attempt that has been made to deliver it.
+type WebhookDelivery struct {
+	WebhookId  string           `json:"webhookId" zoom:"index"`
+	Event      string           `json:"event"`
+	Payload    string           `json:"payload"` // The exact JSON body which is sent
+	Status     string           `json:"status"`
+	Attempts   []WebhookAttempt `json:"attempts"`
+	CreatedAt  int64            `json:"createdAt" zoom:"index"`
+	Identifier `redis:"-"`
+}
+
+// The possible values for WebhookDelivery.Status
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookAttempt records the result of a single attempt to deliver a webhook.
+type WebhookAttempt struct {
+	At         int64  `json:"at"`
+	StatusCode int    `json:"statusCode,omitempty"` // 0 if no response was received
+	Error      string `json:"error,omitempty"`
+	Duration   int64  `json:"duration"` // In milliseconds
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/albrow/5w4g-server/config"
 	"github.com/albrow/5w4g-server/controllers"
 	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/jobs"
 	"github.com/albrow/5w4g-server/models"
 	"github.com/albrow/negroni-json-recovery"
 	"github.com/codegangsta/negroni"
@@ -12,6 +13,9 @@ import (
 	"github.com/martini-contrib/cors"
 	"github.com/unrolled/render"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -24,8 +28,8 @@ func main() {
 	n.UseHandler(cors.Allow(&cors.Options{
 		AllowOrigins:     config.AllowOrigins,
 		AllowMethods:     []string{"GET", "POST", "DELETE", "PUT", "PATCH"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "X-Requested-With", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length", "Content-Type"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "X-Requested-With", "Authorization", "Idempotency-Key"},
+		ExposeHeaders:    []string{"Content-Length", "Content-Type", "Idempotent-Replayed"},
 		AllowCredentials: true,
 	}))
 
@@ -53,43 +57,175 @@ func main() {
 	adminUsers := controllers.AdminUsersController{}
 	router.HandleFunc("/admin_users", RequireAdmin(adminUsers.Create)).Methods("POST")
 	router.HandleFunc("/admin_users/{id}", RequireAdmin(adminUsers.Show)).Methods("GET")
+	router.HandleFunc("/admin_users/{id}", RequireAdmin(adminUsers.Update)).Methods("PUT")
 	router.HandleFunc("/admin_users", RequireAdmin(adminUsers.Index)).Methods("GET")
 	router.HandleFunc("/admin_users/{id}", RequireAdmin(adminUsers.Delete)).Methods("DELETE")
+	router.HandleFunc("/admin_users/{id}/restore", RequireAdmin(adminUsers.Restore)).Methods("POST")
 
 	// Items
 	items := controllers.ItemsController{}
 	router.HandleFunc("/items", RequireAdmin(items.Create)).Methods("POST")
 	router.HandleFunc("/items", items.Index).Methods("GET")
+	router.HandleFunc("/items/import", RequireAdmin(items.Import)).Methods("POST")
+	router.HandleFunc("/items/export", RequireAdmin(items.Export)).Methods("GET")
 	router.HandleFunc("/items/{id}", items.Show).Methods("GET")
 	router.HandleFunc("/items/{id}", RequireAdmin(items.Update)).Methods("PUT")
 	router.HandleFunc("/items/{id}", RequireAdmin(items.Delete)).Methods("DELETE")
+	router.HandleFunc("/items/{id}/restore", RequireAdmin(items.Restore)).Methods("POST")
+	itemRevisions := controllers.ItemRevisionsController{}
+	router.HandleFunc("/items/{id}/revisions", RequireAdmin(itemRevisions.Index)).Methods("GET")
+	router.HandleFunc("/items/{id}/revisions/{revisionId}/restore", RequireAdmin(itemRevisions.Restore)).Methods("POST")
+	stockAdjustments := controllers.StockAdjustmentsController{}
+	router.HandleFunc("/items/{id}/stock_adjustments", RequireAdmin(stockAdjustments.Create)).Methods("POST")
+	router.HandleFunc("/items/{id}/stock_adjustments", RequireAdmin(stockAdjustments.Index)).Methods("GET")
+	router.HandleFunc("/items/{id}/stock_adjustments/reconcile", RequireAdmin(stockAdjustments.Reconcile)).Methods("POST")
+
+	// Audit Log
+	auditLog := controllers.AuditLogController{}
+	router.HandleFunc("/audit_log", RequireAdmin(auditLog.Index)).Methods("GET")
+
+	// Trash
+	trash := controllers.TrashController{}
+	router.HandleFunc("/trash", RequireAdmin(trash.Index)).Methods("GET")
+
+	// Reports
+	reports := controllers.ReportsController{}
+	router.HandleFunc("/reports/sales", RequireAdmin(reports.Sales)).Methods("GET")
+	router.HandleFunc("/reports/items", RequireAdmin(reports.Items)).Methods("GET")
+	router.HandleFunc("/reports/rebuild", RequireAdmin(reports.Rebuild)).Methods("POST")
 
 	// Orders
 	orders := controllers.OrdersController{}
-	router.HandleFunc("/orders", orders.Create).Methods("POST")
+	router.HandleFunc("/orders", lib.Idempotent(orders.Create)).Methods("POST")
 	router.HandleFunc("/orders", RequireAdmin(orders.Index)).Methods("GET")
+	router.HandleFunc("/orders/export", RequireAdmin(orders.Export)).Methods("GET")
 	router.HandleFunc("/orders/{id}", RequireAdmin(orders.Show)).Methods("GET")
 	router.HandleFunc("/orders/{id}", RequireAdmin(orders.Update)).Methods("PUT")
 	router.HandleFunc("/orders/{id}", RequireAdmin(orders.Delete)).Methods("DELETE")
+	router.HandleFunc("/orders/{id}/lookup", orders.Lookup).Methods("GET")
+	router.HandleFunc("/orders/{id}/emails", RequireAdmin(orders.SendEmail)).Methods("POST")
+	router.HandleFunc("/orders/{id}/invoice.pdf", RequireAdmin(orders.Invoice)).Methods("GET")
+	router.HandleFunc("/orders/{id}/packing_slip.pdf", RequireAdmin(orders.PackingSlip)).Methods("GET")
+	refunds := controllers.RefundsController{}
+	router.HandleFunc("/orders/{id}/refunds", RequireAdmin(refunds.Create)).Methods("POST")
+	router.HandleFunc("/orders/{id}/refunds", RequireAdmin(refunds.Index)).Methods("GET")
+	shipments := controllers.ShipmentsController{}
+	router.HandleFunc("/orders/{id}/shipments", RequireAdmin(shipments.Create)).Methods("POST")
+	router.HandleFunc("/orders/{id}/shipments", RequireAdmin(shipments.Index)).Methods("GET")
+	router.HandleFunc("/orders/{id}/shipments/{shipmentId}", RequireAdmin(shipments.Update)).Methods("PUT")
+
+	// Carts
+	carts := controllers.CartsController{}
+	router.HandleFunc("/carts", carts.Create).Methods("POST")
+	router.HandleFunc("/carts/{id}", carts.Show).Methods("GET")
+	router.HandleFunc("/carts/{id}", carts.Update).Methods("PUT")
+	router.HandleFunc("/carts/{id}", carts.Delete).Methods("DELETE")
+	router.HandleFunc("/carts/{id}/merge", carts.Merge).Methods("POST")
+	router.HandleFunc("/carts/{id}/lines", carts.AddLine).Methods("POST")
+	router.HandleFunc("/carts/{id}/lines/{itemId}", carts.UpdateLine).Methods("PUT")
+	router.HandleFunc("/carts/{id}/lines/{itemId}", carts.DeleteLine).Methods("DELETE")
+	router.HandleFunc("/carts/{id}/checkout", lib.Idempotent(carts.Checkout)).Methods("POST")
+	cartReminders := controllers.CartRemindersController{}
+	router.HandleFunc("/cart_reminders/stats", RequireAdmin(cartReminders.Stats)).Methods("GET")
+	router.HandleFunc("/cart_reminders/unsubscribe", cartReminders.Unsubscribe).Methods("GET")
+
+	// Webhooks
+	webhooks := controllers.WebhooksController{}
+	router.HandleFunc("/webhooks", RequireAdmin(webhooks.Create)).Methods("POST")
+	router.HandleFunc("/webhooks", RequireAdmin(webhooks.Index)).Methods("GET")
+	router.HandleFunc("/webhooks/{id}", RequireAdmin(webhooks.Show)).Methods("GET")
+	router.HandleFunc("/webhooks/{id}", RequireAdmin(webhooks.Update)).Methods("PUT")
+	router.HandleFunc("/webhooks/{id}", RequireAdmin(webhooks.Delete)).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id}/deliveries", RequireAdmin(webhooks.Deliveries)).Methods("GET")
+	router.HandleFunc("/webhooks/{id}/deliveries/{deliveryId}/replay", RequireAdmin(webhooks.Replay)).Methods("POST")
+
+	// Background Jobs
+	jobsController := controllers.JobsController{}
+	router.HandleFunc("/jobs", RequireAdmin(jobsController.Stats)).Methods("GET")
+	router.HandleFunc("/jobs/dead", RequireAdmin(jobsController.Dead)).Methods("GET")
+	router.HandleFunc("/jobs/dead/{id}/retry", RequireAdmin(jobsController.Retry)).Methods("POST")
+	router.HandleFunc("/jobs/dead/{id}", RequireAdmin(jobsController.Delete)).Methods("DELETE")
+	router.HandleFunc("/jobs/{id}", RequireAdmin(jobsController.Show)).Methods("GET")
+
+	// Shipping
+	shipping := controllers.ShippingController{}
+	router.HandleFunc("/shipping/quote", shipping.Quote).Methods("POST")
+	shippingZones := controllers.ShippingZonesController{}
+	router.HandleFunc("/shipping/zones", RequireAdmin(shippingZones.Create)).Methods("POST")
+	router.HandleFunc("/shipping/zones", RequireAdmin(shippingZones.Index)).Methods("GET")
+	router.HandleFunc("/shipping/zones/{id}", RequireAdmin(shippingZones.Show)).Methods("GET")
+	router.HandleFunc("/shipping/zones/{id}", RequireAdmin(shippingZones.Update)).Methods("PUT")
+	router.HandleFunc("/shipping/zones/{id}", RequireAdmin(shippingZones.Delete)).Methods("DELETE")
+	shippingRates := controllers.ShippingRatesController{}
+	router.HandleFunc("/shipping/rates", RequireAdmin(shippingRates.Create)).Methods("POST")
+	router.HandleFunc("/shipping/rates", RequireAdmin(shippingRates.Index)).Methods("GET")
+	router.HandleFunc("/shipping/rates/{id}", RequireAdmin(shippingRates.Update)).Methods("PUT")
+	router.HandleFunc("/shipping/rates/{id}", RequireAdmin(shippingRates.Delete)).Methods("DELETE")
+
+	// Taxes
+	taxRates := controllers.TaxRatesController{}
+	router.HandleFunc("/tax/rates", RequireAdmin(taxRates.Create)).Methods("POST")
+	router.HandleFunc("/tax/rates", RequireAdmin(taxRates.Index)).Methods("GET")
+	router.HandleFunc("/tax/rates/{id}", RequireAdmin(taxRates.Update)).Methods("PUT")
+	router.HandleFunc("/tax/rates/{id}", RequireAdmin(taxRates.Delete)).Methods("DELETE")
+
+	// Promotions
+	promotions := controllers.PromotionsController{}
+	router.HandleFunc("/promotions", RequireAdmin(promotions.Create)).Methods("POST")
+	router.HandleFunc("/promotions", RequireAdmin(promotions.Index)).Methods("GET")
+	router.HandleFunc("/promotions/{id}", RequireAdmin(promotions.Show)).Methods("GET")
+	router.HandleFunc("/promotions/{id}", RequireAdmin(promotions.Update)).Methods("PUT")
+	router.HandleFunc("/promotions/{id}", RequireAdmin(promotions.Delete)).Methods("DELETE")
+
+	// Start background tasks
+	if config.Jobs.Concurrency > 0 {
+		pool := jobs.NewPool(config.Jobs.Concurrency, config.Jobs.PollInterval)
+		if err := pool.Start(); err != nil {
+			panic(err)
+		}
+		go stopOnSignal(pool)
+	}
+	if config.Carts.ReminderInterval > 0 {
+		go lib.RunCartReminders(config.Carts.ReminderInterval)
+	}
+	if config.Trash.PurgeInterval > 0 {
+		go lib.RunTrashPurge(config.Trash.PurgeInterval)
+	}
+	if config.Audit.PurgeInterval > 0 {
+		go lib.RunAuditLogPurge(config.Audit.PurgeInterval)
+	}
 
 	// Start the server
 	n.UseHandler(router)
 	n.Run(":" + config.Port)
 }
 
+// stopOnSignal waits for the server to be interrupted or terminated, and then lets
+// any running jobs in pool finish before exiting.
+func stopOnSignal(pool *jobs.Pool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	fmt.Println("[jobs] Waiting for running jobs to finish...")
+	pool.Stop()
+	os.Exit(0)
+}
+
 // RequireAdmin is a middleware-like function that wraps around an http.HandlerFunc.
 // It checks for the presence of a valid JWT in the header of the request. If the token
-// is valid, it calls next. If the token wasn't provided or is invalid, it writes a
-// 401 error to res and returns without calling next.
+// is valid, it calls next, recording the request in the audit log if it changes
+// anything. If the token wasn't provided or is invalid, it writes a 401 error to res
+// and returns without calling next.
 func RequireAdmin(next http.HandlerFunc) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		// If an admin user is not signed in, print an error and don't continue
-		if currentUser := lib.CurrentAdminUser(req); currentUser == nil {
+		currentUser := lib.CurrentAdminUser(req)
+		if currentUser == nil {
 			r := render.New()
 			r.JSON(res, http.StatusUnauthorized, lib.ErrUnauthorized)
 			return
 		}
 		// Otherwise, continue down the middleware chain by calling next
-		next(res, req)
+		lib.AuditRequest(currentUser, res, req, next)
 	}
 }
@@ -2,10 +2,12 @@ package tests
 
 import (
 	"fmt"
+	"github.com/albrow/5w4g-server/lib"
 	"github.com/albrow/5w4g-server/models"
 	"github.com/albrow/fipple"
 	"github.com/albrow/zoom"
 	"testing"
+	"time"
 )
 
 func TestAdminUsersCreate(t *testing.T) {
@@ -116,7 +118,31 @@ func TestAdminUsersDelete(t *testing.T) {
 	res := rec.Do(deleteReq)
 	res.AssertOk()
 
-	// Make sure the user was actually deleted
+	// Make sure the user was moved to the trash and can no longer sign in
+	showReq := rec.NewRequest("GET", "/admin_users/"+admin.Id)
+	showReq.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(showReq).AssertCode(422)
+	trashReq := rec.NewRequest("GET", "/trash")
+	trashReq.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(trashReq).AssertBodyContains("delete@me.com")
+	signInReq := rec.NewRequestWithData("POST", "/admin_users/sign_in", map[string]string{
+		"email":    "delete@me.com",
+		"password": "password",
+	})
+	rec.Do(signInReq).AssertCode(422)
+
+	// Restore the user, and then delete them again
+	restoreReq := rec.NewRequest("POST", "/admin_users/"+admin.Id+"/restore")
+	restoreReq.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(restoreReq).AssertOk()
+	rec.Do(showReq).AssertOk()
+	rec.Do(signInReq).AssertOk()
+	rec.Do(deleteReq).AssertOk()
+
+	// Purging the trash should delete the user for good
+	if _, err := lib.PurgeTrash(time.Now().Add(time.Second)); err != nil {
+		panic(err)
+	}
 	if count, err := zoom.NewQuery("AdminUser").Filter("Email =", "delete@me.com").Count(); err != nil {
 		panic(err)
 	} else if count != 0 {
@@ -0,0 +1,145 @@
+package tests
+
+import (
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	admin, err := getAdminTestUser()
+	if err != nil {
+		panic(err)
+	}
+
+	// Creating an admin user should be recorded, without the password
+	req := rec.NewJSONRequest("POST", "/admin_users", map[string]interface{}{
+		"email":           "audited@test.com",
+		"password":        "auditedPassword",
+		"confirmPassword": "auditedPassword",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", "audit-log-test")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	rec.Do(req).AssertOk()
+	req = rec.NewRequest("GET", "/audit_log?resourceType=admin_users&action=create")
+	req.Header.Add("Authorization", "Bearer "+token)
+	body := getResponseBody(req)
+	for _, expected := range []string{"audited@test.com", "[redacted]", "POST /admin_users", admin.Id, "audit-log-test"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected the audit log to contain %s. Got: %s", expected, body)
+		}
+	}
+	if strings.Contains(body, "auditedPassword") {
+		t.Error("Expected the password not to be recorded in the audit log")
+	}
+
+	// The entry for creating the admin user should have the id from the response
+	created := &models.AdminUser{}
+	if err := zoom.NewQuery("AdminUser").Filter("Email =", "audited@test.com").ScanOne(created); err != nil {
+		panic(err)
+	}
+	auditLog, err := lib.QueryAuditLog(lib.AuditLogFilter{ResourceType: "admin_users", ResourceId: created.Id}, 1, 10)
+	if err != nil {
+		panic(err)
+	}
+	if len(auditLog.Entries) != 1 {
+		t.Fatalf("Expected 1 entry for the new admin user but got %d", len(auditLog.Entries))
+	}
+
+	// The test server has no trusted proxies, so X-Forwarded-For should be ignored
+	if ip := auditLog.Entries[0].Ip; ip == "203.0.113.7" || ip == "" {
+		t.Errorf("Expected the ip to be the address the request came from but got %q", ip)
+	}
+
+	// Updating an item should record the old and new values of the fields that changed
+	item := createMockItem("Audited Item", "An item for testing the audit log.", 1.0)
+	rec.Do(updateItemRequest(rec, item.Id, map[string]string{"price": "2.5", "description": item.Description}, "")).AssertOk()
+	auditLog, err = lib.QueryAuditLog(lib.AuditLogFilter{ResourceType: "items", ResourceId: item.Id}, 1, 10)
+	if err != nil {
+		panic(err)
+	}
+	if len(auditLog.Entries) != 1 {
+		t.Fatalf("Expected 1 entry for the item but got %d", len(auditLog.Entries))
+	}
+	expectedChange := models.AuditFieldChange{Field: "price", Old: "1", New: "2.5"}
+	foundChange := false
+	for _, change := range auditLog.Entries[0].Changes {
+		if change.Field == "description" {
+			t.Error("Expected fields which did not change not to be recorded")
+		}
+		foundChange = foundChange || change == expectedChange
+	}
+	if !foundChange {
+		t.Errorf("Expected the changes to include %+v but got %+v", expectedChange, auditLog.Entries[0].Changes)
+	}
+
+	// Deleting an item should be recorded with the id of the item
+	req = rec.NewRequest("DELETE", "/items/"+item.Id)
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	auditLog, err = lib.QueryAuditLog(lib.AuditLogFilter{ResourceType: "items", ResourceId: item.Id}, 1, 10)
+	if err != nil {
+		panic(err)
+	}
+	if len(auditLog.Entries) != 2 {
+		t.Fatalf("Expected 2 entries for the item but got %d", len(auditLog.Entries))
+	}
+	for _, entry := range auditLog.Entries {
+		if entry.Action == models.AuditActionDelete && (entry.Route != "DELETE /items/:id" || entry.Status != http.StatusOK) {
+			t.Errorf("Entry for deleting the item was incorrect: %+v", entry)
+		}
+	}
+
+	// Requests which don't change anything should not be recorded
+	req = rec.NewRequest("GET", "/items/"+item.Id+"/revisions")
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req)
+	auditLog, err = lib.QueryAuditLog(lib.AuditLogFilter{ResourceId: item.Id}, 1, 10)
+	if err != nil {
+		panic(err)
+	}
+	if auditLog.Total != 2 {
+		t.Errorf("Expected 2 entries for the item but got %d", auditLog.Total)
+	}
+
+	// The log should be paginated
+	auditLog, err = lib.QueryAuditLog(lib.AuditLogFilter{AdminUserId: admin.Id}, 1, 1)
+	if err != nil {
+		panic(err)
+	}
+	if auditLog.Total < 2 || len(auditLog.Entries) != 1 {
+		t.Errorf("Expected 1 entry out of at least 2 but got %d out of %d", len(auditLog.Entries), auditLog.Total)
+	}
+
+	// Invalid filters should not be accepted, and only admins can see the log
+	req = rec.NewRequest("GET", "/audit_log?action=read&perPage=1000")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertCode(422)
+	res.AssertBodyContains("action must be one of")
+	res.AssertBodyContains("perPage must be at most")
+	rec.Get("/audit_log").AssertCode(http.StatusUnauthorized)
+
+	// Purging the log should delete old entries
+	if _, err := lib.PurgeAuditLog(time.Now().Add(time.Second)); err != nil {
+		panic(err)
+	}
+	auditLog, err = lib.QueryAuditLog(lib.AuditLogFilter{ResourceId: item.Id}, 1, 10)
+	if err != nil {
+		panic(err)
+	}
+	if auditLog.Total != 0 {
+		t.Errorf("Expected the audit log to be purged but found %d entries", auditLog.Total)
+	}
+}
@@ -17,17 +17,81 @@ func TestAdminAuth(t *testing.T) {
 		// Admin Users
 		{"POST", "/admin_users"},
 		{"GET", "/admin_users/foo"},
+		{"PUT", "/admin_users/foo"},
 		{"GET", "/admin_users"},
 		{"DELETE", "/admin_users/foo"},
+		{"POST", "/admin_users/foo/restore"},
 		// Items
 		{"POST", "/items"},
+		{"POST", "/items/import"},
+		{"GET", "/items/export"},
 		{"PUT", "/items/foo"},
 		{"DELETE", "/items/foo"},
+		{"POST", "/items/foo/restore"},
+		{"GET", "/items/foo/revisions"},
+		{"POST", "/items/foo/revisions/bar/restore"},
+		{"POST", "/items/foo/stock_adjustments"},
+		{"GET", "/items/foo/stock_adjustments"},
+		{"POST", "/items/foo/stock_adjustments/reconcile"},
+		// Audit Log
+		{"GET", "/audit_log"},
+		// Trash
+		{"GET", "/trash"},
+		// Reports
+		{"GET", "/reports/sales"},
+		{"GET", "/reports/items"},
+		{"POST", "/reports/rebuild"},
 		// Orders
 		{"GET", "/orders"},
+		{"GET", "/orders/export"},
 		{"GET", "/orders/foo"},
 		{"PUT", "/orders/foo"},
 		{"DELETE", "/orders/foo"},
+		{"POST", "/orders/foo/emails"},
+		{"GET", "/orders/foo/invoice.pdf"},
+		{"GET", "/orders/foo/packing_slip.pdf"},
+		{"POST", "/orders/foo/refunds"},
+		{"GET", "/orders/foo/refunds"},
+		{"POST", "/orders/foo/shipments"},
+		{"GET", "/orders/foo/shipments"},
+		{"PUT", "/orders/foo/shipments/bar"},
+		// Cart Reminders
+		{"GET", "/cart_reminders/stats"},
+		// Webhooks
+		{"POST", "/webhooks"},
+		{"GET", "/webhooks"},
+		{"GET", "/webhooks/foo"},
+		{"PUT", "/webhooks/foo"},
+		{"DELETE", "/webhooks/foo"},
+		{"GET", "/webhooks/foo/deliveries"},
+		{"POST", "/webhooks/foo/deliveries/bar/replay"},
+		// Jobs
+		{"GET", "/jobs"},
+		{"GET", "/jobs/dead"},
+		{"POST", "/jobs/dead/foo/retry"},
+		{"DELETE", "/jobs/dead/foo"},
+		{"GET", "/jobs/foo"},
+		// Shipping
+		{"POST", "/shipping/zones"},
+		{"GET", "/shipping/zones"},
+		{"GET", "/shipping/zones/foo"},
+		{"PUT", "/shipping/zones/foo"},
+		{"DELETE", "/shipping/zones/foo"},
+		{"POST", "/shipping/rates"},
+		{"GET", "/shipping/rates"},
+		{"PUT", "/shipping/rates/foo"},
+		{"DELETE", "/shipping/rates/foo"},
+		// Taxes
+		{"POST", "/tax/rates"},
+		{"GET", "/tax/rates"},
+		{"PUT", "/tax/rates/foo"},
+		{"DELETE", "/tax/rates/foo"},
+		// Promotions
+		{"POST", "/promotions"},
+		{"GET", "/promotions"},
+		{"GET", "/promotions/foo"},
+		{"PUT", "/promotions/foo"},
+		{"DELETE", "/promotions/foo"},
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/mailer"
+	"github.com/albrow/fipple"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCartReminders(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+	outbox := mailer.CurrentTransport().(*mailer.OutboxTransport)
+
+	// Create a cart with an email address
+	item := createMockItem("Reminder Test Item", "An item for testing cart reminders.", 3.0)
+	rec.Do(rec.NewJSONRequest("POST", "/carts", map[string]interface{}{
+		"email":           "reminder@test.com",
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 1}},
+		"shippingAddress": testShippingAddress,
+	})).AssertOk()
+	cart := findTestCart("reminder@test.com")
+
+	// Send reminders for every cart, as if they had all been abandoned
+	if _, err := lib.SendCartReminders(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mailer.DeliverQueued(); err != nil {
+		t.Fatal(err)
+	}
+	messages := outbox.MessagesTo("reminder@test.com")
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 reminder to be sent but got %d", len(messages))
+	}
+	if !strings.Contains(messages[0].Text, "Reminder Test Item") {
+		t.Errorf("Expected reminder to contain the name of the item but got:\n%s", messages[0].Text)
+	}
+	if !strings.Contains(messages[0].Text, lib.CartReminderUnsubscribeUrl("reminder@test.com")) {
+		t.Errorf("Expected reminder to contain an unsubscribe link but got:\n%s", messages[0].Text)
+	}
+
+	// Only one reminder should ever be sent for a cart, even if it is changed
+	rec.Do(rec.NewJSONRequest("PUT", fmt.Sprintf("/carts/%s/lines/%s", cart.Id, item.Id), map[string]interface{}{
+		"quantity": 2,
+	})).AssertOk()
+	if _, err := lib.SendCartReminders(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mailer.DeliverQueued(); err != nil {
+		t.Fatal(err)
+	}
+	if messages := outbox.MessagesTo("reminder@test.com"); len(messages) != 1 {
+		t.Errorf("Expected only 1 reminder to be sent but got %d", len(messages))
+	}
+
+	// Checking out the cart should count as a conversion
+	before, err := lib.GetCartReminderStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Do(rec.NewJSONRequest("POST", fmt.Sprintf("/carts/%s/checkout", cart.Id), map[string]interface{}{
+		"paymentSource": testPaymentSource,
+	})).AssertOk()
+	after, err := lib.GetCartReminderStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Converted != before.Converted+1 {
+		t.Errorf("Expected %d conversions but got %d", before.Converted+1, after.Converted)
+	}
+
+	// Only admins can see the stats
+	rec.Get("/cart_reminders/stats").AssertCode(401)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	req := rec.NewRequest("GET", "/cart_reminders/stats")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"converted"`)
+}
+
+func TestCartRemindersUnsubscribe(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	outbox := mailer.CurrentTransport().(*mailer.OutboxTransport)
+
+	// Create a cart with an email address
+	item := createMockItem("Unsubscribe Test Item", "An item for testing cart reminders.", 3.0)
+	rec.Do(rec.NewJSONRequest("POST", "/carts", map[string]interface{}{
+		"email": "unsubscribe@test.com",
+		"items": []map[string]interface{}{{"itemId": item.Id, "quantity": 1}},
+	})).AssertOk()
+
+	// An invalid token should not unsubscribe anyone
+	query := url.Values{}
+	query.Set("email", "unsubscribe@test.com")
+	query.Set("token", "invalid")
+	rec.Get("/cart_reminders/unsubscribe?" + query.Encode()).AssertCode(403)
+
+	// Unsubscribe using the link from the reminder
+	unsubscribeUrl := lib.CartReminderUnsubscribeUrl("unsubscribe@test.com")
+	rec.Get(strings.TrimPrefix(unsubscribeUrl, testUrl)).AssertOk()
+	if _, err := lib.SendCartReminders(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mailer.DeliverQueued(); err != nil {
+		t.Fatal(err)
+	}
+	if messages := outbox.MessagesTo("unsubscribe@test.com"); len(messages) != 0 {
+		t.Errorf("Expected no reminders to be sent after unsubscribing but got %d", len(messages))
+	}
+}
@@ -0,0 +1,208 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/mailer"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCartsLines(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+
+	// Create a cart with one item, which only has one unit in stock
+	item := createMockItem("Cart Test Item", "An item for testing carts.", 4.0)
+	if err := lib.AdjustItemStock(&models.StockAdjustment{ItemId: item.Id, Delta: 1 - item.AmountInStock, Reason: models.StockReasonCorrection}); err != nil {
+		panic(err)
+	}
+	res := rec.Do(rec.NewJSONRequest("POST", "/carts", map[string]interface{}{
+		"email": "cart@test.com",
+		"items": []map[string]interface{}{{"itemId": item.Id, "quantity": 2}},
+	}))
+	res.AssertOk()
+	res.AssertBodyContains(`"subtotal": 8`)
+	res.AssertBodyContains("Only 1 of Cart Test Item are left in stock.")
+	cart := findTestCart("cart@test.com")
+
+	// Add another item and then change the quantity of the first one
+	other := createMockItem("Cart Test Item 2", "Another item for testing carts.", 1.5)
+	res = rec.Do(rec.NewJSONRequest("POST", fmt.Sprintf("/carts/%s/lines", cart.Id), map[string]interface{}{
+		"itemId":   other.Id,
+		"quantity": 2,
+	}))
+	res.AssertOk()
+	res.AssertBodyContains(`"subtotal": 11`)
+	res = rec.Do(rec.NewJSONRequest("PUT", fmt.Sprintf("/carts/%s/lines/%s", cart.Id, item.Id), map[string]interface{}{
+		"quantity": 1,
+	}))
+	res.AssertOk()
+	res.AssertBodyContains(`"subtotal": 7`)
+
+	// Adding an item which doesn't exist should fail
+	res = rec.Do(rec.NewJSONRequest("POST", fmt.Sprintf("/carts/%s/lines", cart.Id), map[string]interface{}{
+		"itemId":   "nonexistent",
+		"quantity": 1,
+	}))
+	res.AssertCode(422)
+
+	// Remove the second item
+	res = rec.Do(rec.NewRequest("DELETE", fmt.Sprintf("/carts/%s/lines/%s", cart.Id, other.Id)))
+	res.AssertOk()
+	res.AssertBodyContains(`"subtotal": 4`)
+
+	// Prices should be live, so changing the price of an item changes the cart
+	item.Price = 6.0
+	if err := zoom.Save(item); err != nil {
+		panic(err)
+	}
+	res = rec.Get("/carts/" + cart.Id)
+	res.AssertOk()
+	res.AssertBodyContains(`"subtotal": 6`)
+
+	// Deleted carts should not be found
+	rec.Do(rec.NewRequest("DELETE", "/carts/"+cart.Id)).AssertOk()
+	rec.Get("/carts/" + cart.Id).AssertCode(404)
+}
+
+func TestCartsMerge(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+	outbox := mailer.CurrentTransport().(*mailer.OutboxTransport)
+
+	// Create a cart for an email address, with a shipping address
+	item := createMockItem("Cart Merge Item", "An item for testing merging carts.", 2.0)
+	rec.Do(rec.NewJSONRequest("POST", "/carts", map[string]interface{}{
+		"email":           "merge@test.com",
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 1}},
+		"shippingAddress": testShippingAddress,
+	})).AssertOk()
+	original := findTestCart("merge@test.com")
+
+	// Create a guest cart, and then set the same email address on it. Nothing from
+	// the original cart should be revealed or copied yet.
+	rec.Do(rec.NewJSONRequest("POST", "/carts", map[string]interface{}{
+		"email": "guest@test.com",
+		"items": []map[string]interface{}{{"itemId": item.Id, "quantity": 2}},
+	})).AssertOk()
+	guest := findTestCart("guest@test.com")
+	res := rec.Do(rec.NewJSONRequest("PUT", "/carts/"+guest.Id, map[string]interface{}{
+		"email": "merge@test.com",
+	}))
+	res.AssertOk()
+	res.AssertBodyContains(`"quantity": 2`)
+	if cart := findTestCart("merge@test.com"); cart.Id != original.Id {
+		t.Errorf("Expected the cart for merge@test.com to still be %s but got %s", original.Id, cart.Id)
+	}
+	guest, err := lib.FindCart(guest.Id)
+	if err != nil {
+		panic(err)
+	}
+	if guest.ShippingAddress != nil {
+		t.Errorf("Expected the guest cart to have no shipping address but got %+v", guest.ShippingAddress)
+	}
+
+	// The owner of the email address should be sent a link to merge the carts
+	if _, err := mailer.DeliverQueued(); err != nil {
+		t.Fatal(err)
+	}
+	messages := outbox.MessagesTo("merge@test.com")
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 merge email to be sent but got %d", len(messages))
+	}
+	mergeUrl, err := url.Parse(lib.CartMergeUrl(guest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(messages[0].Text, mergeUrl.String()) {
+		t.Errorf("Expected the email to contain the merge url but got:\n%s", messages[0].Text)
+	}
+
+	// Only the token from the link should merge the carts
+	rec.Do(rec.NewJSONRequest("POST", "/carts/"+guest.Id+"/merge", map[string]interface{}{
+		"token": "invalid",
+	})).AssertCode(403)
+	res = rec.Do(rec.NewJSONRequest("POST", "/carts/"+guest.Id+"/merge", map[string]interface{}{
+		"token": mergeUrl.Query().Get("mergeToken"),
+	}))
+	res.AssertOk()
+	res.AssertBodyContains(`"quantity": 3`)
+
+	// The original cart should have been merged into the guest cart, without its address
+	rec.Get("/carts/" + original.Id).AssertCode(404)
+	merged := findTestCart("merge@test.com")
+	if merged.Id != guest.Id {
+		t.Errorf("Expected the cart for merge@test.com to be %s but got %s", guest.Id, merged.Id)
+	}
+	if merged.ShippingAddress != nil {
+		t.Errorf("Expected the shipping address not to be merged but got %+v", merged.ShippingAddress)
+	}
+}
+
+func TestCartsCheckout(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+
+	// Create a cart without a shipping address
+	item := createMockItem("Cart Checkout Item", "An item for testing checking out.", 5.0)
+	rec.Do(rec.NewJSONRequest("POST", "/carts", map[string]interface{}{
+		"email": "checkout@test.com",
+		"items": []map[string]interface{}{{"itemId": item.Id, "quantity": 2}},
+	})).AssertOk()
+	cart := findTestCart("checkout@test.com")
+
+	// Checking out without a shipping address should fail
+	res := rec.Do(rec.NewJSONRequest("POST", fmt.Sprintf("/carts/%s/checkout", cart.Id), map[string]interface{}{
+		"paymentSource": testPaymentSource,
+	}))
+	res.AssertCode(422)
+	res.AssertBodyContains("a shipping address is required")
+
+	// Setting an unknown shipping method should fail
+	res = rec.Do(rec.NewJSONRequest("PUT", "/carts/"+cart.Id, map[string]interface{}{
+		"shippingAddress": testShippingAddress,
+		"shippingRateId":  "nonexistent",
+	}))
+	res.AssertCode(422)
+
+	// Once the cart has a shipping address it includes shipping in the total
+	res = rec.Do(rec.NewJSONRequest("PUT", "/carts/"+cart.Id, map[string]interface{}{
+		"shippingAddress": testShippingAddress,
+	}))
+	res.AssertOk()
+	res.AssertBodyContains(`"shippingCost": 3`)
+	res.AssertBodyContains(`"total": 13`)
+
+	// Check out
+	res = rec.Do(rec.NewJSONRequest("POST", fmt.Sprintf("/carts/%s/checkout", cart.Id), map[string]interface{}{
+		"paymentSource": testPaymentSource,
+	}))
+	res.AssertOk()
+	res.AssertBodyContains(`"email": "checkout@test.com"`)
+	res.AssertBodyContains(`"total": 13`)
+	order := &models.Order{}
+	if err := zoom.NewQuery("Order").Filter("Email =", "checkout@test.com").ScanOne(order); err != nil {
+		t.Errorf("Expected an order to be created when checking out but got error: %s", err)
+	}
+
+	// The cart should be gone
+	rec.Get("/carts/" + cart.Id).AssertCode(404)
+}
+
+// findTestCart returns the cart for the given email address. It panics if there is
+// no such cart or there was an error connecting to the database.
+func findTestCart(email string) *models.Cart {
+	cart, err := lib.FindCartByEmail(email)
+	if err != nil {
+		panic(err)
+	}
+	if cart == nil {
+		panic("Could not find cart for " + email)
+	}
+	return cart
+}
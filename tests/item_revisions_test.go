@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"net/http"
+	"testing"
+)
+
+func TestItemRevisions(t *testing.T) {
+	t.Parallel()
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Create an item with the blue image
+	name := "Test Item Revisions"
+	rec.Do(createItemRequest(rec, map[string]string{
+		"name":        name,
+		"description": "An item for testing revisions.",
+		"price":       "1.5",
+	}, blueImage)).AssertOk()
+	item := &models.Item{}
+	if err := zoom.NewQuery("Item").Filter("Name =", name).ScanOne(item); err != nil {
+		panic(err)
+	}
+
+	// Change the price and description, and then the image
+	rec.Do(updateItemRequest(rec, item.Id, map[string]string{
+		"price":       "2.5",
+		"description": "A changed description.",
+	}, "")).AssertOk()
+	rec.Do(updateItemRequest(rec, item.Id, map[string]string{}, redImage)).AssertOk()
+	if calculateHashForS3File(item.ImageS3Path) != redImageHash {
+		t.Error("The image was not changed to the red image.")
+	}
+
+	// Both changes should be listed, newest first
+	req := rec.NewRequest("GET", fmt.Sprintf("/items/%s/revisions", item.Id))
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"field": "price"`)
+	res.AssertBodyContains(`"old": 1.5`)
+	res.AssertBodyContains(`"new": 2.5`)
+	res.AssertBodyContains(`"field": "description"`)
+	res.AssertBodyContains(`"field": "image"`)
+	revisions, err := lib.ItemRevisions(item.Id)
+	if err != nil {
+		panic(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("Expected 2 revisions but got %d", len(revisions))
+	}
+	if revisions[0].Version != 2 || revisions[0].ImageArchivePath == "" {
+		t.Errorf("Expected the newest revision to be for the image. Got: %+v", revisions[0])
+	}
+
+	// Rolling back to the first revision should undo both changes, including the image
+	req = rec.NewRequest("POST", fmt.Sprintf("/items/%s/revisions/%s/restore", item.Id, revisions[1].Id))
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"price": 1.5`)
+	res.AssertBodyContains(`"description": "An item for testing revisions."`)
+	if calculateHashForS3File(item.ImageS3Path) != blueImageHash {
+		t.Error("The image was not restored to the blue image.")
+	}
+
+	// The rollback should be recorded as a revision too
+	revisions, err = lib.ItemRevisions(item.Id)
+	if err != nil {
+		panic(err)
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("Expected 3 revisions but got %d", len(revisions))
+	}
+	if revisions[0].RestoredFrom != revisions[2].Id {
+		t.Errorf("Expected the newest revision to be restored from %s but got %s", revisions[2].Id, revisions[0].RestoredFrom)
+	}
+
+	// Rolling back to a revision which doesn't exist should fail
+	req = rec.NewRequest("POST", fmt.Sprintf("/items/%s/revisions/nonexistent/restore", item.Id))
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertCode(http.StatusNotFound)
+}
@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"archive/zip"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestItemsImport(t *testing.T) {
+	t.Parallel()
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	existing := createMockItem("Test Import Existing", "An item for testing imports.", 1.0)
+
+	// One new item, one change to an existing item, and one invalid item
+	dir, err := ioutil.TempDir("", "items_import")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	csvPath := filepath.Join(dir, "items.csv")
+	csvContents := "name,description,price,image,amountInStock,unknown\n" +
+		"Test Import New,An imported item.,4.5,blue.gif,3,ignored\n" +
+		"Test Import Existing,,2.5,,50,\n" +
+		"Test Import Invalid,Missing a price.,,blue.gif,,\n"
+	if err := ioutil.WriteFile(csvPath, []byte(csvContents), 0644); err != nil {
+		panic(err)
+	}
+	zipPath := createImagesZip(filepath.Join(dir, "images.zip"), blueImage)
+	importRequest := func(dryRun string, setStock string) *fipple.Response {
+		csvFile, err := os.Open(csvPath)
+		if err != nil {
+			panic(err)
+		}
+		zipFile, err := os.Open(zipPath)
+		if err != nil {
+			panic(err)
+		}
+		req := rec.NewMultipartRequest("POST", "/items/import", map[string]string{"dryRun": dryRun, "setStock": setStock},
+			map[string]*os.File{"file": csvFile, "images": zipFile})
+		req.Header.Add("Authorization", "Bearer "+token)
+		return rec.Do(req)
+	}
+
+	// A dry run should report what would happen without changing anything
+	res := importRequest("true", "false")
+	res.AssertOk()
+	res.AssertBodyContains(`"created": 1`)
+	res.AssertBodyContains(`"updated": 1`)
+	res.AssertBodyContains(`"failed": 1`)
+	res.AssertBodyContains("price is required")
+	if count, err := zoom.NewQuery("Item").Filter("Name =", "Test Import New").Count(); err != nil {
+		panic(err)
+	} else if count != 0 {
+		t.Error("Expected a dry run not to create any items")
+	}
+
+	// Importing for real should create and update the valid items
+	importRequest("false", "false").AssertOk()
+	created := &models.Item{}
+	if err := zoom.NewQuery("Item").Filter("Name =", "Test Import New").ScanOne(created); err != nil {
+		t.Fatalf("Expected the new item to be created: %s", err)
+	}
+	if created.Price != 4.5 || created.AmountInStock != 3 || created.Status != models.ItemDraft {
+		t.Errorf("New item was incorrect: %+v", created)
+	}
+	if calculateHashForS3File(created.ImageS3Path) != blueImageHash {
+		t.Error("The image for the new item was not uploaded from the zip file.")
+	}
+	updated := &models.Item{}
+	if err := zoom.ScanById(existing.Id, updated); err != nil {
+		panic(err)
+	}
+	if updated.Price != 2.5 || updated.Description != existing.Description {
+		t.Errorf("Existing item was not updated correctly: %+v", updated)
+	}
+	if updated.AmountInStock != existing.AmountInStock {
+		t.Errorf("Expected the stock of the existing item to stay %d without setStock but got %d", existing.AmountInStock, updated.AmountInStock)
+	}
+	if revisions, err := lib.ItemRevisions(existing.Id); err != nil {
+		panic(err)
+	} else if len(revisions) != 1 {
+		t.Errorf("Expected 1 revision for the updated item but got %d", len(revisions))
+	}
+	if count, err := zoom.NewQuery("Item").Filter("Name =", "Test Import Invalid").Count(); err != nil {
+		panic(err)
+	} else if count != 0 {
+		t.Error("Expected the invalid item not to be created")
+	}
+
+	// With setStock, the stock of existing items should be set too
+	importRequest("false", "true").AssertOk()
+	if err := zoom.ScanById(existing.Id, updated); err != nil {
+		panic(err)
+	}
+	if updated.AmountInStock != 50 {
+		t.Errorf("Expected the stock of the existing item to be set to 50 with setStock but got %d", updated.AmountInStock)
+	}
+
+	// The items should be exported in a format that can be imported again
+	req := rec.NewRequest("GET", "/items/export")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains("id,name,description,price,imageUrl")
+	res.AssertBodyContains(created.Id + ",Test Import New,An imported item.,4.5," + created.ImageUrl)
+
+	// Values which look like formulas should be escaped so spreadsheets don't run them
+	formula := createMockItem("=1+2 Test Import Formula", "@SUM(A1:A2)", 1.0)
+	res = rec.Do(req)
+	res.AssertBodyContains(formula.Id + ",'=1+2 Test Import Formula,'@SUM(A1:A2),1,")
+	req = rec.NewRequest("GET", "/items/export?format=json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"name": "Test Import New"`)
+	req = rec.NewRequest("GET", "/items/export?format=xml")
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertCode(lib.StatusUnprocessableEntity)
+	rec.Get("/items/export").AssertCode(http.StatusUnauthorized)
+}
+
+// createImagesZip creates a zip file at path containing the given images, and returns
+// the path.
+func createImagesZip(path string, images ...string) string {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	writer := zip.NewWriter(f)
+	for _, image := range images {
+		contents, err := ioutil.ReadFile(image)
+		if err != nil {
+			panic(err)
+		}
+		w, err := writer.Create(filepath.Base(image))
+		if err != nil {
+			panic(err)
+		}
+		if _, err := w.Write(contents); err != nil {
+			panic(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		panic(err)
+	}
+	return path
+}
+
+func TestItemsImportImageLimit(t *testing.T) {
+	t.Parallel()
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// An image which is larger than the limit once uncompressed should be rejected,
+	// even though the zip file itself is small
+	dir, err := ioutil.TempDir("", "items_import_limit")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	csvPath := filepath.Join(dir, "items.csv")
+	csvContents := "name,description,price,image\n" +
+		"Test Import Too Large,An imported item.,4.5,large.gif\n"
+	if err := ioutil.WriteFile(csvPath, []byte(csvContents), 0644); err != nil {
+		panic(err)
+	}
+	largePath := filepath.Join(dir, "large.gif")
+	if err := ioutil.WriteFile(largePath, make([]byte, 5<<20+1), 0644); err != nil {
+		panic(err)
+	}
+	zipPath := createImagesZip(filepath.Join(dir, "images.zip"), largePath)
+	csvFile, err := os.Open(csvPath)
+	if err != nil {
+		panic(err)
+	}
+	zipFile, err := os.Open(zipPath)
+	if err != nil {
+		panic(err)
+	}
+	req := rec.NewMultipartRequest("POST", "/items/import", nil,
+		map[string]*os.File{"file": csvFile, "images": zipFile})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertCode(lib.StatusUnprocessableEntity)
+	res.AssertBodyContains("large.gif is larger than the limit of 5 MB for each image.")
+	if count, err := zoom.NewQuery("Item").Filter("Name =", "Test Import Too Large").Count(); err != nil {
+		panic(err)
+	} else if count != 0 {
+		t.Error("Expected the item with the large image not to be created")
+	}
+}
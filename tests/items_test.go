@@ -3,6 +3,7 @@ package tests
 import (
 	"fmt"
 	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/lib"
 	"github.com/albrow/5w4g-server/models"
 	"github.com/albrow/fipple"
 	"github.com/albrow/zoom"
@@ -10,7 +11,9 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -43,6 +46,7 @@ func TestItemsCreate(t *testing.T) {
 	res.AssertBodyContains(fmt.Sprintf(`"name": "%s"`, createName))
 	res.AssertBodyContains(fmt.Sprintf(`"description": "%s"`, createDesc))
 	res.AssertBodyContains(`"price": ` + createPrice)
+	res.AssertBodyContains(`"status": "draft"`)
 
 	// Make sure the item was actually created
 	item := &models.Item{}
@@ -200,6 +204,7 @@ func TestItemsUpdate(t *testing.T) {
 	}
 
 	// Make sure the old file no longer exists
+	runTestJobs()
 	if s3FileExists(origItem.ImageS3Path) {
 		t.Errorf("The old file still exists at %s. Should be deleted since the name was changed.", origItem.ImageS3Path)
 	}
@@ -240,6 +245,7 @@ func TestItemsUpdate(t *testing.T) {
 	}
 
 	// Make sure the old file no longer exists
+	runTestJobs()
 	if s3FileExists(updatedNameAndImageItem.ImageS3Path) {
 		t.Errorf("The old file still exists at %s. Should be deleted since the name was changed.",
 			updatedNameAndImageItem.ImageS3Path)
@@ -289,7 +295,30 @@ func TestItemsDelete(t *testing.T) {
 	res := rec.Do(deleteReq)
 	res.AssertOk()
 
-	// Make sure the item was actually deleted
+	// Make sure the item was moved to the trash, and its image was kept
+	showReq := rec.NewRequest("GET", "/items/"+item.Id)
+	showReq.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(showReq).AssertCode(http.StatusNotFound)
+	trashReq := rec.NewRequest("GET", "/trash")
+	trashReq.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(trashReq).AssertBodyContains(deleteName)
+	runTestJobs()
+	if !s3FileExists(item.ImageS3Path) {
+		t.Error("File was deleted from s3 before the item was purged.")
+	}
+
+	// Restore the item, and then delete it again
+	restoreReq := rec.NewRequest("POST", "/items/"+item.Id+"/restore")
+	restoreReq.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(restoreReq).AssertOk()
+	rec.Do(showReq).AssertOk()
+	rec.Do(restoreReq).AssertCode(http.StatusNotFound)
+	rec.Do(deleteReq).AssertOk()
+
+	// Purging the trash should delete the item for good
+	if _, err := lib.PurgeTrash(time.Now().Add(time.Second)); err != nil {
+		panic(err)
+	}
 	if count, err := zoom.NewQuery("Item").Filter("Name =", deleteName).Count(); err != nil {
 		panic(err)
 	} else if count != 0 {
@@ -297,11 +326,44 @@ func TestItemsDelete(t *testing.T) {
 	}
 
 	// Make sure image was actually deleted from s3
+	runTestJobs()
 	if s3FileExists(item.ImageS3Path) {
 		t.Error("File was not deleted from s3.")
 	}
 }
 
+func TestItemsDeleteOrdered(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Order an item and then move it to the trash
+	order := createTestOrder(rec, "purge@test.com")
+	itemId := order.Items[0].Item.Id
+	deleteReq := rec.NewRequest("DELETE", "/items/"+itemId)
+	deleteReq.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(deleteReq).AssertOk()
+
+	// Purging the trash should keep the item, since the order still refers to it
+	if _, err := lib.PurgeTrash(time.Now().Add(time.Second)); err != nil {
+		panic(err)
+	}
+	if err := zoom.ScanById(itemId, &models.Item{}); err != nil {
+		if _, ok := err.(*zoom.KeyNotFoundError); ok {
+			t.Error("Expected an item which was ordered not to be purged.")
+		} else {
+			panic(err)
+		}
+	}
+	showReq := rec.NewRequest("GET", "/orders/"+order.Id)
+	showReq.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(showReq)
+	res.AssertOk()
+	res.AssertBodyContains(itemId)
+}
+
 func TestItemsIndex(t *testing.T) {
 	rec := fipple.NewRecorder(t, testUrl)
 
@@ -326,6 +388,101 @@ func TestItemsIndex(t *testing.T) {
 	}
 }
 
+func TestItemsStatus(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Create an item with each status
+	now := time.Now().UTC().Unix()
+	published := createMockItem("Test Item Status Published", "A published item.", 1.0)
+	draft := createMockItem("Test Item Status Draft", "A draft item.", 1.0)
+	rec.Do(updateItemRequest(rec, draft.Id, map[string]string{"status": "draft"}, "")).AssertOk()
+	archived := createMockItem("Test Item Status Archived", "An archived item.", 1.0)
+	rec.Do(updateItemRequest(rec, archived.Id, map[string]string{"status": "archived"}, "")).AssertOk()
+	live := createMockItem("Test Item Status Live", "A scheduled item which has gone live.", 1.0)
+	rec.Do(updateItemRequest(rec, live.Id, map[string]string{
+		"status":    "scheduled",
+		"publishAt": strconv.FormatInt(now-60, 10),
+	}, "")).AssertOk()
+	future := createMockItem("Test Item Status Future", "A scheduled item which has not gone live.", 1.0)
+	rec.Do(updateItemRequest(rec, future.Id, map[string]string{
+		"status":    "scheduled",
+		"publishAt": strconv.FormatInt(now+3600, 10),
+	}, "")).AssertOk()
+	public := []*models.Item{published, live}
+	hidden := []*models.Item{draft, archived, future}
+
+	// Scheduled items need a publishAt and the status must be valid
+	res := rec.Do(updateItemRequest(rec, published.Id, map[string]string{"status": "scheduled"}, ""))
+	res.AssertCode(422)
+	res.AssertBodyContains("publishAt")
+	res = rec.Do(updateItemRequest(rec, published.Id, map[string]string{"status": "deleted"}, ""))
+	res.AssertCode(422)
+	res.AssertBodyContains("status")
+
+	// Customers should only see public items
+	body := getResponseBody(rec.NewRequest("GET", "/items"))
+	for _, item := range public {
+		if !strings.Contains(body, item.Name) {
+			t.Errorf("Expected %s to be listed for customers", item.Name)
+		}
+		rec.Get("/items/" + item.Id).AssertOk()
+	}
+	for _, item := range hidden {
+		if strings.Contains(body, item.Name) {
+			t.Errorf("Expected %s not to be listed for customers", item.Name)
+		}
+		rec.Get("/items/" + item.Id).AssertCode(http.StatusNotFound)
+	}
+
+	// Admins should see every item, and be able to filter by status
+	req := rec.NewRequest("GET", "/items")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	for _, item := range append(public, hidden...) {
+		res.AssertBodyContains(item.Name)
+		req := rec.NewRequest("GET", "/items/"+item.Id)
+		req.Header.Add("Authorization", "Bearer "+token)
+		rec.Do(req).AssertOk()
+	}
+	req = rec.NewRequest("GET", "/items?status=draft")
+	req.Header.Add("Authorization", "Bearer "+token)
+	body = getResponseBody(req)
+	if !strings.Contains(body, draft.Name) || strings.Contains(body, published.Name) {
+		t.Errorf("Expected only draft items to be listed. Got: %s", body)
+	}
+	rec.Get("/items?status=draft").AssertCode(http.StatusUnauthorized)
+	req = rec.NewRequest("GET", "/items?status=deleted")
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertCode(422)
+
+	// Customers should not be able to add hidden items to their cart or order them
+	res = rec.Do(rec.NewJSONRequest("POST", "/carts", map[string]interface{}{
+		"email": "status@test.com",
+		"items": []map[string]interface{}{{"itemId": published.Id, "quantity": 1}},
+	}))
+	res.AssertOk()
+	cart := findTestCart("status@test.com")
+	res = rec.Do(rec.NewJSONRequest("POST", fmt.Sprintf("/carts/%s/lines", cart.Id), map[string]interface{}{
+		"itemId":   archived.Id,
+		"quantity": 1,
+	}))
+	res.AssertCode(422)
+	res.AssertBodyContains("itemId")
+	res = rec.Do(rec.NewJSONRequest("POST", "/orders", map[string]interface{}{
+		"email":           "status@test.com",
+		"items":           []map[string]interface{}{{"itemId": draft.Id, "quantity": 1}},
+		"shippingAddress": testShippingAddress,
+		"paymentSource":   testPaymentSource,
+	}))
+	res.AssertCode(422)
+	res.AssertBodyContains("is not available")
+}
+
 // createItemRequest creates and returns an http.Request with the given parameters, which
 // will create an item when sent (e.g. with rec.Do).
 func createItemRequest(rec *fipple.Recorder, fields map[string]string, imageFile string) *http.Request {
@@ -0,0 +1,200 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib/jobs"
+	"github.com/albrow/fipple"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJobs(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Register a handler which records the message for each job
+	mutex := sync.Mutex{}
+	messages := []string{}
+	jobs.Register("test.record", func(job *jobs.Job) error {
+		var msg string
+		if err := job.ScanArgs(&msg); err != nil {
+			return err
+		}
+		mutex.Lock()
+		messages = append(messages, msg)
+		mutex.Unlock()
+		return nil
+	})
+
+	// Only the job which is due should run
+	if _, err := jobs.Enqueue("test", "test.record", "now"); err != nil {
+		panic(err)
+	}
+	delayed, err := jobs.EnqueueIn("test", "test.record", "later", time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	if succeeded, err := jobs.RunQueued("test"); err != nil {
+		t.Fatal(err)
+	} else if succeeded != 1 {
+		t.Errorf("Expected 1 job to succeed but got %d", succeeded)
+	}
+	if len(messages) != 1 || messages[0] != "now" {
+		t.Errorf("Expected only the job which was due to run but got messages %v", messages)
+	}
+
+	// The delayed job should still be waiting
+	req := rec.NewRequest("GET", "/jobs")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"name": "test"`)
+	res.AssertBodyContains(`"scheduled": 1`)
+	req = rec.NewRequest("GET", "/jobs/"+delayed.Id)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"args": "later"`)
+}
+
+func TestJobsDead(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Retry failed jobs right away, and only try them twice
+	defer func(maxAttempts int, backoff time.Duration) {
+		jobs.DefaultMaxAttempts = maxAttempts
+		jobs.RetryBackoff = backoff
+	}(jobs.DefaultMaxAttempts, jobs.RetryBackoff)
+	jobs.DefaultMaxAttempts = 2
+	jobs.RetryBackoff = 0
+
+	// Register a handler which fails until it is fixed, and one which panics
+	fixed := false
+	jobs.Register("test.flaky", func(job *jobs.Job) error {
+		if !fixed {
+			return fmt.Errorf("something went wrong")
+		}
+		return nil
+	})
+	jobs.Register("test.panic", func(job *jobs.Job) error {
+		panic("something went very wrong")
+	})
+	flaky, err := jobs.Enqueue("test", "test.flaky", nil)
+	if err != nil {
+		panic(err)
+	}
+	panicky, err := jobs.Enqueue("test", "test.panic", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	// Both jobs should be retried and then moved to the dead-letter list
+	if succeeded, err := jobs.RunQueued("test"); err != nil {
+		t.Fatal(err)
+	} else if succeeded != 0 {
+		t.Errorf("Expected no jobs to succeed but got %d", succeeded)
+	}
+	if job, err := jobs.Find(flaky.Id); err != nil {
+		panic(err)
+	} else if job == nil || job.Attempts != 2 {
+		t.Errorf("Expected the flaky job to be attempted 2 times but got %+v", job)
+	}
+	req := rec.NewRequest("GET", "/jobs/dead")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(flaky.Id)
+	res.AssertBodyContains("something went wrong")
+	res.AssertBodyContains(panicky.Id)
+	res.AssertBodyContains("panic: something went very wrong")
+
+	// Once the problem is fixed, retrying the job should work
+	fixed = true
+	req = rec.NewRequest("POST", fmt.Sprintf("/jobs/dead/%s/retry", flaky.Id))
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	if succeeded, err := jobs.RunQueued("test"); err != nil {
+		t.Fatal(err)
+	} else if succeeded != 1 {
+		t.Errorf("Expected 1 job to succeed but got %d", succeeded)
+	}
+	if job, err := jobs.Find(flaky.Id); err != nil {
+		panic(err)
+	} else if job != nil {
+		t.Errorf("Expected the job to be deleted after it succeeded but got %+v", job)
+	}
+
+	// The job is no longer dead, so it can't be retried again
+	req = rec.NewRequest("POST", fmt.Sprintf("/jobs/dead/%s/retry", flaky.Id))
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertCode(404)
+
+	// Deleting a dead job should remove it for good
+	req = rec.NewRequest("DELETE", "/jobs/dead/"+panicky.Id)
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	if job, err := jobs.Find(panicky.Id); err != nil {
+		panic(err)
+	} else if job != nil {
+		t.Errorf("Expected the dead job to be deleted but got %+v", job)
+	}
+}
+
+func TestJobsRequeueStale(t *testing.T) {
+	// Register a handler which stops the worker running it part way through the
+	// first time, as if the server crashed, and succeeds after that
+	crashed := false
+	jobs.Register("test.crash", func(job *jobs.Job) error {
+		if !crashed {
+			crashed = true
+			runtime.Goexit()
+		}
+		return nil
+	})
+	job, err := jobs.Enqueue("test.stale", "test.crash", nil)
+	if err != nil {
+		panic(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		jobs.RunQueued("test.stale")
+	}()
+	<-done
+	if !crashed {
+		t.Fatal("Expected the job to be run")
+	}
+
+	// The job was taken off the queue, so it should not run again by itself
+	if succeeded, err := jobs.RunQueued("test.stale"); err != nil {
+		t.Fatal(err)
+	} else if succeeded != 0 {
+		t.Errorf("Expected no jobs to run before the job was requeued but got %d", succeeded)
+	}
+
+	// Requeueing stale jobs should put it back, and then it should succeed
+	if requeued, err := jobs.RequeueStaleJobs(); err != nil {
+		t.Fatal(err)
+	} else if requeued != 1 {
+		t.Errorf("Expected 1 job to be requeued but got %d", requeued)
+	}
+	if succeeded, err := jobs.RunQueued("test.stale"); err != nil {
+		t.Fatal(err)
+	} else if succeeded != 1 {
+		t.Errorf("Expected the requeued job to succeed but got %d", succeeded)
+	}
+	if found, err := jobs.Find(job.Id); err != nil {
+		panic(err)
+	} else if found != nil {
+		t.Errorf("Expected the job to be deleted after it succeeded but got %+v", found)
+	}
+}
@@ -0,0 +1,48 @@
+package tests
+
+import (
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"testing"
+	"time"
+)
+
+func TestLocks(t *testing.T) {
+	config.Init()
+	models.Init()
+
+	// A lock can only be held by one holder at a time
+	first, err := lib.AcquireLock("test", 50*time.Millisecond)
+	if err != nil {
+		panic(err)
+	} else if first == nil {
+		t.Fatal("Expected the lock to be acquired")
+	}
+	if second, err := lib.AcquireLock("test", time.Minute); err != nil {
+		panic(err)
+	} else if second != nil {
+		t.Fatal("Expected the lock not to be acquired while it is held")
+	}
+
+	// Once the lock expires and someone else acquires it, the first holder should
+	// not be able to release it
+	time.Sleep(100 * time.Millisecond)
+	second, err := lib.AcquireLock("test", time.Minute)
+	if err != nil {
+		panic(err)
+	} else if second == nil {
+		t.Fatal("Expected the lock to be acquired after it expired")
+	}
+	if err := first.Release(); err != nil {
+		panic(err)
+	}
+	if third, err := lib.AcquireLock("test", time.Minute); err != nil {
+		panic(err)
+	} else if third != nil {
+		t.Error("Expected releasing an expired lock not to release the new holder's lock")
+	}
+	if err := second.Release(); err != nil {
+		panic(err)
+	}
+}
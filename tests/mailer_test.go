@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/lib/mailer"
+	"github.com/albrow/5w4g-server/models"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMailerNewMessage(t *testing.T) {
+	data := map[string]interface{}{
+		"Lines": []map[string]interface{}{
+			{"Name": "Sticker <Large>", "Quantity": 2, "Price": 3.5},
+		},
+		"CartUrl":        "http://localhost:8000/cart/abc",
+		"UnsubscribeUrl": "http://localhost:4000/cart_reminders/unsubscribe?email=a%40b.com",
+	}
+	msg, err := mailer.NewMessage("cart_reminder", "customer@test.com", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.To != "customer@test.com" {
+		t.Errorf("Expected To to be customer@test.com but got %s", msg.To)
+	}
+	if msg.Subject != "You left something in your cart" {
+		t.Errorf("Unexpected subject: %s", msg.Subject)
+	}
+	if !strings.Contains(msg.Text, "2 x Sticker <Large> ($3.50 each)") {
+		t.Errorf("Expected text to contain the line but got:\n%s", msg.Text)
+	}
+	// The html version should be rendered inside the layout and escaped
+	if !strings.Contains(msg.Html, "<!DOCTYPE html>") {
+		t.Errorf("Expected html to use the layout but got:\n%s", msg.Html)
+	}
+	if !strings.Contains(msg.Html, "Sticker &lt;Large&gt;") {
+		t.Errorf("Expected html to contain the escaped item name but got:\n%s", msg.Html)
+	}
+
+	// Unknown message types should return an error
+	if _, err := mailer.NewMessage("nonexistent", "customer@test.com", nil); err == nil {
+		t.Error("Expected an error for an unknown message type but got none.")
+	}
+}
+
+func TestMailerEncode(t *testing.T) {
+	msg := &mailer.Message{
+		From:    "5w4g <orders@localhost>",
+		To:      "customer@test.com",
+		Subject: "Your order",
+		Text:    "Thanks for your order!",
+		Html:    "<p>Thanks for your order!</p>",
+	}
+	raw, err := mailer.Encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := string(raw)
+	for _, expected := range []string{
+		"Subject: Your order\r\n",
+		"Content-Type: multipart/alternative; boundary=",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+		"Content-Type: text/html; charset=\"utf-8\"",
+		"<p>Thanks for your order!</p>",
+	} {
+		if !strings.Contains(encoded, expected) {
+			t.Errorf("Expected encoded message to contain %q but got:\n%s", expected, encoded)
+		}
+	}
+}
+
+func TestMailerFileTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "5w4g-mailer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	transport := mailer.NewFileTransport(dir)
+	if err := transport.Send(&mailer.Message{
+		From:    "5w4g <orders@localhost>",
+		To:      "customer@test.com",
+		Subject: "Hello",
+		Text:    "Hello from the file transport.",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 .eml file but got %d", len(files))
+	}
+	contents, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "Hello from the file transport.") {
+		t.Errorf("Expected file to contain the message but got:\n%s", contents)
+	}
+}
+
+func TestMailerQueue(t *testing.T) {
+	config.Init()
+	models.Init()
+	outbox := mailer.CurrentTransport().(*mailer.OutboxTransport)
+
+	// Queued messages should only be sent when the queue is delivered
+	if err := mailer.Enqueue(&mailer.Message{
+		To:      "queue@test.com",
+		Subject: "Queued",
+		Text:    "This message was queued.",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if messages := outbox.MessagesTo("queue@test.com"); len(messages) != 0 {
+		t.Fatalf("Expected no messages before delivering the queue but got %d", len(messages))
+	}
+	if _, err := mailer.DeliverQueued(); err != nil {
+		t.Fatal(err)
+	}
+	messages := outbox.MessagesTo("queue@test.com")
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message after delivering the queue but got %d", len(messages))
+	}
+	if messages[0].From != config.Mail.From {
+		t.Errorf("Expected From to default to %s but got %s", config.Mail.From, messages[0].From)
+	}
+}
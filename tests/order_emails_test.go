@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/mailer"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestOrderEmails(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	outbox := mailer.CurrentTransport().(*mailer.OutboxTransport)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Placing an order should send a confirmation
+	order := createTestOrder(rec, "emails@test.com")
+	if _, err := mailer.DeliverQueued(); err != nil {
+		t.Fatal(err)
+	}
+	messages := outbox.MessagesTo("emails@test.com")
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 confirmation email but got %d", len(messages))
+	}
+	for _, expected := range []string{"Test Order Item emails@test.com", lib.OrderLookupUrl(order), "Subtotal: $5.00"} {
+		if !strings.Contains(messages[0].Text, expected) {
+			t.Errorf("Expected confirmation to contain %q but got:\n%s", expected, messages[0].Text)
+		}
+	}
+
+	// Shipping the order should send a shipping notice with the tracking details
+	req := rec.NewJSONRequest("POST", "/orders/"+order.Id+"/shipments", map[string]interface{}{
+		"carrier":        "USPS",
+		"trackingNumber": "9400111899223100000000",
+		"trackingUrl":    "https://tools.usps.com/go/TrackConfirmAction?tLabels=9400111899223100000000",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	if _, err := mailer.DeliverQueued(); err != nil {
+		t.Fatal(err)
+	}
+	messages = outbox.MessagesTo("emails@test.com")
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 emails after shipping but got %d", len(messages))
+	}
+	if !strings.Contains(messages[1].Text, "Tracking number: 9400111899223100000000") {
+		t.Errorf("Expected shipping notice to contain the tracking number but got:\n%s", messages[1].Text)
+	}
+
+	// Marking the order as delivered should not send the shipping notice again
+	req = rec.NewJSONRequest("PUT", "/orders/"+order.Id, map[string]interface{}{
+		"status": "delivered",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	if _, err := mailer.DeliverQueued(); err != nil {
+		t.Fatal(err)
+	}
+	if messages := outbox.MessagesTo("emails@test.com"); len(messages) != 2 {
+		t.Errorf("Expected no more emails after the order was delivered but got %d", len(messages)-2)
+	}
+
+	// Admins can resend the confirmation
+	req = rec.NewJSONRequest("POST", fmt.Sprintf("/orders/%s/emails", order.Id), map[string]interface{}{
+		"type": "order_confirmation",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	req = rec.NewJSONRequest("POST", fmt.Sprintf("/orders/%s/emails", order.Id), map[string]interface{}{
+		"type": "nonexistent",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertCode(422)
+
+	// Every email should be recorded on the order
+	updated := &models.Order{}
+	if err := zoom.ScanById(order.Id, updated); err != nil {
+		panic(err)
+	}
+	expectedTypes := []string{models.OrderEmailConfirmation, models.OrderEmailShipped, models.OrderEmailConfirmation}
+	if len(updated.Emails) != len(expectedTypes) {
+		t.Fatalf("Expected %d emails to be recorded but got %d", len(expectedTypes), len(updated.Emails))
+	}
+	for i, email := range updated.Emails {
+		if email.Type != expectedTypes[i] {
+			t.Errorf("Expected emails[%d] to be %s but got %s", i, expectedTypes[i], email.Type)
+		}
+	}
+}
+
+func TestOrdersLookup(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	order := createTestOrder(rec, "lookup@test.com")
+
+	// The token from the lookup url should let the customer see their order
+	lookupUrl, err := url.Parse(lib.OrderLookupUrl(order))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := rec.Get(fmt.Sprintf("/orders/%s/lookup?token=%s", order.Id, lookupUrl.Query().Get("token")))
+	res.AssertOk()
+	res.AssertBodyContains(`"email": "lookup@test.com"`)
+
+	// Any other token should not
+	rec.Get(fmt.Sprintf("/orders/%s/lookup?token=invalid", order.Id)).AssertCode(403)
+}
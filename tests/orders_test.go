@@ -3,15 +3,21 @@ package tests
 import (
 	"fmt"
 	"github.com/albrow/5w4g-server/config"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/payments"
 	"github.com/albrow/5w4g-server/models"
 	"github.com/albrow/fipple"
 	"github.com/albrow/zoom"
+	"net/http"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestOrdersCreate(t *testing.T) {
 	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
 
 	// First create some items which we can add to the order
 	items := []*models.Item{}
@@ -31,8 +37,10 @@ func TestOrdersCreate(t *testing.T) {
 	}
 	orderEmail := "test@test.com"
 	orderData := map[string]interface{}{
-		"email": orderEmail,
-		"items": orderItems,
+		"email":           orderEmail,
+		"items":           orderItems,
+		"shippingAddress": testShippingAddress,
+		"paymentSource":   testPaymentSource,
 	}
 	req := rec.NewJSONRequest("POST", "/orders", orderData)
 
@@ -40,6 +48,12 @@ func TestOrdersCreate(t *testing.T) {
 	res := rec.Do(req)
 	res.AssertOk()
 	res.AssertBodyContains(fmt.Sprintf(`"email": "%s"`, orderEmail))
+	res.AssertBodyContains(`"postalCode": "94103"`)
+	res.AssertBodyContains(`"status": "pending"`)
+	// The cheapest shipping method should be chosen by default
+	res.AssertBodyContains(`"shippingMethod": "Standard"`)
+	res.AssertBodyContains(`"shippingCost": 3`)
+	res.AssertBodyContains(`"paymentStatus": "authorized"`)
 	for _, item := range items {
 		res.AssertBodyContains(fmt.Sprintf(`"name": "%s"`, item.Name))
 		res.AssertBodyContains(fmt.Sprintf(`"description": "%s"`, item.Description))
@@ -98,5 +112,429 @@ func TestOrdersCreate(t *testing.T) {
 		t.Errorf("order.Items consisted of the following item ids: %v", gotIds)
 	}
 
+	// Check that the shipping address was saved
+	if order.ShippingAddress.City != testShippingAddress["city"] {
+		t.Errorf("order.ShippingAddress.City was incorrect. Expected %s but got %s",
+			testShippingAddress["city"], order.ShippingAddress.City)
+	}
+
 	// TODO: test server-side validation errors
 }
+
+func TestOrdersCreateAddressValidation(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+	item := createMockItem("Order Address Test Item", "An item for testing addresses", 1.0)
+
+	// Use a table-driven test to check for proper validation errors
+	testInputs := []struct {
+		address          map[string]string
+		expectedContains []string
+	}{
+		{
+			// Missing required fields
+			address: map[string]string{"country": "US"},
+			expectedContains: []string{
+				"shippingAddress.name is required",
+				"shippingAddress.line1 is required",
+				"shippingAddress.region is required",
+				"shippingAddress.postalCode is required",
+			},
+		},
+		{
+			// Malformed postal code for the country
+			address: map[string]string{
+				"name":       "Jane Doe",
+				"line1":      "1 Main St",
+				"city":       "Ottawa",
+				"region":     "ON",
+				"postalCode": "12345",
+				"country":    "CA",
+			},
+			expectedContains: []string{"shippingAddress.postalCode must be formatted like"},
+		},
+		{
+			// Country we don't ship to
+			address: map[string]string{
+				"name":    "Jane Doe",
+				"line1":   "1 Main St",
+				"city":    "Nowhere",
+				"country": "ZZ",
+			},
+			expectedContains: []string{"not a country we ship to"},
+		},
+	}
+
+	for _, testInput := range testInputs {
+		req := rec.NewJSONRequest("POST", "/orders", map[string]interface{}{
+			"email":           "address@test.com",
+			"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 1}},
+			"shippingAddress": testInput.address,
+			"paymentSource":   testPaymentSource,
+		})
+		res := rec.Do(req)
+		res.AssertCode(422)
+		for _, txt := range testInput.expectedContains {
+			res.AssertBodyContains(txt)
+		}
+	}
+}
+
+func TestOrdersUpdate(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+
+	// Get a valid token
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// First create an order which we can update
+	order := createTestOrder(rec, "update@test.com")
+
+	// Correct the shipping address
+	newAddress := map[string]string{
+		"name":       "Jane Doe",
+		"line1":      "221B Baker Street",
+		"city":       "London",
+		"postalCode": "nw1 6xe",
+		"country":    "gb",
+	}
+	req := rec.NewJSONRequest("PUT", "/orders/"+order.Id, map[string]interface{}{
+		"shippingAddress": newAddress,
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"postalCode": "NW1 6XE"`)
+	res.AssertBodyContains(`"country": "GB"`)
+
+	// Orders can only be shipped by creating a shipment
+	req = rec.NewJSONRequest("PUT", "/orders/"+order.Id, map[string]interface{}{
+		"status": "shipped",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertCode(422)
+	res.AssertBodyContains("POST /orders/:id/shipments")
+	shipTestOrder(rec, order.Id)
+	req = rec.NewRequest("GET", "/orders/"+order.Id)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"status": "shipped"`)
+	// The payment should have been captured when the order shipped
+	res.AssertBodyContains(`"paymentStatus": "captured"`)
+
+	// Now that the order has shipped, the address should not be changeable
+	req = rec.NewJSONRequest("PUT", "/orders/"+order.Id, map[string]interface{}{
+		"shippingAddress": testShippingAddress,
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertCode(422)
+	res.AssertBodyContains("cannot be changed after it has shipped")
+}
+
+func TestOrdersPayment(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+
+	// Get a valid token
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Orders should not be created if the payment is declined
+	item := createMockItem("Order Payment Test Item", "An item for testing payments.", 5.0)
+	orderData := map[string]interface{}{
+		"email":           "declined@test.com",
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 1}},
+		"shippingAddress": testShippingAddress,
+		"paymentSource":   payments.FakeSourceDeclined,
+	}
+	res := rec.Do(rec.NewJSONRequest("POST", "/orders", orderData))
+	res.AssertCode(402)
+	res.AssertBodyContains("Your card was declined")
+	if count, err := zoom.NewQuery("Order").Filter("Email =", "declined@test.com").Count(); err != nil {
+		panic(err)
+	} else if count != 0 {
+		t.Errorf("Expected no orders to be created when payment was declined, but %d were.", count)
+	}
+	declinedItem := &models.Item{}
+	if err := zoom.ScanById(item.Id, declinedItem); err != nil {
+		panic(err)
+	} else if declinedItem.AmountInStock != item.AmountInStock {
+		t.Errorf("Expected stock to be put back when payment was declined. Expected %d but got %d.", item.AmountInStock, declinedItem.AmountInStock)
+	}
+
+	// Cancelling an order should void the payment
+	order := createTestOrder(rec, "cancel@test.com")
+	req := rec.NewJSONRequest("PUT", "/orders/"+order.Id, map[string]interface{}{
+		"status": "cancelled",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"paymentStatus": "voided"`)
+
+	// Cancelling an order should put its items back in stock
+	cancelledItem := &models.Item{}
+	if err := zoom.ScanById(order.Items[0].Item.Id, cancelledItem); err != nil {
+		panic(err)
+	} else if cancelledItem.AmountInStock != 100 {
+		t.Errorf("Expected stock to be put back when the order was cancelled. Expected 100 but got %d.", cancelledItem.AmountInStock)
+	}
+	adjustments, err := lib.StockHistory(cancelledItem.Id)
+	if err != nil {
+		panic(err)
+	}
+	returned := 0
+	for _, adjustment := range adjustments {
+		if adjustment.Reason == models.StockReasonReturn && adjustment.Reference == order.Id {
+			returned += adjustment.Delta
+		}
+	}
+	if returned != 1 {
+		t.Errorf("Expected the cancellation to be recorded in the stock ledger as a return of 1 but got %d", returned)
+	}
+
+	// A cancelled order cannot be shipped
+	req = rec.NewJSONRequest("PUT", "/orders/"+order.Id, map[string]interface{}{
+		"status": "shipped",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertCode(422)
+	res.AssertBodyContains("cannot be changed from cancelled to shipped")
+}
+
+func TestOrdersAvailability(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+	placeOrder := func(item *models.Item, quantity int) *fipple.Response {
+		return rec.Do(rec.NewJSONRequest("POST", "/orders", map[string]interface{}{
+			"email":           "availability@test.com",
+			"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": quantity}},
+			"shippingAddress": testShippingAddress,
+			"paymentSource":   testPaymentSource,
+		}))
+	}
+
+	// Items which are only sold while in stock can't be oversold
+	inStock := createMockItem("In Stock Test Item", "An item which is only sold while in stock.", 1.0)
+	rec.Do(updateItemRequest(rec, inStock.Id, map[string]string{"amountInStock": "2"}, "")).AssertOk()
+	res := placeOrder(inStock, 3)
+	res.AssertCode(422)
+	res.AssertBodyContains("Only 2 of In Stock Test Item are left in stock.")
+	res = placeOrder(inStock, 2)
+	res.AssertOk()
+	res.AssertBodyContains(`"readyToShip": true`)
+	placeOrder(inStock, 1).AssertBodyContains("In Stock Test Item is out of stock.")
+
+	// Backorder items can go below 0 up to their limit
+	backorder := createMockItem("Backorder Test Item", "An item which can be backordered.", 1.0)
+	rec.Do(updateItemRequest(rec, backorder.Id, map[string]string{
+		"amountInStock":  "1",
+		"availability":   "backorder",
+		"backorderLimit": "2",
+	}, "")).AssertOk()
+	res = placeOrder(backorder, 3)
+	res.AssertOk()
+	res.AssertBodyContains(`"backordered": 2`)
+	res.AssertBodyContains(`"readyToShip": false`)
+	res = placeOrder(backorder, 1)
+	res.AssertCode(422)
+	res.AssertBodyContains("Backorder Test Item can't be ordered right now.")
+
+	// Pre-order items need an expected ship date, which is shown on orders
+	preorder := createMockItem("Preorder Test Item", "An item which can be pre-ordered.", 1.0)
+	res = rec.Do(updateItemRequest(rec, preorder.Id, map[string]string{"availability": "preorder"}, ""))
+	res.AssertCode(422)
+	res.AssertBodyContains("expectedShipDate is required")
+	shipDate := strconv.FormatInt(time.Now().Add(30*24*time.Hour).Unix(), 10)
+	res = rec.Do(updateItemRequest(rec, preorder.Id, map[string]string{
+		"availability":     "preorder",
+		"expectedShipDate": shipDate,
+	}, ""))
+	res.AssertOk()
+	res.AssertBodyContains(`"expectedShipDate": ` + shipDate)
+	res = placeOrder(preorder, 200)
+	res.AssertOk()
+	res.AssertBodyContains(`"preorder": true`)
+	res.AssertBodyContains(`"readyToShip": false`)
+}
+
+func TestOrdersCreateIdempotency(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+
+	item := createMockItem("Order Idempotency Test Item", "An item for testing idempotency.", 5.0)
+	orderData := map[string]interface{}{
+		"email":           "idempotency@test.com",
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 1}},
+		"shippingAddress": testShippingAddress,
+		"paymentSource":   testPaymentSource,
+	}
+
+	// Send the same request twice with the same key. Only one order should be
+	// created, and the second response should be a replay of the first.
+	for i := 0; i < 2; i++ {
+		req := rec.NewJSONRequest("POST", "/orders", orderData)
+		req.Header.Set("Idempotency-Key", "test-idempotency-key")
+		res := rec.Do(req)
+		res.AssertOk()
+		res.AssertBodyContains(`"email": "idempotency@test.com"`)
+		if i == 1 && res.Header.Get("Idempotent-Replayed") != "true" {
+			t.Error("Expected the second response to have an Idempotent-Replayed header but it did not.")
+		}
+	}
+	if count, err := zoom.NewQuery("Order").Filter("Email =", "idempotency@test.com").Count(); err != nil {
+		panic(err)
+	} else if count != 1 {
+		t.Errorf("Expected 1 order to be created but found %d.", count)
+	}
+
+	// Reusing the key with a different body should fail
+	orderData["email"] = "idempotency2@test.com"
+	req := rec.NewJSONRequest("POST", "/orders", orderData)
+	req.Header.Set("Idempotency-Key", "test-idempotency-key")
+	res := rec.Do(req)
+	res.AssertCode(422)
+	res.AssertBodyContains("already been used for a different request")
+}
+
+func TestOrdersExport(t *testing.T) {
+	t.Parallel()
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	order := createTestOrder(rec, "export@test.com")
+	exportRequest := func(params string) *http.Request {
+		req := rec.NewRequest("GET", "/orders/export?"+params)
+		req.Header.Add("Authorization", "Bearer "+token)
+		return req
+	}
+
+	// The CSV should have a row for the line in the order, with the order totals. The
+	// line should have the price the item had when the order was placed.
+	rec.Do(updateItemRequest(rec, order.Items[0].Item.Id, map[string]string{"price": "7"}, "")).AssertOk()
+	res := rec.Do(exportRequest(fmt.Sprintf("since=%d&status=pending", order.CreatedAt)))
+	res.AssertOk()
+	res.AssertBodyContains("orderId,createdAt,status,email,itemId,itemName,quantity,refunded,unitPrice,lineTotal")
+	res.AssertBodyContains(fmt.Sprintf("%s,%s,pending,export@test.com,%s,Test Order Item export@test.com,1,0,5.00,5.00,",
+		order.Id, time.Unix(order.CreatedAt, 0).UTC().Format(time.RFC3339), order.Items[0].Item.Id))
+	res.AssertBodyContains(fmt.Sprintf(",%.2f,", order.Total))
+
+	// JSON Lines should have an object for the order
+	res = rec.Do(exportRequest(fmt.Sprintf("since=%d&format=jsonl", order.CreatedAt)))
+	res.AssertOk()
+	res.AssertBodyContains(`"email":"export@test.com"`)
+
+	// Orders outside of the filters should be left out
+	if body := getResponseBody(exportRequest(fmt.Sprintf("until=%d", order.CreatedAt-1))); strings.Contains(body, order.Id) {
+		t.Error("Expected orders created after until to be left out of the export")
+	}
+	if body := getResponseBody(exportRequest("status=cancelled")); strings.Contains(body, order.Id) {
+		t.Error("Expected orders with a different status to be left out of the export")
+	}
+
+	// Orders should be read in batches without skipping any
+	expected, err := zoom.NewQuery("Order").Filter("CreatedAt >=", order.CreatedAt).Count()
+	if err != nil {
+		panic(err)
+	}
+	count := 0
+	if err := lib.EachOrder(lib.OrderFilter{Since: order.CreatedAt}, 1, func(*models.Order) error {
+		count++
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	if count < expected {
+		t.Errorf("Expected at least %d orders in batches of 1 but got %d", expected, count)
+	}
+
+	// Invalid filters should not be accepted
+	res = rec.Do(exportRequest("status=lost&since=yesterday&format=xml"))
+	res.AssertCode(422)
+	res.AssertBodyContains("status must be one of")
+	res.AssertBodyContains("since must be a UTC unix time")
+	res.AssertBodyContains("format must be either csv or jsonl")
+	rec.Get("/orders/export").AssertCode(http.StatusUnauthorized)
+}
+
+func TestOrdersInvoice(t *testing.T) {
+	t.Parallel()
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	pdfRequest := func(order *models.Order, document string) *fipple.Response {
+		req := rec.NewRequest("GET", fmt.Sprintf("/orders/%s/%s", order.Id, document))
+		req.Header.Add("Authorization", "Bearer "+token)
+		res := rec.Do(req)
+		res.AssertOk()
+		if contentType := res.Header.Get("Content-Type"); contentType != "application/pdf" {
+			t.Errorf("Expected Content-Type to be application/pdf but got %s", contentType)
+		}
+		if !strings.HasPrefix(res.Body, "%PDF-") {
+			t.Errorf("Expected %s to be a PDF", document)
+		}
+		return res
+	}
+	invoiceNumber := func(order *models.Order) int {
+		saved := &models.Order{}
+		if err := zoom.ScanById(order.Id, saved); err != nil {
+			panic(err)
+		}
+		return saved.InvoiceNumber
+	}
+
+	// The first invoice for an order should give it an invoice number, which it keeps
+	first := createTestOrder(rec, "invoice1@test.com")
+	second := createTestOrder(rec, "invoice2@test.com")
+	if invoiceNumber(first) != 0 {
+		t.Error("Expected orders not to have an invoice number until an invoice is generated")
+	}
+	res := pdfRequest(first, "invoice.pdf")
+	number := invoiceNumber(first)
+	if number == 0 {
+		t.Fatal("Expected the order to be given an invoice number")
+	}
+	if disposition := res.Header.Get("Content-Disposition"); !strings.Contains(disposition, lib.FormatInvoiceNumber(number)) {
+		t.Errorf("Expected the filename to contain the invoice number. Got: %s", disposition)
+	}
+	pdfRequest(first, "invoice.pdf")
+	if invoiceNumber(first) != number {
+		t.Errorf("Expected the invoice number to stay %d but got %d", number, invoiceNumber(first))
+	}
+
+	// Later invoices should get later numbers, even if the order was saved without one
+	if err := zoom.Save(second); err != nil {
+		panic(err)
+	}
+	pdfRequest(second, "invoice.pdf")
+	if invoiceNumber(second) <= number {
+		t.Errorf("Expected the second invoice number to be after %d but got %d", number, invoiceNumber(second))
+	}
+	first.InvoiceNumber = 0
+	if err := zoom.Save(first); err != nil {
+		panic(err)
+	}
+	pdfRequest(first, "invoice.pdf")
+	if invoiceNumber(first) != number {
+		t.Errorf("Expected the order to get its invoice number %d back but got %d", number, invoiceNumber(first))
+	}
+
+	// Packing slips should be available for any order too
+	pdfRequest(second, "packing_slip.pdf")
+	req := rec.NewRequest("GET", "/orders/nonexistent/invoice.pdf")
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertCode(http.StatusNotFound)
+	rec.Get(fmt.Sprintf("/orders/%s/packing_slip.pdf", first.Id)).AssertCode(http.StatusUnauthorized)
+}
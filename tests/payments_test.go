@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib/payments"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFakeGateway(t *testing.T) {
+	gateway := payments.NewFakeGateway(0)
+
+	// Declined sources should return a DeclineError
+	if _, err := gateway.Authorize(1000, payments.FakeSourceInsufficientFunds, "test", ""); err == nil {
+		t.Error("Expected an error when authorizing with a declined source but got none.")
+	} else if declineErr, ok := err.(*payments.DeclineError); !ok {
+		t.Errorf("Expected a *payments.DeclineError but got %T: %s", err, err.Error())
+	} else if declineErr.Code != "insufficient_funds" {
+		t.Errorf("Expected decline code insufficient_funds but got %s", declineErr.Code)
+	}
+
+	// Authorize, capture, and then refund in two parts
+	intent, err := gateway.Authorize(1000, "tok_visa", "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intent.Status != payments.StatusAuthorized {
+		t.Errorf("Expected status %s but got %s", payments.StatusAuthorized, intent.Status)
+	}
+	if _, err := gateway.Capture(intent.Id, 2000); err == nil {
+		t.Error("Expected an error when capturing more than was authorized but got none.")
+	}
+	if intent, err = gateway.Capture(intent.Id, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if intent, err = gateway.Refund(intent.Id, 400); err != nil {
+		t.Fatal(err)
+	}
+	if intent.Status != payments.StatusPartiallyRefunded {
+		t.Errorf("Expected status %s but got %s", payments.StatusPartiallyRefunded, intent.Status)
+	}
+	if _, err := gateway.Refund(intent.Id, 700); err == nil {
+		t.Error("Expected an error when refunding more than was captured but got none.")
+	}
+	if intent, err = gateway.Refund(intent.Id, 600); err != nil {
+		t.Fatal(err)
+	}
+	if intent.Status != payments.StatusRefunded {
+		t.Errorf("Expected status %s but got %s", payments.StatusRefunded, intent.Status)
+	}
+
+	// Captured intents cannot be voided
+	if _, err := gateway.Void(intent.Id); err == nil {
+		t.Error("Expected an error when voiding a captured intent but got none.")
+	}
+
+	// Authorizing again with the same idempotency key should return the first intent
+	first, err := gateway.Authorize(1000, "tok_visa", "test", "test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := gateway.Authorize(1000, "tok_visa", "test", "test-key"); err != nil {
+		t.Fatal(err)
+	} else if again.Id != first.Id {
+		t.Errorf("Expected the same intent %s for the same idempotency key but got %s", first.Id, again.Id)
+	}
+	if other, err := gateway.Authorize(1000, "tok_visa", "test", "other-key"); err != nil {
+		t.Fatal(err)
+	} else if other.Id == first.Id {
+		t.Error("Expected a new intent for a different idempotency key")
+	}
+}
+
+func TestStripeGatewayUnauthorizedIntent(t *testing.T) {
+	// A fake Stripe server which needs further action for every payment
+	canceled := false
+	idempotencyKey := ""
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/payment_intents":
+			idempotencyKey = req.Header.Get("Idempotency-Key")
+			fmt.Fprint(res, `{"id": "pi_test", "status": "requires_action", "amount": 1000}`)
+		case "/payment_intents/pi_test/cancel":
+			canceled = true
+			fmt.Fprint(res, `{"id": "pi_test", "status": "canceled", "amount": 1000}`)
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+	defer server.Close()
+	gateway := payments.NewStripeGateway("sk_test", "usd")
+	gateway.BaseUrl = server.URL
+
+	// Anything which isn't authorized should be treated as declined and canceled
+	if _, err := gateway.Authorize(1000, "pm_card_threeDSecure2Required", "test", "test-key"); err == nil {
+		t.Error("Expected an error when the payment requires action but got none.")
+	} else if declineErr, ok := err.(*payments.DeclineError); !ok {
+		t.Errorf("Expected a *payments.DeclineError but got %T: %s", err, err.Error())
+	} else if declineErr.Code != "requires_action" {
+		t.Errorf("Expected decline code requires_action but got %s", declineErr.Code)
+	}
+	if !canceled {
+		t.Error("Expected the payment intent to be canceled")
+	}
+	if idempotencyKey != "test-key" {
+		t.Errorf("Expected the Idempotency-Key header to be test-key but got %q", idempotencyKey)
+	}
+}
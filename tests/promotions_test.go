@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"testing"
+)
+
+func TestPromotionsCode(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+
+	// Get a valid token
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a promotion for 10% off which can only be used once per email
+	req := rec.NewRequestWithData("POST", "/promotions", map[string]string{
+		"code":          "test10",
+		"description":   "10% off for testing",
+		"type":          "percent",
+		"amount":        "10",
+		"perEmailLimit": "1",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"code": "TEST10"`)
+
+	// Place an order using the code
+	item := createMockItem("Promotion Test Item", "An item for testing promotions.", 20.0)
+	orderData := map[string]interface{}{
+		"email":           "promotion@test.com",
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 1}},
+		"shippingAddress": testShippingAddress,
+		"code":            "test10",
+		"paymentSource":   testPaymentSource,
+	}
+	res = rec.Do(rec.NewJSONRequest("POST", "/orders", orderData))
+	res.AssertOk()
+	res.AssertBodyContains(`"discount": 2`)
+	res.AssertBodyContains(`"total": 21`)
+
+	// The code should not be usable again by the same email
+	res = rec.Do(rec.NewJSONRequest("POST", "/orders", orderData))
+	res.AssertCode(422)
+	res.AssertBodyContains("maximum number of times")
+
+	// Cancelling the order should make the code usable again
+	order := &models.Order{}
+	if err := zoom.NewQuery("Order").Filter("Email =", "promotion@test.com").ScanOne(order); err != nil {
+		panic(err)
+	}
+	req = rec.NewJSONRequest("PUT", "/orders/"+order.Id, map[string]interface{}{
+		"status": "cancelled",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	res = rec.Do(rec.NewJSONRequest("POST", "/orders", orderData))
+	res.AssertOk()
+	res.AssertBodyContains(`"discount": 2`)
+
+	// Invalid codes should be rejected
+	orderData["code"] = "NOT-A-REAL-CODE"
+	res = rec.Do(rec.NewJSONRequest("POST", "/orders", orderData))
+	res.AssertCode(422)
+	res.AssertBodyContains("NOT-A-REAL-CODE is not a valid code")
+}
+
+func TestPromotionLineDiscounts(t *testing.T) {
+	stickers := &models.Item{Price: 10.0, Category: "stickers"}
+	stickers.Id = "stickers"
+	shirt := &models.Item{Price: 20.0, Category: "shirts"}
+	shirt.Id = "shirt"
+	order := &models.Order{
+		Items: []*models.OrderItem{
+			{Item: stickers, UnitPrice: stickers.Price, Quantity: 3},
+			{Item: shirt, UnitPrice: shirt.Price, Quantity: 1},
+		},
+	}
+	noDiscounts := []float64{0, 0}
+
+	// A percent promotion limited to a category should only discount that category
+	percent := &models.Promotion{Type: models.PromotionTypePercent, Amount: 50, Categories: []string{"stickers"}}
+	discounts := percent.LineDiscounts(order, noDiscounts)
+	if discounts[0] != 15.0 || discounts[1] != 0 {
+		t.Errorf("Expected percent discounts [15 0] but got %v", discounts)
+	}
+
+	// A fixed promotion should be split in proportion to the remaining line totals
+	fixed := &models.Promotion{Type: models.PromotionTypeFixed, Amount: 10}
+	discounts = fixed.LineDiscounts(order, []float64{10, 0})
+	if discounts[0] != 5.0 || discounts[1] != 5.0 {
+		t.Errorf("Expected fixed discounts [5 5] but got %v", discounts)
+	}
+
+	// A fixed promotion should never exceed the remaining line totals
+	fixed.Amount = 100
+	discounts = fixed.LineDiscounts(order, noDiscounts)
+	if discounts[0] != 30.0 || discounts[1] != 20.0 {
+		t.Errorf("Expected fixed discounts [30 20] but got %v", discounts)
+	}
+
+	// The line discounts for a fixed promotion should always add up to the amount,
+	// even when it can't be split evenly
+	thirds := &models.Order{
+		Items: []*models.OrderItem{
+			{Item: stickers, UnitPrice: stickers.Price, Quantity: 1},
+			{Item: &models.Item{Price: 10.0}, UnitPrice: 10.0, Quantity: 1},
+			{Item: &models.Item{Price: 10.0}, UnitPrice: 10.0, Quantity: 1},
+		},
+	}
+	fixed.Amount = 10
+	discounts = fixed.LineDiscounts(thirds, []float64{0, 0, 0})
+	if discounts[0] != 3.33 || discounts[1] != 3.33 || discounts[2] != 3.34 {
+		t.Errorf("Expected fixed discounts [3.33 3.33 3.34] but got %v", discounts)
+	}
+}
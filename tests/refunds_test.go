@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"testing"
+)
+
+func TestRefundsCreate(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+
+	// Get a valid token
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Create an order for 4 of an item which costs $5 each, and then ship it
+	item := createMockItem("Refund Test Item", "An item for testing refunds.", 5.0)
+	res := rec.Do(rec.NewJSONRequest("POST", "/orders", map[string]interface{}{
+		"email":           "refund@test.com",
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 4}},
+		"shippingAddress": testShippingAddress,
+		"paymentSource":   testPaymentSource,
+	}))
+	res.AssertOk()
+	order := &models.Order{}
+	if err := zoom.NewQuery("Order").Filter("Email =", "refund@test.com").ScanOne(order); err != nil {
+		panic(err)
+	}
+	shipTestOrder(rec, order.Id)
+
+	// Changing the price of the item should not change what is refunded
+	rec.Do(updateItemRequest(rec, item.Id, map[string]string{"price": "50"}, "")).AssertOk()
+
+	// Refund 1 of the items and return it to stock
+	req := rec.NewJSONRequest("POST", fmt.Sprintf("/orders/%s/refunds", order.Id), map[string]interface{}{
+		"reason":  "Damaged in shipping",
+		"lines":   []map[string]interface{}{{"itemId": item.Id, "quantity": 1}},
+		"restock": true,
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"amount": 5`)
+	res.AssertBodyContains(`"reason": "Damaged in shipping"`)
+	res.AssertBodyContains(`"restocked": true`)
+	restockedItem := &models.Item{}
+	if err := zoom.ScanById(item.Id, restockedItem); err != nil {
+		panic(err)
+	}
+	// The order took 4 out of stock, and the refund put 1 back
+	if expected := item.AmountInStock - 4 + 1; restockedItem.AmountInStock != expected {
+		t.Errorf("Expected AmountInStock to be %d after restocking but got %d", expected, restockedItem.AmountInStock)
+	}
+
+	// Trying to refund more items than are left should fail
+	req = rec.NewJSONRequest("POST", fmt.Sprintf("/orders/%s/refunds", order.Id), map[string]interface{}{
+		"reason": "Too many",
+		"lines":  []map[string]interface{}{{"itemId": item.Id, "quantity": 4}},
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertCode(422)
+	res.AssertBodyContains("quantity must be between 1 and 3")
+
+	// Refund the rest of the order, including shipping
+	req = rec.NewJSONRequest("POST", fmt.Sprintf("/orders/%s/refunds", order.Id), map[string]interface{}{
+		"reason": "Customer changed their mind",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"amount": 18`)
+	refundedOrder := &models.Order{}
+	if err := zoom.ScanById(order.Id, refundedOrder); err != nil {
+		panic(err)
+	}
+	if refundedOrder.Status != models.OrderStatusRefunded {
+		t.Errorf("Expected order status to be %s but got %s", models.OrderStatusRefunded, refundedOrder.Status)
+	}
+	if refundedOrder.AmountRefunded != refundedOrder.Total {
+		t.Errorf("Expected AmountRefunded to equal the total of %v but got %v", refundedOrder.Total, refundedOrder.AmountRefunded)
+	}
+
+	// Nothing should be left to refund
+	req = rec.NewJSONRequest("POST", fmt.Sprintf("/orders/%s/refunds", order.Id), map[string]interface{}{
+		"reason": "Refunding twice",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertCode(422)
+	res.AssertBodyContains("nothing left to refund")
+}
+
+func TestRefundsCancel(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+
+	// Get a valid token
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Refunding everything in an order which has not shipped should cancel it and put
+	// its items back in stock, even without restock
+	order := createTestOrder(rec, "refund-cancel@test.com")
+	req := rec.NewJSONRequest("POST", fmt.Sprintf("/orders/%s/refunds", order.Id), map[string]interface{}{
+		"reason": "Customer changed their mind",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"restocked": true`)
+	cancelledOrder := &models.Order{}
+	if err := zoom.ScanById(order.Id, cancelledOrder); err != nil {
+		panic(err)
+	}
+	if cancelledOrder.Status != models.OrderStatusCancelled {
+		t.Errorf("Expected order status to be %s but got %s", models.OrderStatusCancelled, cancelledOrder.Status)
+	}
+	if restocked := cancelledOrder.Items[0].Restocked; restocked != 1 {
+		t.Errorf("Expected the order item to record 1 restocked but got %d", restocked)
+	}
+	item := &models.Item{}
+	if err := zoom.ScanById(order.Items[0].Item.Id, item); err != nil {
+		panic(err)
+	}
+	if item.AmountInStock != 100 {
+		t.Errorf("Expected stock to be put back when the order was cancelled. Expected 100 but got %d.", item.AmountInStock)
+	}
+}
@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReports(t *testing.T) {
+	t.Parallel()
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	order := createTestOrder(rec, "reports@test.com")
+	itemId := order.Items[0].Item.Id
+	today, err := time.Parse(lib.SalesReportDateFormat, time.Now().UTC().Format(lib.SalesReportDateFormat))
+	if err != nil {
+		panic(err)
+	}
+	findItemSales := func() *lib.ItemSales {
+		items, err := lib.QueryItemSales(today, today, lib.ItemSalesByUnits, 100)
+		if err != nil {
+			panic(err)
+		}
+		for _, item := range items {
+			if item.ItemId == itemId {
+				return &item
+			}
+		}
+		return nil
+	}
+
+	// The order should be counted for today
+	report, err := lib.QuerySalesReport(lib.SalesIntervalDay, today, today)
+	if err != nil {
+		panic(err)
+	}
+	if len(report.Buckets) != 1 || report.Buckets[0].Orders < 1 || report.Buckets[0].Revenue < order.Total {
+		t.Errorf("Expected the order to be counted in the report for today. Got: %+v", report)
+	}
+	if sales := findItemSales(); sales == nil {
+		t.Error("Expected the item in the order to be in the item sales report")
+	} else if sales.UnitsSold != 1 || sales.Revenue != 5.0 || sales.Name != order.Items[0].Item.Name {
+		t.Errorf("Item sales were incorrect: %+v", sales)
+	}
+
+	// Both reports should be available as JSON and CSV
+	reportRequest := func(path string) *http.Request {
+		req := rec.NewRequest("GET", path)
+		req.Header.Add("Authorization", "Bearer "+token)
+		return req
+	}
+	res := rec.Do(reportRequest("/reports/sales?interval=week"))
+	res.AssertOk()
+	res.AssertBodyContains(`"averageOrderValue"`)
+	res = rec.Do(reportRequest("/reports/sales?format=csv"))
+	res.AssertOk()
+	res.AssertBodyContains("start,orders,revenue,refunded,netRevenue,averageOrderValue")
+	res.AssertBodyContains(today.Format(lib.SalesReportDateFormat) + ",")
+	res = rec.Do(reportRequest("/reports/items?limit=100&sort=revenue&format=csv"))
+	res.AssertOk()
+	res.AssertBodyContains(fmt.Sprintf("%s,%s,1,5.00", itemId, order.Items[0].Item.Name))
+
+	// Refunding the order should take the item out of the report
+	req := rec.NewJSONRequest("POST", fmt.Sprintf("/orders/%s/refunds", order.Id), map[string]interface{}{
+		"reason": "Testing reports",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	if sales := findItemSales(); sales != nil {
+		t.Errorf("Expected the refunded item to be left out of the item sales report. Got: %+v", sales)
+	}
+
+	// Days should be bucketed into weeks starting on Monday and calendar months
+	date := func(s string) time.Time {
+		d, err := time.Parse(lib.SalesReportDateFormat, s)
+		if err != nil {
+			panic(err)
+		}
+		return d
+	}
+	for interval, expected := range map[string][]string{
+		lib.SalesIntervalWeek:  {"2015-02-23", "2015-03-02", "2015-03-09"},
+		lib.SalesIntervalMonth: {"2015-02-01", "2015-03-01"},
+	} {
+		report, err := lib.QuerySalesReport(interval, date("2015-02-28"), date("2015-03-09"))
+		if err != nil {
+			panic(err)
+		}
+		starts := []string{}
+		for _, bucket := range report.Buckets {
+			starts = append(starts, bucket.Start)
+		}
+		if fmt.Sprint(starts) != fmt.Sprint(expected) {
+			t.Errorf("Expected %s buckets starting on %v but got %v", interval, expected, starts)
+		}
+	}
+
+	// Invalid parameters should not be accepted, and only admins can see reports
+	res = rec.Do(reportRequest("/reports/sales?interval=year&since=2015-02-01&until=2015-01-01&format=xml"))
+	res.AssertCode(422)
+	res.AssertBodyContains("interval must be one of")
+	res.AssertBodyContains("since must not be after until")
+	res.AssertBodyContains("format must be either json or csv")
+	rec.Do(reportRequest("/reports/items?limit=0")).AssertCode(422)
+	rec.Get("/reports/sales").AssertCode(http.StatusUnauthorized)
+}
+
+func TestReportsRebuild(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	order := createTestOrder(rec, "rebuild@test.com")
+	cancelled := createTestOrder(rec, "rebuild-cancelled@test.com")
+	req := rec.NewJSONRequest("PUT", "/orders/"+cancelled.Id, map[string]interface{}{
+		"status": "cancelled",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	day := time.Unix(order.CreatedAt, 0).UTC().Format(lib.SalesReportDateFormat)
+	today, err := time.Parse(lib.SalesReportDateFormat, day)
+	if err != nil {
+		panic(err)
+	}
+	itemSales := func() map[string]lib.ItemSales {
+		items, err := lib.QueryItemSales(today, today, lib.ItemSalesByUnits, 100)
+		if err != nil {
+			panic(err)
+		}
+		sales := map[string]lib.ItemSales{}
+		for _, item := range items {
+			sales[item.ItemId] = item
+		}
+		return sales
+	}
+	itemUnits := func() map[string]int {
+		units := map[string]int{}
+		for itemId, sales := range itemSales() {
+			units[itemId] = sales.UnitsSold
+		}
+		return units
+	}
+	before, err := lib.QuerySalesReport(lib.SalesIntervalDay, today, today)
+	if err != nil {
+		panic(err)
+	}
+
+	// Changing the price of the item should not change the rebuilt report
+	rec.Do(updateItemRequest(rec, order.Items[0].Item.Id, map[string]string{"price": "50"}, "")).AssertOk()
+
+	// Lose the counters for today, and then rebuild them
+	conn := zoom.GetConn()
+	if _, err := conn.Do("DEL", "sales:"+day, "sales:"+day+":itemUnits", "sales:"+day+":itemRevenue"); err != nil {
+		panic(err)
+	}
+	conn.Close()
+	if units := itemUnits(); units[order.Items[0].Item.Id] != 0 {
+		t.Fatalf("Expected the counters to be lost but got %v", units)
+	}
+	req = rec.NewRequest("POST", "/reports/rebuild")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"orders"`)
+
+	// The orders should be counted again, without the cancelled one
+	units := itemUnits()
+	if units[order.Items[0].Item.Id] != 1 {
+		t.Errorf("Expected 1 unit of the item in the rebuilt report but got %d", units[order.Items[0].Item.Id])
+	}
+	if revenue := itemSales()[order.Items[0].Item.Id].Revenue; revenue != 5.0 {
+		t.Errorf("Expected the rebuilt revenue for the item to use the price when it was ordered (5) but got %v", revenue)
+	}
+	if units[cancelled.Items[0].Item.Id] != 0 {
+		t.Errorf("Expected the cancelled order not to be counted in the rebuilt report but got %d units", units[cancelled.Items[0].Item.Id])
+	}
+	after, err := lib.QuerySalesReport(lib.SalesIntervalDay, today, today)
+	if err != nil {
+		panic(err)
+	}
+	if fmt.Sprint(after.Buckets) != fmt.Sprint(before.Buckets) {
+		t.Errorf("Expected the rebuilt report to match the original. Expected %+v but got %+v", before.Buckets, after.Buckets)
+	}
+}
@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestShipments(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+
+	// Get a valid token
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	adminRequest := func(method string, path string, body map[string]interface{}) *http.Request {
+		req := rec.NewJSONRequest(method, path, body)
+		req.Header.Add("Authorization", "Bearer "+token)
+		return req
+	}
+	findOrder := func(id string) *models.Order {
+		order := &models.Order{}
+		if err := zoom.ScanById(id, order); err != nil {
+			panic(err)
+		}
+		return order
+	}
+
+	// Create an order for 3 of an item
+	item := createMockItem("Shipment Test Item", "An item for testing shipments.", 5.0)
+	res := rec.Do(rec.NewJSONRequest("POST", "/orders", map[string]interface{}{
+		"email":           "shipments@test.com",
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 3}},
+		"shippingAddress": testShippingAddress,
+		"paymentSource":   testPaymentSource,
+	}))
+	res.AssertOk()
+	order := &models.Order{}
+	if err := zoom.NewQuery("Order").Filter("Email =", "shipments@test.com").ScanOne(order); err != nil {
+		panic(err)
+	}
+	shipmentsPath := fmt.Sprintf("/orders/%s/shipments", order.Id)
+
+	// Invalid shipments should not be created, and only admins can create them
+	res = rec.Do(adminRequest("POST", shipmentsPath, map[string]interface{}{
+		"trackingUrl": "not a url",
+		"lines":       []map[string]interface{}{{"itemId": item.Id, "quantity": 4}},
+	}))
+	res.AssertCode(422)
+	res.AssertBodyContains("carrier is required")
+	res.AssertBodyContains("trackingUrl must be an http or https url")
+	res.AssertBodyContains("quantity must be between 1 and 3")
+	rec.Do(rec.NewJSONRequest("POST", shipmentsPath, map[string]interface{}{
+		"carrier": "USPS",
+	})).AssertCode(http.StatusUnauthorized)
+
+	// Ship 2 of the items, with the tracking url built from the template for the carrier
+	res = rec.Do(adminRequest("POST", shipmentsPath, map[string]interface{}{
+		"carrier":        "USPS",
+		"trackingNumber": "9400100000000000000001",
+		"lines":          []map[string]interface{}{{"itemId": item.Id, "quantity": 2}},
+	}))
+	res.AssertOk()
+	res.AssertBodyContains(`"trackingUrl": "https://tools.usps.com/go/TrackConfirmAction?tLabels=9400100000000000000001"`)
+	res.AssertBodyContains(`"quantity": 2`)
+	partialOrder := findOrder(order.Id)
+	if partialOrder.Status != models.OrderStatusPartiallyShipped {
+		t.Errorf("Expected order status to be %s but got %s", models.OrderStatusPartiallyShipped, partialOrder.Status)
+	}
+	if partialOrder.Items[0].Shipped != 2 {
+		t.Errorf("Expected 2 of the item to be shipped but got %d", partialOrder.Items[0].Shipped)
+	}
+
+	// Ship the rest of the order with an explicit tracking url
+	res = rec.Do(adminRequest("POST", shipmentsPath, map[string]interface{}{
+		"carrier":     "Local Courier",
+		"trackingUrl": "https://courier.example.com/track/123",
+	}))
+	res.AssertOk()
+	res.AssertBodyContains(`"quantity": 1`)
+	shippedOrder := findOrder(order.Id)
+	if shippedOrder.Status != models.OrderStatusShipped {
+		t.Errorf("Expected order status to be %s but got %s", models.OrderStatusShipped, shippedOrder.Status)
+	}
+	if len(shippedOrder.Shipments) != 2 {
+		t.Fatalf("Expected 2 shipments but got %d", len(shippedOrder.Shipments))
+	}
+	if shippedOrder.TrackingUrl != "https://courier.example.com/track/123" {
+		t.Errorf("Expected the tracking url of the order to be for the latest shipment but got %s", shippedOrder.TrackingUrl)
+	}
+
+	// Nothing is left to ship
+	res = rec.Do(adminRequest("POST", shipmentsPath, map[string]interface{}{"carrier": "USPS"}))
+	res.AssertCode(422)
+
+	// The customer should see both shipments with their tracking links
+	lookupUrl, err := url.Parse(lib.OrderLookupUrl(order))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = rec.Get(fmt.Sprintf("/orders/%s/lookup?token=%s", order.Id, lookupUrl.Query().Get("token")))
+	res.AssertOk()
+	res.AssertBodyContains("https://tools.usps.com/go/TrackConfirmAction?tLabels=9400100000000000000001")
+	res.AssertBodyContains("https://courier.example.com/track/123")
+
+	// The order should be delivered once both shipments are
+	for i, shipment := range shippedOrder.Shipments {
+		path := fmt.Sprintf("%s/%s", shipmentsPath, shipment.Id)
+		rec.Do(adminRequest("PUT", path, map[string]interface{}{"delivered": true})).AssertOk()
+		expectedStatus := models.OrderStatusShipped
+		if i == len(shippedOrder.Shipments)-1 {
+			expectedStatus = models.OrderStatusDelivered
+		}
+		if status := findOrder(order.Id).Status; status != expectedStatus {
+			t.Errorf("Expected order status to be %s after %d deliveries but got %s", expectedStatus, i+1, status)
+		}
+	}
+	rec.Do(adminRequest("PUT", shipmentsPath+"/invalid", map[string]interface{}{"delivered": true})).AssertCode(404)
+}
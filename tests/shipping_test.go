@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"testing"
+)
+
+func TestShippingZonesCreate(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+
+	// Get a valid token
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Create an authenticated request
+	req := rec.NewRequestWithData("POST", "/shipping/zones", map[string]string{
+		"name":      "Test Zone Oceania",
+		"countries": "au, nz",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	// Send the request and check the response
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"name": "Test Zone Oceania"`)
+	res.AssertBodyContains(`"AU"`)
+	res.AssertBodyContains(`"NZ"`)
+
+	// Make sure the zone was actually created
+	if count, err := zoom.NewQuery("ShippingZone").Filter("Name =", "Test Zone Oceania").Count(); err != nil {
+		panic(err)
+	} else if count != 1 {
+		t.Errorf("Expected 1 shipping zone to be created but found %d.", count)
+	}
+
+	// A country can only belong to one zone
+	req = rec.NewRequestWithData("POST", "/shipping/zones", map[string]string{
+		"name":      "Test Zone Australia",
+		"countries": "AU",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertCode(422)
+	res.AssertBodyContains("AU already belongs to the Test Zone Oceania shipping zone")
+}
+
+func TestShippingQuote(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+
+	// Create an item which weighs 1 pound
+	item := createMockItem("Shipping Quote Test Item", "An item for testing shipping quotes.", 2.0)
+	item.Weight = 16
+	if err := zoom.Save(item); err != nil {
+		panic(err)
+	}
+
+	// Get a quote for 2 of the item. Since they weigh 2 pounds total, Express shipping
+	// should use the second weight bracket.
+	req := rec.NewJSONRequest("POST", "/shipping/quote", map[string]interface{}{
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 2}},
+		"shippingAddress": testShippingAddress,
+	})
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"name": "Standard"`)
+	res.AssertBodyContains(`"cost": 3`)
+	res.AssertBodyContains(`"name": "Express"`)
+	res.AssertBodyContains(`"cost": 25`)
+}
+
+func TestShippingRateCost(t *testing.T) {
+	rate := &models.ShippingRate{
+		Type: models.ShippingRateTypeWeight,
+		Brackets: []models.WeightBracket{
+			{MaxWeight: 32, Price: 8.0},
+			{MaxWeight: 8, Price: 2.0},
+		},
+		FreeAbove: 50.0,
+	}
+	testInputs := []struct {
+		subtotal     float64
+		weight       float64
+		expectedCost float64
+		expectedOk   bool
+	}{
+		{10.0, 4, 2.0, true},
+		{10.0, 8, 2.0, true},
+		{10.0, 9, 8.0, true},
+		{60.0, 9, 0.0, true},
+		{10.0, 33, 0.0, false},
+	}
+	for _, testInput := range testInputs {
+		cost, ok := rate.Cost(testInput.subtotal, testInput.weight)
+		if ok != testInput.expectedOk {
+			t.Errorf("Expected ok to be %v for weight %0.1f but got %v", testInput.expectedOk, testInput.weight, ok)
+		}
+		if cost != testInput.expectedCost {
+			t.Errorf("Expected cost %0.2f for subtotal %0.2f and weight %0.1f but got %0.2f",
+				testInput.expectedCost, testInput.subtotal, testInput.weight, cost)
+		}
+	}
+}
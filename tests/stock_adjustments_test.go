@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"testing"
+)
+
+func TestStockAdjustments(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	path := func(item *models.Item, suffix string) string {
+		return fmt.Sprintf("/items/%s/stock_adjustments%s", item.Id, suffix)
+	}
+
+	// Create an item which has stock but nothing in the ledger, and reconcile it
+	item := createMockItem("Stock Ledger Item", "An item for testing the stock ledger.", 1.0)
+	item.AmountInStock = 3
+	if err := zoom.Save(item); err != nil {
+		panic(err)
+	}
+	req := rec.NewRequest("POST", path(item, "/reconcile"))
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"delta": 3`)
+	res.AssertBodyContains(`"reason": "correction"`)
+
+	// Invalid adjustments should not be accepted
+	req = rec.NewJSONRequest("POST", path(item, ""), map[string]interface{}{"delta": 5, "reason": "stolen"})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertCode(422)
+	res.AssertBodyContains("reason must be one of")
+	req = rec.NewJSONRequest("POST", path(item, ""), map[string]interface{}{"delta": 0, "reason": "restock"})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertCode(422)
+
+	// Record a restock
+	req = rec.NewJSONRequest("POST", path(item, ""), map[string]interface{}{
+		"delta":     10,
+		"reason":    "restock",
+		"reference": "Print run #12",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"balance": 13`)
+
+	// Sales and setting the amount directly should also be recorded
+	placeStockTestOrder(rec, item, 2)
+	rec.Do(updateItemRequest(rec, item.Id, map[string]string{"amountInStock": "20"}, "")).AssertOk()
+	req = rec.NewRequest("GET", path(item, ""))
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains("Print run #12")
+	res.AssertBodyContains(`"reason": "sale"`)
+	history, err := lib.StockHistory(item.Id)
+	if err != nil {
+		panic(err)
+	}
+	expected := map[string]int{"correction": 3 + 9, "restock": 10, "sale": -2}
+	deltas := map[string]int{}
+	for _, adjustment := range history {
+		deltas[adjustment.Reason] += adjustment.Delta
+	}
+	for reason, delta := range expected {
+		if deltas[reason] != delta {
+			t.Errorf("Expected the %s adjustments to add up to %d but got %d", reason, delta, deltas[reason])
+		}
+	}
+
+	// The ledger now matches the amount in stock, so there is nothing to reconcile
+	req = rec.NewRequest("POST", path(item, "/reconcile"))
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"amountInStock": 20`)
+	res.AssertBodyContains(`"correction": null`)
+
+	// Items which don't exist should not be found
+	req = rec.NewRequest("GET", "/items/nonexistent/stock_adjustments")
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertCode(404)
+}
+
+func TestSaveItemKeepsStock(t *testing.T) {
+	item := createMockItem("Stock Save Item", "An item for testing that saving keeps the stock.", 1.0)
+
+	// Change the stock after the item was scanned, and then save the stale copy
+	if err := lib.AdjustItemStock(&models.StockAdjustment{
+		ItemId: item.Id,
+		Delta:  -10,
+		Reason: models.StockReasonDamage,
+	}); err != nil {
+		panic(err)
+	}
+	item.Description = "A new description."
+	if err := lib.SaveItem(item); err != nil {
+		panic(err)
+	}
+	if item.AmountInStock != 90 {
+		t.Errorf("Expected AmountInStock to be updated to 90 after saving but got %d", item.AmountInStock)
+	}
+	saved := &models.Item{}
+	if err := zoom.ScanById(item.Id, saved); err != nil {
+		panic(err)
+	}
+	if saved.AmountInStock != 90 {
+		t.Errorf("Expected saving a stale item to keep the stock of 90 but got %d", saved.AmountInStock)
+	}
+	if saved.Description != "A new description." {
+		t.Errorf("Expected the description to be saved but got %s", saved.Description)
+	}
+}
@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/mailer"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStockAlerts(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+	outbox := mailer.CurrentTransport().(*mailer.OutboxTransport)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	admin, err := getAdminTestUser()
+	if err != nil {
+		panic(err)
+	}
+
+	// Subscribe the admin to stock alerts, and register a webhook for them
+	req := rec.NewJSONRequest("PUT", "/admin_users/"+admin.Id, map[string]interface{}{"stockAlerts": true})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"stockAlerts": true`)
+	defer func() {
+		req := rec.NewJSONRequest("PUT", "/admin_users/"+admin.Id, map[string]interface{}{"stockAlerts": false})
+		req.Header.Add("Authorization", "Bearer "+token)
+		rec.Do(req).AssertOk()
+	}()
+	server := httptest.NewServer(&webhookRecorder{code: http.StatusOK})
+	defer server.Close()
+	req = rec.NewJSONRequest("POST", "/webhooks", map[string]interface{}{
+		"url":    server.URL,
+		"events": "item.low_stock,item.out_of_stock",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	webhook := findTestWebhook(server.URL)
+
+	// Create an item with 6 in stock and a threshold of 3
+	item := createMockItem("Stock Alert Item", "An item for testing stock alerts.", 1.0)
+	rec.Do(updateItemRequest(rec, item.Id, map[string]string{
+		"amountInStock":     "6",
+		"lowStockThreshold": "3",
+	}, "")).AssertOk()
+	expectStockAlerts(t, outbox, webhook, item.Name, 0, 0)
+
+	// Going down to the threshold should send a low stock alert, but only once
+	placeStockTestOrder(rec, item, 3)
+	expectStockAlerts(t, outbox, webhook, item.Name, 1, 0)
+	placeStockTestOrder(rec, item, 1)
+	expectStockAlerts(t, outbox, webhook, item.Name, 1, 0)
+
+	// The item should be listed as low on stock, but only for admins
+	req = rec.NewRequest("GET", "/items?stock=low")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(item.Name)
+	req = rec.NewRequest("GET", "/items?stock=out")
+	req.Header.Add("Authorization", "Bearer "+token)
+	outRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer outRes.Body.Close()
+	if body, err := ioutil.ReadAll(outRes.Body); err != nil {
+		panic(err)
+	} else if strings.Contains(string(body), item.Name) {
+		t.Errorf("Expected %s not to be listed as out of stock", item.Name)
+	}
+	rec.Get("/items?stock=low").AssertCode(401)
+
+	// Selling the rest should send an out of stock alert
+	placeStockTestOrder(rec, item, 2)
+	expectStockAlerts(t, outbox, webhook, item.Name, 1, 1)
+
+	// Once the item is restocked, it should be alerted about again
+	rec.Do(updateItemRequest(rec, item.Id, map[string]string{"amountInStock": "10"}, "")).AssertOk()
+	expectStockAlerts(t, outbox, webhook, item.Name, 1, 1)
+	placeStockTestOrder(rec, item, 8)
+	expectStockAlerts(t, outbox, webhook, item.Name, 2, 1)
+}
+
+// placeStockTestOrder places an order for quantity of item, which takes them out of
+// stock.
+func placeStockTestOrder(rec *fipple.Recorder, item *models.Item, quantity int) {
+	rec.Do(rec.NewJSONRequest("POST", "/orders", map[string]interface{}{
+		"email":           "stock@test.com",
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": quantity}},
+		"shippingAddress": testShippingAddress,
+		"paymentSource":   testPaymentSource,
+	})).AssertOk()
+}
+
+// expectStockAlerts checks that the expected number of low and out of stock alerts
+// have been sent for the item with the given name, both by email to the admin test
+// user and to webhook.
+func expectStockAlerts(t *testing.T, outbox *mailer.OutboxTransport, webhook *models.Webhook, itemName string, low int, out int) {
+	if _, err := mailer.DeliverQueued(); err != nil {
+		t.Fatal(err)
+	}
+	emails := map[string]int{}
+	for _, msg := range outbox.MessagesTo("admin@5w4g.com") {
+		if strings.HasPrefix(msg.Subject, "Low stock: "+itemName) {
+			emails[lib.StockLevelLow]++
+		} else if strings.HasPrefix(msg.Subject, "Out of stock: "+itemName) {
+			emails[lib.StockLevelOut]++
+		}
+	}
+	events := map[string]int{}
+	for _, delivery := range findTestWebhookDeliveries(webhook.Id) {
+		events[delivery.Event]++
+	}
+	if emails[lib.StockLevelLow] != low || emails[lib.StockLevelOut] != out {
+		t.Errorf("Expected %d low and %d out of stock emails but got %d and %d", low, out, emails[lib.StockLevelLow], emails[lib.StockLevelOut])
+	}
+	if events[models.WebhookEventItemLowStock] != low || events[models.WebhookEventItemOutOfStock] != out {
+		t.Errorf("Expected %d low and %d out of stock webhook deliveries but got %d and %d", low, out, events[models.WebhookEventItemLowStock], events[models.WebhookEventItemOutOfStock])
+	}
+}
@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"testing"
+)
+
+func TestTaxRatesCreateAndUpdate(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+
+	// Get a valid token
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a rate for Washington state
+	req := rec.NewRequestWithData("POST", "/tax/rates", map[string]string{
+		"country": "us",
+		"region":  "WA",
+		"rate":    "0.065",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"country": "US"`)
+	res.AssertBodyContains(`"version": 1`)
+
+	// Find the rate we just created
+	rate := &models.TaxRate{}
+	if err := zoom.NewQuery("TaxRate").Filter("Country =", "US").ScanOne(rate); err != nil {
+		panic(err)
+	}
+
+	// Place an order to Washington state using the first version of the rate
+	createMockShippingRates()
+	item := createMockItem("Tax Test Item", "An item for testing taxes.", 10.0)
+	address := map[string]string{}
+	for key, value := range testShippingAddress {
+		address[key] = value
+	}
+	address["city"], address["region"], address["postalCode"] = "Seattle", "WA", "98101"
+	req = rec.NewJSONRequest("POST", "/orders", map[string]interface{}{
+		"email":           "tax@test.com",
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 2}},
+		"shippingAddress": address,
+		"paymentSource":   testPaymentSource,
+	})
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"subtotal": 20`)
+	res.AssertBodyContains(`"tax": 1.3`)
+	res.AssertBodyContains(`"total": 24.3`)
+
+	// Change the rate, which should create a new version and retire the old one
+	req = rec.NewRequestWithData("PUT", "/tax/rates/"+rate.Id, map[string]string{
+		"rate": "0.07",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res = rec.Do(req)
+	res.AssertOk()
+	res.AssertBodyContains(`"version": 2`)
+	oldRate := &models.TaxRate{}
+	if err := zoom.ScanById(rate.Id, oldRate); err != nil {
+		panic(err)
+	}
+	if oldRate.IsCurrent() {
+		t.Error("Expected the old version of the tax rate to be retired but it was still current.")
+	}
+
+	// The existing order should keep the rate that was in effect when it was placed
+	order := &models.Order{}
+	if err := zoom.NewQuery("Order").Filter("Email =", "tax@test.com").ScanOne(order); err != nil {
+		panic(err)
+	}
+	if order.Tax != 1.3 {
+		t.Errorf("Expected order.Tax to be 1.3 but got %v", order.Tax)
+	}
+	for _, orderItem := range order.Items {
+		if orderItem.TaxRate != 0.065 {
+			t.Errorf("Expected orderItem.TaxRate to be 0.065 but got %v", orderItem.TaxRate)
+		}
+	}
+}
+
+func TestOrderUpdateTotals(t *testing.T) {
+	inclusiveRate := &models.TaxRate{Rate: 0.2, Inclusive: true}
+	inclusiveRate.Id = "inclusive"
+	exclusiveRate := &models.TaxRate{Rate: 0.1}
+	exclusiveRate.Id = "exclusive"
+	order := &models.Order{
+		ShippingCost: 5.0,
+		Items: []*models.OrderItem{
+			{Item: &models.Item{Price: 12.0}, UnitPrice: 12.0, Quantity: 1},
+			{Item: &models.Item{Price: 4.0}, UnitPrice: 4.0, Quantity: 5},
+			{Item: &models.Item{Price: 1.0}, UnitPrice: 1.0, Quantity: 3},
+		},
+	}
+	order.Items[0].ApplyTaxRate(inclusiveRate)
+	order.Items[1].ApplyTaxRate(exclusiveRate)
+	order.Items[2].ApplyTaxRate(nil)
+	order.UpdateTotals()
+
+	// The inclusive tax is already part of the subtotal, so only the exclusive tax
+	// should be added to the total.
+	if order.Subtotal != 35.0 {
+		t.Errorf("Expected subtotal of 35.0 but got %v", order.Subtotal)
+	}
+	if order.Tax != 4.0 {
+		t.Errorf("Expected tax of 4.0 but got %v", order.Tax)
+	}
+	if order.Total != 42.0 {
+		t.Errorf("Expected total of 42.0 but got %v", order.Total)
+	}
+	if len(order.TaxLines) != 2 {
+		t.Errorf("Expected 2 tax lines but got %d", len(order.TaxLines))
+	}
+}
+
+func TestTaxRatesSpecificity(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+
+	// Get a valid token
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a standard rate for Bavaria and a reduced rate for printed matter in all
+	// of Germany. The region should not be case sensitive.
+	for _, fields := range []map[string]string{
+		{"country": "DE", "region": "by", "rate": "0.19"},
+		{"country": "DE", "category": "printed_matter", "rate": "0.07"},
+	} {
+		req := rec.NewRequestWithData("POST", "/tax/rates", fields)
+		req.Header.Add("Authorization", "Bearer "+token)
+		rec.Do(req).AssertOk()
+	}
+
+	// Printed matter shipped to Bavaria should get the reduced rate, and everything
+	// else should get the standard rate for Bavaria
+	address := models.Address{Country: "de", Region: "By "}
+	lib.NormalizeAddress(&address)
+	order := &models.Order{
+		ShippingAddress: address,
+		Items: []*models.OrderItem{
+			{Item: &models.Item{Price: 10.0, TaxCategory: "printed_matter"}, UnitPrice: 10.0, Quantity: 1},
+			{Item: &models.Item{Price: 10.0}, UnitPrice: 10.0, Quantity: 1},
+		},
+	}
+	if err := lib.ApplyTaxes(order); err != nil {
+		t.Fatal(err)
+	}
+	if order.Items[0].TaxRate != 0.07 {
+		t.Errorf("Expected the printed matter rate of 0.07 but got %v", order.Items[0].TaxRate)
+	}
+	if order.Items[1].TaxRate != 0.19 {
+		t.Errorf("Expected the regional rate of 0.19 but got %v", order.Items[1].TaxRate)
+	}
+}
@@ -6,12 +6,17 @@ import (
 	"github.com/OneOfOne/xxhash/native"
 	"github.com/albrow/5w4g-server/config"
 	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/lib/jobs"
 	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
 	"github.com/albrow/zoom"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/mitchellh/goamz/s3"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -30,6 +35,20 @@ var (
 	adminTestUser *models.AdminUser = nil
 	// whether or not config has been initialized
 	configIsInit = false
+	// testShippingAddress is a valid address which can be used for creating
+	// orders in tests.
+	testShippingAddress = map[string]string{
+		"name":       "John Doe",
+		"line1":      "123 Market St",
+		"line2":      "Apt 4",
+		"city":       "San Francisco",
+		"region":     "CA",
+		"postalCode": "94103",
+		"country":    "US",
+	}
+	// testPaymentSource is a payment source which the fake payment gateway used in
+	// the test environment always accepts.
+	testPaymentSource = "tok_visa"
 )
 
 func getAdminTestToken() (string, error) {
@@ -123,6 +142,31 @@ func s3FileExists(path string) bool {
 	return true
 }
 
+// runTestJobs runs any background jobs which are due. The test server does not run
+// jobs itself, so tests which depend on a job must call this first. It panics if
+// there was a problem with the queue.
+func runTestJobs() {
+	if _, err := jobs.RunQueued(); err != nil {
+		panic(err)
+	}
+}
+
+// getResponseBody sends req and returns the body of the response. Unlike rec.Do, it
+// makes it possible to check that the body does not contain something. It panics
+// if there was a problem sending the request or reading the response.
+func getResponseBody(req *http.Request) string {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	return string(body)
+}
+
 // calculateHashForFile calculates a hash for the file at the given path.
 // It panics if there were any errrors opening the file or calculating the hash.
 func calculateHashForFile(path string) string {
@@ -152,21 +196,105 @@ func calculateHashForS3File(path string) string {
 	return string(h.Sum(nil))
 }
 
-// createMockItem creates an item in the database using a mock (fake) ImageUrl property.
-// This function is useful for cases where we don't actually care about the s3 functionality. E.g.
-// when testing Show and Index. It panics if there was an error creating the item or connecting
-// to the database.
+// createMockItem creates a published item in the database using a mock (fake) ImageUrl
+// property and 100 in stock. This function is useful for cases where we don't actually care about the s3
+// functionality. E.g. when testing Show and Index. It panics if there was an error creating
+// the item or connecting to the database.
 func createMockItem(name, description string, price float64) *models.Item {
 	config.Init()
 	models.Init()
 	item := &models.Item{
-		Name:        name,
-		Description: description,
-		Price:       price,
-		ImageUrl:    "http://lorempixel.com/300/200/cats",
+		Name:          name,
+		Description:   description,
+		Price:         price,
+		ImageUrl:      "http://lorempixel.com/300/200/cats",
+		AmountInStock: 100,
+		Availability:  models.ItemInStock,
+		Status:        models.ItemPublished,
 	}
 	if err := zoom.Save(item); err != nil {
 		panic(err)
 	}
 	return item
 }
+
+// createTestOrder creates an order containing a single mock item by sending a request
+// to the server, and then returns the order as it was saved in the database. It panics
+// if there was an error creating the order or connecting to the database.
+func createTestOrder(rec *fipple.Recorder, email string) *models.Order {
+	createMockShippingRates()
+	item := createMockItem("Test Order Item "+email, "An item for a test order.", 5.0)
+	req := rec.NewJSONRequest("POST", "/orders", map[string]interface{}{
+		"email":           email,
+		"items":           []map[string]interface{}{{"itemId": item.Id, "quantity": 1}},
+		"shippingAddress": testShippingAddress,
+		"paymentSource":   testPaymentSource,
+	})
+	res := rec.Do(req)
+	res.AssertOk()
+	order := &models.Order{}
+	if err := zoom.NewQuery("Order").Filter("Email =", email).ScanOne(order); err != nil {
+		panic(err)
+	}
+	return order
+}
+
+// shipTestOrder ships everything in the order with the given id by sending a request
+// to the server. It panics if there was an error getting a token.
+func shipTestOrder(rec *fipple.Recorder, orderId string) {
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	req := rec.NewJSONRequest("POST", "/orders/"+orderId+"/shipments", map[string]interface{}{
+		"carrier": "USPS",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+}
+
+var mockShippingRatesOnce = sync.Once{}
+
+// createMockShippingRates creates a shipping zone for the United States (which is
+// the country for testShippingAddress) with a flat "Standard" rate of $3.00 and a
+// weight-based "Express" rate, if the zone does not already exist. It panics if
+// there was an error connecting to the database.
+func createMockShippingRates() {
+	mockShippingRatesOnce.Do(func() {
+		config.Init()
+		models.Init()
+		zoneName := "Test Zone United States"
+		if count, err := zoom.NewQuery("ShippingZone").Filter("Name =", zoneName).Count(); err != nil {
+			panic(err)
+		} else if count != 0 {
+			return
+		}
+		zone := &models.ShippingZone{
+			Name:      zoneName,
+			Countries: []string{"US"},
+		}
+		if err := zoom.Save(zone); err != nil {
+			panic(err)
+		}
+		rates := []*models.ShippingRate{
+			{
+				ZoneId: zone.Id,
+				Name:   "Standard",
+				Type:   models.ShippingRateTypeFlat,
+				Price:  3.0,
+			},
+			{
+				ZoneId: zone.Id,
+				Name:   "Express",
+				Type:   models.ShippingRateTypeWeight,
+				Brackets: []models.WeightBracket{
+					{MaxWeight: 16, Price: 10.0},
+					{MaxWeight: 160, Price: 25.0},
+				},
+			},
+		}
+		if err := zoom.MSave(zoom.Models(rates)); err != nil {
+			panic(err)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/albrow/5w4g-server/lib"
+	"github.com/albrow/5w4g-server/models"
+	"github.com/albrow/fipple"
+	"github.com/albrow/zoom"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// webhookRecorder is an http.Handler which records every webhook request it
+// receives and responds with code.
+type webhookRecorder struct {
+	code     int
+	mutex    sync.Mutex
+	requests []*recordedWebhook
+}
+
+type recordedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func (wr *webhookRecorder) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	wr.mutex.Lock()
+	wr.requests = append(wr.requests, &recordedWebhook{header: req.Header, body: body})
+	wr.mutex.Unlock()
+	res.WriteHeader(wr.code)
+}
+
+func (wr *webhookRecorder) received() []*recordedWebhook {
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	return append([]*recordedWebhook{}, wr.requests...)
+}
+
+func TestWebhooks(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	createMockShippingRates()
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	endpoint := &webhookRecorder{code: http.StatusOK}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	// Invalid events should not be accepted
+	req := rec.NewJSONRequest("POST", "/webhooks", map[string]interface{}{
+		"url":    server.URL,
+		"events": "order.created,order.eaten",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	res := rec.Do(req)
+	res.AssertCode(422)
+	res.AssertBodyContains("order.eaten is not a valid event")
+
+	// Register a webhook for new orders
+	req = rec.NewJSONRequest("POST", "/webhooks", map[string]interface{}{
+		"url":    server.URL,
+		"events": "order.created",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	webhook := findTestWebhook(server.URL)
+
+	// Placing an order should deliver a signed order.created event
+	createTestOrder(rec, "webhooks@test.com")
+	if _, err := lib.DeliverQueuedWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	received := endpoint.received()
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 webhook request but got %d", len(received))
+	}
+	if event := received[0].header.Get("X-5w4g-Event"); event != models.WebhookEventOrderCreated {
+		t.Errorf("Expected X-5w4g-Event to be %s but got %s", models.WebhookEventOrderCreated, event)
+	}
+	expectedSignature := lib.SignWebhookPayload(webhook.Secret, received[0].body)
+	if signature := received[0].header.Get("X-5w4g-Signature"); signature != expectedSignature {
+		t.Errorf("Expected X-5w4g-Signature to be %s but got %s", expectedSignature, signature)
+	}
+
+	// The delivery should be recorded, and replaying it should send it again
+	deliveries := findTestWebhookDeliveries(webhook.Id)
+	if len(deliveries) != 1 || deliveries[0].Status != models.WebhookDeliverySucceeded {
+		t.Fatalf("Expected 1 succeeded delivery but got %+v", deliveries)
+	}
+	req = rec.NewRequest("POST", fmt.Sprintf("/webhooks/%s/deliveries/%s/replay", webhook.Id, deliveries[0].Id))
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	if _, err := lib.DeliverQueuedWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	if received := endpoint.received(); len(received) != 2 {
+		t.Errorf("Expected 2 webhook requests after replaying but got %d", len(received))
+	}
+	if deliveries := findTestWebhookDeliveries(webhook.Id); len(deliveries[0].Attempts) != 2 {
+		t.Errorf("Expected 2 attempts after replaying but got %d", len(deliveries[0].Attempts))
+	}
+
+	// Deleting the webhook should delete its deliveries too
+	req = rec.NewRequest("DELETE", "/webhooks/"+webhook.Id)
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	if deliveries := findTestWebhookDeliveries(webhook.Id); len(deliveries) != 0 {
+		t.Errorf("Expected deliveries to be deleted along with the webhook but got %d", len(deliveries))
+	}
+}
+
+func TestWebhooksRetry(t *testing.T) {
+	rec := fipple.NewRecorder(t, testUrl)
+	token, err := getAdminTestToken()
+	if err != nil {
+		panic(err)
+	}
+	endpoint := &webhookRecorder{code: http.StatusInternalServerError}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	// Register a webhook for item updates which always fails
+	req := rec.NewJSONRequest("POST", "/webhooks", map[string]interface{}{
+		"url":    server.URL,
+		"events": "item.updated,item.out_of_stock",
+	})
+	req.Header.Add("Authorization", "Bearer "+token)
+	rec.Do(req).AssertOk()
+	webhook := findTestWebhook(server.URL)
+
+	// Updating the stock of an item to 0 should trigger both events
+	item := createMockItem("Webhook Test Item", "An item for testing webhooks.", 2.0)
+	if err := lib.AdjustItemStock(&models.StockAdjustment{ItemId: item.Id, Delta: 3, Reason: models.StockReasonRestock}); err != nil {
+		panic(err)
+	}
+	rec.Do(updateItemRequest(rec, item.Id, map[string]string{"amountInStock": "0"}, "")).AssertOk()
+	if _, err := lib.DeliverQueuedWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	deliveries := findTestWebhookDeliveries(webhook.Id)
+	if len(deliveries) != 2 {
+		t.Fatalf("Expected 2 deliveries but got %d", len(deliveries))
+	}
+
+	// The failed attempts should be recorded and the deliveries should be retried later
+	for _, delivery := range deliveries {
+		if delivery.Status != models.WebhookDeliveryPending {
+			t.Errorf("Expected delivery to still be pending but got %s", delivery.Status)
+		}
+		if len(delivery.Attempts) != 1 {
+			t.Errorf("Expected 1 attempt but got %d", len(delivery.Attempts))
+		} else if delivery.Attempts[0].StatusCode != http.StatusInternalServerError {
+			t.Errorf("Expected attempt to record status code 500 but got %d", delivery.Attempts[0].StatusCode)
+		}
+	}
+	if _, err := lib.DeliverQueuedWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	if received := endpoint.received(); len(received) != 2 {
+		t.Errorf("Expected retries to wait for the backoff but got %d requests", len(received))
+	}
+}
+
+// findTestWebhook returns the webhook with the given url. It panics if there is no
+// such webhook or there was an error connecting to the database.
+func findTestWebhook(url string) *models.Webhook {
+	var webhooks []*models.Webhook
+	if err := zoom.NewQuery("Webhook").Scan(&webhooks); err != nil {
+		panic(err)
+	}
+	for _, webhook := range webhooks {
+		if webhook.Url == url {
+			return webhook
+		}
+	}
+	panic("Could not find webhook for " + url)
+}
+
+// findTestWebhookDeliveries returns all the deliveries for the given webhook. It
+// panics if there was an error connecting to the database.
+func findTestWebhookDeliveries(webhookId string) []*models.WebhookDelivery {
+	var deliveries []*models.WebhookDelivery
+	if err := zoom.NewQuery("WebhookDelivery").Filter("WebhookId =", webhookId).Order("CreatedAt").Scan(&deliveries); err != nil {
+		panic(err)
+	}
+	return deliveries
+}